@@ -0,0 +1,119 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxBannedRetries bounds how many candidates are rejected for a single
+// position before the filter gives up and accepts the sampler's choice
+const maxBannedRetries = 32
+
+// phraseFilter keeps the sampler from completing banned phrases. Token
+// sequences of each phrase's common spellings are blocked before sampling,
+// and the decoded text is checked as well so that other tokenizations of
+// a phrase are caught too.
+type phraseFilter struct {
+	phrases   [][]byte  // lower-cased phrases
+	sequences [][]Token // tokenizations of every form of every phrase
+	maxLen    int
+	text      []byte // completion generated so far
+}
+
+func newPhraseFilter(m *Model, phrases []string) (*phraseFilter, error) {
+	f := &phraseFilter{}
+	for _, phrase := range phrases {
+		if phrase == "" {
+			continue
+		}
+		f.phrases = append(f.phrases, bytes.ToLower([]byte(phrase)))
+		f.maxLen = max(f.maxLen, len(phrase))
+
+		for _, form := range phraseForms(phrase) {
+			tokens, err := m.Tokenize(form, false, false)
+			if err != nil {
+				return nil, err
+			}
+			if len(tokens) > 0 && !slices.ContainsFunc(f.sequences, func(seq []Token) bool { return slices.Equal(seq, tokens) }) {
+				f.sequences = append(f.sequences, tokens)
+			}
+		}
+	}
+	return f, nil
+}
+
+// phraseForms returns the spellings of a phrase a model is likely to produce
+func phraseForms(phrase string) []string {
+	forms := []string{phrase, strings.ToLower(phrase), strings.ToUpper(phrase)}
+	if r, size := utf8.DecodeRuneInString(phrase); unicode.IsLetter(r) {
+		forms = append(forms, string(unicode.ToUpper(r))+phrase[size:])
+	}
+	n := len(forms)
+	for i := range n {
+		forms = append(forms, " "+forms[i])
+	}
+	return forms
+}
+
+// mask sets the logits of tokens that would finish a banned token sequence
+// to -inf, given the tokens generated so far
+func (f *phraseFilter) mask(logits []float32, history []Token) {
+	for _, seq := range f.sequences {
+		last := len(seq) - 1
+		if len(history) >= last && slices.Equal(history[len(history)-last:], seq[:last]) {
+			logits[seq[last]] = float32(math.Inf(-1))
+		}
+	}
+}
+
+// allows reports whether appending piece keeps the text free of banned phrases
+func (f *phraseFilter) allows(piece string) bool {
+	window := f.text[max(0, len(f.text)-f.maxLen-utf8.UTFMax):]
+	before := bytes.ToLower(window)
+	after := bytes.ToLower(append(slices.Clip(window), piece...))
+	for _, phrase := range f.phrases {
+		if bytes.Contains(after, phrase) && !bytes.Contains(before, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *phraseFilter) record(piece string) {
+	f.text = append(f.text, piece...)
+}
+
+// sampleFiltered samples the next token from logits that have been adjusted
+// for classifier-free guidance and banned phrases
+func (c *Context) sampleFiltered(smpl *sampler, guidance *Context, scale float32, filter *phraseFilter, history []Token) Token {
+	var logits []float32
+	if guidance != nil {
+		logits = c.guidedLogits(guidance, scale)
+	} else {
+		logits = slices.Clone(c.logits(-1))
+	}
+	if filter == nil {
+		return smpl.sampleLogits(logits)
+	}
+
+	filter.mask(logits, history)
+	token := smpl.pick(logits)
+	for range maxBannedRetries {
+		if c.model.IsEOG(token) || filter.allows(c.model.TokenToPiece(token)) {
+			break
+		}
+		logits[token] = float32(math.Inf(-1))
+		token = smpl.pick(logits)
+	}
+
+	smpl.record(logits, token)
+	smpl.accept(token)
+	filter.record(c.model.TokenToPiece(token))
+	return token
+}
@@ -0,0 +1,211 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// branch is one of the sequences GenerateMany fans out to
+type branch struct {
+	seq    int
+	pos    int   // position of the next token to decode
+	next   Token // sampled token waiting to be decoded
+	logits int   // batch index of the branch's logits
+	smpl   *sampler
+	out    *textStream
+	result *GenerateResult
+	done   bool
+}
+
+// GenerateMany generates a completion for each suffix appended to a shared
+// prefix. The prefix is evaluated once and its KV cache entries are shared
+// by all continuations, which are decoded together in the same batches. Up
+// to ContextParams.Sequences-1 suffixes run at a time; a context with a
+// single sequence generates them one after another, still reusing the
+// prefix. The prefix and suffixes are tokenized separately. Results are in
+// suffix order. With a fixed seed, the completion of suffix i is seeded
+// with Seed+i, so that equal suffixes get different completions that the
+// same seed reproduces. Negative prompts, banned phrases, truncation, infinite
+// generation, OnToken and OnTokenInfo are not supported.
+func (c *Context) GenerateMany(ctx context.Context, sharedPrefix string, suffixes []string, opts GenerateOptions) ([]*GenerateResult, error) {
+	start := time.Now()
+	if err := c.model.checkGenerate(); err != nil {
+		return nil, err
+	}
+	prefix, err := c.model.TokenizeWithOptions(sharedPrefix, opts.tokenizeOptions())
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) == 0 {
+		return nil, errors.New("prefix is empty")
+	}
+
+	tails := make([][]Token, len(suffixes))
+	for i, suffix := range suffixes {
+		if tails[i], err = c.model.Tokenize(suffix, false, true); err != nil {
+			return nil, err
+		}
+		if len(prefix)+len(tails[i]) >= c.Size() {
+			return nil, ErrPromptTooLong
+		}
+	}
+
+	results := make([]*GenerateResult, 0, len(suffixes))
+	group := int(C.llama_n_seq_max(c.ptr)) - 1
+	if group < 1 {
+		single := opts
+		single.NegativePrompt, single.Banned, single.OnToken, single.OnTokenInfo, single.Infinite = "", nil, nil, nil, false
+		for i, tail := range tails {
+			result, err := c.generate(ctx, start, append(append([]Token(nil), prefix...), tail...), nthSeed(single, i))
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}
+
+	if err := c.evaluateShared(prefix); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(tails); i += group {
+		end := min(i+group, len(tails))
+		batch, err := c.generateBranches(ctx, start, prefix, tails[i:end], nthSeed(opts, i))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batch...)
+	}
+
+	return results, nil
+}
+
+// generateBranches runs one group of continuations of the prefix held in
+// sequence 0, using sequences 1 to len(tails)
+func (c *Context) generateBranches(ctx context.Context, start time.Time, prefix []Token, tails [][]Token, opts GenerateOptions) (_ []*GenerateResult, err error) {
+	defer c.recoverCall("GenerateMany", &err)
+	mem := C.llama_get_memory(c.ptr)
+	branches := make([]*branch, len(tails))
+	defer func() {
+		for _, b := range branches {
+			if b != nil {
+				b.smpl.free()
+				C.llama_memory_seq_rm(mem, C.llama_seq_id(b.seq), -1, -1)
+			}
+		}
+	}()
+
+	// Every branch re-decodes the last prefix token so that it gets logits
+	// of its own even when its suffix is empty
+	shared := len(prefix) - 1
+	for i, tail := range tails {
+		smpl, err := c.newSampler(nthSeed(opts, i))
+		if err != nil {
+			return nil, err
+		}
+		b := &branch{
+			seq:    i + 1,
+			smpl:   smpl,
+			out:    newTextStream(opts.Stop, nil),
+			result: &GenerateResult{PromptTokens: len(prefix) + len(tail)},
+		}
+		branches[i] = b
+
+		C.llama_memory_seq_cp(mem, 0, C.llama_seq_id(b.seq), 0, C.llama_pos(shared))
+		input := append([]Token{prefix[shared]}, tail...)
+		if err := c.decode(input, shared, b.seq, true); err != nil {
+			return nil, err
+		}
+		b.pos = shared + len(input)
+		c.advance(b, b.smpl.sample(c, -1), opts)
+	}
+
+	for {
+		if ctx.Err() != nil || opts.expired(start) {
+			reason := FinishCancel
+			if ctx.Err() == nil {
+				reason = FinishTimeout
+			}
+			for _, b := range branches {
+				if !b.done {
+					b.finish(reason)
+				}
+			}
+			break
+		}
+
+		c.batch.clear()
+		for _, b := range branches {
+			if b.done {
+				continue
+			}
+			if b.pos >= c.Size() {
+				b.finish(FinishLength)
+				continue
+			}
+			b.logits = int(c.batch.c.n_tokens)
+			c.batch.add(b.next, b.pos, b.seq, true)
+		}
+		if c.batch.c.n_tokens == 0 {
+			break
+		}
+		c.batch.generated = int(c.batch.c.n_tokens)
+		if err := c.decodeBatch(); err != nil {
+			return nil, err
+		}
+
+		for _, b := range branches {
+			if !b.done {
+				b.pos++
+				c.advance(b, b.smpl.sample(c, b.logits), opts)
+			}
+		}
+	}
+
+	results := make([]*GenerateResult, len(branches))
+	for i, b := range branches {
+		results[i] = b.result
+	}
+	return results, nil
+}
+
+// nthSeed returns opts with the seed of the i-th completion of
+// GenerateMany, wrapping around before DefaultSeed
+func nthSeed(opts GenerateOptions, i int) GenerateOptions {
+	if opts.Seed != DefaultSeed {
+		opts.Seed = uint32((uint64(opts.Seed) + uint64(i)) % DefaultSeed)
+	}
+	return opts
+}
+
+// advance handles a token sampled for a branch, ending it on end-of-generation,
+// a stop sequence or MaxTokens
+func (c *Context) advance(b *branch, token Token, opts GenerateOptions) {
+	if c.model.IsEOG(token) {
+		b.finish(FinishStop)
+		return
+	}
+	b.result.CompletionTokens++
+	if b.out.write(c.model.TokenToPiece(token)) {
+		b.finish(FinishStop)
+		return
+	}
+	if opts.MaxTokens > 0 && b.result.CompletionTokens >= opts.MaxTokens {
+		b.finish(FinishLength)
+		return
+	}
+	b.next = token
+}
+
+func (b *branch) finish(reason FinishReason) {
+	b.done = true
+	b.result.FinishReason = reason
+	b.result.Text = b.out.flush()
+	b.result.Sampling, b.result.Seed = b.smpl.samplerStats(), b.smpl.seed
+}
@@ -0,0 +1,222 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// beam is one hypothesis kept during beam search
+type beam struct {
+	tokens  []Token
+	logprob float64
+	seq     int  // sequence holding the beam's tokens in the KV cache
+	logits  int  // batch index of the beam's logits, -1 for the last one
+	done    bool // ended with an end-of-generation token
+}
+
+func (b *beam) score(penalty float32) float64 {
+	if len(b.tokens) == 0 || penalty == 0 {
+		return b.logprob
+	}
+	return b.logprob / math.Pow(float64(len(b.tokens)), float64(penalty))
+}
+
+// BeamSearch generates the completion with the highest length-normalized
+// log-probability found by keeping Width hypotheses at every step. Each beam
+// occupies one sequence of the context, which must have been created with
+// at least Width sequences.
+func (c *Context) BeamSearch(ctx context.Context, prompt string, opts BeamSearchOptions) (*GenerateResult, error) {
+	width := max(opts.Width, 1)
+	if nSeq := int(C.llama_n_seq_max(c.ptr)); width > nSeq {
+		return nil, fmt.Errorf("beam width %d exceeds the context's %d sequences", width, nSeq)
+	}
+
+	tokens, err := c.model.TokenizeWithOptions(prompt, TokenizeOptions{ParseSpecial: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("prompt is empty")
+	}
+	nCtx := c.Size()
+	if len(tokens) >= nCtx {
+		return nil, ErrPromptTooLong
+	}
+
+	mem := C.llama_get_memory(c.ptr)
+	for seq := 1; seq < width; seq++ {
+		C.llama_memory_seq_rm(mem, C.llama_seq_id(seq), -1, -1)
+	}
+	if err := c.evaluate(tokens); err != nil {
+		return nil, err
+	}
+
+	result := &GenerateResult{PromptTokens: len(tokens), FinishReason: FinishLength}
+	beams := []*beam{{seq: 0, logits: -1}}
+
+	for step := 0; ; step++ {
+		if ctx.Err() != nil {
+			result.FinishReason = FinishCancel
+			break
+		}
+		if allDone(beams) {
+			result.FinishReason = FinishStop
+			break
+		}
+		// Every step adds at most one cell per beam to the shared cache
+		if (opts.MaxTokens > 0 && step >= opts.MaxTokens) || len(tokens)+(step+1)*width > nCtx {
+			break
+		}
+
+		beams = c.expandBeams(beams, width, opts.LengthPenalty)
+		if err := c.decodeBeams(beams, len(tokens)); err != nil {
+			c.clearMemory()
+			return nil, err
+		}
+	}
+
+	best := beams[0]
+	for _, b := range beams[1:] {
+		if b.score(opts.LengthPenalty) > best.score(opts.LengthPenalty) {
+			best = b
+		}
+	}
+
+	// Keep only the best beam, as sequence 0
+	if best.seq != 0 {
+		C.llama_memory_seq_rm(mem, 0, -1, -1)
+		C.llama_memory_seq_cp(mem, C.llama_seq_id(best.seq), 0, -1, -1)
+	}
+	for seq := 1; seq < width; seq++ {
+		C.llama_memory_seq_rm(mem, C.llama_seq_id(seq), -1, -1)
+	}
+
+	completion := best.tokens
+	if best.done {
+		completion = completion[:len(completion)-1]
+	}
+	c.tokens = append(c.tokens[:len(tokens)], completion...)
+
+	result.CompletionTokens = len(completion)
+	if result.Text, err = c.model.Detokenize(completion, true, false); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// expandBeams extends every unfinished beam with its most likely next
+// tokens and returns the best width candidates, assigning each a sequence
+func (c *Context) expandBeams(beams []*beam, width int, penalty float32) []*beam {
+	type candidate struct {
+		parent *beam
+		beam   *beam
+	}
+	var candidates []candidate
+	for _, b := range beams {
+		if b.done {
+			candidates = append(candidates, candidate{parent: b, beam: b})
+			continue
+		}
+
+		logprobs := logSoftmax(c.logits(b.logits))
+		for _, token := range topTokens(logprobs, width) {
+			next := &beam{
+				tokens:  append(append([]Token(nil), b.tokens...), token),
+				logprob: b.logprob + float64(logprobs[token]),
+				done:    c.model.IsEOG(token),
+			}
+			candidates = append(candidates, candidate{parent: b, beam: next})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].beam.score(penalty) > candidates[j].beam.score(penalty)
+	})
+	candidates = candidates[:min(width, len(candidates))]
+
+	// The first child of a beam takes over its sequence, further children get
+	// a copy of it in a sequence no surviving beam uses
+	inherits := make([]bool, len(candidates))
+	used := make(map[int]bool)
+	for i, cand := range candidates {
+		if !used[cand.parent.seq] {
+			used[cand.parent.seq] = true
+			cand.beam.seq = cand.parent.seq
+			inherits[i] = true
+		}
+	}
+
+	mem := C.llama_get_memory(c.ptr)
+	var free []int
+	for seq := 0; seq < width; seq++ {
+		if !used[seq] {
+			C.llama_memory_seq_rm(mem, C.llama_seq_id(seq), -1, -1)
+			free = append(free, seq)
+		}
+	}
+
+	next := make([]*beam, len(candidates))
+	for i, cand := range candidates {
+		if !inherits[i] {
+			cand.beam.seq, free = free[0], free[1:]
+			C.llama_memory_seq_cp(mem, C.llama_seq_id(cand.parent.seq), C.llama_seq_id(cand.beam.seq), -1, -1)
+		}
+		next[i] = cand.beam
+	}
+
+	return next
+}
+
+// decodeBeams evaluates the newest token of every unfinished beam in a
+// single batch and records where each beam's logits are
+func (c *Context) decodeBeams(beams []*beam, promptLen int) error {
+	c.batch.clear()
+	for _, b := range beams {
+		if b.done {
+			continue
+		}
+		b.logits = int(c.batch.c.n_tokens)
+		c.batch.add(b.tokens[len(b.tokens)-1], promptLen+len(b.tokens)-1, b.seq, true)
+	}
+	if c.batch.c.n_tokens == 0 {
+		return nil
+	}
+	c.batch.generated = int(c.batch.c.n_tokens)
+	return c.decodeBatch()
+}
+
+func allDone(beams []*beam) bool {
+	for _, b := range beams {
+		if !b.done {
+			return false
+		}
+	}
+	return true
+}
+
+// topTokens returns the k tokens with the highest values
+func topTokens(values []float32, k int) []Token {
+	top := make([]Token, 0, k+1)
+	for i, v := range values {
+		if len(top) == k && v <= values[top[k-1]] {
+			continue
+		}
+		j := sort.Search(len(top), func(j int) bool { return values[top[j]] < v })
+		top = append(top, 0)
+		copy(top[j+1:], top[j:])
+		top[j] = Token(i)
+		if len(top) > k {
+			top = top[:k]
+		}
+	}
+	return top
+}
@@ -0,0 +1,110 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The benchmarks measure the binding layer on the model ALPACA_BENCH_MODEL
+// names, preferably a small one, and are skipped without it:
+//
+//	ALPACA_BENCH_MODEL=model.gguf go test -run '^$' -bench . -count 10 ./bindings
+//
+// Results of two builds can be compared with benchstat.
+const benchModelEnv = "ALPACA_BENCH_MODEL"
+
+const (
+	benchContextSize  = 2048
+	benchPromptTokens = 512 // length of the prompts evaluated by BenchmarkPrefill
+	benchEmbedBatch   = 16  // texts embedded per op by BenchmarkEmbedBatch
+)
+
+// benchText is repeated to build prompts of the requested length
+const benchText = "The quick brown fox jumps over the lazy dog while the farmer watches from the porch. "
+
+// benchModel loads the model of the benchmarks
+func benchModel(b *testing.B) *Model {
+	b.Helper()
+	return loadTestModel(b, fixturePath(b, benchModelEnv, ""), ModelParams{})
+}
+
+// benchPrompt repeats benchText until it is about n tokens long
+func benchPrompt(b *testing.B, m *Model, n int) string {
+	b.Helper()
+	tokens, err := m.Tokenize(benchText, false, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return strings.Repeat(benchText, max(n/max(len(tokens), 1), 1))
+}
+
+// BenchmarkPrefill evaluates a prompt per op. Each prompt starts with the op
+// number so that no prefix is reused from the cache.
+func BenchmarkPrefill(b *testing.B) {
+	m := benchModel(b)
+	c := testContext(b, m, ContextParams{ContextSize: benchContextSize, BatchSize: benchPromptTokens})
+	prompt := benchPrompt(b, m, benchPromptTokens)
+	for i := 0; b.Loop(); i++ {
+		if err := c.Prefill(fmt.Sprintf("%d. %s", i, prompt)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchPromptTokens*b.N)/b.Elapsed().Seconds(), "tokens/s")
+}
+
+// BenchmarkDecode generates one token per op, in generations of up to 128
+// tokens after a short prompt that stays cached
+func BenchmarkDecode(b *testing.B) {
+	c := testContext(b, benchModel(b), ContextParams{ContextSize: benchContextSize})
+	opts := greedy(0)
+	done := 0
+	for done < b.N {
+		opts.MaxTokens = min(b.N-done, 128)
+		res, err := c.Generate(context.Background(), "Once upon a time", opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if res.CompletionTokens == 0 {
+			b.Fatal("the model generated nothing")
+		}
+		done += res.CompletionTokens
+	}
+	b.ReportMetric(float64(done)/b.Elapsed().Seconds(), "tokens/s")
+}
+
+// BenchmarkTokenize tokenizes the prefill prompt per op
+func BenchmarkTokenize(b *testing.B) {
+	m := benchModel(b)
+	prompt := benchPrompt(b, m, benchPromptTokens)
+	b.SetBytes(int64(len(prompt)))
+	for b.Loop() {
+		if _, err := m.Tokenize(prompt, true, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEmbedBatch embeds benchEmbedBatch short texts per op, in shared
+// decodes
+func BenchmarkEmbedBatch(b *testing.B) {
+	c := testContext(b, benchModel(b), ContextParams{
+		ContextSize: benchContextSize,
+		BatchSize:   benchContextSize,
+		UBatchSize:  benchContextSize,
+		Sequences:   benchEmbedBatch,
+	})
+	texts := make([]string, benchEmbedBatch)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("Sentence number %d about %s", i, benchText)
+	}
+	for b.Loop() {
+		if _, err := c.EmbedMany(texts, EmbedOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchEmbedBatch*b.N)/b.Elapsed().Seconds(), "texts/s")
+}
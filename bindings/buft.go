@@ -0,0 +1,61 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// BufferTypes returns the names of the buffer types weights can be placed in
+// with a TensorOverride: one per device, such as "CPU" or "CUDA0"
+func BufferTypes() []string {
+	var names []string
+	for i := range int(C.ggml_backend_dev_count()) {
+		buft := C.ggml_backend_dev_buffer_type(C.ggml_backend_dev_get(C.size_t(i)))
+		if buft != nil {
+			names = append(names, C.GoString(C.ggml_backend_buft_name(buft)))
+		}
+	}
+	return names
+}
+
+// bufferType looks up a buffer type by the name BufferTypes lists it under
+func bufferType(name string) (C.ggml_backend_buffer_type_t, error) {
+	for i := range int(C.ggml_backend_dev_count()) {
+		buft := C.ggml_backend_dev_buffer_type(C.ggml_backend_dev_get(C.size_t(i)))
+		if buft != nil && C.GoString(C.ggml_backend_buft_name(buft)) == name {
+			return buft, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown buffer type %q, have %s", name, strings.Join(BufferTypes(), ", "))
+}
+
+// tensorOverrides builds the NULL-terminated override array of
+// llama_model_params. The returned func frees it, which may happen once the
+// model is loaded.
+func tensorOverrides(overrides []TensorOverride) (*C.struct_llama_model_tensor_buft_override, func(), error) {
+	n := len(overrides) + 1
+	arr := (*C.struct_llama_model_tensor_buft_override)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.struct_llama_model_tensor_buft_override{}))))
+	entries := unsafe.Slice(arr, n)
+	free := func() {
+		for _, e := range entries {
+			C.free(unsafe.Pointer(e.pattern))
+		}
+		C.free(unsafe.Pointer(arr))
+	}
+	for i, o := range overrides {
+		buft, err := bufferType(o.BufferType)
+		if err != nil {
+			free()
+			return nil, nil, err
+		}
+		entries[i] = C.struct_llama_model_tensor_buft_override{pattern: C.CString(o.Pattern), buft: buft}
+	}
+	return arr, free, nil
+}
@@ -0,0 +1,50 @@
+package bindings
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// CallError is returned when a call into llama.cpp fails or a callback
+// panics, with the state of the context at the time to help diagnose it
+type CallError struct {
+	Op  string // the llama.cpp function or callback, e.g. "llama_decode" or "OnToken"
+	Err error
+
+	Model       string // the model's description, e.g. "llama 8B Q4_K - Medium"
+	ContextSize int
+	BatchSize   int
+	UBatchSize  int
+	Tokens      int // tokens in the batch being decoded, 0 when there was none
+
+	// Panic is the value a callback panicked with and Stack the stack of
+	// the goroutine at that point, both nil for failed calls
+	Panic any
+	Stack []byte
+}
+
+func (e *CallError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %v (model %s, n_ctx %d, n_batch %d, n_ubatch %d", e.Op, e.Err, e.Model, e.ContextSize, e.BatchSize, e.UBatchSize)
+	if e.Tokens > 0 {
+		fmt.Fprintf(&b, ", %d tokens in batch", e.Tokens)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// recovered records a panic as the cause of the error
+func (e *CallError) recovered(r any) *CallError {
+	if err, ok := r.(error); ok {
+		e.Err = fmt.Errorf("panic: %w", err)
+	} else {
+		e.Err = fmt.Errorf("panic: %v", r)
+	}
+	e.Panic, e.Stack = r, debug.Stack()
+	return e
+}
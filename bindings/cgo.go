@@ -0,0 +1,21 @@
+//go:build !nollama && !llama_pkgconfig
+
+package bindings
+
+// By default the bindings use the llama.cpp checkout next to them, built by
+// go generate or make build, or by go run ./internal/buildllama -prebuilt.
+// The library directory can't come from the environment here, so make passes
+// the one ALPACA_LLAMA_LIB names in CGO_LDFLAGS, whose -L is searched first.
+//
+// On Windows cgo needs a MinGW gcc or clang, but llama.cpp itself may be
+// built with MSVC, whose multi-config generators put the libraries in
+// build/bin/Release. MinGW links against llama.dll directly. The DLLs must
+// be next to the executable or on PATH when it runs.
+
+// #cgo CFLAGS: -I${SRCDIR}/../llama.cpp/include -I${SRCDIR}/../llama.cpp/ggml/include
+// #cgo CXXFLAGS: -std=c++17 -I${SRCDIR}/../llama.cpp/include -I${SRCDIR}/../llama.cpp/ggml/include
+// #cgo LDFLAGS: -L${SRCDIR}/../llama.cpp/build/bin -lllama
+// #cgo linux LDFLAGS: -lstdc++ -lm
+// #cgo darwin LDFLAGS: -lc++ -framework Accelerate -framework Foundation -framework Metal -framework MetalKit
+// #cgo windows LDFLAGS: -L${SRCDIR}/../llama.cpp/build/bin/Release -lstdc++
+import "C"
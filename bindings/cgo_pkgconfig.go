@@ -0,0 +1,15 @@
+//go:build !nollama && llama_pkgconfig
+
+package bindings
+
+// With the llama_pkgconfig tag the bindings link an installed llama.cpp,
+// e.g. from a distribution package or cmake --install, found through
+// pkg-config. Set PKG_CONFIG_PATH to the directory holding llama.pc when it
+// isn't in a standard location.
+
+// #cgo pkg-config: llama
+// #cgo CXXFLAGS: -std=c++17
+// #cgo linux LDFLAGS: -lstdc++ -lm
+// #cgo darwin LDFLAGS: -lc++
+// #cgo windows LDFLAGS: -lstdc++
+import "C"
@@ -0,0 +1,158 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// ApplyChatTemplate formats messages into a prompt using the model's chat
+// template, or chatml if the model has none. When addAssistant is set the
+// prompt ends with the tokens that start an assistant reply.
+func (m *Model) ApplyChatTemplate(messages []ChatMessage, addAssistant bool) (string, error) {
+	return applyChatTemplate(m.chatTemplate(), messages, addAssistant, m.templateVars())
+}
+
+// CountTokens returns the number of tokens the messages take up as a prompt,
+// formatted with the model's chat template and ready for an assistant reply
+func (m *Model) CountTokens(messages []ChatMessage) (int, error) {
+	prompt, err := m.ApplyChatTemplate(messages, true)
+	if err != nil {
+		return 0, err
+	}
+	tokens, err := m.TokenizeWithOptions(prompt, TokenizeOptions{ParseSpecial: true})
+	if err != nil {
+		return 0, err
+	}
+	return len(tokens), nil
+}
+
+// ApplyChatTemplate formats messages into a prompt using the given template,
+// which is the name of a registered PromptTemplate, a template embedded in a
+// GGUF file or the name of a template built into llama.cpp. Jinja templates
+// are rendered with the jinja package, or by llama.cpp's built-in formatters
+// when they use something the package doesn't support. An empty template
+// selects chatml.
+func ApplyChatTemplate(tmpl string, messages []ChatMessage, addAssistant bool) (string, error) {
+	return applyChatTemplate(tmpl, messages, addAssistant, nil)
+}
+
+// RenderChatTemplate renders the model's Jinja chat template directly,
+// bypassing llama.cpp's built-in formatters. Extra variables such as tools
+// are passed to the template alongside messages, add_generation_prompt,
+// bos_token and eos_token.
+func (m *Model) RenderChatTemplate(messages []ChatMessage, addAssistant bool, vars map[string]any) (string, error) {
+	tmpl := m.chatTemplate()
+	if tmpl == "" {
+		return "", errors.New("model has no chat template")
+	}
+	all := m.templateVars()
+	for k, v := range vars {
+		all[k] = v
+	}
+	return RenderChatTemplate(tmpl, messages, addAssistant, all)
+}
+
+// applyChatTemplate formats messages with the given template, passing vars
+// to Jinja templates
+func applyChatTemplate(tmpl string, messages []ChatMessage, addAssistant bool, vars map[string]any) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("no messages to format")
+	}
+	if tmpl == "" {
+		tmpl = "chatml"
+	}
+	size := 0
+	for _, msg := range messages {
+		size += len(msg.Role) + len(msg.Content)
+		for _, call := range msg.ToolCalls {
+			size += len(call.Name) + len(call.Arguments)
+		}
+	}
+	if err := checkInput(size); err != nil {
+		return "", err
+	}
+	if t, ok := LookupTemplate(tmpl); ok {
+		return t.Format(messages, addAssistant), nil
+	}
+	var jinjaErr error
+	if isJinjaTemplate(tmpl) {
+		prompt, err := RenderChatTemplate(tmpl, messages, addAssistant, vars)
+		if err == nil {
+			return prompt, nil
+		}
+		jinjaErr = err
+	}
+
+	cTmpl := C.CString(tmpl)
+	defer C.free(unsafe.Pointer(cTmpl))
+
+	cMessages := (*C.llama_chat_message)(C.malloc(C.size_t(len(messages)) * C.size_t(unsafe.Sizeof(C.llama_chat_message{}))))
+	defer C.free(unsafe.Pointer(cMessages))
+
+	cSlice := unsafe.Slice(cMessages, len(messages))
+	for i, msg := range messages {
+		cSlice[i].role = C.CString(msg.Role)
+		cSlice[i].content = C.CString(msg.Content)
+		defer C.free(unsafe.Pointer(cSlice[i].role))
+		defer C.free(unsafe.Pointer(cSlice[i].content))
+	}
+
+	buf := make([]byte, 2*size+256)
+	n := C.llama_chat_apply_template(cTmpl, cMessages, C.size_t(len(messages)), C.bool(addAssistant), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)))
+	if int(n) > len(buf) {
+		buf = make([]byte, n)
+		n = C.llama_chat_apply_template(cTmpl, cMessages, C.size_t(len(messages)), C.bool(addAssistant), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)))
+	}
+	if n < 0 {
+		if jinjaErr != nil {
+			return "", jinjaErr
+		}
+		return "", errors.New("unsupported chat template")
+	}
+
+	return string(buf[:n]), nil
+}
+
+// ChatTemplate returns the chat template stored in the model and whether it
+// has one
+func (m *Model) ChatTemplate() (string, bool) {
+	tmpl := m.chatTemplate()
+	return tmpl, tmpl != ""
+}
+
+// TemplateFamily reports the prompt format of the model's chat template, so
+// that stop strings and tool call parsing can be picked to match
+func (m *Model) TemplateFamily() TemplateFamily {
+	return DetectTemplateFamily(m.chatTemplate())
+}
+
+// chatTemplate returns the default chat template stored in the model, if any
+func (m *Model) chatTemplate() string {
+	tmpl := C.llama_model_chat_template(m.ptr, nil)
+	if tmpl == nil {
+		return ""
+	}
+	return C.GoString(tmpl)
+}
+
+// templateVars returns the special token strings chat templates refer to
+func (m *Model) templateVars() map[string]any {
+	return map[string]any{
+		"bos_token": m.tokenText(m.BOS()),
+		"eos_token": m.tokenText(m.EOS()),
+	}
+}
+
+// tokenText returns the vocabulary text of a token, or "" for LLAMA_TOKEN_NULL
+func (m *Model) tokenText(token Token) string {
+	if token < 0 {
+		return ""
+	}
+	return C.GoString(C.llama_vocab_get_text(m.vocab, C.llama_token(token)))
+}
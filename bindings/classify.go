@@ -0,0 +1,71 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Classify returns for each text the probability of each label following
+// it, as scored by the model: zero-shot classification without training a
+// classifier. Labels are scored as written, so they usually start with a
+// space, e.g. " positive" and " negative".
+func (c *Context) Classify(texts, labels []string) ([][]float64, error) {
+	return c.ClassifyWithOptions(texts, labels, ClassifyOptions{})
+}
+
+// ClassifyWithOptions returns for each text the probability of each label
+// following it. The probabilities of a text sum to 1 over the labels.
+func (c *Context) ClassifyWithOptions(texts, labels []string, opts ClassifyOptions) ([][]float64, error) {
+	if len(labels) < 2 {
+		return nil, errors.New("at least two labels are required")
+	}
+	var lengths []int
+	if opts.PerToken {
+		lengths = make([]int, len(labels))
+		for i, label := range labels {
+			tokens, err := c.model.Tokenize(label, false, true)
+			if err != nil {
+				return nil, err
+			}
+			lengths[i] = max(len(tokens), 1)
+		}
+	}
+
+	probs := make([][]float64, len(texts))
+	for i, text := range texts {
+		prompt := text
+		if opts.Template != "" {
+			prompt = strings.ReplaceAll(opts.Template, "{text}", text)
+		}
+		scores, err := c.ScoreMany(prompt, labels)
+		if err != nil {
+			return nil, err
+		}
+		for j := range lengths {
+			scores[j] /= float64(lengths[j])
+		}
+		probs[i] = softmax(scores)
+	}
+	return probs, nil
+}
+
+// softmax turns log-probabilities into probabilities summing to 1
+func softmax(logprobs []float64) []float64 {
+	maxLogprob := math.Inf(-1)
+	for _, l := range logprobs {
+		maxLogprob = max(maxLogprob, l)
+	}
+	probs := make([]float64, len(logprobs))
+	var sum float64
+	for i, l := range logprobs {
+		probs[i] = math.Exp(l - maxLogprob)
+		sum += probs[i]
+	}
+	for i := range probs {
+		probs[i] /= sum
+	}
+	return probs
+}
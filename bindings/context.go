@@ -0,0 +1,464 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Context holds the KV cache and state needed to run inference with a model.
+// A Context is not safe for concurrent use.
+type Context struct {
+	ptr      *C.struct_llama_context
+	params   C.struct_llama_context_params
+	model    *Model
+	batch    *batch
+	tokens   []Token  // tokens of sequence 0 currently held in the KV cache
+	guidance *Context // evaluates negative prompts, created on first use
+
+	// untracked is set when Decode changed the cache behind tokens' back
+	untracked bool
+
+	// deterministic disables prefix reuse, see ContextParams.Deterministic
+	deterministic bool
+
+	eviction EvictionPolicy
+
+	// swa is the sliding window of a model whose cache only holds the
+	// window, see ContextParams.SmallSWACache, 0 otherwise
+	swa int
+
+	// sched is the scheduler running on the context, if any
+	sched atomic.Pointer[Scheduler]
+
+	// threadpools set up for ContextParams.CPU, owned by the context
+	threadpool      *C.struct_ggml_threadpool
+	threadpoolBatch *C.struct_ggml_threadpool
+
+	// shared is ContextParams.Threadpool
+	shared *Threadpool
+
+	// interrupt is the abort flag for InterruptCompute, set up on first use
+	interrupt *interrupt
+}
+
+// NewContext creates an inference context for the model
+func NewContext(model *Model, params ContextParams) (*Context, error) {
+	if model == nil || model.ptr == nil {
+		return nil, errors.New("model is not loaded")
+	}
+	if params.CPU != nil && params.Threadpool != nil {
+		return nil, errors.New("CPU and Threadpool are mutually exclusive")
+	}
+	cParams := params.toC()
+	model.applyRope(&cParams, params.RopeScaling)
+	c, err := newContext(model, cParams)
+	if err != nil {
+		return nil, err
+	}
+	c.deterministic = params.Deterministic
+	c.eviction = params.Eviction
+	if params.SmallSWACache {
+		c.swa = model.SlidingWindow()
+	}
+	if params.CPU != nil {
+		if err := c.attachThreadpools(params.CPU); err != nil {
+			c.Free()
+			return nil, err
+		}
+	}
+	if params.Threadpool != nil {
+		if err := params.Threadpool.attach(c); err != nil {
+			c.Free()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// toC converts the parameters to their llama.cpp representation
+func (params ContextParams) toC() C.struct_llama_context_params {
+	cParams := C.llama_context_default_params()
+	cParams.n_ctx = C.uint32_t(params.ContextSize)
+	if params.BatchSize > 0 {
+		cParams.n_batch = C.uint32_t(params.BatchSize)
+	}
+	if params.UBatchSize > 0 {
+		cParams.n_ubatch = C.uint32_t(params.UBatchSize)
+	}
+	if params.Sequences > 1 {
+		// A unified cache lets sequences share cells, so copying a
+		// sequence costs nothing and every sequence can use all of n_ctx
+		cParams.n_seq_max = C.uint32_t(params.Sequences)
+		cParams.kv_unified = true
+	}
+	if params.DefragThreshold != 0 {
+		cParams.defrag_thold = C.float(params.DefragThreshold)
+	}
+	if params.SmallSWACache {
+		cParams.swa_full = false
+	}
+	if params.Threadpool != nil {
+		// Every thread of a shared pool works on each computation
+		n := C.int32_t(params.Threadpool.Threads())
+		cParams.n_threads, cParams.n_threads_batch = n, n
+	}
+	if params.Threads > 0 {
+		cParams.n_threads = C.int32_t(params.Threads)
+	}
+	if params.ThreadsBatch > 0 {
+		cParams.n_threads_batch = C.int32_t(params.ThreadsBatch)
+	}
+	if params.Deterministic {
+		cParams.n_threads, cParams.n_threads_batch = 1, 1
+		cParams.n_ubatch = cParams.n_batch
+		cParams.flash_attn_type = C.LLAMA_FLASH_ATTN_TYPE_DISABLED
+	}
+	return cParams
+}
+
+func newContext(model *Model, cParams C.struct_llama_context_params) (*Context, error) {
+	model.retain()
+	if tracing() {
+		defer trace("llama_init_from_model", time.Now(),
+			slog.Int("n_ctx", int(cParams.n_ctx)), slog.Int("n_batch", int(cParams.n_batch)), slog.Int("n_ubatch", int(cParams.n_ubatch)),
+			slog.Int("n_seq_max", int(cParams.n_seq_max)), slog.Int("n_threads", int(cParams.n_threads)), slog.Int("n_threads_batch", int(cParams.n_threads_batch)))
+	}
+	ctxPtr := C.llama_init_from_model(model.ptr, cParams)
+	if ctxPtr == nil {
+		model.releaseContext()
+		return nil, errors.New("failed to create context")
+	}
+
+	c := &Context{ptr: ctxPtr, params: cParams, model: model}
+	c.batch = newBatch(int(C.llama_n_batch(ctxPtr)), int(C.llama_n_seq_max(ctxPtr)))
+
+	return c, nil
+}
+
+// Free frees the context
+func (c *Context) Free() {
+	if c.guidance != nil {
+		c.guidance.Free()
+		c.guidance = nil
+	}
+	if c.batch != nil {
+		c.batch.free()
+		c.batch = nil
+	}
+	if c.ptr != nil {
+		C.llama_free(c.ptr)
+		c.ptr = nil
+		c.freeThreadpools()
+		c.freeInterrupt()
+		c.model.releaseContext()
+	}
+}
+
+// Model returns the model the context was created from
+func (c *Context) Model() *Model {
+	return c.model
+}
+
+// Size returns the number of tokens the context can hold
+func (c *Context) Size() int {
+	return int(C.llama_n_ctx(c.ptr))
+}
+
+// MaxTokens returns the most tokens a sequence can hold: the context size,
+// or the size of a slot while a Scheduler runs on the context
+func (c *Context) MaxTokens() int {
+	if s := c.sched.Load(); s != nil {
+		return s.SlotSize()
+	}
+	return c.Size()
+}
+
+// UsedTokens returns the number of tokens sequence seq holds in the KV
+// cache, e.g. to show how full the context is or to decide when to
+// summarize a conversation
+func (c *Context) UsedTokens(seq int) int {
+	mem := C.llama_get_memory(c.ptr)
+	last := C.llama_memory_seq_pos_max(mem, C.llama_seq_id(seq))
+	if last < 0 {
+		return 0
+	}
+	return int(last-C.llama_memory_seq_pos_min(mem, C.llama_seq_id(seq))) + 1
+}
+
+// logits returns the logits of the i-th token of the last batch, -1 for the
+// last one. The slice points into llama.cpp memory and is only valid until the
+// next decode.
+func (c *Context) logits(i int) []float32 {
+	return unsafe.Slice((*float32)(unsafe.Pointer(C.llama_get_logits_ith(c.ptr, C.int32_t(i)))), c.model.VocabSize())
+}
+
+// clearMemory removes all tokens from the KV cache
+func (c *Context) clearMemory() {
+	C.llama_memory_clear(C.llama_get_memory(c.ptr), true)
+	c.tokens = c.tokens[:0]
+	c.untracked = false
+}
+
+// useThreads switches the context to the given thread counts, 0 keeping the
+// current one, and returns a function switching back. Deterministic contexts
+// stay on one thread.
+func (c *Context) useThreads(threads, batch int) (restore func()) {
+	if c.deterministic || (threads <= 0 && batch <= 0) {
+		return func() {}
+	}
+	prev, prevBatch := C.llama_n_threads(c.ptr), C.llama_n_threads_batch(c.ptr)
+	n, nBatch := prev, prevBatch
+	if threads > 0 {
+		n = C.int32_t(threads)
+	}
+	if batch > 0 {
+		nBatch = C.int32_t(batch)
+	}
+	C.llama_set_n_threads(c.ptr, n, nBatch)
+	return func() { C.llama_set_n_threads(c.ptr, prev, prevBatch) }
+}
+
+// canShift reports whether positions in the KV cache can be moved
+func (c *Context) canShift() bool {
+	return bool(C.llama_memory_can_shift(C.llama_get_memory(c.ptr)))
+}
+
+// shift removes n tokens of sequence 0 after the first keep and moves the
+// following ones back, so that positions stay contiguous
+func (c *Context) shift(keep, n int) {
+	mem := C.llama_get_memory(c.ptr)
+	C.llama_memory_seq_rm(mem, 0, C.llama_pos(keep), C.llama_pos(keep+n))
+	C.llama_memory_seq_add(mem, 0, C.llama_pos(keep+n), -1, C.llama_pos(-n))
+	c.tokens = shiftTokens(c.tokens, keep, n)
+}
+
+// evaluate makes sequence 0 hold exactly the given tokens, reusing the
+// prefix it shares with what is already in the KV cache
+func (c *Context) evaluate(tokens []Token) error {
+	_, err := c.evaluateProgress(tokens, nil, nil)
+	return err
+}
+
+// evaluateProgress is evaluate, calling progress after every batch with the
+// number of tokens in the cache so far and the total. It returns the number
+// of tokens reused. Once stop, if set, reports true, it fails with
+// errInterrupted, keeping what was evaluated.
+func (c *Context) evaluateProgress(tokens []Token, progress func(done, total int), stop func() bool) (int, error) {
+	if len(tokens) == 0 {
+		return 0, errors.New("prompt is empty")
+	}
+	if c.untracked || c.deterministic {
+		c.clearMemory()
+	}
+	n := commonPrefix(c.tokens, tokens)
+	if n == len(tokens) {
+		// The last token is decoded again to get logits for it
+		n--
+	}
+	n = c.reusable(0, n)
+
+	if n < len(c.tokens) {
+		if !C.llama_memory_seq_rm(C.llama_get_memory(c.ptr), 0, C.llama_pos(n), -1) {
+			// Recurrent models can't remove part of a sequence
+			c.clearMemory()
+			n = 0
+		}
+		c.tokens = c.tokens[:n]
+	}
+	if !c.deterministic {
+		accountPrompt(len(tokens), n)
+	}
+
+	var batchDone func(int) bool
+	if progress != nil || stop != nil {
+		batchDone = func(end int) bool {
+			if progress != nil {
+				progress(n+end, len(tokens))
+			}
+			return stop == nil || !stop()
+		}
+	}
+	decoded, err := c.decodeProgress(tokens[n:], n, 0, true, batchDone)
+	if err != nil && stop != nil && stop() {
+		// The batches decoded whole are kept, an aborted one may be partly
+		// in the cache
+		if !C.llama_memory_seq_rm(C.llama_get_memory(c.ptr), 0, C.llama_pos(n+decoded), -1) {
+			c.clearMemory()
+			return 0, errInterrupted
+		}
+		c.tokens = append(c.tokens, tokens[n:n+decoded]...)
+		return n, errInterrupted
+	}
+	if err != nil {
+		c.clearMemory()
+		return 0, err
+	}
+	c.tokens = append(c.tokens, tokens[n:]...)
+
+	return n, nil
+}
+
+// evaluateShared makes sequence 0 hold the tokens for copying into
+// sequences that each decode the last token again. Recurrent state can only
+// be copied whole, at its final position, so for recurrent models sequence 0
+// stops before the last token.
+func (c *Context) evaluateShared(tokens []Token) error {
+	if !c.model.IsRecurrent() || len(tokens) == 0 {
+		return c.evaluate(tokens)
+	}
+
+	shared := tokens[:len(tokens)-1]
+	n := commonPrefix(c.tokens, shared)
+	if n < len(c.tokens) || c.untracked {
+		c.clearMemory()
+		n = 0
+	}
+	if err := c.decode(shared[n:], n, 0, false); err != nil {
+		c.clearMemory()
+		return err
+	}
+	c.tokens = append(c.tokens, shared[n:]...)
+
+	return nil
+}
+
+// reusable returns how many of the first n tokens of sequence seq in the
+// cache can be kept to decode from position n on: all, unless a cache
+// holding only the sliding window already dropped tokens the next ones
+// attend to
+func (c *Context) reusable(seq, n int) int {
+	if c.swa == 0 || n == 0 {
+		return n
+	}
+	oldest := int(C.llama_memory_seq_pos_min(C.llama_get_memory(c.ptr), C.llama_seq_id(seq)))
+	if oldest > max(0, n-c.swa) {
+		return 0
+	}
+	return n
+}
+
+// decode evaluates tokens for a sequence starting at pos, splitting them into
+// batches. Logits are only requested for the final token when wantLogits is set.
+func (c *Context) decode(tokens []Token, pos int, seq int, wantLogits bool) error {
+	_, err := c.decodeProgress(tokens, pos, seq, wantLogits, nil)
+	return err
+}
+
+// decodeProgress is decode, calling progress with the number of tokens
+// decoded after every batch. It stops with errInterrupted when progress
+// returns false before the last batch, and returns the number decoded.
+func (c *Context) decodeProgress(tokens []Token, pos int, seq int, wantLogits bool, progress func(decoded int) bool) (int, error) {
+	for start := 0; start < len(tokens); start += c.batch.capacity {
+		end := min(start+c.batch.capacity, len(tokens))
+
+		c.batch.clear()
+		for i := start; i < end; i++ {
+			c.batch.add(tokens[i], pos+i, seq, wantLogits && i == len(tokens)-1)
+		}
+
+		if err := c.decodeBatch(); err != nil {
+			return start, err
+		}
+		if progress != nil && !progress(end) && end < len(tokens) {
+			return end, errInterrupted
+		}
+	}
+
+	return len(tokens), nil
+}
+
+// decodeBatch evaluates the tokens currently in the context's batch. When
+// the KV cache is full, idle sequences are evicted as ContextParams.Eviction
+// allows and the batch is tried once more.
+func (c *Context) decodeBatch() error {
+	tokens := int(c.batch.c.n_tokens)
+	defer c.usePool()()
+	defer c.enter("llama_decode", tokens)()
+	var status DecodeStatus
+	if tracing() {
+		defer func(start time.Time) {
+			trace("llama_decode", start, slog.Int("tokens", tokens), slog.String("status", status.String()))
+		}(time.Now())
+	}
+	start := time.Now()
+	status = decodeStatus(C.llama_decode(c.ptr, c.batch.c))
+	if status == DecodeNoKVSlot && c.eviction == EvictIdle && c.evictIdle() {
+		status = decodeStatus(C.llama_decode(c.ptr, c.batch.c))
+	}
+	// A lone token is one fed back in by a generation loop
+	generated := c.batch.generated
+	if tokens == 1 {
+		generated = 1
+	}
+	accountDecode(tokens, generated, time.Since(start))
+	if status != DecodeOK {
+		return c.callError("llama_decode", tokens, fmt.Errorf("llama_decode failed: %s", status))
+	}
+	return nil
+}
+
+// evictIdle makes room in the KV cache by evicting sequences nothing runs
+// in. Only a Scheduler keeps such sequences, the prompts of finished
+// generations. It reports whether it freed anything.
+func (c *Context) evictIdle() bool {
+	if s := c.sched.Load(); s != nil {
+		return s.evictIdle()
+	}
+	return false
+}
+
+// batch wraps a llama_batch allocated on the C heap
+type batch struct {
+	c        C.struct_llama_batch
+	capacity int
+	nSeqMax  int
+
+	// generated counts the tokens of the batch that were sampled rather
+	// than taken from a prompt, for InferenceStats
+	generated int
+}
+
+func newBatch(capacity, nSeqMax int) *batch {
+	return &batch{
+		c:        C.llama_batch_init(C.int32_t(capacity), 0, C.int32_t(nSeqMax)),
+		capacity: capacity,
+		nSeqMax:  nSeqMax,
+	}
+}
+
+func (b *batch) clear() {
+	b.c.n_tokens = 0
+	b.generated = 0
+}
+
+// add appends a token for a single sequence
+func (b *batch) add(token Token, pos int, seq int, logits bool) {
+	i := int(b.c.n_tokens)
+
+	unsafe.Slice(b.c.token, b.capacity)[i] = C.llama_token(token)
+	unsafe.Slice(b.c.pos, b.capacity)[i] = C.llama_pos(pos)
+	unsafe.Slice(b.c.n_seq_id, b.capacity)[i] = 1
+	seqIDs := unsafe.Slice(b.c.seq_id, b.capacity)[i]
+	unsafe.Slice(seqIDs, b.nSeqMax)[0] = C.llama_seq_id(seq)
+	if logits {
+		unsafe.Slice(b.c.logits, b.capacity)[i] = 1
+	} else {
+		unsafe.Slice(b.c.logits, b.capacity)[i] = 0
+	}
+
+	b.c.n_tokens++
+}
+
+func (b *batch) free() {
+	C.llama_batch_free(b.c)
+}
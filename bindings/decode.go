@@ -0,0 +1,132 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unsafe"
+)
+
+// Batch is a set of tokens evaluated together by Context.Decode. Each token
+// has a position and belongs to one or more sequences.
+type Batch struct {
+	b *batch
+}
+
+// NewBatch allocates a batch for up to capacity tokens, each belonging to at
+// most sequences sequences. It must be freed with Free.
+func NewBatch(capacity, sequences int) *Batch {
+	return &Batch{b: newBatch(capacity, max(sequences, 1))}
+}
+
+// Add appends a token at pos to the given sequences. When logits is set its
+// output is kept and can be read with Context.Logits.
+func (b *Batch) Add(token Token, pos int, logits bool, seqs ...int) error {
+	if b.Len() == b.b.capacity {
+		return fmt.Errorf("batch is full (%d tokens)", b.b.capacity)
+	}
+	if len(seqs) == 0 || len(seqs) > b.b.nSeqMax {
+		return fmt.Errorf("a token must belong to between 1 and %d sequences", b.b.nSeqMax)
+	}
+
+	b.b.add(token, pos, seqs[0], logits)
+	if len(seqs) > 1 {
+		i := b.Len() - 1
+		unsafe.Slice(b.b.c.n_seq_id, b.b.capacity)[i] = C.int32_t(len(seqs))
+		ids := unsafe.Slice(unsafe.Slice(b.b.c.seq_id, b.b.capacity)[i], b.b.nSeqMax)
+		for j, seq := range seqs {
+			ids[j] = C.llama_seq_id(seq)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of tokens in the batch
+func (b *Batch) Len() int {
+	return int(b.b.c.n_tokens)
+}
+
+// Clear removes all tokens from the batch
+func (b *Batch) Clear() {
+	b.b.clear()
+}
+
+// Free frees the batch
+func (b *Batch) Free() {
+	if b.b != nil {
+		b.b.free()
+		b.b = nil
+	}
+}
+
+// Decode evaluates a batch built by the caller, for frameworks that manage
+// sequences and positions themselves. The status tells recoverable failures
+// apart: with DecodeNoKVSlot the batch can be retried in smaller pieces or
+// after freeing cache space. Decoding this way discards the record of
+// sequence 0 that lets Generate reuse a shared prompt prefix, so the next
+// Generate starts from an empty cache.
+func (c *Context) Decode(b *Batch) (DecodeStatus, error) {
+	if b == nil || b.b == nil || b.Len() == 0 {
+		return DecodeError, errors.New("batch is empty")
+	}
+	c.tokens = c.tokens[:0]
+	c.untracked = true
+
+	defer c.usePool()()
+	defer c.enter("llama_decode", b.Len())()
+	if tracing() {
+		defer trace("llama_decode", time.Now(), slog.Int("tokens", b.Len()))
+	}
+	start := time.Now()
+	status := decodeStatus(C.llama_decode(c.ptr, b.b.c))
+	// The caller's batches are accounted as prompts unless they hold one token
+	generated := 0
+	if b.Len() == 1 {
+		generated = 1
+	}
+	accountDecode(b.Len(), generated, time.Since(start))
+	if status != DecodeOK {
+		return status, c.callError("llama_decode", b.Len(), fmt.Errorf("llama_decode failed: %s", status))
+	}
+	return DecodeOK, nil
+}
+
+// CancelSequence ends whatever runs in one sequence without disturbing the
+// others: its KV cache entries are removed and, when a Scheduler runs on the
+// context, the generation in that slot ends with FinishCancel before the
+// next decode step. Unlike the other methods it may be called from any
+// goroutine while a scheduler runs.
+func (c *Context) CancelSequence(seq int) error {
+	if seq < 0 || seq >= int(C.llama_n_seq_max(c.ptr)) {
+		return fmt.Errorf("sequence %d out of range", seq)
+	}
+	if s := c.sched.Load(); s != nil {
+		return s.cancelSequence(seq)
+	}
+
+	C.llama_memory_seq_rm(C.llama_get_memory(c.ptr), C.llama_seq_id(seq), -1, -1)
+	if seq == 0 {
+		c.tokens = c.tokens[:0]
+	}
+	return nil
+}
+
+// decodeStatus maps llama_decode return codes to a DecodeStatus
+func decodeStatus(rc C.int32_t) DecodeStatus {
+	switch rc {
+	case 0:
+		return DecodeOK
+	case 1:
+		return DecodeNoKVSlot
+	case 2:
+		return DecodeAborted
+	default:
+		return DecodeError
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Description returns llama.cpp's description of the model: architecture,
+// size class and quantization, e.g. "llama 8B Q4_K - Medium"
+func (m *Model) Description() string {
+	var buf [128]C.char
+	if m.ptr == nil || C.llama_model_desc(m.ptr, &buf[0], C.size_t(len(buf))) < 0 {
+		return ""
+	}
+	return C.GoString(&buf[0])
+}
+
+// Size returns the size of the model's weights in bytes
+func (m *Model) Size() int64 {
+	return int64(C.llama_model_size(m.ptr))
+}
+
+// Params returns the number of parameters of the model
+func (m *Model) Params() int64 {
+	return int64(C.llama_model_n_params(m.ptr))
+}
+
+// FileType returns the quantization the model file declares, and false for
+// files without general.file_type
+func (m *Model) FileType() (FileType, bool) {
+	v, ok := m.meta("general.file_type")
+	if !ok {
+		return 0, false
+	}
+	ft, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	// llama-quantize sets 1024 when it guessed the type of older files
+	return FileType(ft &^ 1024), true
+}
+
+// Summary describes the model for display, e.g. "8.0B Q4_K_M, 4.6 GiB"
+func (m *Model) Summary() string {
+	if ft, ok := m.FileType(); ok {
+		return fmt.Sprintf("%s %s, %s", FormatParams(m.Params()), ft, FormatBytes(m.Size()))
+	}
+	return fmt.Sprintf("%s, %s", FormatParams(m.Params()), FormatBytes(m.Size()))
+}
@@ -0,0 +1,72 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+//
+// extern void alpacaAbortCallback(char * message);
+import "C"
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// inflight maps the contexts inside llama_decode or sampling to the call
+// they make, for the abort callback to report
+var inflight sync.Map
+
+// call is a call into llama.cpp in flight
+type call struct {
+	op     string
+	tokens int
+}
+
+// callError describes a call on the context that failed with err
+func (c *Context) callError(op string, tokens int, err error) *CallError {
+	return &CallError{
+		Op:          op,
+		Err:         err,
+		Model:       cmp.Or(c.model.Description(), "unknown"),
+		ContextSize: int(C.llama_n_ctx(c.ptr)),
+		BatchSize:   int(C.llama_n_batch(c.ptr)),
+		UBatchSize:  int(C.llama_n_ubatch(c.ptr)),
+		Tokens:      tokens,
+	}
+}
+
+// recoverCall turns a panic of a callback into a CallError stored in err
+// and clears the KV cache, which may no longer match what the context
+// recorded. It must be deferred directly.
+func (c *Context) recoverCall(op string, err *error) {
+	if r := recover(); r != nil {
+		*err = c.callError(op, 0, nil).recovered(r)
+		c.clearMemory()
+	}
+}
+
+// enter records that the context calls into llama.cpp until the returned
+// func is called. llama.cpp aborts the process on failed assertions, which
+// can't be recovered from, but the abort callback reports what was running.
+func (c *Context) enter(op string, tokens int) (exit func()) {
+	inflight.Store(c, call{op, tokens})
+	return func() { inflight.Delete(c) }
+}
+
+// setAbortCallback makes ggml report the calls in flight before it aborts
+func setAbortCallback() {
+	C.ggml_set_abort_callback(C.ggml_abort_callback_t(C.alpacaAbortCallback))
+}
+
+//export alpacaAbortCallback
+func alpacaAbortCallback(message *C.char) {
+	fmt.Fprintf(os.Stderr, "llama.cpp aborted: %s\n", C.GoString(message))
+	inflight.Range(func(k, v any) bool {
+		cl := v.(call)
+		fmt.Fprintf(os.Stderr, "  %v\n", k.(*Context).callError(cl.op, cl.tokens, errors.New("in flight")))
+		return true
+	})
+}
@@ -0,0 +1,8 @@
+// Package bindings provides Go bundings for llama.cpp
+//
+// Building with the nollama tag replaces everything that needs llama.cpp
+// with stubs returning ErrNotBuilt, so programs using the package can be
+// compiled and tested on machines without the library.
+package bindings
+
+//go:generate go run ../internal/buildllama -dir ../llama.cpp
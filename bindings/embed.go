@@ -0,0 +1,311 @@
+//go:build !nollama
+
+package bindings
+
+// #include <string.h>
+// #include "llama.h"
+//
+// // copy_embeddings copies the first n components of the embeddings of
+// // count sequences, or of outputs when pooled is false, into out row after
+// // row. It returns the index of the first one missing, or -1.
+// static int copy_embeddings(struct llama_context * ctx, bool pooled, const int32_t * ids, int count, int n, float * out) {
+// 	for (int i = 0; i < count; i++) {
+// 		const float * e = pooled ? llama_get_embeddings_seq(ctx, ids[i]) : llama_get_embeddings_ith(ctx, ids[i]);
+// 		if (e == NULL) {
+// 			return i;
+// 		}
+// 		memcpy(out + (size_t)i * n, e, (size_t)n * sizeof(float));
+// 	}
+// 	return -1;
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// Embed returns the embedding of text. The model's pooling type decides how
+// token embeddings are combined; models without one use the last token's.
+// The text must fit in a single micro-batch, and the KV cache is cleared.
+func (c *Context) Embed(text string, opts EmbedOptions) ([]float32, error) {
+	raw, err := c.embedding(text, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	scale := normScale(raw, opts.Normalize)
+	embd := make([]float32, len(raw))
+	for i, x := range raw {
+		embd[i] = x * scale
+	}
+	return embd, nil
+}
+
+// EmbedInt8 is like Embed but quantizes the embedding to int8 with a single
+// scale factor, a quarter of the size for storing or sending large corpora
+func (c *Context) EmbedInt8(text string, opts EmbedOptions) (*Int8Embedding, error) {
+	raw, err := c.embedding(text, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var maxAbs float32
+	for _, x := range raw {
+		maxAbs = max(maxAbs, float32(math.Abs(float64(x))))
+	}
+	e := &Int8Embedding{Values: make([]int8, len(raw))}
+	if maxAbs == 0 {
+		return e, nil
+	}
+
+	// Normalizing and quantizing are one multiplication per component
+	e.Scale = maxAbs * normScale(raw, opts.Normalize) / 127
+	q := 127 / maxAbs
+	for i, x := range raw {
+		e.Values[i] = int8(math.Round(float64(x * q)))
+	}
+	return e, nil
+}
+
+// embedding evaluates text and returns its unnormalized embedding, truncated
+// to opts.Dimensions. The slice points into llama.cpp memory and is only
+// valid until the next decode.
+func (c *Context) embedding(text string, opts EmbedOptions) ([]float32, error) {
+	n, err := c.embeddingSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.useThreads(opts.Threads, opts.Threads)()
+
+	tokens, err := c.model.Tokenize(text, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("text is empty")
+	}
+	if len(tokens) > c.batch.capacity || len(tokens) > int(C.llama_n_ubatch(c.ptr)) {
+		return nil, ErrPromptTooLong
+	}
+
+	if tracing() {
+		defer trace("embed", time.Now(), slog.Int("tokens", len(tokens)))
+	}
+	C.llama_set_embeddings(c.ptr, true)
+	defer C.llama_set_embeddings(c.ptr, false)
+	c.clearMemory()
+	defer c.clearMemory()
+
+	if err := c.decode(tokens, 0, 0, true); err != nil {
+		return nil, err
+	}
+
+	var ptr *C.float
+	if C.llama_pooling_type(c.ptr) == C.LLAMA_POOLING_TYPE_NONE {
+		ptr = C.llama_get_embeddings_ith(c.ptr, -1)
+	} else {
+		ptr = C.llama_get_embeddings_seq(c.ptr, 0)
+	}
+	if ptr == nil {
+		return nil, errors.New("failed to get embeddings")
+	}
+
+	return unsafe.Slice((*float32)(unsafe.Pointer(ptr)), n), nil
+}
+
+// EmbedMany returns the embeddings of texts like Embed. Texts are evaluated
+// together, each in a sequence of its own, as many per decode as fit in a
+// micro-batch and in ContextParams.Sequences, which is much faster than
+// embedding them one by one. The KV cache is cleared.
+func (c *Context) EmbedMany(texts []string, opts EmbedOptions) ([][]float32, error) {
+	n, err := c.embeddingSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.useThreads(opts.Threads, opts.Threads)()
+
+	limit := min(c.batch.capacity, int(C.llama_n_ubatch(c.ptr)))
+	tokenized := make([][]Token, len(texts))
+	for i, text := range texts {
+		tokens, err := c.model.Tokenize(text, true, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("text %d is empty", i)
+		}
+		if len(tokens) > limit {
+			return nil, fmt.Errorf("text %d: %w", i, ErrPromptTooLong)
+		}
+		tokenized[i] = tokens
+	}
+
+	if tracing() {
+		defer trace("embed", time.Now(), slog.Int("texts", len(texts)))
+	}
+	embeddings := make([][]float32, len(texts))
+	err = c.evalPooled(tokenized, n, func(i int, raw []float32) {
+		scale := normScale(raw, opts.Normalize)
+		embd := make([]float32, n)
+		for k, x := range raw {
+			embd[k] = x * scale
+		}
+		embeddings[i] = embd
+	})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings, nil
+}
+
+// evalPooled evaluates sequences of at most a micro-batch each, packing
+// several per decode, and calls use with the first n components of each
+// one's pooled output, which is only valid during the call. The KV cache is
+// cleared.
+func (c *Context) evalPooled(tokenized [][]Token, n int, use func(i int, raw []float32)) error {
+	C.llama_set_embeddings(c.ptr, true)
+	defer C.llama_set_embeddings(c.ptr, false)
+	defer c.clearMemory()
+
+	limit := min(c.batch.capacity, int(C.llama_n_ubatch(c.ptr)))
+	pooled := C.llama_pooling_type(c.ptr) != C.LLAMA_POOLING_TYPE_NONE
+	seqs := int(C.llama_n_seq_max(c.ptr))
+	ids := make([]C.int32_t, 0, seqs)
+	out := &EmbeddingMatrix{Dim: n}
+	for start := 0; start < len(tokenized); {
+		c.clearMemory()
+		c.batch.clear()
+		end := start
+		for end < len(tokenized) && end-start < seqs && int(c.batch.c.n_tokens)+len(tokenized[end]) <= limit {
+			for j, t := range tokenized[end] {
+				c.batch.add(t, j, end-start, pooled || j == len(tokenized[end])-1)
+			}
+			end++
+		}
+		if err := c.decodeBatch(); err != nil {
+			return err
+		}
+
+		// One call copies out the sequences' embeddings, or the last
+		// token's of each
+		ids = ids[:0]
+		last := -1
+		for i := start; i < end; i++ {
+			last += len(tokenized[i])
+			if pooled {
+				ids = append(ids, C.int32_t(i-start))
+			} else {
+				ids = append(ids, C.int32_t(last))
+			}
+		}
+		if err := c.copyEmbeddings(out, pooled, ids); err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			use(i, out.Row(i-start))
+		}
+		start = end
+	}
+	return nil
+}
+
+// SetEmbeddings switches Decode from computing logits to computing
+// embeddings, which SequenceEmbeddings reads, for callers building their
+// own batches
+func (c *Context) SetEmbeddings(on bool) {
+	C.llama_set_embeddings(c.ptr, C.bool(on))
+}
+
+// SequenceEmbeddings returns the pooled embeddings of sequences seqs after
+// a Decode with SetEmbeddings on, as the rows of a matrix. They are copied
+// out of llama.cpp in one call rather than one per sequence, which matters
+// when embedding large batches. Models that don't pool token embeddings
+// have none per sequence.
+func (c *Context) SequenceEmbeddings(seqs []int, opts EmbedOptions) (*EmbeddingMatrix, error) {
+	n, err := c.embeddingSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	if C.llama_pooling_type(c.ptr) == C.LLAMA_POOLING_TYPE_NONE {
+		return nil, errors.New("the model doesn't pool embeddings per sequence")
+	}
+	ids := make([]C.int32_t, len(seqs))
+	for i, seq := range seqs {
+		ids[i] = C.int32_t(seq)
+	}
+	m := &EmbeddingMatrix{Dim: n}
+	if err := c.copyEmbeddings(m, true, ids); err != nil {
+		return nil, err
+	}
+	for i := range m.Rows() {
+		row := m.Row(i)
+		scale := normScale(row, opts.Normalize)
+		for k := range row {
+			row[k] *= scale
+		}
+	}
+	return m, nil
+}
+
+// copyEmbeddings fills m with the embeddings of the sequences, or outputs,
+// ids, resizing it to hold them
+func (c *Context) copyEmbeddings(m *EmbeddingMatrix, pooled bool, ids []C.int32_t) error {
+	m.Data = slices.Grow(m.Data[:0], len(ids)*m.Dim)[:len(ids)*m.Dim]
+	if len(ids) == 0 {
+		return nil
+	}
+	if i := C.copy_embeddings(c.ptr, C.bool(pooled), &ids[0], C.int(len(ids)), C.int(m.Dim), (*C.float)(unsafe.Pointer(&m.Data[0]))); i >= 0 {
+		if pooled {
+			return fmt.Errorf("no embedding for sequence %d", ids[i])
+		}
+		return errors.New("failed to get embeddings")
+	}
+	return nil
+}
+
+// embeddingSize returns the number of components of the embeddings opts
+// asks for
+func (c *Context) embeddingSize(opts EmbedOptions) (int, error) {
+	n := int(C.llama_model_n_embd(c.model.ptr))
+	if opts.Dimensions < 0 || opts.Dimensions > n {
+		return 0, fmt.Errorf("dimensions must be between 1 and %d", n)
+	}
+	if opts.Dimensions > 0 {
+		n = opts.Dimensions
+	}
+	return n, nil
+}
+
+// normScale returns the factor that normalizes embd
+func normScale(embd []float32, norm Normalization) float32 {
+	var sum float64
+	switch norm {
+	case NormalizeNone:
+		return 1
+	case NormalizeMaxAbs:
+		for _, x := range embd {
+			sum = max(sum, math.Abs(float64(x)))
+		}
+		sum /= 32760
+	case NormalizeTaxicab:
+		for _, x := range embd {
+			sum += math.Abs(float64(x))
+		}
+	default:
+		for _, x := range embd {
+			sum += float64(x) * float64(x)
+		}
+		sum = math.Sqrt(sum)
+	}
+
+	if sum == 0 {
+		return 1
+	}
+	return float32(1 / sum)
+}
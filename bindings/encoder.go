@@ -0,0 +1,119 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HasEncoder reports whether the model is an encoder-decoder such as T5:
+// the input goes through its encoder with Encode once, and the decoder
+// generates or scores outputs attending to the encoder's output
+func (m *Model) HasEncoder() bool {
+	return bool(C.llama_model_has_encoder(m.ptr))
+}
+
+// HasDecoder reports whether the model can generate. Encoder-only models
+// such as BERT only embed, rerank or classify their input.
+func (m *Model) HasDecoder() bool {
+	return bool(C.llama_model_has_decoder(m.ptr))
+}
+
+// checkGenerate fails unless the decoder can generate from a prompt on its
+// own, before anything is decoded
+func (m *Model) checkGenerate() error {
+	switch {
+	case !m.HasDecoder():
+		return ErrNoDecoder
+	case m.HasEncoder():
+		return ErrNeedsEncode
+	}
+	return nil
+}
+
+// DecoderStart returns the token the decoder of an encoder-decoder model
+// starts its output from
+func (m *Model) DecoderStart() Token {
+	if t := Token(C.llama_model_decoder_start_token(m.ptr)); t != -1 {
+		return t
+	}
+	return m.BOS()
+}
+
+// Encode runs input through the encoder of an encoder-decoder model. The
+// encoder's output stays in the context, so any number of outputs can then
+// be generated with GenerateEncoded or scored with ScoreEncoded without
+// encoding the input again, until the next call to Encode. The input must
+// fit in one batch.
+func (c *Context) Encode(input string) (err error) {
+	if !c.model.HasEncoder() {
+		return ErrNoEncoder
+	}
+	tokens, err := c.model.Tokenize(input, true, true)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errors.New("input is empty")
+	}
+	if limit := min(c.batch.capacity, int(C.llama_n_ubatch(c.ptr))); len(tokens) > limit {
+		return fmt.Errorf("%w: %d tokens, the encoder takes at most %d", ErrPromptTooLong, len(tokens), limit)
+	}
+	defer c.recoverCall("encode", &err)
+
+	// The decoder's cache attended to the previous input
+	c.clearMemory()
+	c.batch.clear()
+	for i, token := range tokens {
+		c.batch.add(token, i, 0, false)
+	}
+	defer c.usePool()()
+	defer c.enter("llama_encode", len(tokens))()
+	if tracing() {
+		defer trace("llama_encode", time.Now())
+	}
+	if rc := C.llama_encode(c.ptr, c.batch.c); rc != 0 {
+		return c.callError("llama_encode", len(tokens), fmt.Errorf("llama_encode failed: %d", int(rc)))
+	}
+	return nil
+}
+
+// GenerateEncoded generates the decoder's output for the input of the last
+// call to Encode
+func (c *Context) GenerateEncoded(ctx context.Context, opts GenerateOptions) (*GenerateResult, error) {
+	if !c.model.HasEncoder() {
+		return nil, ErrNoEncoder
+	}
+	return c.generate(ctx, time.Now(), []Token{c.model.DecoderStart()}, opts)
+}
+
+// ScoreEncoded returns the log-probability of the decoder producing each
+// target for the input of the last call to Encode, e.g. to pick among
+// candidate answers or rerank with T5-style models. Targets sharing a
+// prefix reuse its part of the decoder's cache.
+func (c *Context) ScoreEncoded(targets []string) ([]float64, error) {
+	if !c.model.HasEncoder() {
+		return nil, ErrNoEncoder
+	}
+	start := []Token{c.model.DecoderStart()}
+	scores := make([]float64, len(targets))
+	for i, target := range targets {
+		tokens, err := c.model.Tokenize(target, false, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			return nil, errors.New("target is empty")
+		}
+		if scores[i], err = c.scoreTokens(start, tokens); err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
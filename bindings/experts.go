@@ -0,0 +1,80 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include <string.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"strconv"
+	"unsafe"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// Experts returns the number of experts of a mixture-of-experts model, 0 for
+// dense models
+func (m *Model) Experts() int {
+	return m.metaInt("expert_count")
+}
+
+// ExpertsUsed returns the number of experts run per token, 0 for dense
+// models
+func (m *Model) ExpertsUsed() int {
+	return m.metaInt("expert_used_count")
+}
+
+// metaInt returns an integer hyperparameter of the model's architecture
+func (m *Model) metaInt(name string) int {
+	arch, ok := m.meta("general.architecture")
+	if !ok {
+		return 0
+	}
+	v, ok := m.meta(arch + "." + name)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+// expertsOverride builds the NULL-terminated metadata override array of
+// llama_model_params setting the experts used per token of the model at
+// path. The returned func frees it.
+func expertsOverride(path string, n int) (*C.struct_llama_model_kv_override, func(), error) {
+	f, err := gguf.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	arch, ok := f.String("general.architecture")
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: no general.architecture", path)
+	}
+	var experts int
+	v, _ := f.Get(arch + ".expert_count")
+	switch v := v.(type) {
+	case uint32:
+		experts = int(v)
+	case int32:
+		experts = int(v)
+	}
+	if experts == 0 {
+		return nil, nil, fmt.Errorf("%s is not a mixture-of-experts model", path)
+	}
+	if n < 1 || n > experts {
+		return nil, nil, fmt.Errorf("experts used must be between 1 and %d, got %d", experts, n)
+	}
+
+	arr := (*C.struct_llama_model_kv_override)(C.calloc(2, C.size_t(unsafe.Sizeof(C.struct_llama_model_kv_override{}))))
+	kv := &unsafe.Slice(arr, 2)[0]
+	kv.tag = C.LLAMA_KV_OVERRIDE_TYPE_INT
+	key := C.CString(arch + ".expert_used_count")
+	defer C.free(unsafe.Pointer(key))
+	C.strncpy(&kv.key[0], key, C.size_t(len(kv.key)-1))
+	// val_i64 is the first member of the anonymous union
+	*(*int64)(unsafe.Pointer(&kv.anon0[0])) = int64(n)
+	return arr, func() { C.free(unsafe.Pointer(arr)) }, nil
+}
@@ -0,0 +1,20 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+// FIMPrompt returns the fill-in-the-middle prompt of a code model for
+// completing the text between prefix and suffix, built from the model's FIM
+// tokens as <PRE> prefix <SUF> suffix <MID>. It reports false for models
+// without them. The prompt must be tokenized with special tokens parsed.
+func (m *Model) FIMPrompt(prefix, suffix string) (string, bool) {
+	pre := Token(C.llama_vocab_fim_pre(m.vocab))
+	suf := Token(C.llama_vocab_fim_suf(m.vocab))
+	mid := Token(C.llama_vocab_fim_mid(m.vocab))
+	if pre < 0 || suf < 0 || mid < 0 {
+		return "", false
+	}
+	return m.tokenText(pre) + prefix + m.tokenText(suf) + suffix + m.tokenText(mid), true
+}
@@ -0,0 +1,340 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+	"unicode/utf8"
+)
+
+// Generate evaluates the prompt and generates a completion for it. Tokens
+// the prompt shares with the previous call are not evaluated again.
+// Cancelling ctx stops generation and returns the partial result with
+// FinishCancel.
+func (c *Context) Generate(ctx context.Context, prompt string, opts GenerateOptions) (*GenerateResult, error) {
+	start := time.Now()
+	if err := c.model.checkGenerate(); err != nil {
+		return nil, err
+	}
+	tokens, err := c.model.TokenizeWithOptions(prompt, opts.tokenizeOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.generate(ctx, start, tokens, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Echo {
+		result.Prompt = prompt
+	}
+
+	return result, nil
+}
+
+// generate evaluates the prompt tokens and samples a completion. MaxDuration
+// counts from start.
+func (c *Context) generate(ctx context.Context, start time.Time, tokens []Token, opts GenerateOptions) (_ *GenerateResult, err error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("prompt is empty")
+	}
+	defer c.recoverCall("generate", &err)
+	defer c.useThreads(opts.Threads, opts.ThreadsBatch)()
+
+	if opts.Speculative != nil {
+		if err := c.checkSpeculative(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Infinite {
+		if err := c.checkInfinite(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	nCtx := c.Size()
+	truncated, err := truncateTokens(tokens, nCtx, opts.KeepTokens, opts.MaxTokens, opts.Truncate)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GenerateResult{PromptTokens: len(truncated), TruncatedTokens: len(tokens) - len(truncated)}
+	tokens = truncated
+
+	stop, done := c.interruptible(ctx, start, opts)
+	result.CachedTokens, err = c.evaluateProgress(tokens, opts.OnPrefill, stop)
+	done()
+	if errors.Is(err, errInterrupted) {
+		result.FinishReason = FinishTimeout
+		if ctx.Err() != nil {
+			result.FinishReason = FinishCancel
+		}
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tracing() {
+		// Durations count from the start of the call, so the prefill's is
+		// the time to the first token
+		trace("prefill", start, slog.Int("prompt_tokens", len(tokens)), slog.Int("cached_tokens", result.CachedTokens), slog.Int("truncated_tokens", result.TruncatedTokens))
+		defer func() {
+			if err == nil {
+				trace("generate", start, slog.Int("completion_tokens", result.CompletionTokens), slog.String("finish_reason", string(result.FinishReason)))
+			}
+		}()
+	}
+
+	var guidance *Context
+	if opts.NegativePrompt != "" && opts.GuidanceScale > 1 {
+		if guidance, err = c.startGuidance(opts.NegativePrompt, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var filter *phraseFilter
+	if len(opts.Banned) > 0 {
+		if filter, err = newPhraseFilter(c.model, opts.Banned); err != nil {
+			return nil, err
+		}
+	}
+
+	smpl, err := c.newSampler(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer smpl.free()
+
+	out := newTextStream(opts.Stop, opts.OnToken)
+	if opts.Speculative != nil {
+		if err := c.speculate(ctx, start, smpl, out, opts, result); err != nil {
+			return nil, err
+		}
+		result.Text = out.flush()
+		result.Sampling, result.Seed = smpl.samplerStats(), smpl.seed
+		return result, nil
+	}
+
+	for {
+		if ctx.Err() != nil {
+			result.FinishReason = FinishCancel
+			break
+		}
+		if opts.expired(start) {
+			result.FinishReason = FinishTimeout
+			break
+		}
+		if opts.Infinite && len(c.tokens) >= nCtx {
+			// Half of what follows the kept tokens makes room for the rest
+			keep, discard := contextShift(len(c.tokens), opts.KeepTokens)
+			c.shift(keep, discard)
+			result.ShiftedTokens += discard
+		}
+		if (opts.MaxTokens > 0 && result.CompletionTokens >= opts.MaxTokens) || len(c.tokens) >= nCtx ||
+			(guidance != nil && len(guidance.tokens) >= guidance.Size()) {
+			result.FinishReason = FinishLength
+			break
+		}
+
+		var token Token
+		if guidance != nil || filter != nil {
+			token = c.sampleFiltered(smpl, guidance, opts.GuidanceScale, filter, c.tokens[len(tokens):])
+		} else {
+			token = smpl.sample(c, -1)
+		}
+		if c.model.IsEOG(token) {
+			result.FinishReason = FinishStop
+			break
+		}
+		result.CompletionTokens++
+		if opts.OnTokenInfo != nil {
+			opts.OnTokenInfo(c.tokenInfo(-1, token, opts.TopLogprobs, start))
+		}
+
+		if out.write(c.model.TokenToPiece(token)) {
+			result.FinishReason = FinishStop
+			break
+		}
+
+		if err := c.decode([]Token{token}, len(c.tokens), 0, true); err != nil {
+			c.clearMemory()
+			return nil, err
+		}
+		c.tokens = append(c.tokens, token)
+
+		if guidance != nil {
+			if err := guidance.decode([]Token{token}, len(guidance.tokens), 0, true); err != nil {
+				guidance.clearMemory()
+				return nil, err
+			}
+			guidance.tokens = append(guidance.tokens, token)
+		}
+	}
+
+	result.Text = out.flush()
+	result.Sampling, result.Seed = smpl.samplerStats(), smpl.seed
+
+	return result, nil
+}
+
+// checkInfinite reports options infinite generation can't be used with
+func (c *Context) checkInfinite(opts GenerateOptions) error {
+	switch {
+	case !c.canShift():
+		return errors.New("the model's cache doesn't support context shifting")
+	case opts.Speculative != nil || len(opts.Banned) > 0 || (opts.NegativePrompt != "" && opts.GuidanceScale > 1):
+		return errors.New("infinite generation can't be combined with guidance, banned phrases or speculative decoding")
+	}
+	return nil
+}
+
+// samplingParams returns the sampling parameters of opts, with DefaultSeed
+// replaced by a random seed, or by 0 for deterministic contexts
+func (c *Context) samplingParams(opts GenerateOptions) SamplingParams {
+	params := opts.SamplingParams
+	if params.Seed == DefaultSeed {
+		params.Seed = randomSeed()
+		if c.deterministic {
+			params.Seed = 0
+		}
+	}
+	return params
+}
+
+// randomSeed returns a random seed other than DefaultSeed
+func randomSeed() uint32 {
+	for {
+		if seed := rand.Uint32(); seed != DefaultSeed {
+			return seed
+		}
+	}
+}
+
+// newSampler returns the sampler of a generation with opts
+func (c *Context) newSampler(opts GenerateOptions) (*sampler, error) {
+	smpl, err := newSampler(c.model, c.samplingParams(opts))
+	if err != nil {
+		return nil, err
+	}
+	if opts.SamplerStats {
+		smpl.tally = &samplerTally{}
+	}
+	return smpl, nil
+}
+
+// tokenInfo describes token, sampled from the logits of the i-th token of
+// the last batch
+func (c *Context) tokenInfo(i int, token Token, top int, start time.Time) TokenInfo {
+	logprobs := logSoftmax(c.logits(i))
+	info := TokenInfo{
+		Token:   token,
+		Piece:   c.model.TokenToPiece(token),
+		Logprob: logprobs[token],
+		Elapsed: time.Since(start),
+	}
+	if top > 0 {
+		for _, t := range topTokens(logprobs, top) {
+			info.TopLogprobs = append(info.TopLogprobs, TokenLogprob{Token: t, Piece: c.model.TokenToPiece(t), Logprob: logprobs[t]})
+		}
+	}
+	return info
+}
+
+// expired reports whether MaxDuration has passed since start
+func (opts GenerateOptions) expired(start time.Time) bool {
+	return opts.MaxDuration > 0 && time.Since(start) >= opts.MaxDuration
+}
+
+// textStream accumulates generated text, cuts it at the first stop sequence
+// and forwards the parts that can no longer be part of a stop sequence (or
+// an incomplete UTF-8 character) to the callback
+type textStream struct {
+	buf      []byte
+	sent     int
+	stop     [][]byte
+	callback func(string)
+}
+
+func newTextStream(stop []string, callback func(string)) *textStream {
+	s := &textStream{callback: callback}
+	for _, seq := range stop {
+		if seq != "" {
+			s.stop = append(s.stop, []byte(seq))
+		}
+	}
+	return s
+}
+
+// write appends a piece and reports whether a stop sequence was found
+func (s *textStream) write(piece string) bool {
+	prev := len(s.buf)
+	s.buf = append(s.buf, piece...)
+
+	cut := -1
+	for _, seq := range s.stop {
+		from := max(0, prev-len(seq)+1)
+		if i := bytes.Index(s.buf[from:], seq); i >= 0 && (cut < 0 || from+i < cut) {
+			cut = from + i
+		}
+	}
+	if cut >= 0 {
+		s.buf = s.buf[:cut]
+		s.emit(cut)
+		return true
+	}
+
+	safe := len(s.buf)
+	for _, seq := range s.stop {
+		safe = min(safe, len(s.buf)-partialSuffix(s.buf, seq))
+	}
+	s.emit(completeUTF8(s.buf[:safe]))
+
+	return false
+}
+
+// flush sends everything not yet sent and returns the full text
+func (s *textStream) flush() string {
+	s.emit(len(s.buf))
+	return string(s.buf)
+}
+
+func (s *textStream) emit(end int) {
+	if end <= s.sent {
+		return
+	}
+	if s.callback != nil {
+		s.callback(string(s.buf[s.sent:end]))
+	}
+	s.sent = end
+}
+
+// partialSuffix returns the length of the longest suffix of b that is a
+// proper prefix of seq
+func partialSuffix(b, seq []byte) int {
+	for n := min(len(b), len(seq)-1); n > 0; n-- {
+		if bytes.HasSuffix(b, seq[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// completeUTF8 returns the length of b without a trailing incomplete
+// multi-byte character
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
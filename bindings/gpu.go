@@ -0,0 +1,144 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// MaxDevices returns the most devices llama.cpp can split a model across
+func MaxDevices() int {
+	return int(C.llama_max_devices())
+}
+
+// GPUs returns the names of the GPUs a model is offloaded to, in the order
+// ModelParams.MainGPU and TensorSplit index them. Like llama.cpp, integrated
+// GPUs are only used when there is no discrete one.
+func GPUs() []string {
+	var names []string
+	for _, dev := range gpuDevices() {
+		names = append(names, C.GoString(C.ggml_backend_dev_name(dev)))
+	}
+	return names
+}
+
+// GPUMemory returns the free and total memory of the GPUs in bytes
+func GPUMemory() (free, total int64) {
+	for _, dev := range gpuDevices() {
+		var f, t C.size_t
+		C.ggml_backend_dev_memory(dev, &f, &t)
+		free += int64(f)
+		total += int64(t)
+	}
+	return free, total
+}
+
+// gpuDevices returns the devices GPUs names
+func gpuDevices() []C.ggml_backend_dev_t {
+	Init()
+	var gpus, igpus []C.ggml_backend_dev_t
+	for i := range int(C.ggml_backend_dev_count()) {
+		dev := C.ggml_backend_dev_get(C.size_t(i))
+		switch C.ggml_backend_dev_type(dev) {
+		case C.GGML_BACKEND_DEVICE_TYPE_GPU:
+			gpus = append(gpus, dev)
+		case C.GGML_BACKEND_DEVICE_TYPE_IGPU:
+			igpus = append(igpus, dev)
+		}
+	}
+	if len(gpus) == 0 {
+		return igpus
+	}
+	return gpus
+}
+
+// checkGPUs reports a MainGPU or TensorSplit that doesn't fit the devices.
+// llama.cpp reads TensorSplit past its end and falls back to the CPU or
+// aborts on a main GPU it doesn't have.
+func checkGPUs(params ModelParams) error {
+	gpus := GPUs()
+	have := "no GPUs"
+	if len(gpus) > 0 {
+		have = fmt.Sprintf("%d GPUs: %s", len(gpus), strings.Join(gpus, ", "))
+	}
+	if n := len(params.TensorSplit); n > MaxDevices() {
+		return fmt.Errorf("tensor split has %d entries, llama.cpp supports at most %d devices", n, MaxDevices())
+	} else if n > len(gpus) {
+		return fmt.Errorf("tensor split has %d entries, there are %s", n, have)
+	}
+	for i, p := range params.TensorSplit {
+		if p < 0 {
+			return fmt.Errorf("tensor split entry %d is negative", i)
+		}
+	}
+	if params.MainGPU < 0 || (params.MainGPU > 0 && params.MainGPU >= len(gpus)) {
+		return fmt.Errorf("main GPU %d out of range, there are %s", params.MainGPU, have)
+	}
+	return nil
+}
+
+// applyGPUs sets the GPU parameters of a model. The returned func frees the
+// tensor split, which may happen once the model is loaded.
+func applyGPUs(cParams *C.struct_llama_model_params, params ModelParams) (func(), error) {
+	if err := checkGPUs(params); err != nil {
+		return nil, err
+	}
+	switch params.SplitMode {
+	case SplitLayer:
+		cParams.split_mode = C.LLAMA_SPLIT_MODE_LAYER
+	case SplitRow:
+		cParams.split_mode = C.LLAMA_SPLIT_MODE_ROW
+	case SplitNone:
+		cParams.split_mode = C.LLAMA_SPLIT_MODE_NONE
+	default:
+		return nil, fmt.Errorf("unknown split mode %d", params.SplitMode)
+	}
+	cParams.main_gpu = C.int32_t(params.MainGPU)
+	if len(params.TensorSplit) == 0 {
+		return func() {}, nil
+	}
+
+	// llama.cpp reads one entry per device it supports
+	n := MaxDevices()
+	split := (*C.float)(C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(C.float(0)))))
+	for i, p := range params.TensorSplit {
+		unsafe.Slice(split, n)[i] = C.float(p)
+	}
+	cParams.tensor_split = split
+	return func() { C.free(unsafe.Pointer(split)) }, nil
+}
+
+// gpuLayers returns the n_gpu_layers of ModelParams.GPULayers. Offloading
+// everything asks for one layer more than the model has, for the output
+// layer; llama.cpp caps it, but fallbacks halve it from there.
+func gpuLayers(path string, layers int) int {
+	switch {
+	case layers == GPULayersAuto:
+		plan, err := PlanOffload(path, OffloadOptions{ContextSize: autoOffloadContext})
+		if err != nil || plan.Layers < 0 {
+			return 0
+		}
+		return plan.Layers
+	case layers < 0:
+		return 0
+	case layers > 0:
+		return layers
+	}
+	// Without the layer count, as many as llama.cpp's tools ask for
+	all := 999
+	if f, err := gguf.Open(path); err == nil {
+		arch, _ := f.String("general.architecture")
+		if n := metaUint(f, arch+".block_count"); n > 0 {
+			all = n + 1
+		}
+	}
+	return all
+}
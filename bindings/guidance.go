@@ -0,0 +1,70 @@
+//go:build !nollama
+
+package bindings
+
+import "math"
+
+// guidanceContext returns the context used to evaluate negative prompts,
+// creating it with the same parameters as c on first use
+func (c *Context) guidanceContext() (*Context, error) {
+	if c.guidance == nil {
+		g, err := newContext(c.model, c.params)
+		if err != nil {
+			return nil, err
+		}
+		g.deterministic, g.eviction, g.swa = c.deterministic, c.eviction, c.swa
+		c.guidance = g
+	}
+	return c.guidance, nil
+}
+
+// startGuidance evaluates the negative prompt for classifier-free guidance
+func (c *Context) startGuidance(negativePrompt string, opts GenerateOptions) (*Context, error) {
+	tokens, err := c.model.Tokenize(negativePrompt, true, true)
+	if err != nil {
+		return nil, err
+	}
+	g, err := c.guidanceContext()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err = truncateTokens(tokens, g.Size(), opts.KeepTokens, opts.MaxTokens, opts.Truncate)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.evaluate(tokens); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// guidedLogits combines the logits of the last token decoded in c with those
+// of the guidance context, pushing the distribution away from the negative
+// prompt by scale
+func (c *Context) guidedLogits(g *Context, scale float32) []float32 {
+	logits := logSoftmax(c.logits(-1))
+	negative := logSoftmax(g.logits(-1))
+	for i := range logits {
+		logits[i] = negative[i] + scale*(logits[i]-negative[i])
+	}
+	return logits
+}
+
+// logSoftmax returns a normalized copy of logits
+func logSoftmax(logits []float32) []float32 {
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+	logSum := float32(math.Log(sum))
+
+	out := make([]float32, len(logits))
+	for i, l := range logits {
+		out[i] = l - maxLogit - logSum
+	}
+	return out
+}
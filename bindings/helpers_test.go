@@ -0,0 +1,89 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"os"
+	"testing"
+)
+
+// The integration tests run against GGUF files named by environment
+// variables and are skipped without them. make test downloads a model of
+// about 1 MB, a 260K-parameter llama trained on TinyStories, for
+// ALPACA_TEST_MODEL; its output is nonsense, so tests only check what holds
+// for any model.
+const (
+	testModelEnv     = "ALPACA_TEST_MODEL"
+	defaultTestModel = "../models/stories260K.gguf" // where make test downloads it
+)
+
+// fixturePath returns the file the environment variable env names, def if
+// it is unset, and skips the test if there is none
+func fixturePath(t testing.TB, env, def string) string {
+	t.Helper()
+	path := os.Getenv(env)
+	if path == "" {
+		path = def
+	}
+	if path == "" {
+		t.Skipf("set %s to run this test", env)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Skipf("set %s to run this test: %v", env, err)
+	}
+	return path
+}
+
+// loadTestModel loads the model at path, freed when the test ends
+func loadTestModel(t testing.TB, path string, params ModelParams) *Model {
+	t.Helper()
+	m, err := LoadModelWithParams(path, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Free)
+	return m
+}
+
+// testModel loads the model of the integration tests
+func testModel(t testing.TB) *Model {
+	t.Helper()
+	return loadTestModel(t, fixturePath(t, testModelEnv, defaultTestModel), ModelParams{})
+}
+
+// recurrentModelEnv names a model with a recurrent state, such as a small
+// Mamba or RWKV, for the tests of what such models can't do like others.
+// make test downloads Mamba 130M for it.
+const (
+	recurrentModelEnv     = "ALPACA_TEST_RECURRENT_MODEL"
+	defaultRecurrentModel = "../models/mamba-130m-hf-Q4_K_M.gguf" // where make test downloads it
+)
+
+// recurrentModel loads the recurrent model of the integration tests
+func recurrentModel(t testing.TB) *Model {
+	t.Helper()
+	m := loadTestModel(t, fixturePath(t, recurrentModelEnv, defaultRecurrentModel), ModelParams{})
+	if !m.IsRecurrent() {
+		t.Fatalf("%s names a model that isn't recurrent", recurrentModelEnv)
+	}
+	return m
+}
+
+// testContext creates a context of m, freed when the test ends
+func testContext(t testing.TB, m *Model, params ContextParams) *Context {
+	t.Helper()
+	c, err := NewContext(m, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Free)
+	return c
+}
+
+// greedy returns options generating up to maxTokens tokens without sampling
+func greedy(maxTokens int) GenerateOptions {
+	opts := DefaultGenerateOptions()
+	opts.Temperature = 0
+	opts.MaxTokens = maxTokens
+	return opts
+}
@@ -0,0 +1,199 @@
+package bindings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// HistoryStrategy decides how FitMessages shortens a conversation that
+// doesn't fit in its token budget
+type HistoryStrategy int
+
+const (
+	// HistoryError fails with ErrPromptTooLong
+	HistoryError HistoryStrategy = iota
+	// HistoryDropOldest drops the oldest turns
+	HistoryDropOldest
+	// HistoryDropMiddle drops turns from the middle, keeping the first turn,
+	// which often states the task, and the latest ones
+	HistoryDropMiddle
+	// HistorySummarize condenses the turns before the latest exchange with
+	// FitOptions.Summarizer, then drops the oldest turns if needed
+	HistorySummarize
+)
+
+// String returns the name of the strategy
+func (s HistoryStrategy) String() string {
+	switch s {
+	case HistoryError:
+		return "error"
+	case HistoryDropOldest:
+		return "drop-oldest"
+	case HistoryDropMiddle:
+		return "drop-middle"
+	case HistorySummarize:
+		return "summarize"
+	default:
+		return fmt.Sprintf("HistoryStrategy(%d)", int(s))
+	}
+}
+
+// ParseHistoryStrategy returns the strategy with the given name
+func ParseHistoryStrategy(name string) (HistoryStrategy, error) {
+	for s := HistoryError; s <= HistorySummarize; s++ {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown history strategy %q", name)
+}
+
+// MessageCounter counts the tokens of messages as a prompt, it is
+// implemented by *Model
+type MessageCounter interface {
+	CountTokens(messages []ChatMessage) (int, error)
+}
+
+// FitOptions configures FitMessages
+type FitOptions struct {
+	Strategy  HistoryStrategy
+	MaxTokens int            // tokens the prompt may take
+	Counter   MessageCounter // counts them, e.g. the model's chat template
+
+	// Summarizer condenses turns for HistorySummarize. The summary goes into
+	// a system message after the leading ones, which is dropped first if the
+	// conversation still doesn't fit.
+	Summarizer Summarizer
+}
+
+// FitMessages shortens a conversation until its prompt takes at most
+// MaxTokens, by whole turns: a user message and the replies to it. The
+// leading system messages and the last message are always kept, so when
+// they alone are too long, for example because the last message is, the
+// error wraps ErrPromptTooLong whatever the strategy. messages is not
+// modified.
+func FitMessages(ctx context.Context, messages []ChatMessage, opts FitOptions) ([]ChatMessage, error) {
+	if opts.Counter == nil {
+		return nil, errors.New("a counter is required to fit messages")
+	}
+	if opts.Strategy == HistorySummarize && opts.Summarizer == nil {
+		return nil, errors.New("HistorySummarize needs a Summarizer")
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	msgs := append([]ChatMessage(nil), messages...)
+	head := 0
+	for head < len(msgs)-1 && msgs[head].Role == RoleSystem {
+		head++
+	}
+	summarized := false
+	for {
+		n, err := opts.Counter.CountTokens(msgs)
+		if err != nil {
+			return nil, err
+		}
+		if n <= opts.MaxTokens {
+			return msgs, nil
+		}
+
+		dropped := false
+		switch opts.Strategy {
+		case HistoryError:
+			return nil, fmt.Errorf("%w: conversation needs %d tokens, limit %d", ErrPromptTooLong, n, opts.MaxTokens)
+		case HistoryDropMiddle:
+			// The first turn goes last
+			if second := nextTurn(msgs, head); second < len(msgs)-1 {
+				dropped = dropOldestTurn(&msgs, second)
+			}
+		case HistorySummarize:
+			if !summarized {
+				summarized = true
+				ok, err := summarizeTurns(ctx, &msgs, head, opts.Summarizer)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					// The summary is the oldest turn to drop in turn
+					continue
+				}
+			}
+		}
+		if !dropped && !dropOldestTurn(&msgs, head) {
+			return nil, fmt.Errorf("%w: the last message and the system messages before it need %d tokens, limit %d", ErrPromptTooLong, n, opts.MaxTokens)
+		}
+	}
+}
+
+// summarizeTurns replaces the turns after the first head messages and
+// before the latest exchange with a system message holding their summary.
+// It reports whether there were any.
+func summarizeTurns(ctx context.Context, messages *[]ChatMessage, head int, summarizer Summarizer) (bool, error) {
+	msgs := *messages
+	cut := -1
+	for i := len(msgs) - 2; i >= head; i-- {
+		if msgs[i].Role == RoleUser {
+			cut = i
+			break
+		}
+	}
+	if cut <= head {
+		return false, nil
+	}
+
+	summary, err := summarizer.Summarize(ctx, "", msgs[head:cut])
+	if err != nil {
+		return false, fmt.Errorf("summarizing the conversation: %w", err)
+	}
+	out := append(msgs[:head:head], ChatMessage{Role: RoleSystem, Content: "Summary of the conversation so far:\n" + summary})
+	*messages = append(out, msgs[cut:]...)
+	return true, nil
+}
+
+// nextTurn returns the index of the user message starting the turn after
+// the one at start, len(messages) if there is none
+func nextTurn(messages []ChatMessage, start int) int {
+	end := start + 1
+	for end < len(messages) && messages[end].Role != RoleUser {
+		end++
+	}
+	return end
+}
+
+// dropOldestTurn removes the oldest user message after the first start
+// messages and the replies to it, keeping the final message. It reports
+// whether anything was removed.
+func dropOldestTurn(messages *[]ChatMessage, start int) bool {
+	msgs := *messages
+
+	end := start + 1
+	for end < len(msgs)-1 && msgs[end].Role != RoleUser {
+		end++
+	}
+	if end >= len(msgs) {
+		return false
+	}
+
+	*messages = append(msgs[:start:start], msgs[end:]...)
+	return true
+}
+
+// sessionHead returns the messages a session's history starts with: the
+// system message, which carries the system prompt and the summary of
+// earlier turns, and the pinned messages
+func sessionHead(system string, pinned []ChatMessage, summary string) []ChatMessage {
+	var out []ChatMessage
+	content := system
+	if summary != "" {
+		if content != "" {
+			content += "\n\n"
+		}
+		content += "Summary of the conversation so far:\n" + summary
+	}
+	if content != "" {
+		out = append(out, ChatMessage{Role: RoleSystem, Content: content})
+	}
+	return append(out, pinned...)
+}
@@ -0,0 +1,206 @@
+package bindings
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// sameMessages compares messages, which hold slices and so can't be
+// compared with ==
+func sameMessages(a, b []ChatMessage) bool {
+	return slices.EqualFunc(a, b, func(x, y ChatMessage) bool { return reflect.DeepEqual(x, y) })
+}
+
+// wordCounter counts a word as a token, so that budgets are easy to follow
+type wordCounter struct{}
+
+func (wordCounter) CountTokens(messages []ChatMessage) (int, error) {
+	n := 0
+	for _, m := range messages {
+		n += len(strings.Fields(m.Content))
+	}
+	return n, nil
+}
+
+// msg returns a message of ten words starting with label
+func msg(role, label string) ChatMessage {
+	return ChatMessage{Role: role, Content: label + strings.Repeat(" word", 9)}
+}
+
+// labels returns the first word of every message
+func labels(messages []ChatMessage) []string {
+	out := make([]string, len(messages))
+	for i, m := range messages {
+		out[i] = strings.Fields(m.Content)[0]
+	}
+	return out
+}
+
+var errSummarizer = errors.New("summarizer failed")
+
+type fitTest struct {
+	name       string
+	messages   []ChatMessage
+	strategy   HistoryStrategy
+	max        int
+	summarizer Summarizer
+	want       []string // labels of the messages kept
+	err        error
+}
+
+func TestFitMessages(t *testing.T) {
+	sys := msg(RoleSystem, "system")
+	tools := msg(RoleSystem, "tools")
+	u1, a1 := msg(RoleUser, "u1"), msg(RoleAssistant, "a1")
+	u2, a2 := msg(RoleUser, "u2"), msg(RoleAssistant, "a2")
+	u3, a3 := msg(RoleUser, "u3"), msg(RoleAssistant, "a3")
+	u4 := msg(RoleUser, "u4")
+	huge := ChatMessage{Role: RoleUser, Content: "huge" + strings.Repeat(" word", 99)}
+
+	conversation := []ChatMessage{sys, u1, a1, u2, a2, u3}
+	long := []ChatMessage{sys, u1, a1, u2, a2, u3, a3, u4}
+
+	// The summary message is seven words
+	summarize := SummarizerFunc(func(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+		return "short", nil
+	})
+	failing := SummarizerFunc(func(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+		return "", errSummarizer
+	})
+
+	tests := []fitTest{
+		{name: "fits", messages: conversation, strategy: HistoryError, max: 60, want: []string{"system", "u1", "a1", "u2", "a2", "u3"}},
+		{name: "error", messages: conversation, strategy: HistoryError, max: 59, err: ErrPromptTooLong},
+
+		{name: "drop oldest", messages: conversation, strategy: HistoryDropOldest, max: 40, want: []string{"system", "u2", "a2", "u3"}},
+		{name: "drop oldest to last", messages: conversation, strategy: HistoryDropOldest, max: 20, want: []string{"system", "u3"}},
+		{name: "drop oldest too long", messages: conversation, strategy: HistoryDropOldest, max: 19, err: ErrPromptTooLong},
+
+		{name: "drop middle", messages: long, strategy: HistoryDropMiddle, max: 60, want: []string{"system", "u1", "a1", "u3", "a3", "u4"}},
+		{name: "drop middle keeps first turn", messages: long, strategy: HistoryDropMiddle, max: 40, want: []string{"system", "u1", "a1", "u4"}},
+		{name: "drop middle then first turn", messages: long, strategy: HistoryDropMiddle, max: 39, want: []string{"system", "u4"}},
+
+		{name: "summarize", messages: conversation, strategy: HistorySummarize, max: 50, summarizer: summarize, want: []string{"system", "Summary", "u2", "a2", "u3"}},
+		{name: "summarize then drop summary", messages: conversation, strategy: HistorySummarize, max: 46, summarizer: summarize, want: []string{"system", "u2", "a2", "u3"}},
+		{name: "summarize then drop oldest", messages: conversation, strategy: HistorySummarize, max: 20, summarizer: summarize, want: []string{"system", "u3"}},
+		{name: "summarize nothing to summarize", messages: []ChatMessage{sys, u1, a1, u2}, strategy: HistorySummarize, max: 20, summarizer: summarize, want: []string{"system", "u2"}},
+		{name: "summarizer error", messages: conversation, strategy: HistorySummarize, max: 50, summarizer: failing, err: errSummarizer},
+
+		{name: "pinned system messages", messages: []ChatMessage{sys, tools, u1, a1, u2}, strategy: HistoryDropOldest, max: 30, want: []string{"system", "tools", "u2"}},
+		{name: "pinned system messages too long", messages: []ChatMessage{sys, tools, u1, a1, u2}, strategy: HistoryDropMiddle, max: 29, err: ErrPromptTooLong},
+		{name: "system only", messages: []ChatMessage{sys, tools}, strategy: HistoryDropOldest, max: 19, err: ErrPromptTooLong},
+		{name: "system only fits", messages: []ChatMessage{sys, tools}, strategy: HistoryDropOldest, max: 20, want: []string{"system", "tools"}},
+		{name: "no system prompt", messages: []ChatMessage{u1, a1, u2}, strategy: HistoryDropOldest, max: 10, want: []string{"u2"}},
+		{name: "empty", strategy: HistoryError, max: 0, want: nil},
+	}
+
+	// An oversized last message never fits, whatever the strategy
+	for s := HistoryError; s <= HistorySummarize; s++ {
+		tests = append(tests, fitTest{name: "oversized last message " + s.String(), messages: []ChatMessage{sys, u1, a1, u2, a2, huge}, strategy: s, max: 100, summarizer: summarize, err: ErrPromptTooLong})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := slices.Clone(tt.messages)
+			got, err := FitMessages(context.Background(), tt.messages, FitOptions{
+				Strategy:   tt.strategy,
+				MaxTokens:  tt.max,
+				Counter:    wordCounter{},
+				Summarizer: tt.summarizer,
+			})
+			if !sameMessages(tt.messages, orig) {
+				t.Errorf("messages were modified: %q", labels(tt.messages))
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(labels(got), tt.want) {
+				t.Errorf("got %q, want %q", labels(got), tt.want)
+			}
+			if n, _ := (wordCounter{}).CountTokens(got); n > tt.max {
+				t.Errorf("result takes %d tokens, limit %d", n, tt.max)
+			}
+		})
+	}
+}
+
+func TestFitMessagesSummarizesOlderTurns(t *testing.T) {
+	var summarized []ChatMessage
+	summarizer := SummarizerFunc(func(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+		summarized = messages
+		return "short", nil
+	})
+	messages := []ChatMessage{msg(RoleSystem, "system"), msg(RoleUser, "u1"), msg(RoleAssistant, "a1"), msg(RoleUser, "u2"), msg(RoleAssistant, "a2"), msg(RoleUser, "u3")}
+	got, err := FitMessages(context.Background(), messages, FitOptions{Strategy: HistorySummarize, MaxTokens: 50, Counter: wordCounter{}, Summarizer: summarizer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The latest exchange is kept as is
+	if want := []string{"u1", "a1"}; !slices.Equal(labels(summarized), want) {
+		t.Errorf("summarized %q, want %q", labels(summarized), want)
+	}
+	if got[1].Role != RoleSystem || !strings.HasSuffix(got[1].Content, "short") {
+		t.Errorf("summary message = %+v", got[1])
+	}
+}
+
+func TestFitMessagesOptions(t *testing.T) {
+	messages := []ChatMessage{msg(RoleUser, "u1")}
+	if _, err := FitMessages(context.Background(), messages, FitOptions{MaxTokens: 10}); err == nil {
+		t.Error("no error without a counter")
+	}
+	if _, err := FitMessages(context.Background(), messages, FitOptions{Strategy: HistorySummarize, MaxTokens: 10, Counter: wordCounter{}}); err == nil {
+		t.Error("no error for HistorySummarize without a summarizer")
+	}
+}
+
+func TestParseHistoryStrategy(t *testing.T) {
+	for s := HistoryError; s <= HistorySummarize; s++ {
+		got, err := ParseHistoryStrategy(s.String())
+		if err != nil || got != s {
+			t.Errorf("ParseHistoryStrategy(%q) = %v, %v", s.String(), got, err)
+		}
+	}
+	if _, err := ParseHistoryStrategy("drop-newest"); err == nil {
+		t.Error("no error for an unknown strategy")
+	}
+}
+
+func TestSessionHead(t *testing.T) {
+	pinned := []ChatMessage{msg(RoleUser, "p1"), msg(RoleAssistant, "p2")}
+	tests := []struct {
+		name            string
+		system, summary string
+		pinned          []ChatMessage
+		want            []ChatMessage
+	}{
+		{"empty", "", "", nil, nil},
+		{"system prompt", "Be brief.", "", nil, []ChatMessage{{Role: RoleSystem, Content: "Be brief."}}},
+		{"summary", "", "Hello.", nil, []ChatMessage{
+			{Role: RoleSystem, Content: "Summary of the conversation so far:\nHello."},
+		}},
+		{"system prompt and summary", "Be brief.", "Hello.", nil, []ChatMessage{
+			{Role: RoleSystem, Content: "Be brief.\n\nSummary of the conversation so far:\nHello."},
+		}},
+		{"pinned", "", "", pinned, pinned},
+		{"everything", "Be brief.", "Hello.", pinned, append([]ChatMessage{
+			{Role: RoleSystem, Content: "Be brief.\n\nSummary of the conversation so far:\nHello."},
+		}, pinned...)},
+	}
+	for _, tt := range tests {
+		got := sessionHead(tt.system, tt.pinned, tt.summary)
+		if !sameMessages(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
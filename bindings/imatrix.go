@@ -0,0 +1,190 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+//
+// extern bool alpacaImatrixCallback(struct ggml_tensor * t, bool ask, void * user_data);
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/cgo"
+	"strings"
+	"unsafe"
+)
+
+// ComputeImatrix runs calibration text through the model and collects the
+// activations entering every matrix multiplication with a weight. Like
+// llama-imatrix, the text is split into chunks that are each evaluated in a
+// fresh context starting with BOS. Mixture-of-experts expert tensors are not
+// collected.
+func ComputeImatrix(ctx context.Context, model *Model, text string, opts ImatrixOptions) (*Imatrix, error) {
+	chunk := opts.ChunkSize
+	if chunk <= 0 {
+		chunk = 512
+	}
+
+	tokens, err := model.Tokenize(text, true, false)
+	if err != nil {
+		return nil, err
+	}
+	nChunks := len(tokens) / chunk
+	if nChunks == 0 {
+		return nil, fmt.Errorf("calibration text has %d tokens, need at least %d", len(tokens), chunk)
+	}
+
+	col := &imatrixCollector{
+		sums:          make(map[string][]float64),
+		counts:        make(map[string][]int64),
+		calls:         make(map[string]int),
+		processOutput: opts.ProcessOutput,
+	}
+	handle := cgo.NewHandle(col)
+	defer handle.Delete()
+	userData := (*C.uintptr_t)(C.malloc(C.size_t(unsafe.Sizeof(C.uintptr_t(0)))))
+	defer C.free(unsafe.Pointer(userData))
+	*userData = C.uintptr_t(handle)
+
+	cParams := ContextParams{ContextSize: chunk, BatchSize: chunk, Threads: opts.Threads, ThreadsBatch: opts.Threads}.toC()
+	cParams.cb_eval = C.ggml_backend_sched_eval_callback(C.alpacaImatrixCallback)
+	cParams.cb_eval_user_data = unsafe.Pointer(userData)
+
+	c, err := newContext(model, cParams)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Free()
+	col.c = c
+
+	bos := model.BOS()
+	for i := range nChunks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		input := append([]Token(nil), tokens[i*chunk:(i+1)*chunk]...)
+		if bos >= 0 {
+			input[0] = bos
+		}
+		c.clearMemory()
+		if err := c.decode(input, 0, 0, false); err != nil {
+			if col.err != nil {
+				return nil, col.err
+			}
+			return nil, err
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(i+1, nChunks)
+		}
+	}
+
+	if len(col.sums) == 0 {
+		return nil, errors.New("no activations were collected")
+	}
+	return col.imatrix(nChunks), nil
+}
+
+// imatrixCollector accumulates squared activations from the eval callback
+type imatrixCollector struct {
+	sums          map[string][]float64
+	counts        map[string][]int64
+	calls         map[string]int
+	processOutput bool
+	buf           []byte
+
+	// c is the context evaluating the text, err a panic of the callback
+	c   *Context
+	err error
+}
+
+func (col *imatrixCollector) wants(t *C.struct_ggml_tensor) bool {
+	if t.op != C.GGML_OP_MUL_MAT || t.src[0] == nil || t.src[1] == nil {
+		return false
+	}
+	name := C.GoString(&t.src[0].name[0])
+	return strings.HasPrefix(name, "blk.") || (col.processOutput && name == "output.weight")
+}
+
+// collect adds the squares of the activations in src1, one row per token
+func (col *imatrixCollector) collect(t *C.struct_ggml_tensor) {
+	src0, src1 := t.src[0], t.src[1]
+	if src1._type != C.GGML_TYPE_F32 {
+		return
+	}
+	name := C.GoString(&src0.name[0])
+
+	data := src1.data
+	if !C.ggml_backend_buffer_is_host(src1.buffer) {
+		size := int(C.ggml_nbytes(src1))
+		if cap(col.buf) < size {
+			col.buf = make([]byte, size)
+		}
+		col.buf = col.buf[:size]
+		C.ggml_backend_tensor_get(src1, unsafe.Pointer(&col.buf[0]), 0, C.size_t(size))
+		data = unsafe.Pointer(&col.buf[0])
+	}
+
+	ne0 := int(src1.ne[0])
+	sums, ok := col.sums[name]
+	if !ok || len(sums) != ne0 {
+		sums = make([]float64, ne0)
+		col.sums[name] = sums
+		col.counts[name] = make([]int64, ne0)
+	}
+	counts := col.counts[name]
+
+	for i3 := range int(src1.ne[3]) {
+		for i2 := range int(src1.ne[2]) {
+			for i1 := range int(src1.ne[1]) {
+				off := uintptr(i1)*uintptr(src1.nb[1]) + uintptr(i2)*uintptr(src1.nb[2]) + uintptr(i3)*uintptr(src1.nb[3])
+				row := unsafe.Slice((*float32)(unsafe.Add(data, off)), ne0)
+				for j, x := range row {
+					sums[j] += float64(x) * float64(x)
+					counts[j]++
+				}
+			}
+		}
+	}
+	col.calls[name]++
+}
+
+func (col *imatrixCollector) imatrix(chunks int) *Imatrix {
+	m := &Imatrix{Entries: make(map[string][]float32), Calls: make(map[string]int), Chunks: chunks}
+	for name, sums := range col.sums {
+		counts := col.counts[name]
+		values := make([]float32, len(sums))
+		for j := range sums {
+			if counts[j] > 0 {
+				values[j] = float32(sums[j] / float64(counts[j]))
+			}
+		}
+		m.Entries[name] = values
+		m.Calls[name] = col.calls[name]
+	}
+	return m
+}
+
+//export alpacaImatrixCallback
+func alpacaImatrixCallback(t *C.struct_ggml_tensor, ask C.bool, userData unsafe.Pointer) (ok C.bool) {
+	col := cgo.Handle(*(*C.uintptr_t)(userData)).Value().(*imatrixCollector)
+	// A panic must not unwind through llama.cpp; it aborts the computation
+	defer func() {
+		if r := recover(); r != nil {
+			col.err = col.c.callError("imatrix callback", 0, nil).recovered(r)
+			ok = false
+		}
+	}()
+	if ask {
+		return C.bool(col.wants(t))
+	}
+	if col.wants(t) {
+		col.collect(t)
+	}
+	// Returning false would abort the graph computation
+	return true
+}
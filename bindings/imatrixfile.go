@@ -0,0 +1,132 @@
+package bindings
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Imatrix is an importance matrix: for every weight matrix, the mean of the
+// squared activations seen by each of its input columns while running
+// calibration text. Quantize uses it to keep the weights that matter most.
+type Imatrix struct {
+	Entries map[string][]float32 // weight name to per-column mean squared activation
+	Calls   map[string]int       // number of evaluations behind each entry
+	Chunks  int                  // number of calibration chunks processed
+	Dataset string               // name of the calibration data, stored in the file
+}
+
+// Save writes the importance matrix in the legacy .dat format read by
+// llama-quantize --imatrix
+func (m *Imatrix) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	names := make([]string, 0, len(m.Entries))
+	for name := range m.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	le := binary.LittleEndian
+	writeString := func(s string) {
+		binary.Write(w, le, int32(len(s)))
+		w.WriteString(s)
+	}
+
+	binary.Write(w, le, int32(len(names)))
+	for _, name := range names {
+		values := m.Entries[name]
+		calls := max(m.Calls[name], 1)
+		writeString(name)
+		binary.Write(w, le, int32(calls))
+		binary.Write(w, le, int32(len(values)))
+		// The format stores sums over calls, readers divide by the call count
+		scaled := make([]float32, len(values))
+		for i, v := range values {
+			scaled[i] = v * float32(calls)
+		}
+		binary.Write(w, le, scaled)
+	}
+	binary.Write(w, le, int32(m.Chunks))
+	writeString(m.Dataset)
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadImatrix reads an importance matrix saved in the legacy .dat format
+func LoadImatrix(path string) (*Imatrix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	le := binary.LittleEndian
+
+	readInt := func() (int, error) {
+		var n int32
+		err := binary.Read(r, le, &n)
+		return int(n), err
+	}
+	readString := func() (string, error) {
+		n, err := readInt()
+		if err != nil {
+			return "", err
+		}
+		if n < 0 || n > 1<<16 {
+			return "", fmt.Errorf("invalid string length %d", n)
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return string(buf), err
+	}
+
+	n, err := readInt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read imatrix: %w", err)
+	}
+	m := &Imatrix{Entries: make(map[string][]float32, n), Calls: make(map[string]int, n)}
+	for range n {
+		name, err := readString()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read imatrix: %w", err)
+		}
+		calls, err := readInt()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read imatrix: %w", err)
+		}
+		size, err := readInt()
+		if err != nil || size < 0 || size > math.MaxInt32/4 {
+			return nil, fmt.Errorf("failed to read imatrix entry %q", name)
+		}
+		values := make([]float32, size)
+		if err := binary.Read(r, le, values); err != nil {
+			return nil, fmt.Errorf("failed to read imatrix: %w", err)
+		}
+		if calls > 0 {
+			for i := range values {
+				values[i] /= float32(calls)
+			}
+		}
+		m.Entries[name] = values
+		m.Calls[name] = calls
+	}
+
+	// The chunk count and dataset name were added later and may be missing
+	if m.Chunks, err = readInt(); err == nil {
+		m.Dataset, _ = readString()
+	}
+	return m, nil
+}
@@ -0,0 +1,407 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+const testPrompt = "Once upon a time, there was a little"
+
+func TestModelMetadata(t *testing.T) {
+	m := testModel(t)
+	if m.VocabSize() <= 0 || m.EmbeddingSize() <= 0 || m.Layers() <= 0 {
+		t.Errorf("vocabulary of %d, embeddings of %d, %d layers", m.VocabSize(), m.EmbeddingSize(), m.Layers())
+	}
+	if m.Params() <= 0 || m.Size() <= 0 || m.Description() == "" {
+		t.Errorf("%d parameters, %d bytes, description %q", m.Params(), m.Size(), m.Description())
+	}
+	if !m.HasDecoder() || m.IsRecurrent() {
+		t.Errorf("decoder %v, recurrent %v, want a transformer decoder", m.HasDecoder(), m.IsRecurrent())
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 256})
+
+	res, err := c.Generate(context.Background(), testPrompt, greedy(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PromptTokens == 0 || res.CompletionTokens == 0 || res.CompletionTokens > 16 {
+		t.Errorf("%d prompt tokens and %d completion tokens, want some of both and at most 16 generated", res.PromptTokens, res.CompletionTokens)
+	}
+	if res.FinishReason != FinishLength && res.FinishReason != FinishStop {
+		t.Errorf("finish reason %v", res.FinishReason)
+	}
+
+	// The same prompt is found in the cache
+	again, err := c.Generate(context.Background(), testPrompt, greedy(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.CachedTokens == 0 {
+		t.Error("the prompt was evaluated again")
+	}
+}
+
+func TestGenerateCancelled(t *testing.T) {
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 256})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := c.Generate(ctx, testPrompt, greedy(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FinishReason != FinishCancel || res.CompletionTokens != 0 {
+		t.Errorf("finish reason %v after %d tokens, want cancel before any", res.FinishReason, res.CompletionTokens)
+	}
+}
+
+func TestEvaluateEmpty(t *testing.T) {
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 256})
+	if err := c.evaluate(nil); err == nil {
+		t.Error("no error for an empty prompt")
+	}
+	if err := c.evaluateShared(nil); err == nil {
+		t.Error("no error for an empty shared prompt")
+	}
+}
+
+func TestPromptCache(t *testing.T) {
+	m := testModel(t)
+	params := ContextParams{ContextSize: 256}
+	c := testContext(t, m, params)
+	if err := c.Prefill(testPrompt); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "prompt.state")
+	if err := c.SavePromptCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := testContext(t, m, params)
+	if err := restored.LoadPromptCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.tokens) != len(c.tokens) {
+		t.Fatalf("restored %d tokens, saved %d", len(restored.tokens), len(c.tokens))
+	}
+	res, err := restored.Generate(context.Background(), testPrompt, greedy(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CachedTokens == 0 {
+		t.Error("the restored prompt was evaluated again")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file saved from another model fails before reaching llama.cpp
+	other := append([]byte(nil), data...)
+	other[len(stateMagic)+8]++ // the parameter count
+	if err := os.WriteFile(path, other, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadPromptCache(path); !errors.Is(err, ErrStateIncompatible) {
+		t.Errorf("loading the state of another model: %v", err)
+	}
+
+	// A truncated file fails and leaves a usable context
+	if err := os.WriteFile(path, data[:len(data)-1], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadPromptCache(path); !errors.Is(err, ErrStateCorrupt) {
+		t.Errorf("loading a truncated prompt cache: %v", err)
+	}
+	if _, err := restored.Generate(context.Background(), testPrompt, greedy(4)); err != nil {
+		t.Errorf("generating after a failed load: %v", err)
+	}
+
+	// A context too small for the tokens refuses them
+	small := testContext(t, m, ContextParams{ContextSize: 8})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.tokens) > small.Size() {
+		if err := small.LoadPromptCache(path); err == nil {
+			t.Error("a prompt cache larger than the context loads")
+		}
+	}
+}
+
+// sampledRun is what a generation sampled, token by token
+type sampledRun struct {
+	tokens   []Token
+	logprobs []float32 // of the sampled token, then of its top candidates
+}
+
+func sample(t *testing.T, c *Context, opts GenerateOptions) sampledRun {
+	t.Helper()
+	var r sampledRun
+	opts.OnTokenInfo = func(info TokenInfo) {
+		r.tokens = append(r.tokens, info.Token)
+		r.logprobs = append(r.logprobs, info.Logprob)
+		for _, top := range info.TopLogprobs {
+			r.logprobs = append(r.logprobs, top.Logprob)
+		}
+	}
+	if _, err := c.Generate(context.Background(), testPrompt, opts); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDeterministic(t *testing.T) {
+	m := testModel(t)
+	params := ContextParams{ContextSize: 256, Deterministic: true}
+	opts := DefaultGenerateOptions()
+	opts.MaxTokens = 32
+	opts.Temperature = 0.8
+	opts.Seed = 42
+	opts.TopLogprobs = 4
+
+	c := testContext(t, m, params)
+	first := sample(t, c, opts)
+	if len(first.tokens) == 0 {
+		t.Fatal("the model generated nothing")
+	}
+	// Again in the same context, which evaluates the prompt anew, and in
+	// another one
+	for _, c := range []*Context{c, testContext(t, m, params)} {
+		r := sample(t, c, opts)
+		if !slices.Equal(r.tokens, first.tokens) {
+			t.Fatalf("sampled %v, then %v", first.tokens, r.tokens)
+		}
+		if len(r.logprobs) != len(first.logprobs) {
+			t.Fatalf("%d log-probabilities, then %d", len(first.logprobs), len(r.logprobs))
+		}
+		for i := range first.logprobs {
+			if math.Float32bits(r.logprobs[i]) != math.Float32bits(first.logprobs[i]) {
+				t.Fatalf("log-probability %d is %v, then %v", i, first.logprobs[i], r.logprobs[i])
+			}
+		}
+	}
+}
+
+func TestFork(t *testing.T) {
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 256})
+	if err := c.Prefill(testPrompt); err != nil {
+		t.Fatal(err)
+	}
+	fork, err := c.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Free()
+
+	a, err := c.Generate(context.Background(), testPrompt, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fork.Generate(context.Background(), testPrompt, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.CachedTokens == 0 {
+		t.Error("the fork evaluated the prompt again")
+	}
+	if a.Text != b.Text {
+		t.Errorf("the fork continued with %q, the original with %q", b.Text, a.Text)
+	}
+}
+
+func TestScoreMany(t *testing.T) {
+	m := testModel(t)
+	continuations := []string{" girl", " dog named Max", " boy who liked to play"}
+
+	single := testContext(t, m, ContextParams{ContextSize: 256})
+	shared := testContext(t, m, ContextParams{ContextSize: 256, Sequences: len(continuations)})
+	scores, err := shared.ScoreMany(testPrompt, continuations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != len(continuations) {
+		t.Fatalf("%d scores for %d continuations", len(scores), len(continuations))
+	}
+	for i, cont := range continuations {
+		want, err := single.Score(testPrompt, cont)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scores[i] >= 0 || math.Abs(scores[i]-want) > 1e-3 {
+			t.Errorf("%q scores %v together and %v alone", cont, scores[i], want)
+		}
+	}
+}
+
+func TestGenerateMany(t *testing.T) {
+	suffixes := []string{" girl", " dog", " boy"}
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 256, Sequences: len(suffixes)})
+	results, err := c.GenerateMany(context.Background(), testPrompt, suffixes, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(suffixes) {
+		t.Fatalf("%d results for %d suffixes", len(results), len(suffixes))
+	}
+	for i, res := range results {
+		if res.CompletionTokens == 0 || res.CompletionTokens > 8 {
+			t.Errorf("suffix %q generated %d tokens", suffixes[i], res.CompletionTokens)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	c := testContext(t, testModel(t), ContextParams{ContextSize: 512, Sequences: 2})
+	sched, err := NewScheduler(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Close()
+
+	prompts := []string{testPrompt, "The dog ran to the park and", testPrompt}
+	results := make([]*GenerateResult, len(prompts))
+	errs := make([]error, len(prompts))
+	var wg sync.WaitGroup
+	for i, p := range prompts {
+		wg.Go(func() {
+			results[i], errs[i] = sched.Generate(context.Background(), p, greedy(8))
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if res.CompletionTokens == 0 {
+			t.Errorf("prompt %d generated nothing", i)
+		}
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	m := testModel(t)
+	c := testContext(t, m, ContextParams{ContextSize: 256, BatchSize: 256, UBatchSize: 256, Sequences: 2})
+	texts := []string{testPrompt, "The dog ran to the park"}
+	embeddings, err := c.EmbedMany(texts, EmbedOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != len(texts) {
+		t.Fatalf("%d embeddings for %d texts", len(embeddings), len(texts))
+	}
+	for i, text := range texts {
+		one, err := c.Embed(text, EmbedOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(one) != m.EmbeddingSize() || len(embeddings[i]) != len(one) {
+			t.Fatalf("embeddings of %d and %d, model embeds in %d", len(one), len(embeddings[i]), m.EmbeddingSize())
+		}
+		for j := range one {
+			if math.Abs(float64(one[j]-embeddings[i][j])) > 1e-3 {
+				t.Errorf("%q embeds differently alone and in a batch at %d: %v vs %v", text, j, one[j], embeddings[i][j])
+				break
+			}
+		}
+	}
+}
+
+// decodeSequences decodes a prompt into each sequence, the prefix they
+// share into cells they share
+func decodeSequences(t *testing.T, c *Context, prefix []Token, tails [][]Token) {
+	t.Helper()
+	b := NewBatch(256, len(tails))
+	defer b.Free()
+	seqs := make([]int, len(tails))
+	for i := range seqs {
+		seqs[i] = i
+	}
+	for pos, token := range prefix {
+		if err := b.Add(token, pos, false, seqs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for seq, tail := range tails {
+		for i, token := range tail {
+			if err := b.Add(token, len(prefix)+i, false, seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := c.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeNext decodes token after the tail of every sequence, keeping its
+// logits at the index of the sequence
+func decodeNext(t *testing.T, c *Context, token Token, prefix []Token, tails [][]Token) {
+	t.Helper()
+	b := NewBatch(len(tails), 1)
+	defer b.Free()
+	for seq, tail := range tails {
+		if err := b.Add(token, len(prefix)+len(tail), true, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefragKVCache(t *testing.T) {
+	m := testModel(t)
+	prefix, err := m.Tokenize(testPrompt, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tails [][]Token
+	for _, s := range []string{" girl", " dog named Max", " boy who liked to play"} {
+		tail, err := m.Tokenize(s, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tails = append(tails, tail)
+	}
+
+	params := ContextParams{ContextSize: 256, Sequences: len(tails)}
+	c := testContext(t, m, params)
+	ref := testContext(t, m, params)
+	decodeSequences(t, c, prefix, tails)
+	decodeSequences(t, ref, prefix, tails)
+
+	if err := c.DefragKVCache(); err != nil {
+		t.Fatal(err)
+	}
+	for seq, tail := range tails {
+		if got, want := c.UsedTokens(seq), len(prefix)+len(tail); got != want {
+			t.Errorf("sequence %d holds %d tokens after defragmenting, want %d", seq, got, want)
+		}
+	}
+
+	// Every sequence continues as in the context left alone
+	next := prefix[len(prefix)-1]
+	decodeNext(t, c, next, prefix, tails)
+	decodeNext(t, ref, next, prefix, tails)
+	for seq := range tails {
+		got, want := c.Logits(seq), ref.Logits(seq)
+		for i := range want {
+			if math.Abs(float64(got[i]-want[i])) > 1e-3 {
+				t.Errorf("sequence %d: logit %d is %v after defragmenting, %v without", seq, i, got[i], want[i])
+				break
+			}
+		}
+	}
+}
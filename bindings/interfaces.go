@@ -0,0 +1,20 @@
+package bindings
+
+import "context"
+
+// Generator produces completions, it is implemented by *Context and by
+// fake.Generator for tests that shouldn't need a model
+type Generator interface {
+	Generate(ctx context.Context, prompt string, opts GenerateOptions) (*GenerateResult, error)
+}
+
+// Embedder computes embeddings, it is implemented by *Context and by
+// fake.Embedder
+type Embedder interface {
+	Embed(text string, opts EmbedOptions) ([]float32, error)
+}
+
+var (
+	_ Generator = (*Context)(nil)
+	_ Embedder  = (*Context)(nil)
+)
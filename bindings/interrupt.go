@@ -0,0 +1,96 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+//
+// // The abort callback only reads a flag, so that checking it between
+// // operations costs no call into Go
+// static bool alpaca_interrupted(void * flag) {
+// 	return __atomic_load_n((int *)flag, __ATOMIC_RELAXED) != 0;
+// }
+//
+// static void alpaca_set_interrupted(int * flag, int on) {
+// 	__atomic_store_n(flag, on, __ATOMIC_RELAXED);
+// }
+//
+// static void alpaca_watch_interrupt(struct llama_context * ctx, int * flag) {
+// 	llama_set_abort_callback(ctx, alpaca_interrupted, flag);
+// }
+import "C"
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// errInterrupted is returned by evaluateProgress when it was interrupted
+var errInterrupted = errors.New("prompt evaluation interrupted")
+
+// interrupt is the abort flag of a context, set while a prompt evaluation
+// with InterruptCompute should stop
+type interrupt struct {
+	flag *C.int
+
+	mu    sync.Mutex
+	armed bool // a generation is watching the flag
+}
+
+// interruptible returns the function telling prompt evaluation to stop as
+// opts.Interrupt allows, nil when it only stops between tokens, and the
+// function to call once the prompt is evaluated
+func (c *Context) interruptible(ctx context.Context, start time.Time, opts GenerateOptions) (stop func() bool, done func()) {
+	if opts.Interrupt == InterruptTokens {
+		return nil, func() {}
+	}
+	stop = func() bool {
+		return ctx.Err() != nil || opts.expired(start)
+	}
+	if opts.Interrupt != InterruptCompute {
+		return stop, func() {}
+	}
+
+	if c.interrupt == nil {
+		c.interrupt = &interrupt{flag: (*C.int)(C.calloc(1, C.size_t(unsafe.Sizeof(C.int(0)))))}
+		C.alpaca_watch_interrupt(c.ptr, c.interrupt.flag)
+	}
+	in := c.interrupt
+	in.mu.Lock()
+	in.armed = true
+	in.mu.Unlock()
+	// Once disarmed, a late trigger must not stop the next decode
+	trigger := func() {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		if in.armed {
+			C.alpaca_set_interrupted(in.flag, 1)
+		}
+	}
+	cancel := context.AfterFunc(ctx, trigger)
+	var timer *time.Timer
+	if opts.MaxDuration > 0 {
+		timer = time.AfterFunc(opts.MaxDuration-time.Since(start), trigger)
+	}
+	return stop, func() {
+		cancel()
+		if timer != nil {
+			timer.Stop()
+		}
+		in.mu.Lock()
+		in.armed = false
+		C.alpaca_set_interrupted(in.flag, 0)
+		in.mu.Unlock()
+	}
+}
+
+// freeInterrupt releases the abort flag, after the context is freed
+func (c *Context) freeInterrupt() {
+	if c.interrupt != nil {
+		C.free(unsafe.Pointer(c.interrupt.flag))
+		c.interrupt = nil
+	}
+}
@@ -0,0 +1,110 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import "sync"
+
+// backendState tracks the llama backend and the models and contexts using
+// it, so that it outlives them. Its methods need mu held.
+type backendState struct {
+	mu    sync.Mutex
+	ready bool
+
+	// live counts models, contexts and quantizations; freeing is set when
+	// Free was called while some were live
+	live    int
+	freeing bool
+}
+
+var backend backendState
+
+// Init initializes the llama backend. It is safe to call from several
+// goroutines and more than once; LoadModel, NewContext and Quantize call it
+// themselves, so calling it is only needed to control when the backend
+// starts. Init also cancels a Free that is waiting for resources.
+func Init() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	backend.init()
+}
+
+// Free frees the llama backend. While models or contexts are live it is
+// freed once the last of them is, so one component can't tear it down under
+// another. Calls without a matching Init do nothing, and a later Init
+// initializes the backend again.
+func Free() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if !backend.ready {
+		return
+	}
+	if backend.live > 0 {
+		backend.freeing = true
+		return
+	}
+	backend.free()
+}
+
+// acquireBackend initializes the backend if needed and counts a resource
+// using it
+func acquireBackend() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	backend.init()
+	backend.live++
+}
+
+// releaseBackend releases a resource counted by acquireBackend
+func releaseBackend() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	backend.release()
+}
+
+// retain counts a live context of the model, which keeps both the model and
+// the backend from being freed
+func (m *Model) retain() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	m.contexts++
+	backend.init()
+	backend.live++
+}
+
+// releaseContext releases a context of the model, freeing the model if Free
+// waits for it
+func (m *Model) releaseContext() {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	m.contexts--
+	if m.contexts == 0 && m.freeing {
+		m.free()
+	}
+	backend.release()
+}
+
+func (b *backendState) init() {
+	if !b.ready {
+		metalResources()
+		C.llama_backend_init()
+		setAbortCallback()
+		b.ready = true
+	}
+	b.freeing = false
+}
+
+func (b *backendState) release() {
+	b.live--
+	if b.live == 0 && b.freeing {
+		b.free()
+	}
+}
+
+func (b *backendState) free() {
+	C.llama_backend_free()
+	b.ready = false
+	b.freeing = false
+}
@@ -0,0 +1,43 @@
+package bindings
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// ErrInputTooLarge is returned for text longer than the limit set with
+// SetMaxInputBytes, before any of it is copied into llama.cpp
+var ErrInputTooLarge = errors.New("input exceeds the size limit")
+
+// DefaultMaxInputBytes is the initial input limit: no context holds that
+// many tokens, and copying more would stall the process for nothing
+const DefaultMaxInputBytes = 64 << 20
+
+// maxInputBytes is the input limit, 0 for none
+var maxInputBytes atomic.Int64
+
+func init() {
+	maxInputBytes.Store(DefaultMaxInputBytes)
+}
+
+// SetMaxInputBytes limits the size of the text tokenized or formatted with a
+// chat template in one call, DefaultMaxInputBytes unless set. Longer input
+// fails with ErrInputTooLarge instead of being copied into C memory. 0 turns
+// the limit off, though llama.cpp never takes more than 2 GiB.
+func SetMaxInputBytes(n int64) {
+	maxInputBytes.Store(max(n, 0))
+}
+
+// checkInput fails if n bytes of input are over the limit
+func checkInput(n int) error {
+	limit := maxInputBytes.Load()
+	if limit == 0 || limit > math.MaxInt32 {
+		limit = math.MaxInt32
+	}
+	if int64(n) > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrInputTooLarge, n, limit)
+	}
+	return nil
+}
@@ -1,62 +1,279 @@
-// Package bindings provides Go bundings for llama.cpp
+//go:build !nollama
+
 package bindings
 
-// #cgo CFLAGS: -I${SRCDIR}/../llama.cpp/include -I${SRCDIR}/../llama.cpp/ggml/include
-// #cgo LDFLAGS: -L${SRCDIR}/../llama.cpp/build/bin -lllama -lstdc++ -lm
-// #cgo darwin LDFLAGS: -framework Accelerate -framework Foundation -framework Metal -framework MetalKit
 // #include <stdlib.h>
 // #include "llama.h"
 import "C"
 
 import (
 	"fmt"
+	"log/slog"
+	"os"
+	"time"
 	"unsafe"
 )
 
 type Model struct {
-	ptr *C.struct_llama_model
-}
+	ptr   *C.struct_llama_model
+	vocab *C.struct_llama_vocab
+	mmap  bool   // the weights are mapped from the file
+	path  string // of the file, for what llama.cpp doesn't expose
+	temp  bool   // the file is a copy to remove once the model is freed
 
-// Init initializes the llama backend
-func Init() {
-	C.llama_backend_init()
-}
+	gpuLayers int // offloaded, as the load ended up
 
-// Free frees the llama backend
-func Free() {
-	C.llama_backend_free()
+	// contexts counts the live contexts of the model; freeing is set when
+	// Free was called while there were some. Both are guarded by backend.mu.
+	contexts int
+	freeing  bool
 }
 
 // LoadModel loads a GGUF model from the given path
 func LoadModel(path string) (*Model, error) {
+	return LoadModelWithParams(path, ModelParams{})
+}
+
+// LoadModelWithParams loads a GGUF model from the given path
+func LoadModelWithParams(path string, params ModelParams) (*Model, error) {
+	acquireBackend()
+	if tracing() {
+		defer trace("llama_model_load_from_file", time.Now(), slog.String("path", path), slog.Bool("mmap", !params.NoMmap), slog.Bool("vocab_only", params.VocabOnly))
+	}
 	cPath := C.CString(path)
 	defer C.free(unsafe.Pointer(cPath))
 
-	params := C.llama_model_default_params()
-	modelPtr := C.llama_model_load_from_file(cPath, params)
+	cParams := C.llama_model_default_params()
+	cParams.vocab_only = C.bool(params.VocabOnly)
+	cParams.use_mmap = C.bool(!params.NoMmap)
+	cParams.use_mlock = C.bool(params.UseMlock)
+	if len(params.TensorOverrides) > 0 {
+		overrides, free, err := tensorOverrides(params.TensorOverrides)
+		if err != nil {
+			releaseBackend()
+			return nil, err
+		}
+		defer free()
+		cParams.tensor_buft_overrides = overrides
+	}
+	freeSplit, err := applyGPUs(&cParams, params)
+	if err != nil {
+		releaseBackend()
+		return nil, err
+	}
+	defer freeSplit()
+	if params.ExpertsUsed > 0 {
+		overrides, free, err := expertsOverride(path, params.ExpertsUsed)
+		if err != nil {
+			releaseBackend()
+			return nil, err
+		}
+		defer free()
+		cParams.kv_overrides = overrides
+	}
+	layers := gpuLayers(path, params.GPULayers)
+	cParams.n_gpu_layers = C.int32_t(layers)
+	modelPtr := C.llama_model_load_from_file(cPath, cParams)
+
+	for modelPtr == nil && layers > 0 && params.Fallback != FallbackNone && len(GPUs()) > 0 {
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		retry := "retrying on the CPU"
+		if params.Fallback == FallbackFewerLayers {
+			layers /= 2
+			retry = "retrying with fewer layers offloaded"
+		} else {
+			layers = 0
+		}
+		slog.Warn("loading the model on the GPUs failed, "+retry, "path", path, "fallback", params.Fallback, "gpu_layers", layers)
+		cParams.n_gpu_layers = C.int32_t(layers)
+		modelPtr = C.llama_model_load_from_file(cPath, cParams)
+	}
 
 	if modelPtr == nil {
+		releaseBackend()
 		return nil, fmt.Errorf("failed to load model: %s", path)
 	}
 
-	return &Model{ptr: modelPtr}, nil
+	m := &Model{
+		ptr:   modelPtr,
+		vocab: C.llama_model_get_vocab(modelPtr),
+		mmap:  !params.NoMmap && bool(C.llama_supports_mmap()),
+		path:  path,
+	}
+	if len(GPUs()) > 0 {
+		m.gpuLayers = min(layers, m.Layers()+1)
+	}
+	return m, nil
+}
+
+// GPULayers returns the number of layers offloaded to GPUs, the output
+// layer included, which is below ModelParams.GPULayers when the load fell
+// back to fewer
+func (m *Model) GPULayers() int {
+	return m.gpuLayers
 }
 
-// Free frees the model
+// Free frees the model. While contexts created from it are live, it is
+// freed once the last of them is.
 func (m *Model) Free() {
-	if m.ptr != nil {
-		C.llama_model_free(m.ptr)
-		m.ptr = nil
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if m.ptr == nil {
+		return
 	}
+	if m.contexts > 0 {
+		m.freeing = true
+		return
+	}
+	m.free()
+}
+
+// free frees the model's weights; backend.mu must be held
+func (m *Model) free() {
+	C.llama_model_free(m.ptr)
+	m.ptr = nil
+	m.vocab = nil
+	m.freeing = false
+	if m.temp {
+		os.Remove(m.path)
+	}
+	backend.release()
+}
+
+// IsLoadedFromMmap reports whether the weights are mapped from the model
+// file rather than read into memory
+func (m *Model) IsLoadedFromMmap() bool {
+	return m.mmap
 }
 
 // VocabSize returns the vocabulary size
 func (m *Model) VocabSize() int {
-	vocab := C.llama_model_get_vocab(m.ptr)
-	return int(C.llama_vocab_n_tokens(vocab))
+	return int(C.llama_vocab_n_tokens(m.vocab))
 }
 
 // ContextSize returns the context size
 func (m *Model) ContextSize() int {
 	return int(C.llama_model_n_ctx_train(m.ptr))
 }
+
+// EmbeddingSize returns n_embd, the width of the model's hidden state and
+// of the embeddings it computes
+func (m *Model) EmbeddingSize() int {
+	return int(C.llama_model_n_embd(m.ptr))
+}
+
+// SlidingWindow returns n_swa, the number of recent tokens the layers with
+// sliding window attention attend to, 0 for models without
+func (m *Model) SlidingWindow() int {
+	return int(C.llama_model_n_swa(m.ptr))
+}
+
+// Layers returns n_layer, the number of transformer blocks
+func (m *Model) Layers() int {
+	return int(C.llama_model_n_layer(m.ptr))
+}
+
+// Heads returns n_head, the number of attention heads
+func (m *Model) Heads() int {
+	return int(C.llama_model_n_head(m.ptr))
+}
+
+// HeadsKV returns n_head_kv, the number of key/value heads. It is below
+// Heads for models using grouped-query attention, which shrinks the KV
+// cache by the same factor.
+func (m *Model) HeadsKV() int {
+	return int(C.llama_model_n_head_kv(m.ptr))
+}
+
+// RopeType returns how the model applies rotary position embeddings
+func (m *Model) RopeType() RopeType {
+	return RopeType(C.llama_model_rope_type(m.ptr))
+}
+
+// RopeScalingFor returns the rope scaling RopeScalingAuto picks for a
+// context of nCtx tokens
+func (m *Model) RopeScalingFor(nCtx int) RopeConfig {
+	if m.RopeType() == RopeNone {
+		return RopeConfig{Scaling: RopeScalingModel}
+	}
+	return ropeFor(RopeScalingAuto, nCtx, m.ContextSize(), m.declaresRopeScaling())
+}
+
+// declaresRopeScaling reports whether the model's metadata asks for rope
+// scaling, as models fine-tuned for long contexts with YaRN do
+func (m *Model) declaresRopeScaling() bool {
+	arch, ok := m.meta("general.architecture")
+	if !ok {
+		return false
+	}
+	scaling, ok := m.meta(arch + ".rope.scaling.type")
+	return ok && scaling != "none"
+}
+
+// applyRope sets the rope scaling of context parameters
+func (m *Model) applyRope(cParams *C.struct_llama_context_params, scaling RopeScaling) {
+	nCtx := int(cParams.n_ctx)
+	if nCtx == 0 || m.RopeType() == RopeNone {
+		return
+	}
+	cfg := ropeFor(scaling, nCtx, m.ContextSize(), m.declaresRopeScaling())
+	switch cfg.Scaling {
+	case RopeScalingNone:
+		cParams.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_NONE
+	case RopeScalingLinear:
+		cParams.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_LINEAR
+	case RopeScalingYaRN:
+		cParams.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_YARN
+		cParams.yarn_orig_ctx = C.uint32_t(cfg.OrigContext)
+	}
+	if cfg.FreqScale != 0 {
+		cParams.rope_freq_scale = C.float(cfg.FreqScale)
+	}
+}
+
+// meta returns the value of a metadata key as a string
+func (m *Model) meta(key string) (string, bool) {
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	var buf [256]C.char
+	n := C.llama_model_meta_val_str(m.ptr, cKey, &buf[0], C.size_t(len(buf)))
+	if n < 0 {
+		return "", false
+	}
+	return C.GoString(&buf[0]), true
+}
+
+// Vocab reads the model's tokenizer from its file, including the BPE
+// merges llama.cpp doesn't expose
+func (m *Model) Vocab() (*Vocab, error) {
+	return ReadVocab(m.path)
+}
+
+// VocabType returns the kind of tokenizer the model uses
+func (m *Model) VocabType() VocabType {
+	return VocabType(C.llama_vocab_type(m.vocab))
+}
+
+// IsRecurrent reports whether the model keeps a recurrent state instead of,
+// or as with hybrid models next to, a KV cache (Mamba, RWKV, Jamba). Such
+// state can't be rolled back to an earlier token, so changing an earlier
+// part of the prompt means evaluating it again from the start.
+func (m *Model) IsRecurrent() bool {
+	return bool(C.llama_model_is_recurrent(m.ptr)) || bool(C.llama_model_is_hybrid(m.ptr))
+}
+
+// IsHybrid reports whether the model combines attention layers with a KV
+// cache and recurrent ones (Jamba, Granite 4), which IsRecurrent also
+// reports: the KV cache part can be shifted, the recurrent state not
+func (m *Model) IsHybrid() bool {
+	return bool(C.llama_model_is_hybrid(m.ptr))
+}
+
+// IsDiffusion reports whether the model generates by denoising a whole
+// block of tokens at once (LLaDA, Dream) rather than one token after the
+// other, which Generate doesn't do
+func (m *Model) IsDiffusion() bool {
+	return bool(C.llama_model_is_diffusion(m.ptr))
+}
@@ -0,0 +1,73 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// LoadModelFromReader loads a GGUF model of size bytes read from r, such as
+// an object in remote storage. llama.cpp only loads files, so the model is
+// copied to a temporary file first, which is removed once the model is freed.
+func LoadModelFromReader(r io.ReaderAt, size int64, params ModelParams) (*Model, error) {
+	f, err := os.CreateTemp("", "alpaca-*.gguf")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	_, err = io.Copy(f, io.NewSectionReader(r, 0, size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	m, err := LoadModelWithParams(path, params)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	m.temp = true
+	return m, nil
+}
+
+// LoadModelFromFS loads the GGUF model name of fsys, e.g. a small model
+// embedded in the binary with go:embed, as LoadModelFromReader does
+func LoadModelFromFS(fsys fs.FS, name string, params ModelParams) (*Model, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		// Read sequentially, which is all the copy needs
+		r = &sequentialReaderAt{r: f}
+	}
+	return LoadModelFromReader(r, info.Size(), params)
+}
+
+// sequentialReaderAt adapts a reader to io.ReaderAt for callers that read
+// it once from start to end
+type sequentialReaderAt struct {
+	r   io.Reader
+	off int64
+}
+
+func (s *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off != s.off {
+		return 0, errors.New("model file read out of order")
+	}
+	n, err := s.r.Read(p)
+	s.off += int64(n)
+	return n, err
+}
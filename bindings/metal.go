@@ -0,0 +1,55 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// metalResources points ggml at the Metal shader sources next to the
+// executable, or in the Resources of the .app bundle holding it, unless
+// GGML_METAL_PATH_RESOURCES is set or the shaders are embedded in the
+// library. ggml itself only looks in the directory of argv[0], which is
+// wrong once the binary is relocated, started through PATH or a symlink.
+func metalResources() {
+	if runtime.GOOS != "darwin" || os.Getenv("GGML_METAL_PATH_RESOURCES") != "" {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return
+	}
+	dir := filepath.Dir(exe)
+	for _, d := range []string{dir, filepath.Join(dir, "..", "Resources")} {
+		for _, name := range []string{"ggml-metal.metal", "default.metallib"} {
+			if _, err := os.Stat(filepath.Join(d, name)); err == nil {
+				os.Setenv("GGML_METAL_PATH_RESOURCES", filepath.Clean(d))
+				return
+			}
+		}
+	}
+}
+
+// MetalAvailable reports whether the Metal backend initialized and offers
+// a GPU to offload to. It is false on other platforms, in builds without
+// Metal, and when ggml found no shaders to compile, in which case models run
+// on the CPU.
+func MetalAvailable() bool {
+	Init()
+	for i := range int(C.ggml_backend_dev_count()) {
+		name := C.GoString(C.ggml_backend_dev_name(C.ggml_backend_dev_get(C.size_t(i))))
+		if strings.HasPrefix(name, "Metal") || strings.HasPrefix(name, "MTL") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+//go:build nollama
+
+package bindings
+
+import (
+	"context"
+	"io"
+	"io/fs"
+)
+
+// Model is a loaded model. Without llama.cpp no model can be loaded.
+type Model struct{}
+
+// Init initializes the llama backend
+func Init() {}
+
+// Free frees the llama backend
+func Free() {}
+
+// LoadModel returns ErrNotBuilt
+func LoadModel(path string) (*Model, error) {
+	return nil, ErrNotBuilt
+}
+
+// LoadModelWithParams returns ErrNotBuilt
+func LoadModelWithParams(path string, params ModelParams) (*Model, error) {
+	return nil, ErrNotBuilt
+}
+
+// LoadModelFromReader returns ErrNotBuilt
+func LoadModelFromReader(r io.ReaderAt, size int64, params ModelParams) (*Model, error) {
+	return nil, ErrNotBuilt
+}
+
+// LoadModelFromFS returns ErrNotBuilt
+func LoadModelFromFS(fsys fs.FS, name string, params ModelParams) (*Model, error) {
+	return nil, ErrNotBuilt
+}
+
+func (m *Model) Free()              {}
+func (m *Model) VocabSize() int     { return 0 }
+func (m *Model) ContextSize() int   { return 0 }
+func (m *Model) IsRecurrent() bool  { return false }
+func (m *Model) IsHybrid() bool     { return false }
+func (m *Model) IsDiffusion() bool  { return false }
+func (m *Model) EmbeddingSize() int { return 0 }
+func (m *Model) Layers() int        { return 0 }
+func (m *Model) Heads() int         { return 0 }
+func (m *Model) HeadsKV() int       { return 0 }
+func (m *Model) RopeType() RopeType { return RopeNone }
+func (m *Model) Experts() int       { return 0 }
+func (m *Model) ExpertsUsed() int   { return 0 }
+func (m *Model) RopeScalingFor(nCtx int) RopeConfig {
+	return RopeConfig{Scaling: RopeScalingModel}
+}
+
+func (m *Model) Description() string { return "" }
+func (m *Model) Size() int64         { return 0 }
+func (m *Model) Params() int64       { return 0 }
+func (m *Model) Summary() string     { return "" }
+func (m *Model) FileType() (FileType, bool) {
+	return 0, false
+}
+func (m *Model) Vocab() (*Vocab, error) { return nil, ErrNotBuilt }
+func (m *Model) GPULayers() int         { return 0 }
+
+func (m *Model) VocabType() VocabType   { return VocabNone }
+func (m *Model) IsLoadedFromMmap() bool { return false }
+func (m *Model) BOS() Token             { return -1 }
+func (m *Model) EOS() Token             { return -1 }
+
+func (m *Model) IsEOG(token Token) bool { return false }
+
+func (m *Model) TokenToPiece(token Token) string { return "" }
+
+func (m *Model) Tokenize(text string, addSpecial, parseSpecial bool) ([]Token, error) {
+	return nil, ErrNotBuilt
+}
+
+func (m *Model) TokenizeWithOptions(text string, opts TokenizeOptions) ([]Token, error) {
+	return nil, ErrNotBuilt
+}
+
+func (m *Model) AddsBOS() bool { return false }
+func (m *Model) AddsEOS() bool { return false }
+
+func (m *Model) Detokenize(tokens []Token, removeSpecial, unparseSpecial bool) (string, error) {
+	return "", ErrNotBuilt
+}
+
+func (m *Model) ApplyChatTemplate(messages []ChatMessage, addAssistant bool) (string, error) {
+	return "", ErrNotBuilt
+}
+
+func (m *Model) CountTokens(messages []ChatMessage) (int, error) {
+	return 0, ErrNotBuilt
+}
+
+func (m *Model) RenderChatTemplate(messages []ChatMessage, addAssistant bool, vars map[string]any) (string, error) {
+	return "", ErrNotBuilt
+}
+
+func (m *Model) ChatTemplate() (string, bool) {
+	return "", false
+}
+
+func (m *Model) TemplateFamily() TemplateFamily {
+	return FamilyUnknown
+}
+
+// ApplyChatTemplate formats messages with a registered PromptTemplate or a
+// Jinja template. The templates built into llama.cpp are not available.
+func ApplyChatTemplate(tmpl string, messages []ChatMessage, addAssistant bool) (string, error) {
+	if tmpl == "" {
+		tmpl = "chatml"
+	}
+	if t, ok := LookupTemplate(tmpl); ok {
+		return t.Format(messages, addAssistant), nil
+	}
+	if isJinjaTemplate(tmpl) {
+		return RenderChatTemplate(tmpl, messages, addAssistant, nil)
+	}
+	return "", ErrNotBuilt
+}
+
+// Context is an inference context. Without llama.cpp none can be created.
+type Context struct{}
+
+func (m *Model) FIMPrompt(prefix, suffix string) (string, bool) { return "", false }
+
+func (m *Model) HasEncoder() bool    { return false }
+func (m *Model) HasDecoder() bool    { return false }
+func (m *Model) DecoderStart() Token { return 0 }
+
+// BufferTypes returns nil
+func BufferTypes() []string { return nil }
+
+// MaxDevices returns 0
+func MaxDevices() int { return 0 }
+
+// GPUs returns nil
+func GPUs() []string { return nil }
+
+// GPUMemory returns 0, 0
+func GPUMemory() (free, total int64) { return 0, 0 }
+
+// MetalAvailable returns false
+func MetalAvailable() bool { return false }
+
+// NewContext returns ErrNotBuilt
+func NewContext(model *Model, params ContextParams) (*Context, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Free()                  {}
+func (c *Context) Model() *Model          { return nil }
+func (c *Context) Size() int              { return 0 }
+func (c *Context) MaxTokens() int         { return 0 }
+func (c *Context) UsedTokens(seq int) int { return 0 }
+
+func (c *Context) Generate(ctx context.Context, prompt string, opts GenerateOptions) (*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) GenerateMany(ctx context.Context, sharedPrefix string, suffixes []string, opts GenerateOptions) ([]*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) BeamSearch(ctx context.Context, prompt string, opts BeamSearchOptions) (*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Score(prompt, continuation string) (float64, error) {
+	return 0, ErrNotBuilt
+}
+
+func (c *Context) ScoreMany(prompt string, continuations []string) ([]float64, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Classify(texts, labels []string) ([][]float64, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) ClassifyWithOptions(texts, labels []string, opts ClassifyOptions) ([][]float64, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) EvalAll(tokens []Token) error { return ErrNotBuilt }
+
+func (c *Context) Logits(i int) []float32 { return nil }
+
+func (c *Context) Embed(text string, opts EmbedOptions) ([]float32, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) EmbedMany(texts []string, opts EmbedOptions) ([][]float32, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Encode(input string) error { return ErrNotBuilt }
+
+func (c *Context) ScoreEncoded(targets []string) ([]float64, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) GenerateEncoded(ctx context.Context, opts GenerateOptions) (*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Rerank(query string, documents []string) ([]float32, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) EmbedInt8(text string, opts EmbedOptions) (*Int8Embedding, error) {
+	return nil, ErrNotBuilt
+}
+
+func (c *Context) Prefill(prompt string) error { return ErrNotBuilt }
+
+func (c *Context) SavePromptCache(path string) error { return ErrNotBuilt }
+
+func (c *Context) LoadPromptCache(path string) error { return ErrNotBuilt }
+
+func (c *Context) Fork() (*Context, error) { return nil, ErrNotBuilt }
+
+func (c *Context) DefragKVCache() error { return ErrNotBuilt }
+
+func (c *Context) Decode(b *Batch) (DecodeStatus, error) { return DecodeError, ErrNotBuilt }
+func (c *Context) CancelSequence(seq int) error          { return ErrNotBuilt }
+
+// Batch is a set of tokens evaluated together by Context.Decode
+type Batch struct{}
+
+// NewBatch returns an empty batch that can't be decoded
+func NewBatch(capacity, sequences int) *Batch { return &Batch{} }
+
+func (b *Batch) Add(token Token, pos int, logits bool, seqs ...int) error { return ErrNotBuilt }
+func (b *Batch) Len() int                                                 { return 0 }
+func (b *Batch) Clear()                                                   {}
+func (b *Batch) Free()                                                    {}
+
+// Session is a conversation with a model. Without llama.cpp none can be
+// started.
+type Session struct{}
+
+// NewSession returns ErrNotBuilt
+func NewSession(ctx *Context, opts SessionOptions) (*Session, error) {
+	return nil, ErrNotBuilt
+}
+
+func (s *Session) Messages() []ChatMessage { return nil }
+func (s *Session) Tokens() int             { return 0 }
+func (s *Session) Reset()                  {}
+
+func (s *Session) Send(userMsg string) (string, error) { return "", ErrNotBuilt }
+
+func (s *Session) SendContext(ctx context.Context, userMsg string) (*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+// NewSummarizer returns a Summarizer failing with ErrNotBuilt
+func NewSummarizer(ctx *Context, opts GenerateOptions) Summarizer {
+	return SummarizerFunc(func(context.Context, string, []ChatMessage) (string, error) {
+		return "", ErrNotBuilt
+	})
+}
+
+// Scheduler runs generations with continuous batching. Without llama.cpp
+// none can be started.
+type Scheduler struct{}
+
+// NewScheduler returns ErrNotBuilt
+func NewScheduler(c *Context) (*Scheduler, error) {
+	return nil, ErrNotBuilt
+}
+
+// NewSchedulerWithOptions returns ErrNotBuilt
+func NewSchedulerWithOptions(c *Context, opts SchedulerOptions) (*Scheduler, error) {
+	return nil, ErrNotBuilt
+}
+
+func (s *Scheduler) Close()                           {}
+func (s *Scheduler) Slots() int                       { return 0 }
+func (s *Scheduler) SlotSize() int                    { return 0 }
+func (s *Scheduler) Active() int                      { return 0 }
+func (s *Scheduler) Queued() int                      { return 0 }
+func (s *Scheduler) Do(fn func(*Context) error) error { return ErrNotBuilt }
+
+func (s *Scheduler) Generate(ctx context.Context, prompt string, opts GenerateOptions) (*GenerateResult, error) {
+	return nil, ErrNotBuilt
+}
+
+// ComputeImatrix returns ErrNotBuilt
+func ComputeImatrix(ctx context.Context, model *Model, text string, opts ImatrixOptions) (*Imatrix, error) {
+	return nil, ErrNotBuilt
+}
+
+// Quantize returns ErrNotBuilt
+func Quantize(input, output string, params QuantizeParams) error {
+	return ErrNotBuilt
+}
+
+// Threadpool is a pool of inference threads shared by contexts
+type Threadpool struct{}
+
+// NewThreadpool returns ErrNotBuilt
+func NewThreadpool(threads int, p *CPUParams) (*Threadpool, error) {
+	return nil, ErrNotBuilt
+}
+
+func (p *Threadpool) Threads() int { return 0 }
+
+func (p *Threadpool) Free() {}
+
+func (m *Model) SlidingWindow() int { return 0 }
+
+func (c *Context) SetEmbeddings(on bool) {}
+
+func (c *Context) SequenceEmbeddings(seqs []int, opts EmbedOptions) (*EmbeddingMatrix, error) {
+	return nil, ErrNotBuilt
+}
@@ -0,0 +1,152 @@
+package bindings
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// defaultOffloadReserve is the GPU memory PlanOffload leaves for compute
+// buffers without OffloadOptions.Reserve
+const defaultOffloadReserve = 512 << 20
+
+// autoOffloadContext is the context size GPULayersAuto plans the KV cache for
+const autoOffloadContext = 4096
+
+// OffloadOptions configures PlanOffload
+type OffloadOptions struct {
+	// ContextSize is the number of tokens of KV cache, summed over the
+	// contexts that will be created, kept next to the offloaded layers
+	ContextSize int
+
+	// FreeMemory is the GPU memory to plan for in bytes, 0 for what the
+	// GPUs have free now
+	FreeMemory int64
+
+	// Reserve is left for llama.cpp's compute buffers, which grow with the
+	// batch size, 0 for 512 MiB
+	Reserve int64
+}
+
+// OffloadPlan is how much of a model fits in GPU memory
+type OffloadPlan struct {
+	// Layers is the ModelParams.GPULayers to load the model with: the
+	// last Layers blocks are offloaded, and the output layer too when
+	// Layers is Total. It is GPULayersNone when nothing fits.
+	Layers int
+	Total  int // blocks of the model plus the output layer
+
+	LayerBytes  []int64 // weights and KV cache of each block as offloaded
+	OutputBytes int64   // weights of the output layer
+	GPUBytes    int64   // taken by the offloaded layers
+	FreeMemory  int64   // planned for, before the reserve
+}
+
+// PlanOffload computes how many layers of the model at path fit in the
+// free memory of the GPUs, from the sizes of its tensors in the file. It
+// is an estimate: compute buffers are only accounted for by the reserve.
+func PlanOffload(path string, opts OffloadOptions) (*OffloadPlan, error) {
+	f, err := gguf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	free := opts.FreeMemory
+	if free == 0 {
+		free, _ = GPUMemory()
+	}
+	if free <= 0 {
+		return nil, errors.New("no GPU memory to offload to")
+	}
+	reserve := opts.Reserve
+	if reserve == 0 {
+		reserve = defaultOffloadReserve
+	}
+
+	arch, _ := f.String("general.architecture")
+	blocks := metaUint(f, arch+".block_count")
+	if blocks == 0 {
+		return nil, fmt.Errorf("%s: no %s.block_count", path, arch)
+	}
+	plan := &OffloadPlan{Total: blocks + 1, LayerBytes: make([]int64, blocks), FreeMemory: free}
+
+	// Tied embeddings reuse the input embeddings as the output layer, of
+	// which a copy is offloaded
+	var embeddings int64
+	tied := true
+	for _, t := range f.Tensors {
+		size, err := t.Size()
+		if err != nil {
+			return nil, err
+		}
+		name := t.Name
+		switch {
+		case strings.HasPrefix(name, "blk."):
+			i, err := strconv.Atoi(strings.SplitN(name, ".", 3)[1])
+			if err != nil || i < 0 || i >= blocks {
+				return nil, fmt.Errorf("%s: tensor %q outside the %d blocks", path, name, blocks)
+			}
+			plan.LayerBytes[i] += int64(size)
+		case name == "token_embd.weight":
+			embeddings = int64(size)
+		case strings.HasPrefix(name, "output"):
+			plan.OutputBytes += int64(size)
+			tied = tied && name != "output.weight"
+		}
+	}
+	if tied {
+		plan.OutputBytes += embeddings
+	}
+
+	// Keys and values are cached in F16
+	kv := int64(max(opts.ContextSize, 0)) * int64(kvWidth(f, arch)) * 2 * 2
+	for i := range plan.LayerBytes {
+		plan.LayerBytes[i] += kv
+	}
+
+	// llama.cpp offloads the last blocks first
+	budget := free - reserve
+	for i := blocks - 1; i >= 0 && plan.GPUBytes+plan.LayerBytes[i] <= budget; i-- {
+		plan.GPUBytes += plan.LayerBytes[i]
+		plan.Layers++
+	}
+	if plan.Layers == blocks && plan.GPUBytes+plan.OutputBytes <= budget {
+		plan.GPUBytes += plan.OutputBytes
+		plan.Layers++
+	}
+	if plan.Layers == 0 {
+		plan.Layers = GPULayersNone
+	}
+	return plan, nil
+}
+
+// kvWidth returns the number of keys and values cached per token and block
+func kvWidth(f *gguf.File, arch string) int {
+	embd := metaUint(f, arch+".embedding_length")
+	heads := metaUint(f, arch+".attention.head_count")
+	headsKV := metaUint(f, arch+".attention.head_count_kv")
+	if headsKV == 0 {
+		headsKV = heads
+	}
+	keys := metaUint(f, arch+".attention.key_length")
+	if keys == 0 && heads > 0 {
+		keys = embd / heads
+	}
+	return headsKV * keys
+}
+
+// metaUint returns an unsigned metadata value, the largest entry of an
+// array such as the per-layer head counts of some models
+func metaUint(f *gguf.File, key string) int {
+	v, _ := f.Get(key)
+	best := 0
+	for _, n := range asInts([]any{v}) {
+		best = max(best, int(n))
+	}
+	for _, n := range asInts(v) {
+		best = max(best, int(n))
+	}
+	return best
+}
@@ -0,0 +1,129 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"crypto/sha256"
+	"slices"
+	"unsafe"
+)
+
+// promptCacheMin is the fewest tokens worth keeping in or restoring from a
+// prompt cache; shorter prefixes are quicker to evaluate again
+const promptCacheMin = 64
+
+// promptCache keeps the KV cache of sequences whose slot was taken over by
+// another prompt, so that a later prompt sharing their prefix, such as the
+// next turn of the conversation, skips evaluating it in whichever slot it
+// lands. Entries are keyed by a hash of their tokens and the least recently
+// used go first once the cache holds more than max bytes.
+type promptCache struct {
+	max     int64
+	size    int64
+	entries []*cachedPrompt // most recently used last
+}
+
+type cachedPrompt struct {
+	key    [sha256.Size]byte
+	tokens []Token
+	state  []byte
+}
+
+func tokensKey(tokens []Token) [sha256.Size]byte {
+	return sha256.Sum256(unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(tokens))), len(tokens)*int(unsafe.Sizeof(Token(0)))))
+}
+
+// lookup returns the entry sharing the longest prefix with tokens, if it
+// shares more than have tokens by a margin worth restoring. With a
+// recurrent model only an entry that is a whole prefix of tokens can be
+// used, since the state can't be rolled back.
+func (pc *promptCache) lookup(tokens []Token, have int, recurrent bool) *cachedPrompt {
+	var best *cachedPrompt
+	bestN := have + promptCacheMin
+	for _, e := range pc.entries {
+		n := commonPrefix(e.tokens, tokens)
+		if recurrent && n < len(e.tokens) {
+			continue
+		}
+		if n >= bestN {
+			best, bestN = e, n
+		}
+	}
+	if best != nil {
+		pc.touch(best)
+	}
+	return best
+}
+
+// put adds the state of a sequence holding tokens. Entries that are a
+// prefix of it are dropped, it serves the same prompts.
+func (pc *promptCache) put(tokens []Token, state []byte) {
+	if int64(len(state)) > pc.max {
+		return
+	}
+	key := tokensKey(tokens)
+	pc.entries = slices.DeleteFunc(pc.entries, func(e *cachedPrompt) bool {
+		if e.key == key || commonPrefix(e.tokens, tokens) == len(e.tokens) {
+			pc.size -= int64(len(e.state))
+			return true
+		}
+		return false
+	})
+	pc.entries = append(pc.entries, &cachedPrompt{key: key, tokens: slices.Clone(tokens), state: state})
+	pc.size += int64(len(state))
+	for pc.size > pc.max {
+		pc.size -= int64(len(pc.entries[0].state))
+		pc.entries = pc.entries[1:]
+	}
+}
+
+// has reports whether the cache holds tokens, marking the entry used
+func (pc *promptCache) has(tokens []Token) bool {
+	key := tokensKey(tokens)
+	for _, e := range pc.entries {
+		if e.key == key {
+			pc.touch(e)
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *promptCache) touch(e *cachedPrompt) {
+	i := slices.Index(pc.entries, e)
+	pc.entries = append(append(pc.entries[:i], pc.entries[i+1:]...), e)
+}
+
+// keep saves the KV cache of a slot into the prompt cache before all but
+// its first n tokens are dropped, if the part lost is worth keeping
+func (s *Scheduler) keep(sl *slot, n int) {
+	if s.cache == nil || len(sl.tokens)-n < promptCacheMin || s.cache.has(sl.tokens) {
+		return
+	}
+	id := C.llama_seq_id(sl.seq)
+	size := C.llama_state_seq_get_size(s.c.ptr, id)
+	if size == 0 || int64(size) > s.cache.max {
+		return
+	}
+	buf := make([]byte, size)
+	if n := C.llama_state_seq_get_data(s.c.ptr, (*C.uint8_t)(unsafe.Pointer(&buf[0])), size, id); n != 0 {
+		s.cache.put(sl.tokens, buf[:n])
+	}
+}
+
+// restore replaces the KV cache of a slot with a cached prompt. On failure
+// the slot is left empty.
+func (s *Scheduler) restore(sl *slot, e *cachedPrompt) {
+	s.keep(sl, 0)
+	id := C.llama_seq_id(sl.seq)
+	C.llama_memory_seq_rm(C.llama_get_memory(s.c.ptr), id, -1, -1)
+	sl.tokens = nil
+	if C.llama_state_seq_set_data(s.c.ptr, (*C.uint8_t)(unsafe.Pointer(&e.state[0])), C.size_t(len(e.state)), id) == 0 {
+		C.llama_memory_seq_rm(C.llama_get_memory(s.c.ptr), id, -1, -1)
+		return
+	}
+	sl.tokens = slices.Clone(e.tokens)
+}
@@ -0,0 +1,22 @@
+//go:build !nollama
+
+// llama_model_quantize_params.imatrix points to a C++ map, which can't be
+// built from Go. This shim builds it from plain arrays.
+
+#include <string>
+#include <unordered_map>
+#include <vector>
+
+#include "llama.h"
+
+extern "C" uint32_t alpaca_quantize_imatrix(const char * fname_inp, const char * fname_out, llama_model_quantize_params * params,
+                                            const char ** names, const float ** values, const int64_t * sizes, size_t n) {
+    std::unordered_map<std::string, std::vector<float>> imatrix;
+    for (size_t i = 0; i < n; i++) {
+        imatrix.emplace(names[i], std::vector<float>(values[i], values[i] + sizes[i]));
+    }
+    params->imatrix = &imatrix;
+    uint32_t rc = llama_model_quantize(fname_inp, fname_out, params);
+    params->imatrix = nullptr;
+    return rc;
+}
@@ -0,0 +1,99 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+//
+// uint32_t alpaca_quantize_imatrix(const char * fname_inp, const char * fname_out, llama_model_quantize_params * params,
+//                                  const char ** names, const float ** values, const int64_t * sizes, size_t n);
+import "C"
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Quantize writes a quantized copy of the GGUF model at input to output
+func Quantize(input, output string, params QuantizeParams) error {
+	acquireBackend()
+	defer releaseBackend()
+	if tracing() {
+		defer trace("llama_model_quantize", time.Now(), slog.String("input", input), slog.String("output", output), slog.String("type", params.FileType.String()))
+	}
+
+	cInput := C.CString(input)
+	defer C.free(unsafe.Pointer(cInput))
+	cOutput := C.CString(output)
+	defer C.free(unsafe.Pointer(cOutput))
+
+	cParams := C.llama_model_quantize_default_params()
+	cParams.ftype = C.enum_llama_ftype(params.FileType)
+	cParams.nthread = C.int32_t(params.Threads)
+	cParams.allow_requantize = C.bool(params.AllowRequantize)
+	cParams.quantize_output_tensor = C.bool(!params.KeepOutputTensor)
+	cParams.pure = C.bool(params.Pure)
+	if t := params.OutputType; t != nil {
+		cParams.output_tensor_type = C.enum_ggml_type(*t)
+	}
+	if t := params.TokenEmbeddingType; t != nil {
+		cParams.token_embedding_type = C.enum_ggml_type(*t)
+	}
+
+	imatrix := params.Imatrix
+	if imatrix == nil && params.ImatrixPath != "" {
+		var err error
+		if imatrix, err = LoadImatrix(params.ImatrixPath); err != nil {
+			return err
+		}
+	}
+
+	var rc C.uint32_t
+	if imatrix == nil || len(imatrix.Entries) == 0 {
+		rc = C.llama_model_quantize(cInput, cOutput, &cParams)
+	} else {
+		rc = quantizeWithImatrix(cInput, cOutput, &cParams, imatrix)
+	}
+	if rc != 0 {
+		return fmt.Errorf("failed to quantize model (code %d)", int(rc))
+	}
+	return nil
+}
+
+// quantizeWithImatrix copies the importance matrix to C memory for the C++
+// shim, which builds the std::unordered_map llama.cpp expects
+func quantizeWithImatrix(input, output *C.char, params *C.llama_model_quantize_params, imatrix *Imatrix) C.uint32_t {
+	names := make([]string, 0, len(imatrix.Entries))
+	for name := range imatrix.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	n := len(names)
+	ptrSize := C.size_t(unsafe.Sizeof(uintptr(0)))
+	cNames := (**C.char)(C.malloc(C.size_t(n) * ptrSize))
+	defer C.free(unsafe.Pointer(cNames))
+	cValues := (**C.float)(C.malloc(C.size_t(n) * ptrSize))
+	defer C.free(unsafe.Pointer(cValues))
+	cSizes := (*C.int64_t)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.int64_t(0)))))
+	defer C.free(unsafe.Pointer(cSizes))
+
+	nameSlice := unsafe.Slice(cNames, n)
+	valueSlice := unsafe.Slice(cValues, n)
+	sizeSlice := unsafe.Slice(cSizes, n)
+	for i, name := range names {
+		values := imatrix.Entries[name]
+		nameSlice[i] = C.CString(name)
+		defer C.free(unsafe.Pointer(nameSlice[i]))
+
+		valueSlice[i] = (*C.float)(C.malloc(C.size_t(max(len(values), 1)) * C.size_t(unsafe.Sizeof(C.float(0)))))
+		defer C.free(unsafe.Pointer(valueSlice[i]))
+		copy(unsafe.Slice((*float32)(unsafe.Pointer(valueSlice[i])), len(values)), values)
+		sizeSlice[i] = C.int64_t(len(values))
+	}
+
+	return C.alpaca_quantize_imatrix(input, output, params, cNames, cValues, cSizes, C.size_t(n))
+}
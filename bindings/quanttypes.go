@@ -0,0 +1,122 @@
+package bindings
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QuantTypeInfo describes a FileType Quantize can produce
+type QuantTypeInfo struct {
+	Type FileType
+	Name string // as llama-quantize spells it, e.g. "Q4_K_M"
+
+	// BitsPerWeight is the nominal size of the type most tensors get.
+	// Mixes such as Q4_K_M keep some tensors at a higher precision, so whole
+	// files come out slightly larger.
+	BitsPerWeight float32
+
+	// Description is llama-quantize's note on the type: the size and
+	// perplexity increase it measured, or how the type quantizes
+	Description string
+
+	// Recommended marks the types llama-quantize suggests as a good balance
+	// of size and quality
+	Recommended bool
+
+	// NeedsImatrix is set for types that give unusable models without an
+	// importance matrix
+	NeedsImatrix bool
+}
+
+// quantTypes follows the list of llama-quantize in the pinned llama.cpp
+// release, in the same order
+var quantTypes = []QuantTypeInfo{
+	{Type: FileTypeQ4_0, Name: "Q4_0", BitsPerWeight: 4.5, Description: "4.34G, +0.4685 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ4_1, Name: "Q4_1", BitsPerWeight: 5, Description: "4.78G, +0.4511 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ5_0, Name: "Q5_0", BitsPerWeight: 5.5, Description: "5.21G, +0.1316 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ5_1, Name: "Q5_1", BitsPerWeight: 6, Description: "5.65G, +0.1062 ppl @ Llama-3-8B"},
+	{Type: FileTypeIQ2_XXS, Name: "IQ2_XXS", BitsPerWeight: 2.06, Description: "2.06 bpw quantization", NeedsImatrix: true},
+	{Type: FileTypeIQ2_XS, Name: "IQ2_XS", BitsPerWeight: 2.31, Description: "2.31 bpw quantization", NeedsImatrix: true},
+	{Type: FileTypeIQ2_S, Name: "IQ2_S", BitsPerWeight: 2.5, Description: "2.5 bpw quantization", NeedsImatrix: true},
+	{Type: FileTypeIQ2_M, Name: "IQ2_M", BitsPerWeight: 2.7, Description: "2.7 bpw quantization"},
+	{Type: FileTypeIQ1_S, Name: "IQ1_S", BitsPerWeight: 1.56, Description: "1.56 bpw quantization", NeedsImatrix: true},
+	{Type: FileTypeIQ1_M, Name: "IQ1_M", BitsPerWeight: 1.75, Description: "1.75 bpw quantization", NeedsImatrix: true},
+	{Type: FileTypeTQ1_0, Name: "TQ1_0", BitsPerWeight: 1.69, Description: "1.69 bpw ternarization"},
+	{Type: FileTypeTQ2_0, Name: "TQ2_0", BitsPerWeight: 2.06, Description: "2.06 bpw ternarization"},
+	{Type: FileTypeQ2_K, Name: "Q2_K", BitsPerWeight: 2.63, Description: "2.96G, +3.5199 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ2_K_S, Name: "Q2_K_S", BitsPerWeight: 2.63, Description: "2.96G, +3.1836 ppl @ Llama-3-8B", NeedsImatrix: true},
+	{Type: FileTypeIQ3_XXS, Name: "IQ3_XXS", BitsPerWeight: 3.06, Description: "3.06 bpw quantization"},
+	{Type: FileTypeIQ3_S, Name: "IQ3_S", BitsPerWeight: 3.44, Description: "3.44 bpw quantization"},
+	{Type: FileTypeIQ3_M, Name: "IQ3_M", BitsPerWeight: 3.66, Description: "3.66 bpw quantization mix"},
+	{Type: FileTypeQ3_K_S, Name: "Q3_K_S", BitsPerWeight: 3.44, Description: "3.41G, +1.6321 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ3_K_M, Name: "Q3_K_M", BitsPerWeight: 3.44, Description: "3.74G, +0.6569 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ3_K_L, Name: "Q3_K_L", BitsPerWeight: 3.44, Description: "4.03G, +0.5562 ppl @ Llama-3-8B"},
+	{Type: FileTypeIQ3_XS, Name: "IQ3_XS", BitsPerWeight: 3.3, Description: "3.3 bpw quantization"},
+	{Type: FileTypeIQ4_NL, Name: "IQ4_NL", BitsPerWeight: 4.5, Description: "4.50 bpw non-linear quantization"},
+	{Type: FileTypeIQ4_XS, Name: "IQ4_XS", BitsPerWeight: 4.25, Description: "4.25 bpw non-linear quantization"},
+	{Type: FileTypeQ4_K_S, Name: "Q4_K_S", BitsPerWeight: 4.5, Description: "4.37G, +0.2689 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ4_K_M, Name: "Q4_K_M", BitsPerWeight: 4.5, Description: "4.58G, +0.1754 ppl @ Llama-3-8B", Recommended: true},
+	{Type: FileTypeQ5_K_S, Name: "Q5_K_S", BitsPerWeight: 5.5, Description: "5.21G, +0.1049 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ5_K_M, Name: "Q5_K_M", BitsPerWeight: 5.5, Description: "5.33G, +0.0569 ppl @ Llama-3-8B", Recommended: true},
+	{Type: FileTypeQ6_K, Name: "Q6_K", BitsPerWeight: 6.56, Description: "6.14G, +0.0217 ppl @ Llama-3-8B"},
+	{Type: FileTypeQ8_0, Name: "Q8_0", BitsPerWeight: 8.5, Description: "7.96G, +0.0026 ppl @ Llama-3-8B"},
+	{Type: FileTypeF16, Name: "F16", BitsPerWeight: 16, Description: "14.00G, +0.0020 ppl @ Mistral-7B"},
+	{Type: FileTypeBF16, Name: "BF16", BitsPerWeight: 16, Description: "14.00G, -0.0050 ppl @ Mistral-7B"},
+	{Type: FileTypeF32, Name: "F32", BitsPerWeight: 32, Description: "26.00G @ 7B"},
+}
+
+// QuantTypes returns the file types Quantize supports, in the order
+// llama-quantize lists them
+func QuantTypes() []QuantTypeInfo {
+	return append([]QuantTypeInfo(nil), quantTypes...)
+}
+
+// String returns the name of the file type, e.g. "Q4_K_M"
+func (t FileType) String() string {
+	for _, info := range quantTypes {
+		if info.Type == t {
+			return info.Name
+		}
+	}
+	return fmt.Sprintf("FileType(%d)", int(t))
+}
+
+// ParseFileType returns the file type with the given name, ignoring case
+func ParseFileType(name string) (FileType, error) {
+	for _, info := range quantTypes {
+		if strings.EqualFold(info.Name, name) {
+			return info.Type, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quantization type %q", name)
+}
+
+// tensorTypeNames are the names ggml gives the tensor types
+var tensorTypeNames = map[TensorType]string{
+	TensorTypeF32: "f32", TensorTypeF16: "f16", TensorTypeBF16: "bf16",
+	TensorTypeQ4_0: "q4_0", TensorTypeQ4_1: "q4_1", TensorTypeQ5_0: "q5_0", TensorTypeQ5_1: "q5_1", TensorTypeQ8_0: "q8_0",
+	TensorTypeQ2_K: "q2_K", TensorTypeQ3_K: "q3_K", TensorTypeQ4_K: "q4_K", TensorTypeQ5_K: "q5_K", TensorTypeQ6_K: "q6_K",
+	TensorTypeIQ2_XXS: "iq2_xxs", TensorTypeIQ2_XS: "iq2_xs", TensorTypeIQ2_S: "iq2_s",
+	TensorTypeIQ3_XXS: "iq3_xxs", TensorTypeIQ3_S: "iq3_s",
+	TensorTypeIQ1_S: "iq1_s", TensorTypeIQ1_M: "iq1_m", TensorTypeIQ4_NL: "iq4_nl", TensorTypeIQ4_XS: "iq4_xs",
+	TensorTypeTQ1_0: "tq1_0", TensorTypeTQ2_0: "tq2_0", TensorTypeMXFP4: "mxfp4",
+}
+
+// String returns ggml's name of the tensor type, e.g. "q6_K"
+func (t TensorType) String() string {
+	if name, ok := tensorTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TensorType(%d)", int(t))
+}
+
+// ParseTensorType returns the tensor type with the given name, ignoring
+// case, as llama-quantize's --output-tensor-type accepts it
+func ParseTensorType(name string) (TensorType, error) {
+	for t, n := range tensorTypeNames {
+		if strings.EqualFold(n, name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tensor type %q", name)
+}
@@ -0,0 +1,144 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Recurrent models keep no per-token cache: a sequence can only be
+// extended, or copied whole at its final position
+
+func TestRecurrentGenerateMany(t *testing.T) {
+	m := recurrentModel(t)
+	suffixes := []string{" girl", " dog", " boy"}
+	c := testContext(t, m, ContextParams{ContextSize: 256, Sequences: len(suffixes)})
+	results, err := c.GenerateMany(context.Background(), testPrompt, suffixes, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(suffixes) {
+		t.Fatalf("%d results for %d suffixes", len(results), len(suffixes))
+	}
+
+	// Every sequence continues from the shared state as a prompt of its own
+	// would
+	single := testContext(t, m, ContextParams{ContextSize: 256})
+	for i, suffix := range suffixes {
+		want, err := single.Generate(context.Background(), testPrompt+suffix, greedy(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[i].Text != want.Text {
+			t.Errorf("suffix %q continued with %q together and %q alone", suffix, results[i].Text, want.Text)
+		}
+	}
+}
+
+func TestRecurrentScoreMany(t *testing.T) {
+	m := recurrentModel(t)
+	continuations := []string{" girl", " dog named Max", " boy who liked to play"}
+
+	single := testContext(t, m, ContextParams{ContextSize: 256})
+	shared := testContext(t, m, ContextParams{ContextSize: 256, Sequences: len(continuations)})
+	scores, err := shared.ScoreMany(testPrompt, continuations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != len(continuations) {
+		t.Fatalf("%d scores for %d continuations", len(scores), len(continuations))
+	}
+	for i, cont := range continuations {
+		want, err := single.Score(testPrompt, cont)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scores[i] >= 0 || math.Abs(scores[i]-want) > 1e-3 {
+			t.Errorf("%q scores %v together and %v alone", cont, scores[i], want)
+		}
+	}
+}
+
+// TestRecurrentCacheReuse checks that a prompt extending the cached state
+// reuses it, and that one diverging from it, which would need part of the
+// state removed, clears the cache and is evaluated from the start
+func TestRecurrentCacheReuse(t *testing.T) {
+	m := recurrentModel(t)
+	c := testContext(t, m, ContextParams{ContextSize: 256})
+	fresh := testContext(t, m, ContextParams{ContextSize: 256})
+
+	if err := c.Prefill(testPrompt); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Generate(context.Background(), testPrompt+" girl", greedy(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CachedTokens == 0 {
+		t.Error("the prompt extending the cached one was evaluated again")
+	}
+
+	// The cache now holds the generated tokens too, which this prompt
+	// doesn't continue
+	diverging := testPrompt + " dog"
+	res, err = c.Generate(context.Background(), diverging, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CachedTokens != 0 {
+		t.Errorf("reused %d tokens of a state that can't be cut", res.CachedTokens)
+	}
+	want, err := fresh.Generate(context.Background(), diverging, greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != want.Text {
+		t.Errorf("continued with %q after clearing the cache, %q in a fresh context", res.Text, want.Text)
+	}
+}
+
+// TestRecurrentPromptCache checks that a saved recurrent state restores to
+// the same continuation as evaluating the prompt
+func TestRecurrentPromptCache(t *testing.T) {
+	m := recurrentModel(t)
+	params := ContextParams{ContextSize: 256}
+	c := testContext(t, m, params)
+	if err := c.Prefill(testPrompt); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "prompt.state")
+	if err := c.SavePromptCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored context held another state, which the file replaces
+	restored := testContext(t, m, params)
+	if err := restored.Prefill("Once upon a time there was a dog"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadPromptCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(restored.tokens, c.tokens) {
+		t.Fatalf("restored %d tokens, saved %d", len(restored.tokens), len(c.tokens))
+	}
+	res, err := restored.Generate(context.Background(), testPrompt+" girl", greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CachedTokens == 0 {
+		t.Error("the restored prompt was evaluated again")
+	}
+	fresh := testContext(t, m, params)
+	want, err := fresh.Generate(context.Background(), testPrompt+" girl", greedy(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != want.Text {
+		t.Errorf("continued with %q from the restored state, %q from the prompt", res.Text, want.Text)
+	}
+}
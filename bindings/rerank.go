@@ -0,0 +1,86 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// Rerank scores how relevant each document is to query with a reranking
+// (cross-encoder) model such as bge-reranker, higher being more relevant.
+// Scores are the model's raw logits, so they compare between documents but
+// aren't probabilities. Pairs are evaluated together like EmbedMany's texts,
+// and the KV cache is cleared.
+func (c *Context) Rerank(query string, documents []string) ([]float32, error) {
+	if C.llama_pooling_type(c.ptr) != C.LLAMA_POOLING_TYPE_RANK {
+		return nil, ErrNotReranker
+	}
+
+	limit := min(c.batch.capacity, int(C.llama_n_ubatch(c.ptr)))
+	tokenized := make([][]Token, len(documents))
+	for i, doc := range documents {
+		tokens, err := c.model.rerankTokens(query, doc)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) > limit {
+			return nil, fmt.Errorf("document %d: %w", i, ErrPromptTooLong)
+		}
+		tokenized[i] = tokens
+	}
+
+	if tracing() {
+		defer trace("rerank", time.Now(), slog.Int("documents", len(documents)))
+	}
+	scores := make([]float32, len(documents))
+	err := c.evalPooled(tokenized, 1, func(i int, raw []float32) {
+		scores[i] = raw[0]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
+
+// rerankTokens returns the input of a reranker for a query and document: the
+// model's "rerank" template when it has one, and otherwise the pair
+// separated by special tokens as the model was trained with,
+// [BOS] query [EOS] [SEP] document [EOS]
+func (m *Model) rerankTokens(query, doc string) ([]Token, error) {
+	cName := C.CString("rerank")
+	defer C.free(unsafe.Pointer(cName))
+	if tmpl := C.llama_model_chat_template(m.ptr, cName); tmpl != nil {
+		prompt := strings.NewReplacer("{query}", query, "{document}", doc).Replace(C.GoString(tmpl))
+		return m.Tokenize(prompt, true, true)
+	}
+
+	q, err := m.Tokenize(query, false, false)
+	if err != nil {
+		return nil, err
+	}
+	d, err := m.Tokenize(doc, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	push := func(t C.llama_token) {
+		if t != C.LLAMA_TOKEN_NULL {
+			tokens = append(tokens, Token(t))
+		}
+	}
+	push(C.llama_vocab_bos(m.vocab))
+	tokens = append(tokens, q...)
+	push(C.llama_vocab_eos(m.vocab))
+	push(C.llama_vocab_sep(m.vocab))
+	tokens = append(tokens, d...)
+	push(C.llama_vocab_eos(m.vocab))
+	return tokens, nil
+}
@@ -0,0 +1,93 @@
+package bindings
+
+import "fmt"
+
+// RopeScaling is how rotary position embeddings are stretched to run a
+// model past the context length it was trained with
+type RopeScaling int
+
+const (
+	// RopeScalingAuto stretches embeddings only when the context is longer
+	// than the training context and the model doesn't declare scaling of
+	// its own: linearly up to twice the length, with YaRN beyond that
+	RopeScalingAuto RopeScaling = iota
+	// RopeScalingModel leaves scaling to the model's metadata, as
+	// llama.cpp does by default
+	RopeScalingModel
+	// RopeScalingNone turns scaling off
+	RopeScalingNone
+	// RopeScalingLinear divides positions by the extension factor, which
+	// holds up for modest extensions
+	RopeScalingLinear
+	// RopeScalingYaRN interpolates the frequencies unevenly, keeping the
+	// high ones that encode local order, which degrades less at large
+	// factors
+	RopeScalingYaRN
+)
+
+func (s RopeScaling) String() string {
+	switch s {
+	case RopeScalingAuto:
+		return "auto"
+	case RopeScalingModel:
+		return "model"
+	case RopeScalingNone:
+		return "none"
+	case RopeScalingLinear:
+		return "linear"
+	case RopeScalingYaRN:
+		return "yarn"
+	}
+	return fmt.Sprintf("RopeScaling(%d)", int(s))
+}
+
+// ParseRopeScaling returns the scaling with the given name, as String
+// prints it
+func ParseRopeScaling(name string) (RopeScaling, error) {
+	for s := RopeScalingAuto; s <= RopeScalingYaRN; s++ {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rope scaling %q", name)
+}
+
+// RopeConfig is the rope scaling a context is created with
+type RopeConfig struct {
+	// Scaling is RopeScalingModel, RopeScalingNone, RopeScalingLinear or
+	// RopeScalingYaRN; Auto is resolved to one of them
+	Scaling RopeScaling
+
+	// FreqScale is rope_freq_scale, the inverse of the extension factor;
+	// 0 keeps the model's
+	FreqScale float32
+
+	// OrigContext is yarn_orig_ctx, the training context YaRN stretches
+	OrigContext int
+}
+
+// ropeFor resolves scaling for a context of nCtx tokens on a model trained
+// with nCtxTrain. declared is set when the model's metadata asks for scaling
+// itself, which Auto then defers to.
+func ropeFor(scaling RopeScaling, nCtx, nCtxTrain int, declared bool) RopeConfig {
+	extended := nCtxTrain > 0 && nCtx > nCtxTrain
+	if scaling == RopeScalingAuto {
+		switch {
+		case !extended || declared:
+			scaling = RopeScalingModel
+		case nCtx <= 2*nCtxTrain:
+			scaling = RopeScalingLinear
+		default:
+			scaling = RopeScalingYaRN
+		}
+	}
+
+	cfg := RopeConfig{Scaling: scaling}
+	if (scaling == RopeScalingLinear || scaling == RopeScalingYaRN) && extended {
+		cfg.FreqScale = float32(nCtxTrain) / float32(nCtx)
+	}
+	if scaling == RopeScalingYaRN {
+		cfg.OrigContext = nCtxTrain
+	}
+	return cfg
+}
@@ -0,0 +1,268 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+	"unsafe"
+
+	"github.com/matthiase/alpaca/grammar"
+)
+
+// sampler wraps a llama.cpp sampler chain
+type sampler struct {
+	ptr  *C.struct_llama_sampler
+	cur  *C.llama_token_data // candidate buffer for sampleLogits
+	n    int
+	size int // candidates the chain left in cur at the last pick
+	seed uint32
+
+	tally *samplerTally // nil unless GenerateOptions.SamplerStats is set
+}
+
+// samplerTally accumulates the SamplerStats of a generation
+type samplerTally struct {
+	stats      SamplerStats
+	entropy    float64
+	candidates int
+}
+
+func newSampler(m *Model, params SamplingParams) (*sampler, error) {
+	gbnf := params.Grammar
+	if params.Regex != "" {
+		if gbnf != "" {
+			return nil, errors.New("grammar and regex are mutually exclusive")
+		}
+		var err error
+		if gbnf, err = grammar.FromRegex(params.Regex); err != nil {
+			return nil, err
+		}
+	}
+
+	if gbnf != "" {
+		// llama.cpp only logs what is wrong with a grammar
+		if _, err := grammar.Compile(gbnf); err != nil {
+			return nil, err
+		}
+	}
+	if gbnf == "" && (len(params.GrammarTriggers) > 0 || len(params.GrammarTriggerTokens) > 0) {
+		return nil, errors.New("grammar triggers need a grammar")
+	}
+
+	for token := range params.LogitBias {
+		if token < 0 || int(token) >= m.VocabSize() {
+			return nil, fmt.Errorf("logit bias for token %d outside the vocabulary", token)
+		}
+	}
+
+	chain := C.llama_sampler_chain_init(C.llama_sampler_chain_default_params())
+
+	if gbnf != "" {
+		cGrammar := C.CString(gbnf)
+		defer C.free(unsafe.Pointer(cGrammar))
+		cRoot := C.CString("root")
+		defer C.free(unsafe.Pointer(cRoot))
+
+		var g *C.struct_llama_sampler
+		if len(params.GrammarTriggers) > 0 || len(params.GrammarTriggerTokens) > 0 {
+			g = lazyGrammar(m, cGrammar, cRoot, params.GrammarTriggers, params.GrammarTriggerTokens)
+		} else {
+			g = C.llama_sampler_init_grammar(m.vocab, cGrammar, cRoot)
+		}
+		if g == nil {
+			C.llama_sampler_free(chain)
+			return nil, errors.New("failed to parse grammar")
+		}
+		C.llama_sampler_chain_add(chain, g)
+	}
+
+	if len(params.LogitBias) > 0 {
+		biases := make([]C.llama_logit_bias, 0, len(params.LogitBias))
+		for token, bias := range params.LogitBias {
+			biases = append(biases, C.llama_logit_bias{token: C.llama_token(token), bias: C.float(bias)})
+		}
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_logit_bias(C.int32_t(m.VocabSize()), C.int32_t(len(biases)), &biases[0]))
+	}
+
+	repeat := params.RepeatPenalty
+	if repeat <= 0 {
+		repeat = 1
+	}
+	if repeat != 1 || params.FrequencyPenalty != 0 || params.PresencePenalty != 0 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_penalties(C.int32_t(params.RepeatLastN), C.float(repeat),
+			C.float(params.FrequencyPenalty), C.float(params.PresencePenalty)))
+	}
+
+	if params.Temperature <= 0 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_greedy())
+		return &sampler{ptr: chain, seed: params.Seed}, nil
+	}
+
+	// Same order as the default chain of llama-cli
+	minKeep := C.size_t(max(params.MinKeep, 0))
+	if params.TopK > 0 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_top_k(C.int32_t(params.TopK)))
+	}
+	if params.TypicalP > 0 && params.TypicalP < 1 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_typical(C.float(params.TypicalP), minKeep))
+	}
+	if params.TopP > 0 && params.TopP < 1 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_top_p(C.float(params.TopP), minKeep))
+	}
+	if params.MinP > 0 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_min_p(C.float(params.MinP), minKeep))
+	}
+	if params.DynTempRange > 0 {
+		exponent := params.DynTempExp
+		if exponent <= 0 {
+			exponent = 1
+		}
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_temp_ext(C.float(params.Temperature), C.float(params.DynTempRange), C.float(exponent)))
+	} else {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_temp(C.float(params.Temperature)))
+	}
+	C.llama_sampler_chain_add(chain, C.llama_sampler_init_dist(C.uint32_t(params.Seed)))
+
+	return &sampler{ptr: chain, seed: params.Seed}, nil
+}
+
+// lazyGrammar returns a grammar sampler that is only enforced once one of
+// the trigger words or tokens is generated
+func lazyGrammar(m *Model, cGrammar, cRoot *C.char, words []string, tokens []Token) *C.struct_llama_sampler {
+	// The grammar applies from the captured trigger on, after any text
+	patterns := make([]*C.char, len(words))
+	for i, word := range words {
+		patterns[i] = C.CString(`[\s\S]*?(` + regexp.QuoteMeta(word) + `)[\s\S]*`)
+		defer C.free(unsafe.Pointer(patterns[i]))
+	}
+	var cPatterns **C.char
+	if len(patterns) > 0 {
+		cPatterns = &patterns[0]
+	}
+	var cTokens *C.llama_token
+	if len(tokens) > 0 {
+		cTokens = (*C.llama_token)(unsafe.Pointer(&tokens[0]))
+	}
+	return C.llama_sampler_init_grammar_lazy_patterns(m.vocab, cGrammar, cRoot, cPatterns, C.size_t(len(patterns)), cTokens, C.size_t(len(tokens)))
+}
+
+// sample picks the next token from the logits of the i-th token of the last
+// batch, -1 for the last one, and accepts it into the chain
+func (s *sampler) sample(c *Context, i int) Token {
+	defer c.enter("llama_sampler_sample", 0)()
+	if tracing() {
+		defer trace("llama_sampler_sample", time.Now())
+	}
+	start := time.Now()
+	var token Token
+	if s.tally != nil {
+		// llama_sampler_sample does the same, but hides the candidates
+		logits := c.logits(i)
+		token = s.pick(logits)
+		s.record(logits, token)
+		s.accept(token)
+	} else {
+		token = Token(C.llama_sampler_sample(s.ptr, c.ptr, C.int32_t(i)))
+	}
+	stats.sample.add(1, time.Since(start))
+	return token
+}
+
+// sampleLogits picks the next token from the given logits rather than the
+// context's and accepts it into the chain
+func (s *sampler) sampleLogits(logits []float32) Token {
+	start := time.Now()
+	token := s.pick(logits)
+	s.record(logits, token)
+	s.accept(token)
+	stats.sample.add(1, time.Since(start))
+	return token
+}
+
+// pick runs the chain over the given logits without accepting the result
+func (s *sampler) pick(logits []float32) Token {
+	if s.cur == nil || s.n < len(logits) {
+		C.free(unsafe.Pointer(s.cur))
+		s.cur = (*C.llama_token_data)(C.malloc(C.size_t(len(logits)) * C.size_t(unsafe.Sizeof(C.llama_token_data{}))))
+		s.n = len(logits)
+	}
+
+	data := unsafe.Slice(s.cur, len(logits))
+	for i, l := range logits {
+		data[i] = C.llama_token_data{id: C.llama_token(i), logit: C.float(l)}
+	}
+	cur := C.llama_token_data_array{data: s.cur, size: C.size_t(len(logits)), selected: -1}
+	C.llama_sampler_apply(s.ptr, &cur)
+	s.size = int(cur.size)
+
+	return Token(data[cur.selected].id)
+}
+
+// record adds token, picked from logits by the last pick, to the tally
+func (s *sampler) record(logits []float32, token Token) {
+	if s.tally == nil {
+		return
+	}
+	candidates := 0
+	for _, d := range unsafe.Slice(s.cur, s.size) {
+		if !math.IsInf(float64(d.logit), -1) {
+			candidates++
+		}
+	}
+	entropy := 0.0
+	for _, l := range logSoftmax(logits) {
+		if !math.IsInf(float64(l), -1) {
+			entropy -= math.Exp(float64(l)) * float64(l)
+		}
+	}
+
+	t := s.tally
+	t.stats.Tokens++
+	t.entropy += entropy
+	t.candidates += candidates
+	t.stats.MaxEntropy = max(t.stats.MaxEntropy, entropy)
+	if candidates == 1 {
+		t.stats.Forced++
+	}
+	if top, _ := argmax(logits); top == token {
+		t.stats.Top++
+	}
+}
+
+// samplerStats returns the stats of what was sampled so far, nil unless
+// they are tallied
+func (s *sampler) samplerStats() *SamplerStats {
+	if s.tally == nil {
+		return nil
+	}
+	out := s.tally.stats
+	if out.Tokens > 0 {
+		out.MeanEntropy = s.tally.entropy / float64(out.Tokens)
+		out.MeanCandidates = float64(s.tally.candidates) / float64(out.Tokens)
+	}
+	return &out
+}
+
+// accept records a token in the chain's history, e.g. for repeat penalties
+func (s *sampler) accept(token Token) {
+	C.llama_sampler_accept(s.ptr, C.llama_token(token))
+}
+
+func (s *sampler) free() {
+	if s.cur != nil {
+		C.free(unsafe.Pointer(s.cur))
+		s.cur = nil
+	}
+	if s.ptr != nil {
+		C.llama_sampler_free(s.ptr)
+		s.ptr = nil
+	}
+}
@@ -0,0 +1,709 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler runs generations from many goroutines on one context with
+// continuous batching: every sequence of the context is a slot, and each
+// decode batch holds the next token of every running generation plus as
+// much of newly arrived prompts as fits. Requests wait in a queue only while
+// all slots are busy, and start at the next token boundary once one frees
+// up. A slot keeps its KV cache after a generation, so a later prompt
+// sharing its prefix, such as the next turn of a conversation, only
+// evaluates the new part; with SchedulerOptions.PromptCacheSize that holds
+// too once the slot was taken over by another prompt.
+//
+// The context must not be used directly while the scheduler runs, except
+// through Do.
+type Scheduler struct {
+	c     *Context
+	opts  SchedulerOptions
+	slots []*slot
+	turn  int  // slot served first in the next step
+	doing bool // a function passed to Do holds the context
+	cache *promptCache
+	warm  []Token // SchedulerOptions.WarmPrompt
+
+	mu        sync.Mutex
+	queue     []*job
+	cancelled []int // sequences to empty before the next step
+	closed    bool
+	wake      chan struct{}
+	stop      chan struct{}
+	exited    chan struct{}
+
+	active atomic.Int32
+}
+
+// job is a generation, or a function passed to Do, waiting for or holding a
+// slot
+type job struct {
+	ctx    context.Context
+	start  time.Time // MaxDuration counts from here
+	tokens []Token
+	opts   GenerateOptions
+	smpl   *sampler
+	result *GenerateResult
+	fn     func(*Context) error
+	err    error
+	done   chan struct{}
+}
+
+// slot is one sequence of the context
+type slot struct {
+	seq     int
+	tokens  []Token // in the KV cache of the sequence
+	pending []Token // still to be decoded
+	logits  int     // batch index of the logits of the last pending token, -1 if not in the batch
+	decoded int     // tokens in the current batch
+	prefill bool    // the prompt is still being evaluated
+	job     *job
+	out     *textStream
+}
+
+// errSchedulerClosed is returned to generations still queued when the
+// scheduler is closed
+var errSchedulerClosed = errors.New("scheduler is closed")
+
+// NewScheduler starts scheduling generations on c, with one slot per
+// sequence of ContextParams.Sequences. The KV cache is cleared first.
+func NewScheduler(c *Context) (*Scheduler, error) {
+	return NewSchedulerWithOptions(c, SchedulerOptions{})
+}
+
+// NewSchedulerWithOptions starts scheduling generations on c with the given
+// options
+func NewSchedulerWithOptions(c *Context, opts SchedulerOptions) (*Scheduler, error) {
+	if c == nil || c.ptr == nil {
+		return nil, errors.New("context is not initialized")
+	}
+	c.clearMemory()
+
+	s := &Scheduler{
+		c:      c,
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	for seq := range int(C.llama_n_seq_max(c.ptr)) {
+		s.slots = append(s.slots, &slot{seq: seq, logits: -1})
+	}
+	if opts.PromptCacheSize > 0 {
+		s.cache = &promptCache{max: opts.PromptCacheSize}
+	}
+	if opts.WarmPrompt != "" && !c.deterministic {
+		if c.model.IsRecurrent() {
+			// A recurrent state can't be cut back to a prefix to copy
+			return nil, errors.New("WarmPrompt needs a model with a KV cache")
+		}
+		warm, err := c.model.TokenizeWithOptions(opts.WarmPrompt, TokenizeOptions{ParseSpecial: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(warm) >= s.SlotSize() {
+			return nil, fmt.Errorf("%w: WarmPrompt has %d tokens, slots hold %d", ErrPromptTooLong, len(warm), s.SlotSize())
+		}
+		s.warm = warm
+	}
+	c.sched.Store(s)
+	go s.run()
+
+	return s, nil
+}
+
+// Close stops the scheduler. Running generations end with FinishCancel and
+// queued ones fail. The context can be used directly again afterwards.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.exited
+	s.c.sched.Store(nil)
+}
+
+// Slots returns the number of generations that can run at once
+func (s *Scheduler) Slots() int {
+	return len(s.slots)
+}
+
+// SlotSize returns the number of tokens a slot can hold, the share of the
+// context of each sequence
+func (s *Scheduler) SlotSize() int {
+	return s.c.Size() / len(s.slots)
+}
+
+// Active returns the number of running generations
+func (s *Scheduler) Active() int {
+	return int(s.active.Load())
+}
+
+// Queued returns the number of generations waiting for a slot
+func (s *Scheduler) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, j := range s.queue {
+		if j.fn == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Generate queues a generation and waits for it, like Context.Generate.
+// Prompts are truncated to SlotSize. OnToken, OnTokenInfo and OnPrefill are
+// called from the scheduler's goroutine and hold up the other generations
+// until they return. Negative prompts, banned phrases and speculative
+// decoding and infinite generation are not supported.
+func (s *Scheduler) Generate(ctx context.Context, prompt string, opts GenerateOptions) (*GenerateResult, error) {
+	start := time.Now()
+	if opts.Speculative != nil || opts.Infinite || len(opts.Banned) > 0 || (opts.NegativePrompt != "" && opts.GuidanceScale > 1) {
+		return nil, errors.New("the scheduler doesn't support guidance, banned phrases, speculative decoding or infinite generation")
+	}
+	if err := s.c.model.checkGenerate(); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.c.model.TokenizeWithOptions(prompt, opts.tokenizeOptions())
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("prompt is empty")
+	}
+	truncated, err := truncateTokens(tokens, s.SlotSize(), opts.KeepTokens, opts.MaxTokens, opts.Truncate)
+	if err != nil {
+		return nil, err
+	}
+
+	smpl, err := s.c.newSampler(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		ctx:    ctx,
+		start:  start,
+		tokens: truncated,
+		opts:   opts,
+		smpl:   smpl,
+		result: &GenerateResult{PromptTokens: len(truncated), TruncatedTokens: len(tokens) - len(truncated)},
+		done:   make(chan struct{}),
+	}
+	if err := s.submit(j); err != nil {
+		smpl.free()
+		return nil, err
+	}
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		if s.remove(j) {
+			smpl.free()
+			j.result.FinishReason = FinishCancel
+		} else {
+			// Already running, it ends at the next token boundary
+			<-j.done
+		}
+	}
+	if j.err != nil {
+		return nil, j.err
+	}
+	if opts.Echo {
+		j.result.Prompt = prompt
+	}
+	return j.result, nil
+}
+
+// Do waits for the running generations to finish and calls fn with the
+// context while no other generation starts, e.g. to compute embeddings. The
+// KV cache is cleared afterwards, since fn may have changed it.
+func (s *Scheduler) Do(fn func(*Context) error) error {
+	j := &job{fn: fn, done: make(chan struct{})}
+	if err := s.submit(j); err != nil {
+		return err
+	}
+	<-j.done
+	return j.err
+}
+
+func (s *Scheduler) submit(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSchedulerClosed
+	}
+	s.queue = append(s.queue, j)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cancelSequence asks the scheduler's goroutine to empty a slot
+func (s *Scheduler) cancelSequence(seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSchedulerClosed
+	}
+	s.cancelled = append(s.cancelled, seq)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// evictIdle removes the KV cache of the slots without a generation, which
+// only hold prompts kept for reuse, and reports whether any held tokens. It
+// runs on the scheduler's goroutine, and evicts nothing while a function
+// passed to Do may be using the slots' sequences.
+func (s *Scheduler) evictIdle() bool {
+	if s.doing {
+		return false
+	}
+	mem := C.llama_get_memory(s.c.ptr)
+	evicted := false
+	for _, sl := range s.slots {
+		if sl.job != nil || len(sl.tokens) == 0 {
+			continue
+		}
+		s.keep(sl, 0)
+		C.llama_memory_seq_rm(mem, C.llama_seq_id(sl.seq), -1, -1)
+		sl.tokens = nil
+		evicted = true
+	}
+	return evicted
+}
+
+// warmUp gives the empty idle slots the KV cache of the warm prompt, or one
+// idle slot when none holds it, so that there is always one to start from.
+// It is copied from a slot that holds it, and evaluated only when none does.
+// It runs on the scheduler's goroutine while no generation is running.
+func (s *Scheduler) warmUp() {
+	if len(s.warm) == 0 || s.doing {
+		return
+	}
+	holds := func(sl *slot) bool {
+		return commonPrefix(sl.tokens, s.warm) == len(s.warm)
+	}
+
+	var src, spare *slot
+	var targets []*slot
+	idleHolds := false
+	for _, sl := range s.slots {
+		switch {
+		case holds(sl):
+			if src == nil {
+				src = sl
+			}
+			idleHolds = idleHolds || sl.job == nil
+		case sl.job != nil:
+		case len(sl.tokens) == 0:
+			targets = append(targets, sl)
+		case spare == nil || commonPrefix(sl.tokens, s.warm) > commonPrefix(spare.tokens, s.warm):
+			spare = sl
+		}
+	}
+	if len(targets) == 0 && !idleHolds && spare != nil {
+		// The slot closest to the warm prompt is taken over, its cache kept
+		// when there is a prompt cache
+		s.keep(spare, 0)
+		C.llama_memory_seq_rm(C.llama_get_memory(s.c.ptr), C.llama_seq_id(spare.seq), -1, -1)
+		spare.tokens = nil
+		targets = append(targets, spare)
+	}
+
+	mem := C.llama_get_memory(s.c.ptr)
+	for _, sl := range targets {
+		if src != nil {
+			C.llama_memory_seq_cp(mem, C.llama_seq_id(src.seq), C.llama_seq_id(sl.seq), 0, C.llama_pos(len(s.warm)))
+		} else {
+			start := time.Now()
+			if err := s.c.decode(s.warm, 0, sl.seq, false); err != nil {
+				// Tried again the next time the scheduler is idle
+				C.llama_memory_seq_rm(mem, C.llama_seq_id(sl.seq), -1, -1)
+				return
+			}
+			if tracing() {
+				trace("warm_up", start, slog.Int("slot", sl.seq), slog.Int("tokens", len(s.warm)))
+			}
+			src = sl
+		}
+		sl.tokens = append([]Token(nil), s.warm...)
+	}
+}
+
+// dropCancelled ends the generations in slots passed to CancelSequence and
+// removes their KV cache entries
+func (s *Scheduler) dropCancelled() {
+	s.mu.Lock()
+	cancelled := s.cancelled
+	s.cancelled = nil
+	s.mu.Unlock()
+
+	for _, seq := range cancelled {
+		sl := s.slots[seq]
+		if sl.job != nil {
+			s.finish(sl, FinishCancel)
+		}
+		C.llama_memory_seq_rm(C.llama_get_memory(s.c.ptr), C.llama_seq_id(seq), -1, -1)
+		sl.tokens = nil
+	}
+}
+
+// remove takes a job off the queue and reports whether it was still there
+func (s *Scheduler) remove(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, q := range s.queue {
+		if q == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// next takes the job at the head of the queue if it can start: a generation
+// when a slot is free, a function once no generation runs
+func (s *Scheduler) next() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	j := s.queue[0]
+	if j.fn != nil && s.active.Load() > 0 {
+		return nil
+	}
+	if j.fn == nil && int(s.active.Load()) == len(s.slots) {
+		return nil
+	}
+	s.queue = s.queue[1:]
+	return j
+}
+
+func (s *Scheduler) run() {
+	defer close(s.exited)
+	defer s.shutdown()
+
+	for {
+		s.dropCancelled()
+		for j := s.next(); j != nil; j = s.next() {
+			if j.fn != nil {
+				s.doing = true
+				j.err = s.do(j.fn)
+				s.doing = false
+				s.reset()
+				close(j.done)
+				continue
+			}
+			s.start(j)
+		}
+
+		if s.active.Load() == 0 {
+			s.warmUp()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		for _, sl := range s.slots {
+			switch {
+			case sl.job == nil:
+			case sl.job.ctx.Err() != nil:
+				s.guard(sl, func(sl *slot) { s.finish(sl, FinishCancel) })
+			case sl.job.opts.expired(sl.job.start):
+				s.guard(sl, func(sl *slot) { s.finish(sl, FinishTimeout) })
+			}
+		}
+		if err := s.step(); err != nil {
+			for _, sl := range s.slots {
+				if sl.job != nil {
+					sl.job.err = err
+					s.finish(sl, FinishCancel)
+				}
+			}
+			s.reset()
+		}
+	}
+}
+
+// start puts a generation in the free slot whose KV cache shares the longest
+// prefix with its prompt
+func (s *Scheduler) start(j *job) {
+	var best *slot
+	bestN := -1
+	for _, sl := range s.slots {
+		if sl.job != nil {
+			continue
+		}
+		if n := commonPrefix(sl.tokens, j.tokens); n > bestN {
+			best, bestN = sl, n
+		}
+	}
+
+	n := bestN
+	if s.c.deterministic {
+		n = 0
+	} else if s.cache != nil {
+		if e := s.cache.lookup(j.tokens, n, s.c.model.IsRecurrent()); e != nil {
+			s.restore(best, e)
+			n = commonPrefix(best.tokens, j.tokens)
+		}
+	}
+	if n == len(j.tokens) {
+		// The last token is decoded again to get logits for it
+		n--
+	}
+	n = s.c.reusable(best.seq, n)
+	if n < len(best.tokens) {
+		s.keep(best, n)
+		mem := C.llama_get_memory(s.c.ptr)
+		if !C.llama_memory_seq_rm(mem, C.llama_seq_id(best.seq), C.llama_pos(n), -1) {
+			C.llama_memory_seq_rm(mem, C.llama_seq_id(best.seq), -1, -1)
+			n = 0
+		}
+		best.tokens = best.tokens[:n]
+	}
+	j.result.CachedTokens = n
+	if !s.c.deterministic {
+		accountPrompt(len(j.tokens), n)
+	}
+
+	if tracing() {
+		// The duration is the time the generation waited in the queue
+		trace("schedule", j.start, slog.Int("slot", best.seq), slog.Int("prompt_tokens", len(j.tokens)), slog.Int("cached_tokens", n))
+	}
+	best.job, best.prefill = j, true
+	best.pending = append([]Token(nil), j.tokens[n:]...)
+	best.out = newTextStream(j.opts.Stop, j.opts.OnToken)
+	s.active.Add(1)
+}
+
+// step decodes one batch: the next token of every generating slot first,
+// then chunks of pending prompts in the remaining space, up to
+// MaxPromptTokens. Prompt tokens are handed out round-robin, one at a time,
+// so concurrent prompts are evaluated at the same pace. The slot served
+// first rotates between steps so that none is favoured when the batch runs
+// out of room.
+func (s *Scheduler) step() error {
+	b := s.c.batch
+	b.clear()
+
+	order := make([]*slot, 0, len(s.slots))
+	for i := range s.slots {
+		sl := s.slots[(s.turn+i)%len(s.slots)]
+		sl.logits, sl.decoded = -1, 0
+		if sl.job != nil {
+			order = append(order, sl)
+		}
+	}
+	s.turn = (s.turn + 1) % len(s.slots)
+
+	var prompts []*slot
+	for _, sl := range order {
+		if len(sl.pending) > 1 {
+			prompts = append(prompts, sl)
+		} else if int(b.c.n_tokens) < b.capacity {
+			if !sl.prefill {
+				b.generated++
+			}
+			s.add(sl, 1)
+		}
+	}
+
+	budget := b.capacity - int(b.c.n_tokens)
+	if s.opts.MaxPromptTokens > 0 {
+		budget = min(budget, s.opts.MaxPromptTokens)
+	}
+	share := make([]int, len(prompts))
+	for given := true; budget > 0 && given; {
+		given = false
+		for i, sl := range prompts {
+			if budget > 0 && share[i] < len(sl.pending) {
+				share[i]++
+				budget--
+				given = true
+			}
+		}
+	}
+	for i, sl := range prompts {
+		s.add(sl, share[i])
+	}
+
+	if b.c.n_tokens == 0 {
+		return nil
+	}
+	if err := s.c.decodeBatch(); err != nil {
+		return err
+	}
+
+	for _, sl := range s.slots {
+		if sl.job != nil {
+			s.guard(sl, s.sampled)
+		}
+	}
+	return nil
+}
+
+// sampled reports the progress of a slot whose tokens were decoded and
+// samples its next token if it asked for logits
+func (s *Scheduler) sampled(sl *slot) {
+	if sl.prefill && sl.decoded > 0 && sl.job.opts.OnPrefill != nil {
+		sl.job.opts.OnPrefill(len(sl.tokens), len(sl.job.tokens))
+	}
+	if sl.logits >= 0 {
+		sl.prefill = false
+		s.advance(sl, sl.job.smpl.sample(s.c, sl.logits))
+	}
+}
+
+// guard runs fn for a slot. A panic in the job's callbacks fails that job
+// alone with a CallError, and the slot's KV cache is dropped as it may not
+// match its tokens.
+func (s *Scheduler) guard(sl *slot, fn func(*slot)) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if sl.job != nil {
+			sl.job.err = s.c.callError("Scheduler", 0, nil).recovered(r)
+			// The stream isn't flushed, which would call OnToken again
+			s.end(sl, FinishCancel)
+		}
+		C.llama_memory_seq_rm(C.llama_get_memory(s.c.ptr), C.llama_seq_id(sl.seq), -1, -1)
+		sl.tokens = nil
+	}()
+	fn(sl)
+}
+
+// do runs the function of a Do job, turning a panic into its error
+func (s *Scheduler) do(fn func(*Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.c.callError("Scheduler.Do", 0, nil).recovered(r)
+		}
+	}()
+	return fn(s.c)
+}
+
+// add moves the next n pending tokens of a slot into the batch, asking for
+// logits if they include the last one
+func (s *Scheduler) add(sl *slot, n int) {
+	b := s.c.batch
+	for i := range n {
+		last := i == len(sl.pending)-1
+		if last {
+			sl.logits = int(b.c.n_tokens)
+		}
+		b.add(sl.pending[i], len(sl.tokens)+i, sl.seq, last)
+	}
+	sl.tokens = append(sl.tokens, sl.pending[:n]...)
+	sl.pending = sl.pending[n:]
+	sl.decoded += n
+}
+
+// advance handles a token sampled for a slot, ending its generation on
+// end-of-generation, a stop sequence, MaxTokens or a full slot
+func (s *Scheduler) advance(sl *slot, token Token) {
+	j := sl.job
+	if s.c.model.IsEOG(token) {
+		s.finish(sl, FinishStop)
+		return
+	}
+	j.result.CompletionTokens++
+	if j.opts.OnTokenInfo != nil {
+		j.opts.OnTokenInfo(s.c.tokenInfo(sl.logits, token, j.opts.TopLogprobs, j.start))
+	}
+	if sl.out.write(s.c.model.TokenToPiece(token)) {
+		s.finish(sl, FinishStop)
+		return
+	}
+	if (j.opts.MaxTokens > 0 && j.result.CompletionTokens >= j.opts.MaxTokens) || len(sl.tokens) >= s.SlotSize() {
+		s.finish(sl, FinishLength)
+		return
+	}
+	sl.pending = []Token{token}
+}
+
+// finish ends the generation in a slot. The slot's KV cache is kept for
+// prompts sharing its prefix.
+func (s *Scheduler) finish(sl *slot, reason FinishReason) {
+	sl.job.result.Text = sl.out.flush()
+	s.end(sl, reason)
+}
+
+// end frees the slot of a generation that ended for reason
+func (s *Scheduler) end(sl *slot, reason FinishReason) {
+	j := sl.job
+	j.result.FinishReason = reason
+	j.result.Sampling, j.result.Seed = j.smpl.samplerStats(), j.smpl.seed
+	j.smpl.free()
+	close(j.done)
+
+	sl.job, sl.pending, sl.out = nil, nil, nil
+	s.active.Add(-1)
+}
+
+// reset clears the KV cache of every slot
+func (s *Scheduler) reset() {
+	s.c.clearMemory()
+	for _, sl := range s.slots {
+		sl.tokens = nil
+	}
+}
+
+// shutdown ends the running generations and fails the queued ones
+func (s *Scheduler) shutdown() {
+	for _, sl := range s.slots {
+		if sl.job != nil {
+			s.finish(sl, FinishCancel)
+		}
+	}
+
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+	for _, j := range queue {
+		if j.smpl != nil {
+			j.smpl.free()
+		}
+		j.err = errSchedulerClosed
+		close(j.done)
+	}
+
+	s.reset()
+}
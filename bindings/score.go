@@ -0,0 +1,213 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Score returns the log-probability of continuation following prompt: the
+// sum of the natural-log probabilities of its tokens. Comparing the scores
+// of several continuations of the same prompt answers multiple-choice
+// questions; the prompt is only evaluated once across such calls.
+func (c *Context) Score(prompt, continuation string) (float64, error) {
+	tokens, err := c.model.TokenizeWithOptions(prompt, TokenizeOptions{ParseSpecial: true})
+	if err != nil {
+		return 0, err
+	}
+	target, err := c.model.Tokenize(continuation, false, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, errors.New("prompt is empty")
+	}
+	if len(target) == 0 {
+		return 0, errors.New("continuation is empty")
+	}
+	return c.scoreTokens(tokens, target)
+}
+
+// scoreTokens returns the log-probability of target following tokens
+func (c *Context) scoreTokens(tokens, target []Token) (float64, error) {
+	if len(tokens)+len(target) > c.Size() {
+		return 0, ErrPromptTooLong
+	}
+
+	if err := c.evaluate(tokens); err != nil {
+		return 0, err
+	}
+	logprob := tokenLogprob(c.logits(-1), target[0])
+
+	// Every continuation token but the last is decoded with logits, which
+	// give the probability of the token after it
+	rest := target[:len(target)-1]
+	for start := 0; start < len(rest); start += c.batch.capacity {
+		end := min(start+c.batch.capacity, len(rest))
+
+		c.batch.clear()
+		for i := start; i < end; i++ {
+			c.batch.add(rest[i], len(c.tokens)+i-start, 0, true)
+		}
+		if err := c.decodeBatch(); err != nil {
+			c.clearMemory()
+			return 0, err
+		}
+		for i := start; i < end; i++ {
+			logprob += tokenLogprob(c.logits(i-start), target[i+1])
+		}
+		c.tokens = append(c.tokens, rest[start:end]...)
+	}
+
+	return logprob, nil
+}
+
+// ScoreMany returns the log-probability of each continuation following
+// prompt. With ContextParams.Sequences above 1 the continuations share the
+// prompt's KV cache entries and are decoded together, several sequences
+// per batch; otherwise they are scored one after another.
+func (c *Context) ScoreMany(prompt string, continuations []string) ([]float64, error) {
+	scores := make([]float64, len(continuations))
+	group := int(C.llama_n_seq_max(c.ptr)) - 1
+	if group < 1 {
+		for i, continuation := range continuations {
+			score, err := c.Score(prompt, continuation)
+			if err != nil {
+				return nil, err
+			}
+			scores[i] = score
+		}
+		return scores, nil
+	}
+
+	tokens, err := c.model.TokenizeWithOptions(prompt, TokenizeOptions{ParseSpecial: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("prompt is empty")
+	}
+	targets := make([][]Token, len(continuations))
+	for i, continuation := range continuations {
+		if targets[i], err = c.model.Tokenize(continuation, false, true); err != nil {
+			return nil, err
+		}
+		if len(targets[i]) == 0 {
+			return nil, errors.New("continuation is empty")
+		}
+		if len(tokens)+len(targets[i]) > c.Size() {
+			return nil, ErrPromptTooLong
+		}
+	}
+
+	if err := c.evaluateShared(tokens); err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(targets); start += group {
+		end := min(start+group, len(targets))
+		if err := c.scoreGroup(tokens, targets[start:end], scores[start:end]); err != nil {
+			return nil, err
+		}
+	}
+
+	return scores, nil
+}
+
+// scoreGroup scores continuations of the prompt held in sequence 0 using
+// sequences 1 to len(targets), packing their tokens into shared batches
+func (c *Context) scoreGroup(prompt []Token, targets [][]Token, scores []float64) error {
+	mem := C.llama_get_memory(c.ptr)
+	defer func() {
+		for i := range targets {
+			C.llama_memory_seq_rm(mem, C.llama_seq_id(i+1), -1, -1)
+		}
+	}()
+
+	// Each batch entry's logits give the probability of the next target token
+	type entry struct {
+		target int
+		next   Token
+	}
+	var entries []entry
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := c.decodeBatch(); err != nil {
+			return err
+		}
+		for i, e := range entries {
+			scores[e.target] += tokenLogprob(c.logits(i), e.next)
+		}
+		entries = entries[:0]
+		c.batch.clear()
+		return nil
+	}
+
+	// The last prompt token is decoded again in every sequence to get the
+	// probability of the first continuation token
+	shared := len(prompt) - 1
+	c.batch.clear()
+	for i, target := range targets {
+		seq := i + 1
+		C.llama_memory_seq_cp(mem, 0, C.llama_seq_id(seq), 0, C.llama_pos(shared))
+
+		input := append([]Token{prompt[shared]}, target[:len(target)-1]...)
+		for j, token := range input {
+			c.batch.add(token, shared+j, seq, true)
+			entries = append(entries, entry{target: i, next: target[j]})
+			if len(entries) == c.batch.capacity {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+// EvalAll clears the KV cache and evaluates tokens in a single batch, keeping
+// the logits of every position: Logits(i) then returns the distribution
+// predicted after tokens[i]. The tokens must fit in one batch.
+func (c *Context) EvalAll(tokens []Token) error {
+	if len(tokens) > c.batch.capacity {
+		return fmt.Errorf("%d tokens exceed the batch size of %d", len(tokens), c.batch.capacity)
+	}
+
+	c.clearMemory()
+	c.batch.clear()
+	for i, token := range tokens {
+		c.batch.add(token, i, 0, true)
+	}
+	if err := c.decodeBatch(); err != nil {
+		c.clearMemory()
+		return err
+	}
+	c.tokens = append(c.tokens, tokens...)
+	return nil
+}
+
+// Logits returns the logits computed for the i-th token of the last batch,
+// -1 for the last one. The slice points into llama.cpp memory and is only
+// valid until the next call that evaluates tokens.
+func (c *Context) Logits(i int) []float32 {
+	return c.logits(i)
+}
+
+// tokenLogprob returns the log-probability of token under the softmax of logits
+func tokenLogprob(logits []float32, token Token) float64 {
+	maxLogit := math.Inf(-1)
+	for _, l := range logits {
+		maxLogit = max(maxLogit, float64(l))
+	}
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - maxLogit)
+	}
+	return float64(logits[token]) - maxLogit - math.Log(sum)
+}
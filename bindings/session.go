@@ -0,0 +1,250 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Session is a conversation with a model. It keeps the message history,
+// formats it with the chat template and drops the oldest turns once the
+// conversation no longer fits in the context, or summarizes them with
+// SessionOptions.Summarizer. The system prompt is always kept. A Session is
+// not safe for concurrent use.
+type Session struct {
+	ctx      *Context
+	template string
+	opts     GenerateOptions
+	messages []ChatMessage
+	tokens   int
+
+	system     string
+	pinned     []ChatMessage
+	summary    string // of the turns no longer in messages
+	summarizer Summarizer
+	threshold  float32
+}
+
+// NewSession starts a conversation in the given context
+func NewSession(ctx *Context, opts SessionOptions) (*Session, error) {
+	if ctx == nil || ctx.ptr == nil {
+		return nil, errors.New("context is not initialized")
+	}
+
+	s := &Session{
+		ctx:      ctx,
+		template: opts.Template,
+		opts:     opts.GenerateOptions,
+
+		system:     opts.SystemPrompt,
+		pinned:     append([]ChatMessage(nil), opts.Pinned...),
+		summarizer: opts.Summarizer,
+		threshold:  opts.SummarizeThreshold,
+	}
+	if s.threshold <= 0 {
+		s.threshold = defaultSummarizeThreshold
+	}
+	if s.template == "" {
+		s.template = ctx.model.chatTemplate()
+	}
+	if s.template == "" {
+		s.template = "chatml"
+	}
+	stop := DetectTemplateFamily(s.template).Stop()
+	if t, ok := LookupTemplate(s.template); ok {
+		stop = t.Stop
+	}
+	s.opts.Stop = append(append([]string(nil), s.opts.Stop...), stop...)
+	s.messages = s.withSystem(nil, "")
+
+	return s, nil
+}
+
+// Messages returns the conversation history currently kept in the session
+func (s *Session) Messages() []ChatMessage {
+	return append([]ChatMessage(nil), s.messages...)
+}
+
+// Tokens returns the number of tokens the conversation used in the last turn
+func (s *Session) Tokens() int {
+	return s.tokens
+}
+
+// Send adds a user message and returns the model's reply
+func (s *Session) Send(userMsg string) (string, error) {
+	result, err := s.SendContext(context.Background(), userMsg)
+	if err != nil {
+		return "", err
+	}
+	return result.Text, nil
+}
+
+// SendContext adds a user message and generates the model's reply. The reply
+// is added to the history unless generation fails.
+func (s *Session) SendContext(ctx context.Context, userMsg string) (*GenerateResult, error) {
+	start := time.Now()
+	messages := append(s.Messages(), ChatMessage{Role: RoleUser, Content: userMsg})
+
+	reserve := s.opts.MaxTokens
+	if reserve <= 0 {
+		reserve = s.ctx.Size() / 4
+	}
+
+	summary := s.summary
+	var tokens []Token
+	for {
+		prompt, err := applyChatTemplate(s.template, messages, true, s.ctx.model.templateVars())
+		if err != nil {
+			return nil, err
+		}
+		tokens, err = s.ctx.model.TokenizeWithOptions(prompt, s.opts.tokenizeOptions())
+		if err != nil {
+			return nil, err
+		}
+		if s.summarizer != nil && float32(len(tokens)+reserve) > s.threshold*float32(s.ctx.Size()) {
+			summarized, err := s.summarize(ctx, &messages, &summary)
+			if err != nil {
+				return nil, err
+			}
+			if summarized {
+				continue
+			}
+		}
+		if len(tokens)+reserve <= s.ctx.Size() {
+			break
+		}
+
+		// Shift the context by dropping the oldest turn
+		if !dropOldestTurn(&messages, s.head(summary)) {
+			if s.opts.Truncate == TruncateError {
+				return nil, fmt.Errorf("%w: message needs %d tokens, context size %d", ErrPromptTooLong, len(tokens)+reserve, s.ctx.Size())
+			}
+			break
+		}
+	}
+
+	// Truncation and context shifts keep the pinned messages
+	opts := s.opts
+	head, err := s.headTokens(summary)
+	if err != nil {
+		return nil, err
+	}
+	opts.KeepTokens = keepTokens(head, tokens, opts.KeepTokens)
+
+	result, err := s.ctx.generate(ctx, start, tokens, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.messages = append(messages, ChatMessage{Role: RoleAssistant, Content: result.Text})
+	s.summary = summary
+	s.tokens = result.TotalTokens()
+
+	return result, nil
+}
+
+// Reset clears the history, keeping only the system prompt
+func (s *Session) Reset() {
+	s.summary = ""
+	s.messages = s.withSystem(nil, "")
+	s.tokens = 0
+}
+
+// defaultSummarizeThreshold is the share of the context a conversation may
+// use before it is summarized, when SessionOptions.SummarizeThreshold is 0
+const defaultSummarizeThreshold = 0.75
+
+// summarize condenses the turns before the latest exchange into summary and
+// replaces them in messages. It reports whether there were any.
+func (s *Session) summarize(ctx context.Context, messages *[]ChatMessage, summary *string) (bool, error) {
+	msgs := *messages
+	start := s.head(*summary)
+
+	// The new message and the exchange before it stay as they are
+	cut := -1
+	for i := len(msgs) - 2; i >= start; i-- {
+		if msgs[i].Role == RoleUser {
+			cut = i
+			break
+		}
+	}
+	if cut <= start {
+		return false, nil
+	}
+
+	text, err := s.summarizer.Summarize(ctx, *summary, msgs[start:cut])
+	if err != nil {
+		return false, fmt.Errorf("summarizing the conversation: %w", err)
+	}
+	*summary = text
+	*messages = s.withSystem(msgs[cut:], text)
+	return true, nil
+}
+
+// withSystem prepends the pinned messages to messages
+func (s *Session) withSystem(messages []ChatMessage, summary string) []ChatMessage {
+	return append(sessionHead(s.system, s.pinned, summary), messages...)
+}
+
+// head returns the number of pinned messages the history starts with
+func (s *Session) head(summary string) int {
+	return len(s.withSystem(nil, summary))
+}
+
+// headTokens returns the tokens of the pinned messages, as the prompt
+// starts with them
+func (s *Session) headTokens(summary string) ([]Token, error) {
+	pinned := s.withSystem(nil, summary)
+	if len(pinned) == 0 {
+		return nil, nil
+	}
+	prompt, err := applyChatTemplate(s.template, pinned, false, s.ctx.model.templateVars())
+	if err != nil {
+		return nil, err
+	}
+	return s.ctx.model.TokenizeWithOptions(prompt, s.opts.tokenizeOptions())
+}
+
+// NewSummarizer returns a Summarizer that asks the model of ctx for the
+// summary, generating with opts. ctx may be the session's own context, whose
+// conversation is then evaluated again for the next reply.
+func NewSummarizer(ctx *Context, opts GenerateOptions) Summarizer {
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = defaultSummaryTokens
+	}
+	opts.Stop = append(append([]string(nil), opts.Stop...), ctx.model.TemplateFamily().Stop()...)
+
+	return SummarizerFunc(func(c context.Context, summary string, messages []ChatMessage) (string, error) {
+		var b strings.Builder
+		if summary != "" {
+			b.WriteString("Summary of the earlier conversation:\n" + summary + "\n\n")
+		}
+		b.WriteString("Conversation:\n")
+		for _, msg := range messages {
+			b.WriteString(msg.Role + ": " + msg.Content + "\n")
+		}
+
+		prompt, err := ctx.model.ApplyChatTemplate([]ChatMessage{
+			{Role: RoleSystem, Content: summaryInstruction},
+			{Role: RoleUser, Content: b.String()},
+		}, true)
+		if err != nil {
+			return "", err
+		}
+		result, err := ctx.Generate(c, prompt, opts)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(result.Text), nil
+	})
+}
+
+// defaultSummaryTokens caps summaries when the options set no MaxTokens
+const defaultSummaryTokens = 256
+
+const summaryInstruction = "Summarize the conversation below, merging in the earlier summary if there is one. " +
+	"Keep names, facts, decisions and open questions; leave out pleasantries. Reply with the summary only."
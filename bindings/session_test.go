@@ -0,0 +1,82 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSessionKeepsPinned(t *testing.T) {
+	pinned := []ChatMessage{
+		{Role: RoleUser, Content: "Tell me about the dog."},
+		{Role: RoleAssistant, Content: "The dog was big and happy."},
+	}
+	summarizer := SummarizerFunc(func(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+		return "They talked about a little girl.", nil
+	})
+	tests := []struct {
+		name       string
+		summarizer Summarizer
+		infinite   bool
+	}{
+		{"dropping turns", nil, false},
+		{"summarizing", summarizer, false},
+		{"shifting", nil, true},
+	}
+	m := testModel(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testContext(t, m, ContextParams{ContextSize: 256})
+			opts := greedy(32)
+			opts.Truncate = TruncateLeft
+			if tt.infinite {
+				// Replies outgrow the context, which shifts
+				opts.MaxTokens = 2 * c.Size()
+				opts.Infinite = true
+				opts.LogitBias = map[Token]float32{m.EOS(): float32(math.Inf(-1))}
+			}
+			s, err := NewSession(c, SessionOptions{
+				SystemPrompt:    "Once upon a time there was a dog.",
+				Pinned:          pinned,
+				GenerateOptions: opts,
+				Summarizer:      tt.summarizer,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			shifted := 0
+			for i := range 6 {
+				msg := strings.Repeat("The little girl went to the park to play with her friends. ", 3)
+				res, err := s.SendContext(context.Background(), msg)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				shifted += res.ShiftedTokens
+
+				head := sessionHead(s.system, pinned, s.summary)
+				if got := s.Messages(); len(got) < len(head) || !sameMessages(got[:len(head)], head) {
+					t.Fatalf("message %d: the history starts with %v, want %v", i, got, head)
+				}
+				tokens, err := s.headTokens(s.summary)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The last tokens of the head may be rendered differently
+				// when more messages follow
+				if keep := keepTokens(tokens, c.tokens, 0); keep < len(tokens)-2 {
+					t.Fatalf("message %d: the context keeps %d of the %d tokens of the pinned messages", i, keep, len(tokens))
+				}
+			}
+			if tt.summarizer != nil && s.summary == "" {
+				t.Error("the conversation was never summarized")
+			}
+			if tt.infinite && shifted == 0 {
+				t.Error("the context never shifted")
+			}
+		})
+	}
+}
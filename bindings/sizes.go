@@ -0,0 +1,34 @@
+package bindings
+
+import "fmt"
+
+// FormatParams formats a parameter count the way model names give it, e.g.
+// "8.0B", "135M" or "1.1T"
+func FormatParams(n int64) string {
+	switch {
+	case n >= 1e12:
+		return fmt.Sprintf("%.1fT", float64(n)/1e12)
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.0fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.0fK", float64(n)/1e3)
+	}
+	return fmt.Sprint(n)
+}
+
+// FormatBytes formats a byte count in the largest binary unit that keeps it
+// above 1, e.g. "4.6 GiB"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, exp := float64(n)/unit, 0
+	for size >= unit && exp < 3 {
+		size /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGT"[exp])
+}
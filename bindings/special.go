@@ -0,0 +1,67 @@
+package bindings
+
+// SpecialTokenPolicy decides whether a BOS or EOS token is added when text
+// is tokenized
+type SpecialTokenPolicy int
+
+const (
+	// SpecialAuto adds the token if the model's metadata asks for it
+	SpecialAuto SpecialTokenPolicy = iota
+	// SpecialAlways adds the token whatever the metadata says
+	SpecialAlways
+	// SpecialNever leaves the token out
+	SpecialNever
+)
+
+// String returns the name of the policy
+func (p SpecialTokenPolicy) String() string {
+	switch p {
+	case SpecialAuto:
+		return "auto"
+	case SpecialAlways:
+		return "always"
+	case SpecialNever:
+		return "never"
+	}
+	return "unknown"
+}
+
+// add reports whether the token is added to a model that wants it or not
+func (p SpecialTokenPolicy) add(wanted bool) bool {
+	switch p {
+	case SpecialAlways:
+		return true
+	case SpecialNever:
+		return false
+	}
+	return wanted
+}
+
+// TokenizeOptions configures Model.TokenizeWithOptions
+type TokenizeOptions struct {
+	// AddBOS and AddEOS decide whether the text is framed by BOS and EOS
+	// tokens. BOS is never added twice: text that already starts with it,
+	// as rendered by some chat templates, keeps a single one.
+	AddBOS SpecialTokenPolicy
+	AddEOS SpecialTokenPolicy
+
+	// ParseSpecial recognizes special tokens written in the text, such as
+	// "<|im_start|>"
+	ParseSpecial bool
+}
+
+// tokenizeOptions returns the options prompts are tokenized with
+func (o GenerateOptions) tokenizeOptions() TokenizeOptions {
+	return TokenizeOptions{AddBOS: o.AddBOS, AddEOS: o.AddEOS, ParseSpecial: true}
+}
+
+// frame adds BOS and EOS to tokens unless they are there already
+func frame(tokens []Token, bos, eos Token, addBOS, addEOS bool) []Token {
+	if addBOS && bos >= 0 && (len(tokens) == 0 || tokens[0] != bos) {
+		tokens = append([]Token{bos}, tokens...)
+	}
+	if addEOS && eos >= 0 && (len(tokens) == 0 || tokens[len(tokens)-1] != eos) {
+		tokens = append(tokens, eos)
+	}
+	return tokens
+}
@@ -0,0 +1,223 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// defaultDraftTokens is the draft length when SpeculativeOptions.Tokens is 0
+const defaultDraftTokens = 8
+
+// checkSpeculative reports options speculative decoding can't be used with
+func (c *Context) checkSpeculative(opts GenerateOptions) error {
+	spec := opts.Speculative
+	switch {
+	case spec.Draft == nil:
+		return errors.New("speculative decoding needs a draft context")
+	case spec.Draft == c:
+		return errors.New("the draft context must not be the target context")
+	case spec.Draft.model.VocabSize() != c.model.VocabSize():
+		return errors.New("the draft model's vocabulary doesn't match the target model's")
+	case c.model.IsRecurrent() || spec.Draft.model.IsRecurrent():
+		// Rejected draft tokens have to be removed from the KV cache
+		return errors.New("speculative decoding doesn't support recurrent models")
+	case len(opts.Banned) > 0 || (opts.NegativePrompt != "" && opts.GuidanceScale > 1):
+		return errors.New("speculative decoding can't be combined with banned phrases or guidance")
+	case spec.AcceptProbability < 0 || spec.AcceptProbability > 1:
+		return errors.New("AcceptProbability must be between 0 and 1")
+	case (spec.Verify != VerifySampled || spec.AcceptProbability > 0) && opts.Grammar != "":
+		// A draft token accepted past the sampler may break the grammar
+		return errors.New("a grammar needs sampled verification without AcceptProbability")
+	}
+	return nil
+}
+
+// speculate generates like the loop in generate, but decodes the tokens a
+// draft model proposes in one batch and keeps the ones the target model
+// would have sampled itself. Each step yields at least one token: the first
+// the target disagrees with, or one more after a fully accepted draft.
+func (c *Context) speculate(ctx context.Context, start time.Time, smpl *sampler, out *textStream, opts GenerateOptions, result *GenerateResult) error {
+	spec := *opts.Speculative
+	if spec.Tokens <= 0 {
+		spec.Tokens = defaultDraftTokens
+	}
+	nCtx := c.Size()
+
+	// emit adds a token sampled from the i-th logits of the last batch to
+	// the output and reports whether generation ends with it
+	emit := func(token Token, i int) bool {
+		if c.model.IsEOG(token) {
+			result.FinishReason = FinishStop
+			return true
+		}
+		result.CompletionTokens++
+		if opts.OnTokenInfo != nil {
+			opts.OnTokenInfo(c.tokenInfo(i, token, opts.TopLogprobs, start))
+		}
+		if out.write(c.model.TokenToPiece(token)) {
+			result.FinishReason = FinishStop
+			return true
+		}
+		return false
+	}
+
+	full := func() bool {
+		return (opts.MaxTokens > 0 && result.CompletionTokens >= opts.MaxTokens) || len(c.tokens) >= nCtx
+	}
+
+	// Index of the logits token was sampled from
+	token, from := smpl.sample(c, -1), -1
+	for {
+		if ctx.Err() != nil {
+			result.FinishReason = FinishCancel
+			return nil
+		}
+		if opts.expired(start) {
+			result.FinishReason = FinishTimeout
+			return nil
+		}
+		if full() {
+			result.FinishReason = FinishLength
+			return nil
+		}
+		if emit(token, from) {
+			return nil
+		}
+
+		// The draft is limited so that the target's batch fits its context
+		// and accepted tokens don't exceed MaxTokens
+		n := min(spec.Tokens, c.batch.capacity-1, nCtx-len(c.tokens)-1, spec.Draft.Size()-len(c.tokens)-1)
+		if opts.MaxTokens > 0 {
+			n = min(n, opts.MaxTokens-result.CompletionTokens)
+		}
+		var draft []Token
+		if n > 0 {
+			var err error
+			if draft, err = spec.Draft.draft(append(c.tokens, token), n, spec.MinProbability); err != nil {
+				return err
+			}
+		}
+		result.DraftTokens += len(draft)
+		if len(draft) > 0 {
+			result.DraftSteps++
+		}
+
+		base := len(c.tokens)
+		c.batch.clear()
+		c.batch.add(token, base, 0, true)
+		for i, t := range draft {
+			c.batch.add(t, base+1+i, 0, true)
+		}
+		c.batch.generated = int(c.batch.c.n_tokens)
+		if err := c.decodeBatch(); err != nil {
+			c.clearMemory()
+			return err
+		}
+		c.tokens = append(append(c.tokens, token), draft...)
+
+		for i := 0; ; i++ {
+			if i < len(draft) && spec.accepts(c.logits(i), draft[i]) {
+				smpl.accept(draft[i])
+				token = draft[i]
+			} else {
+				token = smpl.sample(c, i)
+			}
+			from = i
+			if i == len(draft) || token != draft[i] {
+				// Draft tokens from here on were rejected
+				c.truncate(base + 1 + i)
+				break
+			}
+			result.AcceptedTokens++
+
+			done := true
+			switch {
+			case ctx.Err() != nil:
+				result.FinishReason = FinishCancel
+			case opts.expired(start):
+				result.FinishReason = FinishTimeout
+			case full():
+				result.FinishReason = FinishLength
+			default:
+				done = emit(token, i)
+			}
+			if done {
+				// Like the loop in generate, the final token is not kept
+				c.truncate(base + 1 + i)
+				return nil
+			}
+		}
+	}
+}
+
+// accepts reports whether the draft token is accepted from the target's
+// logits before sampling, as Verify and AcceptProbability allow
+func (spec *SpeculativeOptions) accepts(logits []float32, token Token) bool {
+	if spec.Verify == VerifySampled && spec.AcceptProbability <= 0 {
+		return false
+	}
+	top, p := argmax(logits)
+	if top == token {
+		return spec.Verify == VerifyGreedy || p >= spec.AcceptProbability
+	}
+	// Scaled from the probability of the most likely token
+	p *= float32(math.Exp(float64(logits[token] - logits[top])))
+	return spec.AcceptProbability > 0 && p >= spec.AcceptProbability
+}
+
+// draft proposes up to n tokens following tokens, greedily, stopping early
+// when the most likely token is less likely than minProb
+func (c *Context) draft(tokens []Token, n int, minProb float32) ([]Token, error) {
+	if err := c.evaluate(tokens); err != nil {
+		return nil, err
+	}
+
+	var draft []Token
+	for len(draft) < n {
+		token, p := argmax(c.logits(-1))
+		if p < minProb {
+			break
+		}
+		draft = append(draft, token)
+		if len(draft) == n {
+			break
+		}
+		if err := c.decode([]Token{token}, len(c.tokens), 0, true); err != nil {
+			c.clearMemory()
+			return nil, err
+		}
+		c.tokens = append(c.tokens, token)
+	}
+	return draft, nil
+}
+
+// argmax returns the most likely token and its probability
+func argmax(logits []float32) (Token, float32) {
+	best := 0
+	for i, l := range logits {
+		if l > logits[best] {
+			best = i
+		}
+	}
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - logits[best]))
+	}
+	return Token(best), float32(1 / sum)
+}
+
+// truncate removes the tokens from position n on from sequence 0
+func (c *Context) truncate(n int) {
+	if n >= len(c.tokens) {
+		return
+	}
+	C.llama_memory_seq_rm(C.llama_get_memory(c.ptr), 0, C.llama_pos(n), -1)
+	c.tokens = c.tokens[:n]
+}
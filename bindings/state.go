@@ -0,0 +1,209 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// Prefill evaluates the prompt into the KV cache without generating, e.g.
+// to build a prompt cache with SavePromptCache
+func (c *Context) Prefill(prompt string) error {
+	tokens, err := c.model.TokenizeWithOptions(prompt, TokenizeOptions{ParseSpecial: true})
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errors.New("prompt is empty")
+	}
+	if len(tokens) > c.Size() {
+		return fmt.Errorf("prompt of %d tokens does not fit in a context of %d", len(tokens), c.Size())
+	}
+	return c.evaluate(tokens)
+}
+
+// SavePromptCache writes the KV cache and the tokens it holds to a file.
+// Restoring it with LoadPromptCache is much faster than evaluating a long
+// prompt again. The file records the model, the KV cache types and the
+// versions of its format and of llama.cpp's state, so that loading it
+// after an upgrade fails with ErrStateIncompatible rather than corrupting
+// the cache.
+func (c *Context) SavePromptCache(path string) error {
+	size := C.llama_state_get_size(c.ptr)
+	buf := C.malloc(size)
+	if buf == nil {
+		return fmt.Errorf("failed to allocate %d bytes to save prompt cache to %s", size, path)
+	}
+	defer C.free(buf)
+	n := C.llama_state_get_data(c.ptr, (*C.uint8_t)(buf), size)
+	if n == 0 {
+		return fmt.Errorf("failed to save prompt cache to %s", path)
+	}
+	return writeStateFile(path, c.stateHeader(), c.tokens, unsafe.Slice((*byte)(buf), n))
+}
+
+// LoadPromptCache restores a file written by SavePromptCache, replacing the
+// contents of the KV cache. Later calls to Generate only evaluate the part
+// of their prompt that isn't in the cache. The file must fit in the context
+// and have been saved with the same model and KV cache types, by a build of
+// the same file format and llama.cpp state version, or the error wraps
+// ErrStateIncompatible. A file that isn't a whole prompt cache fails with
+// ErrStateCorrupt. Files saved by earlier releases, in llama.cpp's own
+// session format, are loaded as before.
+func (c *Context) LoadPromptCache(path string) error {
+	f, tokens, size, err := openStateFile(path, c.stateHeader(), c.Size())
+	if err == errSessionFile {
+		return c.loadSessionFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The state goes straight into C memory, as llama_state_load_file reads it
+	buf := C.malloc(C.size_t(size))
+	if buf == nil {
+		return fmt.Errorf("failed to allocate %d bytes to load prompt cache from %s", size, path)
+	}
+	defer C.free(buf)
+	if _, err := io.ReadFull(f, unsafe.Slice((*byte)(buf), size)); err != nil {
+		return truncated(path, err)
+	}
+	if C.llama_state_set_data(c.ptr, (*C.uint8_t)(buf), C.size_t(size)) != C.size_t(size) {
+		c.clearMemory()
+		return fmt.Errorf("%w: llama.cpp failed to load the state in %s", ErrStateCorrupt, path)
+	}
+	c.tokens = append(c.tokens[:0], tokens...)
+	c.untracked = false
+	return nil
+}
+
+// loadSessionFile loads a prompt cache written by llama_state_save_file,
+// which checks its own version
+func (c *Context) loadSessionFile(path string) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	tokens := make([]Token, c.Size())
+	var n C.size_t
+	if !C.llama_state_load_file(c.ptr, cPath, tokenPtr(tokens), C.size_t(len(tokens)), &n) {
+		c.clearMemory()
+		return fmt.Errorf("%w: llama.cpp failed to load the session file %s", ErrStateCorrupt, path)
+	}
+	c.tokens = append(c.tokens[:0], tokens[:n]...)
+	c.untracked = false
+	return nil
+}
+
+// stateHeader describes the state of the context, as written before it
+func (c *Context) stateHeader() stateHeader {
+	m := c.model
+	return stateHeader{
+		Version: stateVersion,
+		Session: C.LLAMA_SESSION_VERSION,
+		stateModel: stateModel{
+			Params: m.Params(),
+			Size:   m.Size(),
+			Embd:   int32(m.EmbeddingSize()),
+			Layers: int32(m.Layers()),
+			Vocab:  int32(m.VocabSize()),
+			TypeK:  int32(c.params.type_k),
+			TypeV:  int32(c.params.type_v),
+		},
+		Model: m.Description(),
+	}
+}
+
+// Fork returns a new context holding a copy of this context's KV cache, so
+// several continuations can be explored from the same point without
+// evaluating the prefix again. The fork must be freed separately.
+func (c *Context) Fork() (*Context, error) {
+	fork, err := newContext(c.model, c.params)
+	if err != nil {
+		return nil, err
+	}
+
+	size := C.llama_state_get_size(c.ptr)
+	buf := C.malloc(size)
+	if buf == nil {
+		fork.Free()
+		return nil, fmt.Errorf("failed to allocate %d bytes to copy context state", size)
+	}
+	defer C.free(buf)
+	n := C.llama_state_get_data(c.ptr, (*C.uint8_t)(buf), size)
+	if n == 0 || C.llama_state_set_data(fork.ptr, (*C.uint8_t)(buf), n) != n {
+		fork.Free()
+		return nil, errors.New("failed to copy context state")
+	}
+	fork.tokens = append([]Token(nil), c.tokens...)
+	fork.untracked = c.untracked
+	fork.deterministic, fork.eviction, fork.swa = c.deterministic, c.eviction, c.swa
+
+	return fork, nil
+}
+
+// DefragKVCache compacts the KV cache by moving every sequence in turn to
+// fresh cells, saving its state, removing it and restoring it, for
+// long-running contexts whose decodes start failing with DecodeNoKVSlot
+// although enough cells are free. Sequences that shared cells, such as the
+// copies of a prefix made by GenerateMany, each get their own cells
+// afterwards. Only one sequence is held outside the cache at a time, and
+// one that fails to be restored is removed on its own; the error says which
+// sequences were lost.
+func (c *Context) DefragKVCache() error {
+	mem := C.llama_get_memory(c.ptr)
+	var lost []int
+	var errs []error
+	for seq := range int(C.llama_n_seq_max(c.ptr)) {
+		if C.llama_memory_seq_pos_max(mem, C.llama_seq_id(seq)) < 0 {
+			continue
+		}
+		removed, err := c.moveSequence(seq)
+		if removed {
+			lost = append(lost, seq)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("defragmenting the KV cache lost sequences %v: %w", lost, errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// moveSequence saves sequence seq, removes it from the cache and restores
+// it. It reports whether the sequence was lost, a failed restore leaving
+// it removed.
+func (c *Context) moveSequence(seq int) (lost bool, err error) {
+	mem := C.llama_get_memory(c.ptr)
+	id := C.llama_seq_id(seq)
+	size := C.llama_state_seq_get_size(c.ptr, id)
+	buf := C.malloc(size)
+	if buf == nil {
+		return false, fmt.Errorf("failed to allocate %d bytes to save sequence %d", size, seq)
+	}
+	defer C.free(buf)
+	n := C.llama_state_seq_get_data(c.ptr, (*C.uint8_t)(buf), size, id)
+	if n == 0 {
+		return false, fmt.Errorf("failed to save sequence %d", seq)
+	}
+
+	C.llama_memory_seq_rm(mem, id, -1, -1)
+	if C.llama_state_seq_set_data(c.ptr, (*C.uint8_t)(buf), n, id) == 0 {
+		// A partial restore is removed as well
+		C.llama_memory_seq_rm(mem, id, -1, -1)
+		if seq == 0 {
+			c.tokens = c.tokens[:0]
+		}
+		return true, fmt.Errorf("failed to restore sequence %d", seq)
+	}
+	return false, nil
+}
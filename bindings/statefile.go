@@ -0,0 +1,200 @@
+package bindings
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stateMagic starts the files written by SavePromptCache
+const stateMagic = "ALPS"
+
+// stateVersion is the layout of those files. It must be bumped whenever
+// what they hold changes, so that older files fail to load with a clear
+// error instead of being misread.
+const stateVersion = 1
+
+// sessionMagic starts the files of llama_state_save_file, which
+// SavePromptCache wrote before its files had a header of their own
+const sessionMagic = 0x6767736e // "ggsn"
+
+// stateHeader tells what a state file was saved from. The KV cache it
+// holds only makes sense to the same model with the same cache types, and
+// to llama.cpp builds laying out their state alike.
+type stateHeader struct {
+	Version uint32 // stateVersion
+	Session uint32 // LLAMA_SESSION_VERSION of the llama.cpp build
+	stateModel
+	Model string // description of the model, for errors
+}
+
+// stateModel is the part of the header a file must match to be loaded
+type stateModel struct {
+	Params, Size        int64 // of the model
+	Embd, Layers, Vocab int32
+	TypeK, TypeV        int32 // ggml types of the KV cache
+}
+
+// compatible returns an error wrapping ErrStateIncompatible if a file with
+// header h can't be loaded where want describes
+func (h stateHeader) compatible(want stateHeader) error {
+	switch {
+	case h.Version != want.Version:
+		return fmt.Errorf("%w: file format version %d, this build reads version %d", ErrStateIncompatible, h.Version, want.Version)
+	case h.Session != want.Session:
+		return fmt.Errorf("%w: saved by llama.cpp with state version %d, this build has version %d", ErrStateIncompatible, h.Session, want.Session)
+	case h.stateModel != want.stateModel:
+		if h.TypeK != want.TypeK || h.TypeV != want.TypeV {
+			return fmt.Errorf("%w: KV cache of types %d/%d, the context has %d/%d", ErrStateIncompatible, h.TypeK, h.TypeV, want.TypeK, want.TypeV)
+		}
+		return fmt.Errorf("%w: saved with model %q of %d parameters, loaded with %q of %d", ErrStateIncompatible, h.Model, h.Params, want.Model, want.Params)
+	}
+	return nil
+}
+
+// writeStateFile writes the state of a context and the tokens it holds
+// after header h. It goes to a temporary file renamed into place, so that a
+// crash while saving leaves the previous file.
+func writeStateFile(path string, h stateHeader, tokens []Token, state []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString(stateMagic)
+	binary.Write(&buf, le, [2]uint32{h.Version, h.Session})
+	binary.Write(&buf, le, h.stateModel)
+	binary.Write(&buf, le, uint32(len(h.Model)))
+	buf.WriteString(h.Model)
+	binary.Write(&buf, le, uint32(len(tokens)))
+	binary.Write(&buf, le, tokens)
+	binary.Write(&buf, le, uint64(len(state)))
+
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		_, err = f.Write(state)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// errSessionFile is returned by openStateFile for a file in the format of
+// llama_state_save_file, which the caller loads with llama.cpp
+var errSessionFile = errors.New("llama.cpp session file")
+
+// openStateFile opens a file written by writeStateFile and reads its
+// header and tokens, checking that it can be loaded where want describes
+// and that the tokens fit in maxTokens. The file is left at the state,
+// size bytes as llama_state_get_data returned it, for the caller to read
+// and close; the state itself is never read into memory here.
+func openStateFile(path string, want stateHeader, maxTokens int) (f *os.File, tokens []Token, size int64, err error) {
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	tokens, size, err = readStateHeader(f, path, want, maxTokens)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	return f, tokens, size, nil
+}
+
+func readStateHeader(f *os.File, path string, want stateHeader, maxTokens int) ([]Token, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	le := binary.LittleEndian
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	if le.Uint32(magic[:]) == sessionMagic {
+		return nil, 0, errSessionFile
+	}
+	if string(magic[:]) != stateMagic {
+		return nil, 0, fmt.Errorf("%w: %s is not a prompt cache", ErrStateCorrupt, path)
+	}
+
+	var h stateHeader
+	var versions [2]uint32
+	if err := binary.Read(f, le, &versions); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	h.Version, h.Session = versions[0], versions[1]
+	// Later versions may lay out the rest differently
+	if h.Version != want.Version {
+		return nil, 0, h.compatible(want)
+	}
+
+	if err := binary.Read(f, le, &h.stateModel); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	var n uint32
+	if err := binary.Read(f, le, &n); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	if int64(n) > info.Size() {
+		return nil, 0, truncated(path, io.ErrUnexpectedEOF)
+	}
+	model := make([]byte, n)
+	if _, err := io.ReadFull(f, model); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	h.Model = string(model)
+	if err := h.compatible(want); err != nil {
+		return nil, 0, err
+	}
+
+	if err := binary.Read(f, le, &n); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	if int(n) > maxTokens {
+		return nil, 0, fmt.Errorf("prompt cache of %d tokens does not fit in a context of %d", n, maxTokens)
+	}
+	if int64(n)*4 > info.Size() {
+		return nil, 0, truncated(path, io.ErrUnexpectedEOF)
+	}
+	tokens := make([]Token, n)
+	if err := binary.Read(f, le, tokens); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+
+	var size uint64
+	if err := binary.Read(f, le, &size); err != nil {
+		return nil, 0, truncated(path, err)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	if left := info.Size() - offset; size == 0 || size != uint64(left) {
+		return nil, 0, fmt.Errorf("%w: %s holds %d bytes of state, expected %d", ErrStateCorrupt, path, left, size)
+	}
+	return tokens, int64(size), nil
+}
+
+// truncated returns the error of a read of the file at path that failed,
+// wrapping ErrStateCorrupt if it ended early
+func truncated(path string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s is truncated", ErrStateCorrupt, path)
+	}
+	return fmt.Errorf("reading prompt cache %s: %w", path, err)
+}
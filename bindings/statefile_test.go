@@ -0,0 +1,203 @@
+package bindings
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var testStateHeader = stateHeader{
+	Version: stateVersion,
+	Session: 9,
+	stateModel: stateModel{
+		Params: 8_030_261_248,
+		Size:   4_920_734_976,
+		Embd:   4096,
+		Layers: 32,
+		Vocab:  128256,
+		TypeK:  1,
+		TypeV:  1,
+	},
+	Model: "llama 8B Q4_K - Medium",
+}
+
+// readState reads a state file the way LoadPromptCache does
+func readState(path string, want stateHeader, maxTokens int) ([]Token, []byte, error) {
+	f, tokens, size, err := openStateFile(path, want, maxTokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	state := make([]byte, size)
+	if _, err := io.ReadFull(f, state); err != nil {
+		return nil, nil, err
+	}
+	return tokens, state, nil
+}
+
+func writeTestState(t *testing.T, h stateHeader) (path string, tokens []Token, state []byte) {
+	t.Helper()
+	path = filepath.Join(t.TempDir(), "conv.state")
+	tokens = []Token{1, 15043, 3186, 29991, 128255}
+	state = []byte("the state of the KV cache")
+	if err := writeStateFile(path, h, tokens, state); err != nil {
+		t.Fatal(err)
+	}
+	return path, tokens, state
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path, tokens, state := writeTestState(t, testStateHeader)
+
+	gotTokens, gotState, err := readState(path, testStateHeader, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(gotTokens, tokens) {
+		t.Errorf("tokens = %v, want %v", gotTokens, tokens)
+	}
+	if string(gotState) != string(state) {
+		t.Errorf("state = %q, want %q", gotState, state)
+	}
+
+	// Saving again replaces the file and leaves no temporary file behind
+	if err := writeStateFile(path, testStateHeader, tokens[:2], state); err != nil {
+		t.Fatal(err)
+	}
+	if gotTokens, _, err = readState(path, testStateHeader, 16); err != nil || !slices.Equal(gotTokens, tokens[:2]) {
+		t.Errorf("after saving again, tokens = %v, %v, want %v", gotTokens, err, tokens[:2])
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want 1", len(entries))
+	}
+}
+
+func TestStateFileEmptyTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conv.state")
+	if err := writeStateFile(path, testStateHeader, nil, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	tokens, state, err := readState(path, testStateHeader, 16)
+	if err != nil || len(tokens) != 0 || len(state) != 1 {
+		t.Errorf("readState = %v, %v, %v, want no tokens and 1 byte of state", tokens, state, err)
+	}
+}
+
+func TestStateFileIncompatible(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(h *stateHeader)
+	}{
+		{"newer format", func(h *stateHeader) { h.Version++ }},
+		{"older format", func(h *stateHeader) { h.Version-- }},
+		{"llama.cpp state version", func(h *stateHeader) { h.Session++ }},
+		{"model parameters", func(h *stateHeader) { h.Params--; h.Model = "llama 7B Q4_K - Medium" }},
+		{"model size", func(h *stateHeader) { h.Size *= 2 }},
+		{"embedding size", func(h *stateHeader) { h.Embd = 2048 }},
+		{"layers", func(h *stateHeader) { h.Layers = 16 }},
+		{"vocabulary", func(h *stateHeader) { h.Vocab = 32000 }},
+		{"K cache type", func(h *stateHeader) { h.TypeK = 8 }},
+		{"V cache type", func(h *stateHeader) { h.TypeV = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := testStateHeader
+			tt.change(&saved)
+
+			// The file was saved by a build differing from the loading one,
+			// and the other way around
+			for _, h := range [][2]stateHeader{{saved, testStateHeader}, {testStateHeader, saved}} {
+				path, _, _ := writeTestState(t, h[0])
+				_, _, err := readState(path, h[1], 16)
+				if !errors.Is(err, ErrStateIncompatible) {
+					t.Errorf("err = %v, want ErrStateIncompatible", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStateFileDescriptionIgnored(t *testing.T) {
+	saved := testStateHeader
+	saved.Model = "llama 8B Q4_K"
+	path, _, _ := writeTestState(t, saved)
+	if _, _, err := readState(path, testStateHeader, 16); err != nil {
+		t.Errorf("a description changed by llama.cpp fails the load: %v", err)
+	}
+}
+
+func TestStateFileTooManyTokens(t *testing.T) {
+	path, tokens, _ := writeTestState(t, testStateHeader)
+	_, _, err := readState(path, testStateHeader, len(tokens)-1)
+	if err == nil || errors.Is(err, ErrStateIncompatible) || errors.Is(err, ErrStateCorrupt) {
+		t.Errorf("err = %v, want an error about the context size", err)
+	}
+}
+
+func TestStateFileTruncated(t *testing.T) {
+	path, _, _ := writeTestState(t, testStateHeader)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(data) {
+		if err := os.WriteFile(path, data[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readState(path, testStateHeader, 16); !errors.Is(err, ErrStateCorrupt) {
+			t.Fatalf("file cut to %d of %d bytes: err = %v, want ErrStateCorrupt", n, len(data), err)
+		}
+	}
+
+	// Trailing bytes are as wrong as missing ones
+	if err := os.WriteFile(path, append(data, 0), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readState(path, testStateHeader, 16); !errors.Is(err, ErrStateCorrupt) {
+		t.Errorf("file with a trailing byte: err = %v, want ErrStateCorrupt", err)
+	}
+}
+
+func TestStateFileNotPromptCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conv.state")
+	if err := os.WriteFile(path, []byte("GGUF\x03\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := readState(path, testStateHeader, 16)
+	if !errors.Is(err, ErrStateCorrupt) {
+		t.Errorf("err = %v, want ErrStateCorrupt", err)
+	}
+}
+
+func TestStateFileReadError(t *testing.T) {
+	// Failing to read a file says nothing about what it holds
+	dir := t.TempDir()
+	for _, path := range []string{dir, filepath.Join(dir, "missing.state")} {
+		if _, _, err := readState(path, testStateHeader, 16); err == nil || errors.Is(err, ErrStateCorrupt) {
+			t.Errorf("%s: err = %v, want a read error", path, err)
+		}
+	}
+}
+
+func TestStateFileSessionFallback(t *testing.T) {
+	// The start of a file of llama_state_save_file: magic, version and
+	// token count
+	path := filepath.Join(t.TempDir(), "conv.state")
+	data := binary.LittleEndian.AppendUint32(nil, sessionMagic)
+	data = binary.LittleEndian.AppendUint32(data, 9)
+	data = binary.LittleEndian.AppendUint32(data, 0)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readState(path, testStateHeader, 16); err != errSessionFile {
+		t.Errorf("err = %v, want errSessionFile", err)
+	}
+}
@@ -0,0 +1,96 @@
+package bindings
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// PhaseStats accounts the time spent in llama.cpp in one phase of inference
+type PhaseStats struct {
+	Calls  int64
+	Tokens int64
+	Time   time.Duration
+}
+
+// InferenceStats is the time spent in llama.cpp since the process started,
+// across all contexts. pprof can't see into C code, so CPU time inside
+// the library shows up as cgo calls; these counters attribute it.
+type InferenceStats struct {
+	// Prefill counts prompt tokens evaluated and Decode the sampled tokens
+	// fed back in; a batch mixing both has its time split by token count
+	Prefill PhaseStats
+	Decode  PhaseStats
+	Sample  PhaseStats
+
+	PromptCache CacheStats
+}
+
+// CacheStats counts how often prompts reused the tokens a context's KV
+// cache already held for an earlier prompt, instead of evaluating them
+type CacheStats struct {
+	Hits   int64 // prompts reusing cached tokens
+	Misses int64 // prompts evaluated from the start
+	Tokens int64 // prompt tokens of both
+	Saved  int64 // prompt tokens taken from the cache
+}
+
+// phaseCounters are the counters of a PhaseStats
+type phaseCounters struct {
+	calls, tokens, nanos atomic.Int64
+}
+
+func (p *phaseCounters) add(tokens int, d time.Duration) {
+	p.calls.Add(1)
+	p.tokens.Add(int64(tokens))
+	p.nanos.Add(int64(d))
+}
+
+func (p *phaseCounters) read() PhaseStats {
+	return PhaseStats{Calls: p.calls.Load(), Tokens: p.tokens.Load(), Time: time.Duration(p.nanos.Load())}
+}
+
+var stats struct {
+	prefill, decode, sample phaseCounters
+
+	hits, misses, promptTokens, saved atomic.Int64
+}
+
+// ReadInferenceStats returns the counters of time spent in llama.cpp
+func ReadInferenceStats() InferenceStats {
+	return InferenceStats{
+		Prefill: stats.prefill.read(), Decode: stats.decode.read(), Sample: stats.sample.read(),
+		PromptCache: CacheStats{
+			Hits: stats.hits.Load(), Misses: stats.misses.Load(),
+			Tokens: stats.promptTokens.Load(), Saved: stats.saved.Load(),
+		},
+	}
+}
+
+// PublishExpvar publishes the counters of ReadInferenceStats as an expvar
+// with the given name, served at /debug/vars by expvar's handler
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return ReadInferenceStats() }))
+}
+
+// accountDecode records a decoded batch of prompt and generated tokens
+func accountDecode(tokens, generated int, d time.Duration) {
+	generated = min(generated, tokens)
+	if prompt := tokens - generated; prompt > 0 {
+		stats.prefill.add(prompt, d*time.Duration(prompt)/time.Duration(tokens))
+	}
+	if generated > 0 {
+		stats.decode.add(generated, d*time.Duration(generated)/time.Duration(tokens))
+	}
+}
+
+// accountPrompt records a prompt of tokens of which cached were reused
+func accountPrompt(tokens, cached int) {
+	if cached > 0 {
+		stats.hits.Add(1)
+	} else {
+		stats.misses.Add(1)
+	}
+	stats.promptTokens.Add(int64(tokens))
+	stats.saved.Add(int64(cached))
+}
@@ -0,0 +1,262 @@
+package bindings
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matthiase/alpaca/jinja"
+)
+
+// PromptTemplate formats a conversation for a model family. Built-in
+// templates are used for models whose GGUF file lacks a chat template.
+type PromptTemplate struct {
+	Name string
+
+	// Format renders the messages into a prompt. When addAssistant is set
+	// the prompt ends with the start of an assistant reply.
+	Format func(messages []ChatMessage, addAssistant bool) string
+
+	// Stop holds the strings that end a turn, for models that don't mark
+	// them as end-of-generation tokens
+	Stop []string
+}
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]PromptTemplate{}
+)
+
+func init() {
+	for _, t := range []PromptTemplate{
+		{Name: "chatml", Format: formatChatML, Stop: []string{"<|im_end|>"}},
+		{Name: "llama3", Format: formatLlama3, Stop: []string{"<|eot_id|>"}},
+		{Name: "mistral", Format: formatMistral, Stop: []string{"</s>"}},
+		{Name: "gemma", Format: formatGemma, Stop: []string{"<end_of_turn>"}},
+		{Name: "phi3", Format: formatPhi3, Stop: []string{"<|end|>"}},
+	} {
+		RegisterTemplate(t)
+	}
+}
+
+// RegisterTemplate makes a template available by name, replacing any
+// template already registered with that name
+func RegisterTemplate(t PromptTemplate) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates[t.Name] = t
+}
+
+// LookupTemplate returns the template registered with the given name
+func LookupTemplate(name string) (PromptTemplate, bool) {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	t, ok := templates[name]
+	return t, ok
+}
+
+// TemplateNames returns the names of all registered templates
+func TemplateNames() []string {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TemplateFamily is the prompt format a chat template follows. Families are
+// named after the built-in PromptTemplate producing the same format.
+type TemplateFamily string
+
+const (
+	FamilyUnknown TemplateFamily = ""
+	FamilyChatML  TemplateFamily = "chatml"
+	FamilyLlama3  TemplateFamily = "llama3"
+	FamilyMistral TemplateFamily = "mistral"
+	FamilyGemma   TemplateFamily = "gemma"
+)
+
+// familyMarkers are the tokens that identify each family in template source
+var familyMarkers = []struct {
+	family TemplateFamily
+	marker string
+}{
+	{FamilyChatML, "<|im_start|>"},
+	{FamilyLlama3, "<|start_header_id|>"},
+	{FamilyGemma, "<start_of_turn>"},
+	{FamilyMistral, "[INST]"},
+}
+
+// DetectTemplateFamily reports the family of a chat template, given as Jinja
+// source or as the name of a template, or FamilyUnknown
+func DetectTemplateFamily(tmpl string) TemplateFamily {
+	for _, m := range familyMarkers {
+		if TemplateFamily(tmpl) == m.family || strings.Contains(tmpl, m.marker) {
+			return m.family
+		}
+	}
+	return FamilyUnknown
+}
+
+// Stop returns the strings that end a turn in the family's format
+func (f TemplateFamily) Stop() []string {
+	if f == FamilyUnknown {
+		return nil
+	}
+	t, _ := LookupTemplate(string(f))
+	return t.Stop
+}
+
+func formatChatML(messages []ChatMessage, addAssistant bool) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		b.WriteString("<|im_start|>" + msg.Role + "\n" + msg.Content + "<|im_end|>\n")
+	}
+	if addAssistant {
+		b.WriteString("<|im_start|>assistant\n")
+	}
+	return b.String()
+}
+
+func formatLlama3(messages []ChatMessage, addAssistant bool) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		b.WriteString("<|start_header_id|>" + msg.Role + "<|end_header_id|>\n\n" + strings.TrimSpace(msg.Content) + "<|eot_id|>")
+	}
+	if addAssistant {
+		b.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+	}
+	return b.String()
+}
+
+// formatMistral needs no assistant prefix, the reply follows [/INST] directly
+func formatMistral(messages []ChatMessage, _ bool) string {
+	var b strings.Builder
+	system, messages := splitSystem(messages)
+	for i, msg := range messages {
+		switch msg.Role {
+		case RoleAssistant:
+			b.WriteString(" " + strings.TrimSpace(msg.Content) + "</s>")
+		default:
+			content := strings.TrimSpace(msg.Content)
+			if i == 0 && system != "" {
+				content = system + "\n\n" + content
+			}
+			b.WriteString("[INST] " + content + " [/INST]")
+		}
+	}
+	return b.String()
+}
+
+func formatGemma(messages []ChatMessage, addAssistant bool) string {
+	var b strings.Builder
+	system, messages := splitSystem(messages)
+	for i, msg := range messages {
+		role := msg.Role
+		if role == RoleAssistant {
+			role = "model"
+		}
+		content := strings.TrimSpace(msg.Content)
+		if i == 0 && system != "" {
+			content = system + "\n\n" + content
+		}
+		b.WriteString("<start_of_turn>" + role + "\n" + content + "<end_of_turn>\n")
+	}
+	if addAssistant {
+		b.WriteString("<start_of_turn>model\n")
+	}
+	return b.String()
+}
+
+func formatPhi3(messages []ChatMessage, addAssistant bool) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		b.WriteString("<|" + msg.Role + "|>\n" + msg.Content + "<|end|>\n")
+	}
+	if addAssistant {
+		b.WriteString("<|assistant|>\n")
+	}
+	return b.String()
+}
+
+// splitSystem separates a leading system message for templates that fold it
+// into the first user message
+func splitSystem(messages []ChatMessage) (string, []ChatMessage) {
+	if len(messages) > 0 && messages[0].Role == RoleSystem {
+		return strings.TrimSpace(messages[0].Content), messages[1:]
+	}
+	return "", messages
+}
+
+// RenderChatTemplate renders a Jinja chat template with the given messages
+// and extra variables. A leading bos_token is removed from the result since
+// tokenizing the prompt adds it again.
+func RenderChatTemplate(tmpl string, messages []ChatMessage, addAssistant bool, vars map[string]any) (string, error) {
+	msgs := make([]templateMessage, len(messages))
+	for i, msg := range messages {
+		msgs[i] = newTemplateMessage(msg)
+	}
+	all := map[string]any{
+		"messages":              msgs,
+		"add_generation_prompt": addAssistant,
+		"bos_token":             "",
+		"eos_token":             "",
+	}
+	for k, v := range vars {
+		all[k] = v
+	}
+
+	out, err := jinja.Render(tmpl, all)
+	if err != nil {
+		return "", err
+	}
+	if bos, _ := all["bos_token"].(string); bos != "" {
+		out = strings.TrimPrefix(out, bos)
+	}
+	return out, nil
+}
+
+// templateMessage is a message as Hugging Face chat templates see it. The
+// template reads it through its JSON encoding, which keeps the fields and
+// the keys of the arguments in order.
+type templateMessage struct {
+	Role       string             `json:"role"`
+	Content    string             `json:"content"`
+	ToolCalls  []templateToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string             `json:"tool_call_id,omitempty"`
+}
+
+type templateToolCall struct {
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+func newTemplateMessage(msg ChatMessage) templateMessage {
+	m := templateMessage{Role: msg.Role, Content: msg.Content, ToolCallID: msg.ToolCallID}
+	for _, call := range msg.ToolCalls {
+		tc := templateToolCall{ID: call.ID, Type: "function"}
+		tc.Function.Name = call.Name
+		// Templates expect the arguments as an object; those that aren't
+		// valid JSON are passed as the string they are
+		tc.Function.Arguments = json.RawMessage(call.Arguments)
+		if !json.Valid(tc.Function.Arguments) {
+			tc.Function.Arguments, _ = json.Marshal(call.Arguments)
+		}
+		m.ToolCalls = append(m.ToolCalls, tc)
+	}
+	return m
+}
+
+// isJinjaTemplate reports whether tmpl looks like template source rather than
+// a template name
+func isJinjaTemplate(tmpl string) bool {
+	return strings.Contains(tmpl, "{%") || strings.Contains(tmpl, "{{")
+}
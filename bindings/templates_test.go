@@ -0,0 +1,35 @@
+package bindings
+
+import "testing"
+
+// toolTemplate renders tool calls and responses the way the Qwen2.5 and
+// Hermes templates do
+const toolTemplate = `{%- for m in messages %}
+{{- '<|' + m.role + '|>' + m.content }}
+{%- for call in m.tool_calls %}
+{{- '<call id=' + call.id + '>' + call.function.name + ' ' + call.function.arguments | tojson + '</call>' }}
+{%- endfor %}
+{%- if m.tool_call_id %}{{ ' for ' + m.tool_call_id }}{% endif %}
+{%- endfor %}`
+
+func TestRenderChatTemplateToolCalls(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: RoleUser, Content: "Weather?"},
+		{Role: RoleAssistant, ToolCalls: []ToolCall{
+			{ID: "call_1", Name: "get_weather", Arguments: `{"location": "Paris", "format": "celsius"}`},
+			{ID: "call_2", Name: "echo", Arguments: `not json`},
+		}},
+		{Role: "tool", Content: "22", ToolCallID: "call_1"},
+	}
+	got, err := RenderChatTemplate(toolTemplate, messages, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<|user|>Weather?<|assistant|>` +
+		`<call id=call_1>get_weather {"location": "Paris", "format": "celsius"}</call>` +
+		`<call id=call_2>echo "not json"</call>` +
+		`<|tool|>22 for call_1`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+//go:build !nollama
+
+package bindings
+
+// #include "llama.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Threadpool is a pool of inference threads that several contexts share
+// through ContextParams.Threadpool, so that a process running many contexts
+// doesn't start more threads than it has cores. The contexts take turns:
+// ggml runs one computation at a time on a pool.
+type Threadpool struct {
+	ptr     *C.struct_ggml_threadpool
+	threads int
+
+	// run is held while a context computes on the pool
+	run sync.Mutex
+
+	// users counts the live contexts on the pool; freeing is set when Free
+	// was called while there were some. Both are guarded by mu.
+	mu      sync.Mutex
+	users   int
+	freeing bool
+}
+
+// NewThreadpool starts a pool of threads placed as p says, nil for no
+// pinning and normal priority
+func NewThreadpool(threads int, p *CPUParams) (*Threadpool, error) {
+	if threads <= 0 {
+		return nil, errors.New("a threadpool needs at least one thread")
+	}
+	if p == nil {
+		p = &CPUParams{}
+	}
+	ptr, err := newThreadpool(threads, p)
+	if err != nil {
+		return nil, err
+	}
+	return &Threadpool{ptr: ptr, threads: threads}, nil
+}
+
+// Threads returns the number of threads of the pool
+func (p *Threadpool) Threads() int {
+	return p.threads
+}
+
+// Free stops the pool's threads. While contexts using it are live, it is
+// freed once the last of them is.
+func (p *Threadpool) Free() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users > 0 {
+		p.freeing = true
+		return
+	}
+	p.free()
+}
+
+// free frees the pool; p.mu must be held
+func (p *Threadpool) free() {
+	if p.ptr != nil {
+		C.ggml_threadpool_free(p.ptr)
+		p.ptr = nil
+	}
+}
+
+// attach runs the context's computations on the shared pool
+func (p *Threadpool) attach(c *Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ptr == nil || p.freeing {
+		return errors.New("threadpool is freed")
+	}
+	p.users++
+	c.shared = p
+	C.llama_attach_threadpool(c.ptr, p.ptr, p.ptr)
+	return nil
+}
+
+// release counts a context off the pool, freeing it if Free waits for it
+func (p *Threadpool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users--
+	if p.users == 0 && p.freeing {
+		p.free()
+	}
+}
+
+// usePool takes the context's shared threadpool for a computation until
+// the returned func is called
+func (c *Context) usePool() (done func()) {
+	if c.shared == nil {
+		return func() {}
+	}
+	c.shared.run.Lock()
+	return c.shared.run.Unlock
+}
+
+// attachThreadpools runs the context's threads on threadpools configured by
+// p, one for generation and, when the thread counts differ, one for prompt
+// processing
+func (c *Context) attachThreadpools(p *CPUParams) error {
+	threads, batch := int(c.params.n_threads), int(c.params.n_threads_batch)
+	pool, err := newThreadpool(threads, p)
+	if err != nil {
+		return err
+	}
+	c.threadpool = pool
+	if batch != threads {
+		if c.threadpoolBatch, err = newThreadpool(batch, p); err != nil {
+			return err
+		}
+	}
+	C.llama_attach_threadpool(c.ptr, c.threadpool, c.threadpoolBatch)
+	return nil
+}
+
+// newThreadpool creates a threadpool of n threads
+func newThreadpool(n int, p *CPUParams) (*C.struct_ggml_threadpool, error) {
+	if p.Priority < PriorityLow || p.Priority > PriorityRealtime {
+		return nil, fmt.Errorf("unknown thread priority %d", p.Priority)
+	}
+	if p.Poll < 0 || p.Poll > 100 {
+		return nil, errors.New("poll must be between 0 and 100")
+	}
+
+	params := C.ggml_threadpool_params_default(C.int(n))
+	for _, cpu := range p.CPUs {
+		if cpu < 0 || cpu >= C.GGML_MAX_N_THREADS {
+			return nil, fmt.Errorf("cpu %d is out of range", cpu)
+		}
+		params.cpumask[cpu] = true
+	}
+	params.strict_cpu = C.bool(p.Strict)
+	params.prio = C.enum_ggml_sched_priority(p.Priority)
+	if p.Poll > 0 {
+		params.poll = C.uint32_t(p.Poll)
+	}
+
+	pool := C.ggml_threadpool_new(&params)
+	if pool == nil {
+		return nil, errors.New("failed to create threadpool")
+	}
+	return pool, nil
+}
+
+// freeThreadpools frees the threadpools once the context no longer uses
+// them, and releases a shared one
+func (c *Context) freeThreadpools() {
+	if c.shared != nil {
+		c.shared.release()
+		c.shared = nil
+	}
+	if c.threadpool != nil {
+		C.ggml_threadpool_free(c.threadpool)
+		c.threadpool = nil
+	}
+	if c.threadpoolBatch != nil {
+		C.ggml_threadpool_free(c.threadpoolBatch)
+		c.threadpoolBatch = nil
+	}
+}
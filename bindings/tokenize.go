@@ -0,0 +1,129 @@
+//go:build !nollama
+
+package bindings
+
+// #include <stdlib.h>
+// #include "llama.h"
+import "C"
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+	"unsafe"
+)
+
+// Tokenize converts text into tokens. When addSpecial is set the BOS/EOS
+// tokens configured by the model are added, and when parseSpecial is set
+// special tokens written in the text (e.g. "<|im_start|>") are recognized.
+func (m *Model) Tokenize(text string, addSpecial, parseSpecial bool) ([]Token, error) {
+	if tracing() {
+		start, n := time.Now(), 0
+		defer func() { trace("llama_tokenize", start, slog.Int("bytes", len(text)), slog.Int("tokens", n)) }()
+		tokens, err := m.tokenize(text, addSpecial, parseSpecial)
+		n = len(tokens)
+		return tokens, err
+	}
+	return m.tokenize(text, addSpecial, parseSpecial)
+}
+
+func (m *Model) tokenize(text string, addSpecial, parseSpecial bool) ([]Token, error) {
+	if err := checkInput(len(text)); err != nil {
+		return nil, err
+	}
+	cText := C.CString(text)
+	defer C.free(unsafe.Pointer(cText))
+
+	// A token is never shorter than a byte, so this only needs to grow for
+	// the special tokens that may be added
+	tokens := make([]Token, len(text)+2)
+	n := C.llama_tokenize(m.vocab, cText, C.int32_t(len(text)), tokenPtr(tokens), C.int32_t(len(tokens)), C.bool(addSpecial), C.bool(parseSpecial))
+	if n < 0 {
+		tokens = make([]Token, -n)
+		n = C.llama_tokenize(m.vocab, cText, C.int32_t(len(text)), tokenPtr(tokens), C.int32_t(len(tokens)), C.bool(addSpecial), C.bool(parseSpecial))
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("failed to tokenize text of %d bytes", len(text))
+	}
+
+	return tokens[:n], nil
+}
+
+// TokenizeWithOptions converts text into tokens, adding BOS and EOS as the
+// options decide
+func (m *Model) TokenizeWithOptions(text string, opts TokenizeOptions) ([]Token, error) {
+	tokens, err := m.Tokenize(text, false, opts.ParseSpecial)
+	if err != nil {
+		return nil, err
+	}
+	return frame(tokens, m.BOS(), m.EOS(), opts.AddBOS.add(m.AddsBOS()), opts.AddEOS.add(m.AddsEOS())), nil
+}
+
+// AddsBOS reports whether the model's metadata asks for a BOS token at the
+// start of the input
+func (m *Model) AddsBOS() bool {
+	return bool(C.llama_vocab_get_add_bos(m.vocab))
+}
+
+// AddsEOS reports whether the model's metadata asks for an EOS token at the
+// end of the input
+func (m *Model) AddsEOS() bool {
+	return bool(C.llama_vocab_get_add_eos(m.vocab))
+}
+
+// TokenToPiece returns the text of a single token
+func (m *Model) TokenToPiece(token Token) string {
+	buf := make([]byte, 64)
+	n := C.llama_token_to_piece(m.vocab, C.llama_token(token), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)), 0, false)
+	if n < 0 {
+		buf = make([]byte, -n)
+		n = C.llama_token_to_piece(m.vocab, C.llama_token(token), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)), 0, false)
+	}
+	if n <= 0 {
+		return ""
+	}
+
+	return string(buf[:n])
+}
+
+// Detokenize converts tokens back into text
+func (m *Model) Detokenize(tokens []Token, removeSpecial, unparseSpecial bool) (string, error) {
+	if len(tokens) == 0 {
+		return "", nil
+	}
+
+	buf := make([]byte, len(tokens)*8)
+	n := C.llama_detokenize(m.vocab, tokenPtr(tokens), C.int32_t(len(tokens)), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)), C.bool(removeSpecial), C.bool(unparseSpecial))
+	if n < 0 {
+		buf = make([]byte, -n)
+		n = C.llama_detokenize(m.vocab, tokenPtr(tokens), C.int32_t(len(tokens)), (*C.char)(unsafe.Pointer(&buf[0])), C.int32_t(len(buf)), C.bool(removeSpecial), C.bool(unparseSpecial))
+	}
+	if n < 0 {
+		return "", fmt.Errorf("failed to detokenize %d tokens", len(tokens))
+	}
+
+	return string(buf[:n]), nil
+}
+
+// IsEOG reports whether the token ends generation (EOS, EOT, ...)
+func (m *Model) IsEOG(token Token) bool {
+	return bool(C.llama_vocab_is_eog(m.vocab, C.llama_token(token)))
+}
+
+// BOS returns the beginning-of-sequence token, or -1 if the model has none
+func (m *Model) BOS() Token {
+	return Token(C.llama_vocab_bos(m.vocab))
+}
+
+// EOS returns the end-of-sequence token, or -1 if the model has none
+func (m *Model) EOS() Token {
+	return Token(C.llama_vocab_eos(m.vocab))
+}
+
+// tokenPtr returns a C pointer to the first token of the slice
+func tokenPtr(tokens []Token) *C.llama_token {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return (*C.llama_token)(unsafe.Pointer(&tokens[0]))
+}
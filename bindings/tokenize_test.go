@@ -0,0 +1,190 @@
+//go:build !nollama
+
+package bindings
+
+import (
+	"cmp"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// The tokenizer tests load vocab-only GGUF files, such as those llama.cpp
+// keeps in its models directory, which the defaults point at
+const (
+	spmVocabEnv = "ALPACA_TEST_SPM_VOCAB"
+	bpeVocabEnv = "ALPACA_TEST_BPE_VOCAB"
+
+	defaultSPMVocab = "../llama.cpp/models/ggml-vocab-llama-spm.gguf"
+	defaultBPEVocab = "../llama.cpp/models/ggml-vocab-llama-bpe.gguf"
+)
+
+// tokenizerCases cover whitespace handling and characters that SPM vocabs
+// encode with byte fallback
+var tokenizerCases = []string{
+	"Hello world",
+	" leading space",
+	"  two leading spaces",
+	"double  space",
+	"trailing space ",
+	"new\nline",
+	"\n\nblank lines\n\n",
+	"\ttab",
+	"Alpaca 🦙 emoji",
+	"日本語のテキスト",
+	"Ελληνικά and кириллица",
+	"combining é",
+	"1234567890 3.14159",
+	"func main() {\n\treturn\n}",
+	"<not a special token>",
+}
+
+var vocabFixtures = []struct {
+	name, env, def string
+	typ            VocabType
+}{
+	{"spm", spmVocabEnv, defaultSPMVocab, VocabSPM},
+	{"bpe", bpeVocabEnv, defaultBPEVocab, VocabBPE},
+}
+
+// vocabs loads the fixture vocabularies that are present by name, and
+// skips the test if none is
+func vocabs(t *testing.T) map[string]*Model {
+	t.Helper()
+	out := make(map[string]*Model)
+	for _, f := range vocabFixtures {
+		path := cmp.Or(os.Getenv(f.env), f.def)
+		if _, err := os.Stat(path); err != nil {
+			t.Logf("set %s to test a %s vocabulary: %v", f.env, f.name, err)
+			continue
+		}
+		m := loadTestModel(t, path, ModelParams{VocabOnly: true})
+		if m.VocabType() != f.typ {
+			t.Fatalf("%s has a %v vocabulary, want %v", path, m.VocabType(), f.typ)
+		}
+		out[f.name] = m
+	}
+	if len(out) == 0 {
+		t.Skipf("set %s or %s to run this test", spmVocabEnv, bpeVocabEnv)
+	}
+	return out
+}
+
+func TestTokenizeRoundTrip(t *testing.T) {
+	for name, m := range vocabs(t) {
+		for _, text := range tokenizerCases {
+			tokens, err := m.Tokenize(text, true, false)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := m.Detokenize(tokens, true, false)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got != text {
+				t.Errorf("%s: %q detokenized to %q", name, text, got)
+			}
+		}
+	}
+}
+
+func TestTokenPieces(t *testing.T) {
+	for name, m := range vocabs(t) {
+		for _, text := range tokenizerCases {
+			tokens, err := m.Tokenize(text, false, false)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			// Pieces are bytes, a character may be split over several of
+			// them; SPM vocabs may add a leading space
+			var b strings.Builder
+			for _, token := range tokens {
+				b.WriteString(m.TokenToPiece(token))
+			}
+			pieces := b.String()
+			if !strings.HasSuffix(pieces, text) || strings.TrimLeft(strings.TrimSuffix(pieces, text), " ") != "" {
+				t.Errorf("%s: pieces of %q join to %q", name, text, pieces)
+			}
+		}
+	}
+}
+
+func TestByteFallback(t *testing.T) {
+	for name, m := range vocabs(t) {
+		if m.VocabType() != VocabSPM {
+			continue
+		}
+		// The llama is too recent for the vocabulary, its bytes are tokens
+		tokens, err := m.Tokenize("🦙", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		split := false
+		for _, token := range tokens {
+			if p := m.TokenToPiece(token); p != "" && !utf8.ValidString(p) {
+				split = true
+			}
+		}
+		if !split {
+			t.Errorf("%s: 🦙 tokenized to %v without byte tokens", name, tokens)
+		}
+	}
+}
+
+func TestSpecialTokens(t *testing.T) {
+	for name, m := range vocabs(t) {
+		for _, token := range []Token{m.BOS(), m.EOS()} {
+			if token < 0 {
+				continue
+			}
+			text, err := m.Detokenize([]Token{token}, false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text == "" {
+				t.Errorf("%s: special token %d has no text", name, token)
+				continue
+			}
+
+			tokens, err := m.Tokenize(text, false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 1 || tokens[0] != token {
+				t.Errorf("%s: %q tokenized to %v, want [%d]", name, text, tokens, token)
+			}
+
+			// Without parseSpecial the text is only text
+			tokens, err = m.Tokenize(text, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) == 1 && tokens[0] == token {
+				t.Errorf("%s: %q was parsed as special without parseSpecial", name, text)
+			}
+		}
+	}
+}
+
+func TestTokenizeAddsBOS(t *testing.T) {
+	for name, m := range vocabs(t) {
+		if !m.AddsBOS() {
+			continue
+		}
+		tokens, err := m.Tokenize("Hello", true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) == 0 || tokens[0] != m.BOS() {
+			t.Errorf("%s: %v does not start with BOS %d", name, tokens, m.BOS())
+		}
+		without, err := m.Tokenize("Hello", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(without) != len(tokens)-1 {
+			t.Errorf("%s: %d tokens with BOS, %d without", name, len(tokens), len(without))
+		}
+	}
+}
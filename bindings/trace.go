@@ -0,0 +1,49 @@
+package bindings
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tracer receives a debug record per binding call when tracing is on
+var tracer atomic.Pointer[slog.Logger]
+
+func init() {
+	if os.Getenv("ALPACA_TRACE") != "" {
+		SetTraceLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+}
+
+// SetTraceLogger turns on tracing: every call into llama.cpp — loading,
+// tokenizing, each decoded batch and sampled token, and the phases of a
+// generation — is logged at debug level with its parameters and duration.
+// nil turns tracing off. Setting ALPACA_TRACE in the environment traces to
+// stderr from the start.
+func SetTraceLogger(l *slog.Logger) {
+	tracer.Store(l)
+}
+
+// tracing reports whether calls are traced, so that callers can skip
+// building attributes
+func tracing() bool {
+	l := tracer.Load()
+	return l != nil && l.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// trace logs a call that started at start. It is meant to be deferred
+// behind a tracing check:
+//
+//	if tracing() {
+//		defer trace("llama_decode", time.Now(), slog.Int("tokens", n))
+//	}
+func trace(op string, start time.Time, attrs ...slog.Attr) {
+	l := tracer.Load()
+	if l == nil {
+		return
+	}
+	attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+	l.LogAttrs(context.Background(), slog.LevelDebug, op, attrs...)
+}
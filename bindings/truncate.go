@@ -0,0 +1,105 @@
+package bindings
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPromptTooLong is returned when a prompt does not fit in the context and
+// truncation is disabled
+var ErrPromptTooLong = errors.New("prompt exceeds context size")
+
+// TruncateStrategy decides what happens when a prompt does not fit in the context
+type TruncateStrategy int
+
+const (
+	// TruncateError fails with ErrPromptTooLong
+	TruncateError TruncateStrategy = iota
+	// TruncateLeft drops the oldest tokens after the first KeepTokens
+	TruncateLeft
+	// TruncateMiddle drops tokens from the middle, keeping the beginning and the end
+	TruncateMiddle
+)
+
+// String returns the name of the strategy
+func (s TruncateStrategy) String() string {
+	switch s {
+	case TruncateError:
+		return "error"
+	case TruncateLeft:
+		return "left"
+	case TruncateMiddle:
+		return "middle"
+	default:
+		return fmt.Sprintf("TruncateStrategy(%d)", int(s))
+	}
+}
+
+// truncateTokens fits tokens into a context of nCtx tokens, leaving room for
+// reserve generated tokens. The first keep tokens (e.g. the system prompt)
+// are never removed.
+func truncateTokens(tokens []Token, nCtx, keep, reserve int, strategy TruncateStrategy) ([]Token, error) {
+	if len(tokens) < nCtx {
+		return tokens, nil
+	}
+	if strategy == TruncateError {
+		return nil, fmt.Errorf("%w: %d tokens, context size %d", ErrPromptTooLong, len(tokens), nCtx)
+	}
+
+	keep = max(0, min(keep, len(tokens)))
+	// Without an explicit budget leave half of the remaining space for the
+	// completion, like llama.cpp does when it truncates
+	if reserve <= 0 || reserve >= nCtx-keep {
+		reserve = (nCtx - keep) / 2
+	}
+	limit := nCtx - reserve
+	if keep >= limit {
+		return nil, fmt.Errorf("%w: %d tokens must be kept, context size %d", ErrPromptTooLong, keep, nCtx)
+	}
+
+	out := make([]Token, 0, limit)
+	switch strategy {
+	case TruncateLeft:
+		out = append(out, tokens[:keep]...)
+		out = append(out, tokens[len(tokens)-(limit-keep):]...)
+	case TruncateMiddle:
+		head := max(keep, limit/2)
+		out = append(out, tokens[:head]...)
+		out = append(out, tokens[len(tokens)-(limit-head):]...)
+	default:
+		return nil, fmt.Errorf("unknown truncation strategy %s", strategy)
+	}
+
+	return out, nil
+}
+
+// keepTokens returns how many leading tokens of prompt truncation and
+// context shifts keep: at least keep, and all those it shares with head,
+// the tokens of the messages a session pins. Templates may render the end of
+// a message differently when more follow, so only the tokens both agree on
+// are pinned.
+func keepTokens(head, prompt []Token, keep int) int {
+	return min(max(keep, commonPrefix(head, prompt)), len(prompt))
+}
+
+// contextShift returns how many leading tokens a full context of n tokens
+// keeps when it shifts, keep unless that leaves nothing to discard, and how
+// many of the tokens after them it discards: half, to make room for the rest
+func contextShift(n, keep int) (kept, discard int) {
+	kept = max(min(keep, n-2), 0)
+	return kept, (n - kept) / 2
+}
+
+// shiftTokens removes the n tokens after the first keep from tokens
+func shiftTokens(tokens []Token, keep, n int) []Token {
+	return append(tokens[:keep], tokens[keep+n:]...)
+}
+
+// commonPrefix returns the number of leading tokens a and b share
+func commonPrefix(a, b []Token) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,161 @@
+package bindings
+
+import (
+	"hash/fnv"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestContextShift(t *testing.T) {
+	tests := []struct {
+		n, keep       int
+		kept, discard int
+	}{
+		{100, 0, 0, 50},
+		{100, 10, 10, 45},
+		{101, 10, 10, 45},
+		{100, 97, 97, 1},
+		{100, 98, 98, 1},
+		{100, 99, 98, 1}, // something is always discarded
+		{100, 500, 98, 1},
+		{100, -3, 0, 50},
+		{2, 1, 0, 1},
+		{1, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		kept, discard := contextShift(tt.n, tt.keep)
+		if kept != tt.kept || discard != tt.discard {
+			t.Errorf("contextShift(%d, %d) = %d, %d, want %d, %d", tt.n, tt.keep, kept, discard, tt.kept, tt.discard)
+		}
+	}
+}
+
+func TestShiftTokens(t *testing.T) {
+	got := shiftTokens([]Token{0, 1, 2, 3, 4, 5, 6}, 2, 3)
+	if want := []Token{0, 1, 5, 6}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestKeepTokens(t *testing.T) {
+	tests := []struct {
+		name         string
+		head, prompt []Token
+		keep, want   int
+	}{
+		{"nothing pinned", nil, []Token{1, 2, 3}, 0, 0},
+		{"KeepTokens alone", nil, []Token{1, 2, 3}, 2, 2},
+		{"head", []Token{1, 2}, []Token{1, 2, 3, 4}, 0, 2},
+		{"head rendered differently at its end", []Token{1, 2, 9}, []Token{1, 2, 3, 4}, 0, 2},
+		{"KeepTokens beyond the head", []Token{1, 2}, []Token{1, 2, 3, 4}, 3, 3},
+		{"head beyond KeepTokens", []Token{1, 2, 3}, []Token{1, 2, 3, 4}, 1, 3},
+		{"KeepTokens beyond the prompt", nil, []Token{1, 2}, 5, 2},
+		{"stale head", []Token{7, 8}, []Token{1, 2, 3}, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := keepTokens(tt.head, tt.prompt, tt.keep); got != tt.want {
+			t.Errorf("%s: keepTokens(%v, %v, %d) = %d, want %d", tt.name, tt.head, tt.prompt, tt.keep, got, tt.want)
+		}
+	}
+}
+
+// renderTokens formats messages like a chat template and tokenizes them by
+// word. A message ends with <end> when it is the last one of a prompt that
+// doesn't open the reply, like templates that render the end of a message
+// differently when more follow.
+func renderTokens(messages []ChatMessage, open bool) []Token {
+	var words []string
+	for i, m := range messages {
+		words = append(words, "<"+m.Role+">")
+		words = append(words, strings.Fields(m.Content)...)
+		if i == len(messages)-1 && !open {
+			words = append(words, "<end>")
+		} else {
+			words = append(words, "<eot>")
+		}
+	}
+	if open {
+		words = append(words, "<assistant>")
+	}
+	tokens := make([]Token, len(words))
+	for i, w := range words {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		tokens[i] = Token(h.Sum32() >> 1)
+	}
+	return tokens
+}
+
+// TestShiftKeepsPinned follows a session turn: the pinned messages, with the
+// summary of earlier turns if there is one, are kept through truncation and
+// every context shift while the reply is generated
+func TestShiftKeepsPinned(t *testing.T) {
+	turn := []ChatMessage{msg(RoleUser, "u1"), msg(RoleAssistant, "a1"), msg(RoleUser, "u2")}
+	pinned := []ChatMessage{msg(RoleUser, "p1"), msg(RoleAssistant, "p2")}
+	tests := []struct {
+		name    string
+		system  string
+		pinned  []ChatMessage
+		summary string
+		keep    int // GenerateOptions.KeepTokens
+		nCtx    int
+	}{
+		{"nothing pinned", "", nil, "", 0, 40},
+		{"KeepTokens alone", "", nil, "", 5, 40},
+		{"system prompt", "You are a helpful llama.", nil, "", 0, 40},
+		{"pinned messages", "", pinned, "", 0, 64},
+		{"system prompt and pinned messages", "Be brief.", pinned, "", 0, 64},
+		{"summary", "", nil, "The user asked about alpacas.", 0, 48},
+		{"system prompt and summary", "Be brief.", pinned, "The user asked about alpacas.", 0, 80},
+		{"KeepTokens beyond the head", "Be brief.", nil, "", 20, 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := sessionHead(tt.system, tt.pinned, tt.summary)
+			head := renderTokens(messages, false)
+			if len(messages) == 0 {
+				head = nil
+			}
+			prompt := renderTokens(append(messages, turn...), true)
+			keep := keepTokens(head, prompt, tt.keep)
+			// The last token of the head is rendered differently
+			if pin := max(len(head)-1, 0); keep < pin || keep < min(tt.keep, len(prompt)) {
+				t.Fatalf("keeps %d tokens, the head has %d", keep, len(head))
+			}
+			want := slices.Clone(prompt[:keep])
+
+			tokens, err := truncateTokens(prompt, tt.nCtx, keep, 8, TruncateLeft)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range 3 * tt.nCtx {
+				if len(tokens) >= tt.nCtx {
+					kept, discard := contextShift(len(tokens), keep)
+					tokens = shiftTokens(tokens, kept, discard)
+				}
+				tokens = append(tokens, Token(i))
+				if !slices.Equal(tokens[:keep], want) {
+					t.Fatalf("after %d tokens the context starts with %v, want %v", i+1, tokens[:keep], want)
+				}
+			}
+		})
+	}
+}
+
+// TestSummaryChangesHead checks that once turns are summarized, the tokens
+// pinned for the former summary no longer match the prompt
+func TestSummaryChangesHead(t *testing.T) {
+	turn := []ChatMessage{msg(RoleUser, "u2")}
+	before := renderTokens(sessionHead("Be brief.", nil, "The user said hello."), false)
+	after := sessionHead("Be brief.", nil, "The user said hello and asked about alpacas.")
+	prompt := renderTokens(append(after, turn...), true)
+
+	head := renderTokens(after, false)
+	if got := keepTokens(head, prompt, 0); got != len(head)-1 {
+		t.Errorf("the current head pins %d tokens, want %d", got, len(head)-1)
+	}
+	if got := keepTokens(before, prompt, 0); got >= len(before)-1 {
+		t.Errorf("the former head pins %d of its %d tokens", got, len(before))
+	}
+}
@@ -0,0 +1,1009 @@
+package bindings
+
+// This file holds the types shared by the llama.cpp bindings and the
+// nollama stubs.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotBuilt is returned by every function that needs llama.cpp when the
+// package is built with the nollama tag
+var ErrNotBuilt = errors.New("alpaca was built without llama.cpp (nollama tag)")
+
+// ErrNotReranker is returned by Rerank when the model doesn't pool its
+// output into a relevance score
+var ErrNotReranker = errors.New("model is not a reranker")
+
+// ErrNoEncoder is returned by Encode when the model is decoder-only
+var ErrNoEncoder = errors.New("model has no encoder")
+
+// ErrNoDecoder is returned by generation when the model is encoder-only,
+// such as BERT embedding models
+var ErrNoDecoder = errors.New("model has no decoder")
+
+// ErrNeedsEncode is returned by generation from a prompt when the model is
+// an encoder-decoder, whose input goes through Encode and GenerateEncoded
+var ErrNeedsEncode = errors.New("encoder-decoder models generate with Encode and GenerateEncoded")
+
+// ErrStateIncompatible is returned by LoadPromptCache for a file saved by
+// another version of alpaca or llama.cpp, or from another model or KV cache
+// type, whose state would corrupt the KV cache
+var ErrStateIncompatible = errors.New("prompt cache is incompatible")
+
+// ErrStateCorrupt is returned by LoadPromptCache for a file that isn't a
+// whole prompt cache, e.g. one cut short by a crash. Errors reading the
+// file don't wrap it.
+var ErrStateCorrupt = errors.New("prompt cache is corrupt")
+
+// Token is a single entry in the model's vocabulary
+type Token int32
+
+// ModelParams configures how a model is loaded. Zero values fall back to the
+// llama.cpp defaults.
+type ModelParams struct {
+	// VocabOnly loads only the vocabulary, which takes milliseconds. Such a
+	// model can tokenize and apply chat templates but not create a context.
+	VocabOnly bool
+
+	// NoMmap reads the weights into memory instead of mapping the file.
+	// Mapping is faster to load and shares pages between processes, but
+	// pages can be evicted under memory pressure and read back later.
+	NoMmap bool
+
+	// UseMlock locks the weights in RAM so they are never swapped or
+	// evicted, avoiding page-fault stalls on machines short of memory
+	UseMlock bool
+
+	// TensorOverrides place the weights whose names match a pattern in a
+	// buffer type other than the one their layer is offloaded to, like
+	// llama.cpp's --override-tensor. The first matching override wins.
+	TensorOverrides []TensorOverride
+
+	// ExpertsUsed lowers the number of experts a mixture-of-experts model
+	// runs per token, trading quality for speed, without editing the file.
+	// llama.cpp fixes it when loading, so contexts wanting different counts
+	// need models loaded with each; with mmap they share the weights' pages.
+	// 0 keeps the model's.
+	ExpertsUsed int
+
+	// SplitMode decides how a model is spread over several GPUs, MainGPU
+	// is the GPU used with SplitNone and for the KV cache with SplitRow, and
+	// TensorSplit gives the share of the model each GPU gets, as GPUs lists
+	// them; empty splits by free memory. Loading fails when they name GPUs
+	// that aren't there.
+	SplitMode   SplitMode
+	MainGPU     int
+	TensorSplit []float32
+
+	// GPULayers is the number of layers offloaded to GPUs: 0 offloads them
+	// all, as llama.cpp does by default, GPULayersAuto as many as
+	// PlanOffload finds room for with a context of 4096 tokens, and
+	// GPULayersNone none
+	GPULayers int
+
+	// Fallback decides what happens when the model can't be loaded on the
+	// GPUs, because they are out of memory or their driver is missing
+	Fallback GPUFallback
+}
+
+const (
+	GPULayersNone = -1
+	GPULayersAuto = -2
+)
+
+// GPUFallback is what LoadModelWithParams does when loading a model on GPUs
+// fails. Every retry is logged as a warning.
+type GPUFallback int
+
+const (
+	FallbackNone        GPUFallback = iota // return the error
+	FallbackFewerLayers                    // retry with half the layers offloaded until it loads, down to none
+	FallbackCPU                            // retry once with no layer offloaded
+)
+
+// String returns the name ParseGPUFallback parses
+func (f GPUFallback) String() string {
+	switch f {
+	case FallbackNone:
+		return "none"
+	case FallbackFewerLayers:
+		return "fewer"
+	case FallbackCPU:
+		return "cpu"
+	default:
+		return fmt.Sprintf("GPUFallback(%d)", int(f))
+	}
+}
+
+// ParseGPUFallback parses a fallback policy: none, fewer or cpu
+func ParseGPUFallback(s string) (GPUFallback, error) {
+	switch s {
+	case "none":
+		return FallbackNone, nil
+	case "fewer":
+		return FallbackFewerLayers, nil
+	case "cpu":
+		return FallbackCPU, nil
+	}
+	return 0, fmt.Errorf("unknown GPU fallback %q, want none, fewer or cpu", s)
+}
+
+// SplitMode is how a model is spread over several GPUs
+type SplitMode int
+
+const (
+	SplitLayer SplitMode = iota // whole layers per GPU
+	SplitRow                    // the rows of every weight across GPUs
+	SplitNone                   // everything on MainGPU
+)
+
+// ParseSplitMode parses a split mode as llama.cpp's --split-mode takes it:
+// layer, row or none
+func ParseSplitMode(s string) (SplitMode, error) {
+	switch s {
+	case "layer":
+		return SplitLayer, nil
+	case "row":
+		return SplitRow, nil
+	case "none":
+		return SplitNone, nil
+	}
+	return 0, fmt.Errorf("unknown split mode %q, want layer, row or none", s)
+}
+
+// TensorOverride places the tensors matching Pattern, a regular expression
+// in the syntax of std::regex such as `\.ffn_.*_exps\.`, in BufferType, the
+// name of a buffer type as BufferTypes lists it, e.g. "CPU" or "CUDA0".
+// Keeping the experts of a mixture-of-experts model in CPU memory while the
+// rest is offloaded lets models run that don't fit in VRAM.
+type TensorOverride struct {
+	Pattern    string
+	BufferType string
+}
+
+// ParseTensorOverrides parses overrides in the syntax of llama.cpp's
+// --override-tensor: comma-separated pattern=buffer type pairs, e.g.
+// `exps=CPU,attn=CUDA0`
+func ParseTensorOverrides(s string) ([]TensorOverride, error) {
+	var overrides []TensorOverride
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i <= 0 || i == len(part)-1 {
+			return nil, fmt.Errorf("invalid tensor override %q, want pattern=buffer type", part)
+		}
+		overrides = append(overrides, TensorOverride{Pattern: part[:i], BufferType: part[i+1:]})
+	}
+	return overrides, nil
+}
+
+// RopeType is the rotary position embedding variant of a model, matching
+// llama_rope_type
+type RopeType int
+
+const (
+	RopeNone   RopeType = -1 // no rotary embeddings
+	RopeNorm   RopeType = 0  // consecutive pairs, as in the original Llama
+	RopeNeoX   RopeType = 2  // halves rotated together, as in GPT-NeoX
+	RopeMRoPE  RopeType = 8  // multimodal sections, as in Qwen2-VL
+	RopeVision RopeType = 24 // vision encoders
+)
+
+func (t RopeType) String() string {
+	switch t {
+	case RopeNone:
+		return "none"
+	case RopeNorm:
+		return "norm"
+	case RopeNeoX:
+		return "neox"
+	case RopeMRoPE:
+		return "mrope"
+	case RopeVision:
+		return "vision"
+	}
+	return fmt.Sprintf("RopeType(%d)", int(t))
+}
+
+// VocabType is the tokenizer of a model, matching llama_vocab_type
+type VocabType int
+
+const (
+	VocabNone   VocabType = iota // no vocabulary
+	VocabSPM                     // SentencePiece BPE with byte fallback, as in Llama 2
+	VocabBPE                     // byte-level BPE, as in GPT-2 and Llama 3
+	VocabWPM                     // WordPiece, as in BERT
+	VocabUGM                     // SentencePiece unigram, as in T5
+	VocabRWKV                    // greedy tokenization with a trie, as in RWKV
+	VocabPLaMo2                  // PLaMo-2
+)
+
+func (t VocabType) String() string {
+	names := []string{"none", "spm", "bpe", "wpm", "ugm", "rwkv", "plamo2"}
+	if t >= 0 && int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("VocabType(%d)", int(t))
+}
+
+// ContextParams configures an inference context. Zero values fall back to
+// the llama.cpp defaults.
+type ContextParams struct {
+	ContextSize  int // n_ctx, 0 uses the size the model was trained with
+	BatchSize    int // n_batch, the maximum number of tokens per decode
+	Threads      int // threads used for generation
+	ThreadsBatch int // threads used for prompt processing
+	Sequences    int // n_seq_max, the number of sequences sharing the KV cache
+
+	// UBatchSize is n_ubatch, the physical batch size: decodes are split
+	// into pieces of this many tokens for the backend. Larger values speed up
+	// prompt processing on GPUs at the cost of memory. It is capped at
+	// BatchSize, and embedding models that aren't causal need it to hold a
+	// whole input.
+	UBatchSize int
+
+	// Deterministic makes repeated calls give bit-identical results on the
+	// same machine and build, for environments that must reproduce outputs.
+	// Everything runs on one thread with a single micro-batch per decode and
+	// flash attention off. Generate evaluates the whole prompt every time
+	// rather than reusing a cached prefix, since logits depend on how the
+	// prompt was split into batches, and the random DefaultSeed is replaced
+	// by 0. GPU kernels may still differ between devices and drivers.
+	Deterministic bool
+
+	// DefragThreshold defragments the KV cache during decode once more than
+	// this fraction of it is fragmented. 0 keeps the llama.cpp default, a
+	// negative value disables it.
+	DefragThreshold float32
+
+	// Eviction decides what may be evicted when the KV cache is full during
+	// Generate and the other high-level calls, which then retry the decode
+	// once before failing
+	Eviction EvictionPolicy
+
+	// CPU pins the inference threads to CPUs and sets their priority, so
+	// that latency-sensitive deployments can keep them away from the cores
+	// handling network I/O. nil leaves scheduling to the operating system.
+	CPU *CPUParams
+
+	// Threadpool runs the context on a pool shared with other contexts
+	// instead of threads of its own. It can't be combined with CPU, which
+	// the pool was created with, and must be freed after the contexts.
+	Threadpool *Threadpool
+
+	// RopeScaling decides how a ContextSize beyond the model's training
+	// context is reached; Model.RopeScalingFor shows what Auto picks
+	RopeScaling RopeScaling
+
+	// SmallSWACache sizes the cache of the sliding window attention layers
+	// of models such as Gemma 2 and 3 to their window (Model.SlidingWindow)
+	// instead of the whole context, which saves most of their memory. Tokens
+	// that slid out of the window are gone, though, so a cached prompt prefix
+	// is only reused while the tokens it ends with still see all they should,
+	// and prompts that differ further back are evaluated again.
+	SmallSWACache bool
+}
+
+// EvictionPolicy decides how a decode that finds no room in the KV cache
+// makes some. Context.Decode never evicts; callers managing sequences
+// themselves get DecodeNoKVSlot.
+type EvictionPolicy int
+
+const (
+	// EvictIdle removes the cache of sequences no generation runs in: the
+	// prompts a Scheduler keeps in free slots for reuse
+	EvictIdle EvictionPolicy = iota
+	// EvictNone fails right away
+	EvictNone
+)
+
+// CPUParams configures the threadpools a context runs on
+type CPUParams struct {
+	// CPUs lists the indices of the CPUs the threads may run on, empty
+	// allows all of them
+	CPUs []int
+
+	// Strict places the threads on the listed CPUs one each, in order,
+	// instead of letting every thread run on any of them
+	Strict bool
+
+	Priority Priority
+
+	// Poll is how long idle threads busy-wait for work before sleeping,
+	// from 0 to 100. Polling more lowers latency at the cost of CPU time.
+	// 0 keeps the ggml default of 50.
+	Poll int
+}
+
+// Priority is the scheduling priority of inference threads. Priorities
+// above normal may need elevated privileges.
+type Priority int
+
+const (
+	PriorityLow      Priority = -1
+	PriorityNormal   Priority = 0
+	PriorityMedium   Priority = 1
+	PriorityHigh     Priority = 2
+	PriorityRealtime Priority = 3
+)
+
+// Chat message roles understood by all chat templates
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// DecodeStatus is the outcome of Context.Decode
+type DecodeStatus int
+
+const (
+	DecodeOK       DecodeStatus = iota
+	DecodeNoKVSlot              // no room in the KV cache for the batch
+	DecodeAborted               // the abort callback stopped the computation
+	DecodeError                 // invalid batch or internal failure
+)
+
+func (s DecodeStatus) String() string {
+	switch s {
+	case DecodeOK:
+		return "ok"
+	case DecodeNoKVSlot:
+		return "no KV cache slot"
+	case DecodeAborted:
+		return "aborted"
+	default:
+		return "error"
+	}
+}
+
+// ChatMessage is a single message in a conversation. Jinja chat templates
+// receive the tool calls too and render them in the model's format; other
+// templates only see the content.
+type ChatMessage struct {
+	Role       string
+	Content    string
+	ToolCalls  []ToolCall // calls made by an assistant message
+	ToolCallID string     // the call a tool message answers
+}
+
+// ToolCall is a call of a function made by an assistant message
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string // JSON object
+}
+
+// DefaultSeed picks a random seed for every generation, which
+// GenerateResult.Seed reports
+const DefaultSeed = 0xFFFFFFFF
+
+// SamplingParams controls how the next token is picked. A zero temperature
+// selects greedy decoding.
+type SamplingParams struct {
+	Temperature   float32
+	DynTempRange  float32 // dynamic temperature varies within Temperature ± range, 0 disables it
+	DynTempExp    float32 // exponent mapping entropy to temperature, 0 means 1
+	TopK          int
+	TopP          float32
+	MinP          float32
+	TypicalP      float32 // locally typical sampling, 1.0 disables it
+	RepeatPenalty float32 // 1.0 disables the penalty
+	RepeatLastN   int     // number of recent tokens the penalties look at
+
+	// Seed seeds the random number generator of the generation's own
+	// sampler, so generations with fixed seeds give the same tokens however
+	// many others run alongside them, as long as the logits are the same.
+	Seed uint32
+
+	// FrequencyPenalty is subtracted from a token's logit for every time it
+	// appears in the last RepeatLastN tokens, PresencePenalty once if it
+	// appears at all. 0 disables them.
+	FrequencyPenalty float32
+	PresencePenalty  float32
+
+	// MinKeep is the fewest candidates top-p, min-p and typical sampling
+	// leave, like the --min-keep flag of llama-cli
+	MinKeep int
+
+	// Grammar is a GBNF grammar the output must match; mistakes in it fail
+	// the call with a grammar.SyntaxError. Regex is a regular expression
+	// the whole output must match, converted to a grammar with
+	// grammar.FromRegex. At most one of them may be set.
+	Grammar string
+	Regex   string
+
+	// GrammarTriggers makes the grammar lazy, as llama.cpp does for tool
+	// calls: the output is free until one of these strings appears, and
+	// from the trigger on it must match the grammar. GrammarTriggerTokens
+	// trigger it on tokens, such as a model's special token starting tool
+	// calls.
+	GrammarTriggers      []string
+	GrammarTriggerTokens []Token
+
+	// LogitBias is added to the logits of the given tokens before sampling,
+	// as the logit_bias field of the OpenAI API does. Negative infinity
+	// bans a token.
+	LogitBias map[Token]float32
+}
+
+// DefaultSamplingParams returns the defaults used by llama-cli
+func DefaultSamplingParams() SamplingParams {
+	return SamplingParams{
+		Temperature:   0.8,
+		DynTempExp:    1.0,
+		TopK:          40,
+		TopP:          0.95,
+		MinP:          0.05,
+		TypicalP:      1.0,
+		RepeatPenalty: 1.0,
+		RepeatLastN:   64,
+		Seed:          DefaultSeed,
+	}
+}
+
+// FinishReason describes why generation ended
+type FinishReason string
+
+const (
+	FinishStop    FinishReason = "stop"    // end-of-generation token or stop sequence
+	FinishLength  FinishReason = "length"  // MaxTokens or the context size was reached
+	FinishCancel  FinishReason = "cancel"  // the context.Context was cancelled
+	FinishTimeout FinishReason = "timeout" // MaxDuration ran out
+)
+
+// Interruption is how soon a generation stops while its prompt is evaluated
+type Interruption int
+
+const (
+	// InterruptTokens only stops between generated tokens, once the whole
+	// prompt has been evaluated
+	InterruptTokens Interruption = iota
+	// InterruptBatches also stops between the batches of BatchSize tokens a
+	// long prompt is decoded in, which costs nothing
+	InterruptBatches
+	// InterruptCompute also stops within a batch, through llama.cpp's abort
+	// callback, which the CPU backend checks between operations. The batch
+	// being computed is dropped from the KV cache.
+	InterruptCompute
+)
+
+// String returns the name of the interruption
+func (i Interruption) String() string {
+	switch i {
+	case InterruptTokens:
+		return "tokens"
+	case InterruptBatches:
+		return "batches"
+	case InterruptCompute:
+		return "compute"
+	default:
+		return fmt.Sprintf("Interruption(%d)", int(i))
+	}
+}
+
+// ParseInterruption returns the interruption with the given name
+func ParseInterruption(name string) (Interruption, error) {
+	for i := InterruptTokens; i <= InterruptCompute; i++ {
+		if i.String() == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown interruption %q", name)
+}
+
+// GenerateOptions controls a single call to Generate
+type GenerateOptions struct {
+	SamplingParams
+
+	MaxTokens int      // 0 generates until end-of-generation or the context is full
+	Stop      []string // generation ends when any of these is produced
+	Echo      bool     // include the prompt in the result
+
+	// MaxDuration ends generation with FinishTimeout once this much time has
+	// passed since the call, prompt evaluation included. It is checked
+	// between tokens, and during prompt evaluation as Interrupt allows. 0
+	// sets no limit.
+	MaxDuration time.Duration
+
+	// Interrupt decides how soon cancelling the call's context or running
+	// out of MaxDuration stops the evaluation of a long prompt. The tokens
+	// evaluated until then stay in the KV cache, so that the same prompt
+	// resumes from them. The Scheduler interrupts prompts between steps
+	// whatever it is set to.
+	Interrupt Interruption
+
+	// Truncate decides what happens when the prompt does not fit in the
+	// context. KeepTokens leading tokens, such as the system prompt, are
+	// never removed.
+	Truncate   TruncateStrategy
+	KeepTokens int
+
+	// Threads and ThreadsBatch override the context's thread counts for
+	// generation and prompt processing during the call, 0 keeping them.
+	// Deterministic contexts and the Scheduler, whose generations share
+	// decode calls, ignore them.
+	Threads      int
+	ThreadsBatch int
+
+	// Infinite keeps generating when the context is full, like the
+	// interactive mode of llama.cpp's main: the first KeepTokens tokens stay
+	// and half of the rest is discarded, the remaining tokens being shifted
+	// back. It needs a model whose cache supports shifting and can't be
+	// combined with guidance, banned phrases or speculative decoding.
+	Infinite bool
+
+	// AddBOS and AddEOS decide whether the prompt is framed by BOS and EOS
+	// tokens, by default as the model's metadata asks. BOS is not added to
+	// a prompt that already starts with it.
+	AddBOS SpecialTokenPolicy
+	AddEOS SpecialTokenPolicy
+
+	// Banned phrases are never generated, regardless of case or whether they
+	// start a word
+	Banned []string
+
+	// NegativePrompt enables classifier-free guidance when GuidanceScale is
+	// above 1: it is evaluated in a second context and the next-token
+	// distribution is pushed away from what it predicts.
+	NegativePrompt string
+	GuidanceScale  float32
+
+	// Speculative enables speculative decoding with a draft model
+	Speculative *SpeculativeOptions
+
+	// OnToken is called with each new piece of text as it is generated.
+	// Text belonging to a stop sequence is never passed to it.
+	OnToken func(piece string)
+
+	// OnTokenInfo is called with every generated token, including those of
+	// a stop sequence, along with its log-probability and the TopLogprobs
+	// most likely alternatives. Computing them costs a pass over the
+	// vocabulary per token, so it is only done when set.
+	OnTokenInfo func(TokenInfo)
+	TopLogprobs int
+
+	// OnPrefill is called while the prompt is evaluated, after every batch,
+	// with the number of prompt tokens in the cache so far and the total.
+	// Tokens reused from the previous call count as evaluated.
+	OnPrefill func(done, total int)
+
+	// SamplerStats fills GenerateResult.Sampling. Like OnTokenInfo it costs
+	// a pass over the vocabulary per token.
+	SamplerStats bool
+}
+
+// TokenInfo describes a generated token for GenerateOptions.OnTokenInfo.
+// Log-probabilities are those of the model, before sampling changes the
+// distribution.
+type TokenInfo struct {
+	Token       Token
+	Piece       string
+	Logprob     float32
+	TopLogprobs []TokenLogprob // most likely first
+	Elapsed     time.Duration  // since the call began
+}
+
+// TokenLogprob is a candidate token and its log-probability
+type TokenLogprob struct {
+	Token   Token
+	Piece   string
+	Logprob float32
+}
+
+// SpeculativeOptions configures speculative decoding: a small draft model
+// proposes several tokens that the target model then checks in a single
+// batch. The output is the same as without a draft; only its speed changes.
+type SpeculativeOptions struct {
+	// Draft is a context of the draft model, which must share the target
+	// model's vocabulary. Its KV cache is reused across calls.
+	Draft *Context
+
+	// Tokens is the most tokens drafted per step, 0 means 8
+	Tokens int
+
+	// MinProbability ends a draft early once the draft model's most likely
+	// token is less likely than this
+	MinProbability float32
+
+	// Verify decides which draft tokens the target model accepts
+	Verify Verification
+
+	// AcceptProbability, when above 0, also accepts a draft token the
+	// target model would not have sampled if it gives the token at least
+	// this probability. Drafts are accepted further at the cost of replies
+	// drifting from what the target model would have generated on its own.
+	// It can't be combined with a grammar.
+	AcceptProbability float32
+}
+
+// Verification is how the target model checks draft tokens
+type Verification int
+
+const (
+	// VerifySampled accepts a draft token when the target model samples the
+	// same one, so replies are those the target model generates without a
+	// draft
+	VerifySampled Verification = iota
+	// VerifyGreedy also accepts a draft token when it is the target model's
+	// most likely one, even if sampling at a temperature picked another.
+	// Replies lean towards the target's greedy choices. It can't be
+	// combined with a grammar.
+	VerifyGreedy
+)
+
+// String returns the name of the verification
+func (v Verification) String() string {
+	switch v {
+	case VerifySampled:
+		return "sampled"
+	case VerifyGreedy:
+		return "greedy"
+	default:
+		return fmt.Sprintf("Verification(%d)", int(v))
+	}
+}
+
+// ParseVerification returns the verification with the given name
+func ParseVerification(name string) (Verification, error) {
+	for v := VerifySampled; v <= VerifyGreedy; v++ {
+		if v.String() == name {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown verification %q", name)
+}
+
+// DefaultGenerateOptions returns options using the default sampling parameters
+func DefaultGenerateOptions() GenerateOptions {
+	return GenerateOptions{SamplingParams: DefaultSamplingParams()}
+}
+
+// GenerateResult is the outcome of a call to Generate
+type GenerateResult struct {
+	Text             string       // the generated text, without any stop sequence
+	Prompt           string       // the prompt, only set when GenerateOptions.Echo is true
+	PromptTokens     int          // number of prompt tokens evaluated
+	TruncatedTokens  int          // number of prompt tokens dropped to fit the context
+	CachedTokens     int          // number of prompt tokens reused from the KV cache instead of evaluated
+	CompletionTokens int          // number of tokens generated
+	FinishReason     FinishReason // why generation ended
+
+	// DraftTokens and AcceptedTokens count the tokens proposed by the draft
+	// model and those the target model agreed with, when decoding
+	// speculatively, and DraftSteps the drafts they came in
+	DraftTokens    int
+	AcceptedTokens int
+	DraftSteps     int
+
+	// ShiftedTokens counts the tokens discarded to make room in infinite
+	// generation
+	ShiftedTokens int
+
+	// Sampling summarizes the distributions the tokens were sampled from,
+	// when GenerateOptions.SamplerStats is set
+	Sampling *SamplerStats
+
+	// Seed is the seed the sampler was seeded with, the one drawn for
+	// DefaultSeed, to generate the same tokens again
+	Seed uint32
+}
+
+// SamplerStats describes how a generation was sampled, to compare sampling
+// settings or prompts. Entropies are those of the distribution the sampler
+// chain was given, before temperature and truncation change it. With
+// speculative decoding the target model samples once per drafted token and
+// once more per step, rejected drafts included.
+type SamplerStats struct {
+	Tokens      int     // tokens sampled, the end-of-generation one included
+	MeanEntropy float64 // mean entropy of the next-token distribution, in nats
+	MaxEntropy  float64 // entropy of the most uncertain token
+
+	// MeanCandidates is the mean number of tokens the grammar and the top-k,
+	// typical, top-p and min-p samplers left to pick from. Greedy sampling
+	// truncates nothing.
+	MeanCandidates float64
+
+	// Forced counts the tokens for which a single candidate was left and
+	// Top those that were the most likely one
+	Forced int
+	Top    int
+}
+
+// TotalTokens returns the number of prompt and completion tokens
+func (r *GenerateResult) TotalTokens() int {
+	return r.PromptTokens + r.CompletionTokens
+}
+
+// AcceptanceRate returns the share of draft tokens that were accepted, 0 when
+// none were drafted
+func (r *GenerateResult) AcceptanceRate() float64 {
+	if r.DraftTokens == 0 {
+		return 0
+	}
+	return float64(r.AcceptedTokens) / float64(r.DraftTokens)
+}
+
+// AcceptedPerStep returns the mean number of draft tokens accepted per
+// draft, 0 when none were drafted. Close to SpeculativeOptions.Tokens, longer
+// drafts may pay off; far below it, shorter ones waste less.
+func (r *GenerateResult) AcceptedPerStep() float64 {
+	if r.DraftSteps == 0 {
+		return 0
+	}
+	return float64(r.AcceptedTokens) / float64(r.DraftSteps)
+}
+
+// SchedulerOptions controls a Scheduler
+type SchedulerOptions struct {
+	// MaxPromptTokens caps the prompt tokens evaluated per decode step
+	// across all slots, so that a long prompt is evaluated in pieces between
+	// the tokens of running generations instead of holding them up for a
+	// whole batch. 0 only limits them to the batch size.
+	MaxPromptTokens int
+
+	// PromptCacheSize is the memory, in bytes, used to keep the KV cache of
+	// slots taken over by other prompts. A prompt sharing a long prefix with
+	// a kept one, such as the next turn of a conversation or another request
+	// with the same system prompt and history, then starts from it in any
+	// slot instead of evaluating the prefix again. 0 keeps nothing.
+	PromptCacheSize int64
+
+	// WarmPrompt is evaluated ahead of requests into the slots that hold
+	// nothing, typically a long system prompt as the chat template renders
+	// it up to the first user message. A new conversation starting with it
+	// then lands in such a slot and only evaluates its own messages. Slots
+	// that lose it, to another prompt or to eviction, get it back whenever
+	// the scheduler is idle, copied from a slot that holds it rather than
+	// evaluated again. It is ignored for deterministic contexts, which
+	// never reuse prompts.
+	WarmPrompt string
+}
+
+// BeamSearchOptions controls a call to BeamSearch
+type BeamSearchOptions struct {
+	Width     int // number of beams, limited by ContextParams.Sequences
+	MaxTokens int // 0 generates until every beam ends or the context is full
+
+	// LengthPenalty is the exponent applied to a beam's length when its
+	// log-probability is normalized. Values above 1 favour longer outputs,
+	// 0 ranks beams by raw log-probability.
+	LengthPenalty float32
+}
+
+// DefaultBeamSearchOptions returns four beams with length normalization
+func DefaultBeamSearchOptions() BeamSearchOptions {
+	return BeamSearchOptions{Width: 4, LengthPenalty: 1}
+}
+
+// ClassifyOptions configures ClassifyWithOptions
+type ClassifyOptions struct {
+	// Template is the prompt each text is classified with, {text} marking
+	// where the text goes, e.g. "Review: {text}\nSentiment:". Empty uses
+	// the text as the prompt.
+	Template string
+
+	// PerToken compares labels by their mean log-probability per token
+	// rather than the total, so labels of several tokens aren't penalized
+	// for their length
+	PerToken bool
+}
+
+// Normalization is how Embed scales the embeddings it returns, matching the
+// embd_normalize values of llama.cpp
+type Normalization int
+
+const (
+	NormalizeEuclidean Normalization = iota // unit L2 norm, for cosine similarity
+	NormalizeNone                           // raw model output
+	NormalizeMaxAbs                         // largest component scaled to the int16 range
+	NormalizeTaxicab                        // unit L1 norm
+)
+
+// EmbedOptions configures Embed
+type EmbedOptions struct {
+	Normalize Normalization
+
+	// Dimensions truncates the embedding to its first n components before
+	// normalizing, for models trained with Matryoshka representation
+	// learning. 0 keeps the full embedding.
+	Dimensions int
+
+	// Threads overrides the context's thread count during the call, e.g. to
+	// keep background indexing from slowing down a chat. 0 keeps it.
+	Threads int
+}
+
+// Int8Embedding is an embedding quantized to int8: component i is
+// approximately Values[i] * Scale
+type Int8Embedding struct {
+	Values []int8
+	Scale  float32
+}
+
+// EmbeddingMatrix holds embeddings of one size in a single allocation, as
+// the rows of a row-major matrix
+type EmbeddingMatrix struct {
+	Dim  int
+	Data []float32
+}
+
+// Rows returns the number of embeddings
+func (m *EmbeddingMatrix) Rows() int {
+	if m.Dim == 0 {
+		return 0
+	}
+	return len(m.Data) / m.Dim
+}
+
+// Row returns embedding i, sharing the matrix's memory
+func (m *EmbeddingMatrix) Row(i int) []float32 {
+	return m.Data[i*m.Dim : (i+1)*m.Dim : (i+1)*m.Dim]
+}
+
+// Float32 returns the dequantized embedding
+func (e *Int8Embedding) Float32() []float32 {
+	out := make([]float32, len(e.Values))
+	for i, v := range e.Values {
+		out[i] = float32(v) * e.Scale
+	}
+	return out
+}
+
+// FileType is the quantization applied to a model's tensors, with the
+// values of llama_ftype
+type FileType int
+
+const (
+	FileTypeF32     FileType = 0
+	FileTypeF16     FileType = 1
+	FileTypeBF16    FileType = 32
+	FileTypeQ4_0    FileType = 2
+	FileTypeQ4_1    FileType = 3
+	FileTypeQ5_0    FileType = 8
+	FileTypeQ5_1    FileType = 9
+	FileTypeQ8_0    FileType = 7
+	FileTypeQ2_K    FileType = 10
+	FileTypeQ2_K_S  FileType = 21
+	FileTypeQ3_K_S  FileType = 11
+	FileTypeQ3_K_M  FileType = 12
+	FileTypeQ3_K_L  FileType = 13
+	FileTypeQ4_K_S  FileType = 14
+	FileTypeQ4_K_M  FileType = 15
+	FileTypeQ5_K_S  FileType = 16
+	FileTypeQ5_K_M  FileType = 17
+	FileTypeQ6_K    FileType = 18
+	FileTypeIQ1_S   FileType = 24
+	FileTypeIQ1_M   FileType = 31
+	FileTypeIQ2_XXS FileType = 19
+	FileTypeIQ2_XS  FileType = 20
+	FileTypeIQ2_S   FileType = 28
+	FileTypeIQ2_M   FileType = 29
+	FileTypeIQ3_XXS FileType = 23
+	FileTypeIQ3_XS  FileType = 22
+	FileTypeIQ3_S   FileType = 26
+	FileTypeIQ3_M   FileType = 27
+	FileTypeIQ4_NL  FileType = 25
+	FileTypeIQ4_XS  FileType = 30
+	FileTypeTQ1_0   FileType = 36
+	FileTypeTQ2_0   FileType = 37
+)
+
+// TensorType is the data type of a single tensor, with the values of
+// ggml_type
+type TensorType int
+
+const (
+	TensorTypeF32     TensorType = 0
+	TensorTypeF16     TensorType = 1
+	TensorTypeQ4_0    TensorType = 2
+	TensorTypeQ4_1    TensorType = 3
+	TensorTypeQ5_0    TensorType = 6
+	TensorTypeQ5_1    TensorType = 7
+	TensorTypeQ8_0    TensorType = 8
+	TensorTypeQ2_K    TensorType = 10
+	TensorTypeQ3_K    TensorType = 11
+	TensorTypeQ4_K    TensorType = 12
+	TensorTypeQ5_K    TensorType = 13
+	TensorTypeQ6_K    TensorType = 14
+	TensorTypeIQ2_XXS TensorType = 16
+	TensorTypeIQ2_XS  TensorType = 17
+	TensorTypeIQ3_XXS TensorType = 18
+	TensorTypeIQ1_S   TensorType = 19
+	TensorTypeIQ4_NL  TensorType = 20
+	TensorTypeIQ3_S   TensorType = 21
+	TensorTypeIQ2_S   TensorType = 22
+	TensorTypeIQ4_XS  TensorType = 23
+	TensorTypeIQ1_M   TensorType = 29
+	TensorTypeBF16    TensorType = 30
+	TensorTypeTQ1_0   TensorType = 34
+	TensorTypeTQ2_0   TensorType = 35
+	TensorTypeMXFP4   TensorType = 39
+)
+
+// QuantizeParams configures Quantize. The options mirror those of
+// llama-quantize.
+type QuantizeParams struct {
+	FileType FileType
+	Threads  int // 0 uses the number of hardware threads
+
+	// Imatrix guides which weights keep the most precision. It makes a large
+	// difference for the IQ and 2-3 bit types, some of which require it.
+	// ImatrixPath loads one from a file written by Imatrix.Save or
+	// llama-imatrix instead.
+	Imatrix     *Imatrix
+	ImatrixPath string
+
+	// AllowRequantize accepts an input that is already quantized, at a cost
+	// in quality compared to quantizing the original weights
+	AllowRequantize bool
+
+	// KeepOutputTensor leaves output.weight unquantized
+	KeepOutputTensor bool
+
+	// Pure quantizes every tensor to FileType's main type instead of the
+	// mix the file type normally keeps some tensors at a higher precision in
+	Pure bool
+
+	// OutputType and TokenEmbeddingType override the types of the output
+	// projection and the token embeddings, nil leaves them to the file type
+	OutputType         *TensorType
+	TokenEmbeddingType *TensorType
+}
+
+// ImatrixOptions configures ComputeImatrix
+type ImatrixOptions struct {
+	ChunkSize     int  // tokens per calibration chunk, 0 uses 512
+	Threads       int  // 0 uses the llama.cpp default
+	ProcessOutput bool // also collect the output projection, which Quantize rarely needs
+
+	// Progress is called after each chunk
+	Progress func(done, total int)
+}
+
+// SessionOptions configures a Session
+type SessionOptions struct {
+	// SystemPrompt is pinned: it is never dropped or summarized, and its
+	// tokens stay in the KV cache when the context is shifted or truncated
+	SystemPrompt string
+
+	// Pinned messages follow the system prompt and are kept like it, e.g.
+	// tool definitions or examples of the expected replies
+	Pinned []ChatMessage
+
+	// Template is a registered template name or a chat template, defaults
+	// to the one embedded in the model and then to chatml
+	Template string
+
+	// GenerateOptions are used for every reply. When MaxTokens is 0 a
+	// quarter of the context is reserved for the reply.
+	GenerateOptions GenerateOptions
+
+	// Summarizer, if set, condenses the oldest turns into a summary kept
+	// with the system prompt once the conversation and the reply need more
+	// than SummarizeThreshold of the context, 0 meaning 0.75. The latest
+	// exchange is always kept verbatim, and turns are still dropped when the
+	// summary doesn't make enough room.
+	Summarizer         Summarizer
+	SummarizeThreshold float32
+}
+
+// Summarizer condenses turns of a conversation. summary is what earlier
+// turns were condensed into, "" for none, and the result replaces both.
+type Summarizer interface {
+	Summarize(ctx context.Context, summary string, messages []ChatMessage) (string, error)
+}
+
+// SummarizerFunc adapts a function to a Summarizer
+type SummarizerFunc func(ctx context.Context, summary string, messages []ChatMessage) (string, error)
+
+func (f SummarizerFunc) Summarize(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+	return f(ctx, summary, messages)
+}
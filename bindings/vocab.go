@@ -0,0 +1,132 @@
+package bindings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// Vocab is a model's tokenizer as its GGUF file stores it: the tokens, the
+// BPE merges and the tokens added on top of the trained vocabulary. Two
+// files with the same Fingerprint split text into the same tokens, which is
+// what an index of embeddings relies on.
+type Vocab struct {
+	Model string // tokenizer.ggml.model, e.g. "gpt2" for byte-level BPE or "llama" for SentencePiece
+	Pre   string // tokenizer.ggml.pre, the pre-tokenizer, e.g. "llama-bpe"
+
+	Tokens []string
+	Merges []string // in priority order, each as "left right"; empty but for BPE
+
+	// Added are the control tokens, such as "<|im_start|>", and the tokens
+	// defined by the user, in the order of their IDs
+	Added []AddedToken
+
+	BOS, EOS Token // -1 when the file sets none
+}
+
+// AddedToken is a token that is not part of the trained vocabulary
+type AddedToken struct {
+	Token   Token
+	Text    string
+	Control bool // a control token rather than a user-defined one
+}
+
+// tokenizer.ggml.token_type values for added tokens
+const (
+	tokenTypeControl     = 3
+	tokenTypeUserDefined = 4
+)
+
+// ReadVocab reads the tokenizer of the GGUF file at path. It only reads the
+// metadata, so it works without llama.cpp and on files too large to load.
+func ReadVocab(path string) (*Vocab, error) {
+	f, err := gguf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return vocabOf(f, path)
+}
+
+// vocabOf returns the tokenizer of the GGUF file read from path
+func vocabOf(f *gguf.File, path string) (*Vocab, error) {
+	v := &Vocab{}
+	v.Model, _ = f.String("tokenizer.ggml.model")
+	v.Pre, _ = f.String("tokenizer.ggml.pre")
+	tokens, _ := f.Get("tokenizer.ggml.tokens")
+	if v.Tokens, _ = tokens.([]string); v.Tokens == nil {
+		return nil, fmt.Errorf("%s: no tokenizer.ggml.tokens", path)
+	}
+	merges, _ := f.Get("tokenizer.ggml.merges")
+	v.Merges, _ = merges.([]string)
+
+	types, _ := f.Get("tokenizer.ggml.token_type")
+	for i, t := range asInts(types) {
+		if (t == tokenTypeControl || t == tokenTypeUserDefined) && i < len(v.Tokens) {
+			v.Added = append(v.Added, AddedToken{Token: Token(i), Text: v.Tokens[i], Control: t == tokenTypeControl})
+		}
+	}
+	v.BOS = tokenID(f, "tokenizer.ggml.bos_token_id")
+	v.EOS = tokenID(f, "tokenizer.ggml.eos_token_id")
+	return v, nil
+}
+
+// tokenID returns the token a metadata key names, -1 if it is not set
+func tokenID(f *gguf.File, key string) Token {
+	v, _ := f.Get(key)
+	if ids := asInts([]any{v}); len(ids) == 1 {
+		return Token(ids[0])
+	}
+	return -1
+}
+
+// asInts returns the integers of a GGUF array, skipping other values
+func asInts(v any) []int64 {
+	var out []int64
+	add := func(x any) {
+		switch x := x.(type) {
+		case int32:
+			out = append(out, int64(x))
+		case uint32:
+			out = append(out, int64(x))
+		case int64:
+			out = append(out, x)
+		case uint64:
+			out = append(out, int64(x))
+		}
+	}
+	switch v := v.(type) {
+	case []int32:
+		for _, x := range v {
+			add(x)
+		}
+	case []uint32:
+		for _, x := range v {
+			add(x)
+		}
+	case []any:
+		for _, x := range v {
+			add(x)
+		}
+	}
+	return out
+}
+
+// Fingerprint returns a hash of everything in the vocabulary that decides
+// how text is tokenized
+func (v *Vocab) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %d %d %d\n", v.Model, v.Pre, len(v.Tokens), len(v.Merges), len(v.Added))
+	for _, t := range v.Tokens {
+		fmt.Fprintf(h, "%q\n", t)
+	}
+	for _, m := range v.Merges {
+		fmt.Fprintf(h, "%q\n", m)
+	}
+	for _, a := range v.Added {
+		fmt.Fprintf(h, "%d %t\n", a.Token, a.Control)
+	}
+	fmt.Fprintf(h, "%d %d\n", v.BOS, v.EOS)
+	return hex.EncodeToString(h.Sum(nil))
+}
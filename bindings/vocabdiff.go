@@ -0,0 +1,222 @@
+package bindings
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// VocabDiff is how one tokenizer differs from another, the zero value
+// when they split text alike
+type VocabDiff struct {
+	Model, Pre [2]string // tokenizer models and pre-tokenizers, when they differ
+	Size       [2]int    // sizes of the vocabularies, when they differ
+
+	// Changed counts the IDs both vocabularies have with different tokens,
+	// the first of which is FirstChanged
+	Changed      int
+	FirstChanged Token
+
+	Merges bool // the BPE merges or their priorities differ
+	Added  bool // the added tokens differ
+
+	BOS, EOS [2]Token // when they differ
+}
+
+// DiffVocab compares the tokenizers a and b
+func DiffVocab(a, b *Vocab) VocabDiff {
+	var d VocabDiff
+	if a.Model != b.Model {
+		d.Model = [2]string{a.Model, b.Model}
+	}
+	if a.Pre != b.Pre {
+		d.Pre = [2]string{a.Pre, b.Pre}
+	}
+	if len(a.Tokens) != len(b.Tokens) {
+		d.Size = [2]int{len(a.Tokens), len(b.Tokens)}
+	}
+	for i := range min(len(a.Tokens), len(b.Tokens)) {
+		if a.Tokens[i] != b.Tokens[i] {
+			if d.Changed == 0 {
+				d.FirstChanged = Token(i)
+			}
+			d.Changed++
+		}
+	}
+	d.Merges = !slices.Equal(a.Merges, b.Merges)
+	d.Added = !slices.Equal(a.Added, b.Added)
+	if a.BOS != b.BOS {
+		d.BOS = [2]Token{a.BOS, b.BOS}
+	}
+	if a.EOS != b.EOS {
+		d.EOS = [2]Token{a.EOS, b.EOS}
+	}
+	return d
+}
+
+// Same reports whether the tokenizers split text alike
+func (d VocabDiff) Same() bool {
+	return d == VocabDiff{}
+}
+
+// Differences describes every difference, one per line
+func (d VocabDiff) Differences() []string {
+	var out []string
+	if d.Model != [2]string{} {
+		out = append(out, fmt.Sprintf("tokenizer model %q vs %q", d.Model[0], d.Model[1]))
+	}
+	if d.Pre != [2]string{} {
+		out = append(out, fmt.Sprintf("pre-tokenizer %q vs %q", d.Pre[0], d.Pre[1]))
+	}
+	if d.Size != [2]int{} {
+		out = append(out, fmt.Sprintf("%d vs %d tokens", d.Size[0], d.Size[1]))
+	}
+	if d.Changed > 0 {
+		out = append(out, fmt.Sprintf("%d tokens changed, from ID %d on", d.Changed, d.FirstChanged))
+	}
+	if d.Merges {
+		out = append(out, "different BPE merges")
+	}
+	if d.Added {
+		out = append(out, "different added tokens")
+	}
+	if d.BOS != [2]Token{} {
+		out = append(out, fmt.Sprintf("BOS token %d vs %d", d.BOS[0], d.BOS[1]))
+	}
+	if d.EOS != [2]Token{} {
+		out = append(out, fmt.Sprintf("EOS token %d vs %d", d.EOS[0], d.EOS[1]))
+	}
+	return out
+}
+
+// EmbeddingCompat tells whether vectors of one model can be searched in an
+// index of another's
+type EmbeddingCompat int
+
+const (
+	// EmbeddingsCompatible means the files agree on everything their
+	// headers tell, weights aside: the same architecture, tokenizer, size,
+	// pooling and tensors of the same shapes and types
+	EmbeddingsCompatible EmbeddingCompat = iota
+	// EmbeddingsApproximate means the files only differ in how their
+	// tensors are quantized. Vectors are close but not equal, so similarity
+	// scores shift slightly; re-embedding gives exact results.
+	EmbeddingsApproximate
+	// EmbeddingsIncompatible means vectors of one are meaningless in an
+	// index of the other, even when their sizes match
+	EmbeddingsIncompatible
+)
+
+// String returns the name of the verdict
+func (c EmbeddingCompat) String() string {
+	switch c {
+	case EmbeddingsCompatible:
+		return "compatible"
+	case EmbeddingsApproximate:
+		return "approximate"
+	case EmbeddingsIncompatible:
+		return "incompatible"
+	default:
+		return fmt.Sprintf("EmbeddingCompat(%d)", int(c))
+	}
+}
+
+// EmbeddingReport is the result of CompareEmbeddingModels
+type EmbeddingReport struct {
+	Verdict EmbeddingCompat
+	Vocab   VocabDiff
+	Size    [2]int // embedding sizes of the two models
+
+	// Reasons explains the verdict, one difference per line
+	Reasons []string
+}
+
+// CompareEmbeddingModels reports whether vectors embedded by the GGUF model
+// at query can be searched in an index built with the one at index. Only
+// the headers are read, so it is quick, works without llama.cpp and can't
+// tell a fine-tune from its base model when they keep the same name.
+func CompareEmbeddingModels(index, query string) (*EmbeddingReport, error) {
+	files := make([]*gguf.File, 2)
+	vocabs := make([]*Vocab, 2)
+	for i, path := range []string{index, query} {
+		f, err := gguf.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if vocabs[i], err = vocabOf(f, path); err != nil {
+			return nil, err
+		}
+		files[i] = f
+	}
+
+	r := &EmbeddingReport{Vocab: DiffVocab(vocabs[0], vocabs[1])}
+	var incompatible, approximate []string
+	differ := func(what string, a, b any) {
+		if a != b {
+			incompatible = append(incompatible, fmt.Sprintf("%s %v vs %v", what, a, b))
+		}
+	}
+
+	arch := [2]string{}
+	for i, f := range files {
+		arch[i], _ = f.String("general.architecture")
+		size, _ := f.Get(arch[i] + ".embedding_length")
+		if n := asInts([]any{size}); len(n) == 1 {
+			r.Size[i] = int(n[0])
+		}
+	}
+	differ("architecture", arch[0], arch[1])
+	differ("embedding size", r.Size[0], r.Size[1])
+	differ("pooling", metaInt(files[0], arch[0]+".pooling_type"), metaInt(files[1], arch[1]+".pooling_type"))
+	name0, _ := files[0].String("general.name")
+	name1, _ := files[1].String("general.name")
+	differ("model", fmt.Sprintf("%q", name0), fmt.Sprintf("%q", name1))
+	incompatible = append(incompatible, r.Vocab.Differences()...)
+
+	// Tensors are matched by name, since converters may order them apart
+	tensors := make(map[string]gguf.TensorInfo, len(files[1].Tensors))
+	for _, t := range files[1].Tensors {
+		tensors[t.Name] = t
+	}
+	reshaped, quantized := 0, 0
+	example := ""
+	for _, t := range files[0].Tensors {
+		u, ok := tensors[t.Name]
+		switch {
+		case !ok || !slices.Equal(t.Dims, u.Dims):
+			if reshaped == 0 {
+				example = t.Name
+			}
+			reshaped++
+		case t.Type != u.Type:
+			quantized++
+		}
+	}
+	switch {
+	case reshaped > 0:
+		incompatible = append(incompatible, fmt.Sprintf("%d tensors missing or of other shapes, such as %q", reshaped, example))
+	case len(files[0].Tensors) != len(files[1].Tensors):
+		incompatible = append(incompatible, fmt.Sprintf("%d vs %d tensors", len(files[0].Tensors), len(files[1].Tensors)))
+	}
+	if quantized > 0 {
+		approximate = append(approximate, fmt.Sprintf("%d tensors quantized differently", quantized))
+	}
+
+	switch {
+	case len(incompatible) > 0:
+		r.Verdict, r.Reasons = EmbeddingsIncompatible, append(incompatible, approximate...)
+	case len(approximate) > 0:
+		r.Verdict, r.Reasons = EmbeddingsApproximate, approximate
+	}
+	return r, nil
+}
+
+// metaInt returns an integer metadata value, -1 if it is not set
+func metaInt(f *gguf.File, key string) int64 {
+	v, _ := f.Get(key)
+	if n := asInts([]any{v}); len(n) == 1 {
+		return n[0]
+	}
+	return -1
+}
@@ -0,0 +1,93 @@
+// Package buildinfo describes the llama.cpp build the bindings expect: the
+// pinned revision and the CMake options for each GPU backend.
+package buildinfo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// LlamaCppRepository is where llama.cpp is cloned from
+	LlamaCppRepository = "https://github.com/ggerganov/llama.cpp.git"
+
+	// LlamaCppVersion is the llama.cpp release tag the bindings are written
+	// against. Other revisions may not match the C API.
+	LlamaCppVersion = "b6500"
+)
+
+// backends maps backend names to the CMake options enabling them
+var backends = map[string][]string{
+	"cpu":    nil,
+	"metal":  {"-DGGML_METAL=ON", "-DGGML_METAL_EMBED_LIBRARY=ON"},
+	"cuda":   {"-DGGML_CUDA=ON"},
+	"hip":    {"-DGGML_HIP=ON"},
+	"vulkan": {"-DGGML_VULKAN=ON"},
+	"sycl":   {"-DGGML_SYCL=ON", "-DCMAKE_C_COMPILER=icx", "-DCMAKE_CXX_COMPILER=icpx"},
+	"blas":   {"-DGGML_BLAS=ON", "-DGGML_BLAS_VENDOR=OpenBLAS"},
+}
+
+// Backends returns the names of the supported backends
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CMakeFlags returns the options configuring llama.cpp for a backend on the
+// given GOOS. llama.cpp enables Metal on macOS by default, so the other
+// backends turn it off there.
+func CMakeFlags(backend string, goos string) ([]string, error) {
+	flags, ok := backends[strings.ToLower(backend)]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, expected one of %s", backend, strings.Join(Backends(), ", "))
+	}
+	flags = append([]string{"-DBUILD_SHARED_LIBS=ON", "-DLLAMA_CURL=OFF", "-DLLAMA_BUILD_TESTS=OFF", "-DLLAMA_BUILD_EXAMPLES=OFF"}, flags...)
+	if goos == "darwin" && strings.ToLower(backend) != "metal" {
+		flags = append(flags, "-DGGML_METAL=OFF")
+	}
+	return flags, nil
+}
+
+// prebuilt is a CPU build attached to the llama.cpp release
+type prebuilt struct {
+	platform string // the platform in the archive's name
+	sha256   string // hex digest of the archive of LlamaCppVersion
+}
+
+// prebuiltPlatforms maps GOOS/GOARCH to the CPU builds attached to llama.cpp
+// releases. The digests change with LlamaCppVersion; go run
+// ./internal/buildllama -sums downloads the archives and prints them.
+var prebuiltPlatforms = map[string]prebuilt{
+	"linux/amd64":   {"ubuntu-x64", ""},
+	"darwin/arm64":  {"macos-arm64", ""},
+	"darwin/amd64":  {"macos-x64", ""},
+	"windows/amd64": {"win-cpu-x64", ""},
+	"windows/arm64": {"win-cpu-arm64", ""},
+}
+
+// PrebuiltPlatforms returns the GOOS/GOARCH pairs with prebuilt libraries
+func PrebuiltPlatforms() []string {
+	names := make([]string, 0, len(prebuiltPlatforms))
+	for name := range prebuiltPlatforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrebuiltURL returns the download URL of the prebuilt llama.cpp libraries
+// for a platform and the SHA-256 the archive must have, empty when none is
+// pinned
+func PrebuiltURL(goos, goarch string) (url, sha256 string, err error) {
+	p, ok := prebuiltPlatforms[goos+"/"+goarch]
+	if !ok {
+		return "", "", fmt.Errorf("no prebuilt llama.cpp for %s/%s, build it from source", goos, goarch)
+	}
+	return fmt.Sprintf("https://github.com/ggml-org/llama.cpp/releases/download/%s/llama-%s-bin-%s.zip",
+		LlamaCppVersion, LlamaCppVersion, p.platform), p.sha256, nil
+}
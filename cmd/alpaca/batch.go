@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// batchRequest is a line of the input of alpaca batch
+type batchRequest struct {
+	ID          string                 `json:"id"`
+	Prompt      string                 `json:"prompt"`
+	Messages    []bindings.ChatMessage `json:"messages"`
+	MaxTokens   *int                   `json:"max_tokens"`
+	Temperature *float32               `json:"temperature"`
+	Seed        *int64                 `json:"seed"`
+}
+
+// batchResult is a line of the output of alpaca batch
+type batchResult struct {
+	Index            int                   `json:"index"`
+	ID               string                `json:"id,omitempty"`
+	Seed             uint32                `json:"seed"`
+	Text             string                `json:"text"`
+	FinishReason     bindings.FinishReason `json:"finish_reason,omitempty"`
+	PromptTokens     int                   `json:"prompt_tokens"`
+	CompletionTokens int                   `json:"completion_tokens"`
+	Error            string                `json:"error,omitempty"`
+}
+
+// batch generates a completion for every line of a JSONL file, running
+// several at once in the sequences of one context
+func batch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	modelPath := fs.String("model", "", "Path to GGUF model")
+	input := fs.String("input", "-", "JSONL file of requests, each with a prompt or chat messages, - for stdin")
+	output := fs.String("output", "-", "JSONL file to write a result per request to, - for stdout")
+	ctxSize := fs.Int("ctx", 4096, "Context size, shared by the parallel sequences")
+	parallel := fs.Int("parallel", 4, "Requests generated at once with continuous batching")
+	maxTokens := fs.Int("max-tokens", 256, "Tokens generated per request unless it sets max_tokens")
+	temperature := fs.Float64("temperature", 0.8, "Sampling temperature unless a request sets temperature")
+	seed := fs.Uint("seed", 0, "Seed of the first request, the others get the following ones unless they set seed")
+	resume := fs.Bool("resume", false, "Append to -output, skipping the requests it already has results for")
+	fs.Parse(args)
+
+	if *modelPath == "" {
+		log.Fatal("Please provide -model flag")
+	}
+	if *resume && *output == "-" {
+		log.Fatal("-resume needs an -output file")
+	}
+
+	in := os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	var out io.Writer = os.Stdout
+	var done map[int]bool
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if *resume {
+			if done, err = readCheckpoint(f); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Resuming with %d requests done", len(done))
+		} else if err := f.Truncate(0); err != nil {
+			log.Fatal(err)
+		}
+		out = syncWriter{f}
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	model, err := bindings.LoadModel(*modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	c, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: *ctxSize, Sequences: max(*parallel, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Free()
+
+	// A single sequence has no use for the scheduler
+	var gen bindings.Generator = c
+	if *parallel > 1 {
+		sched, err := bindings.NewScheduler(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sched.Close()
+		gen = sched
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	defaults := bindings.DefaultGenerateOptions()
+	defaults.MaxTokens = *maxTokens
+	defaults.Temperature = float32(*temperature)
+
+	n, failed, err := runBatch(ctx, gen, model, in, out, done, defaults, uint32(*seed), max(*parallel, 1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Generated %d completions, %d failed", n-len(done), failed)
+}
+
+// syncWriter writes every result through to the disk, so that the output
+// is a checkpoint to resume from even after a power loss
+type syncWriter struct {
+	f *os.File
+}
+
+func (w syncWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.f.Sync()
+}
+
+// readCheckpoint returns the indices of the requests an earlier run wrote
+// results for, leaving out failed ones to try them again. A partial last
+// line, from a run that was killed while writing it, is cut off, and f is
+// left positioned at the end to append to it.
+func readCheckpoint(f *os.File) (map[int]bool, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if err := f.Truncate(int64(end)); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(int64(end), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	done := make(map[int]bool)
+	for i, line := range bytes.Split(data[:end], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var res batchResult
+		if err := json.Unmarshal(line, &res); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", f.Name(), i+1, err)
+		}
+		if res.Error == "" {
+			done[res.Index] = true
+		}
+	}
+	return done, nil
+}
+
+// runBatch reads requests from in and writes their results to out in the
+// order they finish, keeping parallel requests generating at once and
+// skipping those done. Request i is seeded with seed+i unless it sets a
+// seed, so a resumed run generates what an uninterrupted one would have.
+// It returns the number of requests and of failed ones.
+func runBatch(ctx context.Context, gen bindings.Generator, model *bindings.Model, in io.Reader, out io.Writer, done map[int]bool, defaults bindings.GenerateOptions, seed uint32, parallel int) (int, int, error) {
+	type job struct {
+		index int
+		req   batchRequest
+	}
+	jobs := make(chan job)
+
+	var mu sync.Mutex // guards out, failed and werr
+	failed := 0
+	var werr error
+	enc := json.NewEncoder(out)
+
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Go(func() {
+			for j := range jobs {
+				opts := defaults
+				opts.Seed = seed + uint32(j.index)
+				res := generateBatch(ctx, gen, model, j.req, opts)
+				res.Index = j.index
+				if res.FinishReason == bindings.FinishCancel {
+					// Interrupted, so it is generated again on resuming
+					continue
+				}
+				mu.Lock()
+				if res.Error != "" {
+					failed++
+				}
+				if err := enc.Encode(res); err != nil && werr == nil {
+					werr = err
+				}
+				mu.Unlock()
+			}
+		})
+	}
+
+	// Lines may hold long conversations
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64<<20)
+	n := 0
+	for ; scanner.Scan() && ctx.Err() == nil; n++ {
+		if done[n] {
+			continue
+		}
+		var req batchRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			close(jobs)
+			wg.Wait()
+			return n, failed, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		jobs <- job{n, req}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		return n, failed, err
+	}
+	return n, failed, errors.Join(werr, ctx.Err())
+}
+
+// generateBatch generates the completion of one request
+func generateBatch(ctx context.Context, gen bindings.Generator, model *bindings.Model, req batchRequest, defaults bindings.GenerateOptions) batchResult {
+	res := batchResult{ID: req.ID}
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		var err error
+		if prompt, err = model.ApplyChatTemplate(req.Messages, true); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+	if prompt == "" {
+		res.Error = "request has neither a prompt nor messages"
+		return res
+	}
+
+	opts := defaults
+	if req.MaxTokens != nil {
+		opts.MaxTokens = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		opts.Temperature = *req.Temperature
+	}
+	if req.Seed != nil {
+		opts.Seed = uint32(*req.Seed)
+	}
+	res.Seed = opts.Seed
+
+	out, err := gen.Generate(ctx, prompt, opts)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Text = out.Text
+	res.FinishReason = out.FinishReason
+	res.PromptTokens = out.PromptTokens
+	res.CompletionTokens = out.CompletionTokens
+	return res
+}
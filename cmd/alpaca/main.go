@@ -0,0 +1,372 @@
+// Command alpaca runs models from the command line.
+//
+// Usage:
+//
+//	alpaca serve -model model.gguf [-addr :8080]
+//	alpaca pull [-lock alpaca.lock] [model ...]
+//	alpaca models list|rm|prune
+//	alpaca vocab-diff index-model.gguf query-model.gguf
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/server"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "batch":
+		batch(os.Args[2:])
+	case "pull":
+		pull(os.Args[2:])
+	case "models":
+		models(os.Args[2:])
+	case "vocab-diff":
+		vocabDiff(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: alpaca serve -model model.gguf [flags]")
+	fmt.Fprintln(os.Stderr, "       alpaca batch -model model.gguf -input prompts.jsonl -output results.jsonl [flags]")
+	fmt.Fprintln(os.Stderr, "       alpaca pull [-lock alpaca.lock] [model ...]")
+	fmt.Fprintln(os.Stderr, "       alpaca models list|rm|prune [flags]")
+	fmt.Fprintln(os.Stderr, "       alpaca vocab-diff [-strict] index-model.gguf query-model.gguf")
+	os.Exit(2)
+}
+
+// serve runs an OpenAI-compatible HTTP server for one model
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	modelPath := fs.String("model", "", "Path to GGUF model")
+	addr := fs.String("addr", ":8080", "Address to listen on")
+	name := fs.String("name", "", "Model name reported to clients, defaults to the file name")
+	ctxSize := fs.Int("ctx", 4096, "Context size")
+	batchSize := fs.Int("batch", 0, "Logical batch size, the most tokens per decode, 0 for the default")
+	ubatchSize := fs.Int("ubatch", 0, "Physical batch size, the most tokens the backend processes at once, 0 for the default")
+	smallSWA := fs.Bool("small-swa-cache", false, "Cache only the sliding window of sliding window attention layers, saving memory but reusing fewer cached prompts")
+	overrideTensor := fs.String("override-tensor", "", "Buffer types for the weights matching patterns, e.g. exps=CPU to keep MoE experts in CPU memory")
+	experts := fs.Int("experts", 0, "Experts run per token by a mixture-of-experts model, fewer is faster, 0 for the model's")
+	gpuLayers := fs.String("gpu-layers", "all", "Layers offloaded to GPUs: a count, all, none, or auto for as many as fit in free GPU memory")
+	gpuFallback := fs.String("gpu-fallback", "none", "When the model doesn't load on the GPUs, retry with fewer layers offloaded or cpu only: none, fewer or cpu")
+	splitMode := fs.String("split-mode", "layer", "How to spread the model over several GPUs: layer, row or none")
+	mainGPU := fs.Int("main-gpu", 0, "GPU to use with -split-mode none, and for the KV cache with row")
+	tensorSplit := fs.String("tensor-split", "", "Share of the model per GPU, e.g. 3,1, empty to split by free memory")
+	cpus := fs.String("cpus", "", "CPUs to run inference threads on, e.g. 0-3,8, empty for all")
+	cpuStrict := fs.Bool("cpu-strict", false, "Pin each inference thread to one of -cpus in turn")
+	priority := fs.String("priority", "normal", "Priority of inference threads: low, normal, medium, high or realtime")
+	slots := fs.Int("slots", 1, "Generations run at once with continuous batching, sharing the context")
+	promptStep := fs.Int("max-prompt-tokens", 512, "Prompt tokens evaluated per step with several slots, 0 for the batch size")
+	warmSystem := fs.Bool("warm-system-prompt", false, "Evaluate the profile's system prompt into idle slots ahead of requests, with several slots")
+	promptCache := fs.Int("prompt-cache", 0, "MiB of memory keeping the KV cache of conversations whose slot was reused, with several slots")
+	maxTokens := fs.Int("max-tokens", 0, "Upper bound on tokens generated per request, 0 for none")
+	maxDuration := fs.Duration("max-duration", 0, "Upper bound on the time spent generating per request, 0 for none")
+	maxContext := fs.Int("max-context", 0, "Upper bound on prompt plus generated tokens per request, 0 for the context size")
+	interrupt := fs.String("interrupt", "batches", "How soon a cancelled request or -max-duration stops prompt evaluation: tokens, batches or compute")
+	maxRequest := fs.Int64("max-request-bytes", 32<<20, "Upper bound on the size of request bodies, 0 for none")
+	defaultTokens := fs.Int("default-max-tokens", 512, "Tokens generated when a request sets no max_tokens")
+	temperature := fs.Float64("temperature", 0.8, "Default sampling temperature")
+	ui := fs.Bool("ui", true, "Serve a chat page at /")
+	ollama := fs.Bool("ollama", false, "Also serve the Ollama API under /api")
+	profiles := fs.String("profiles", "", "JSON file of per-model default profiles, merged over the built-in ones")
+	draftPath := fs.String("draft-model", "", "Path to a smaller GGUF model with the same vocabulary, for speculative decoding")
+	draftTokens := fs.Int("draft-tokens", 8, "Most tokens drafted per step")
+	draftMinP := fs.Float64("draft-min-p", 0.5, "Stop drafting when the draft model's top token is less likely than this")
+	draftVerify := fs.String("draft-verify", "sampled", "How draft tokens are accepted: sampled, when the served model samples them too, or greedy, also when they are its most likely")
+	draftAcceptP := fs.Float64("draft-accept-p", 0, "Also accept draft tokens the served model gives at least this probability, 0 for none")
+	embedWindow := fs.Duration("embed-batch-window", 0, "Time embedding requests wait to be evaluated together with others, 0 for none")
+	embedCache := fs.Int("embed-cache", 0, "Embeddings of recent inputs kept to answer repeated inputs, 0 for none")
+	jobRetention := fs.Duration("job-retention", time.Hour, "How long the results of background jobs are kept for polling")
+	wsOrigins := fs.String("ws-origins", "", "Comma-separated origins of other sites allowed to open /v1/ws, * for any")
+	stateDir := fs.String("state-dir", "", "Directory to keep the KV cache of each conversation in across restarts")
+	usageLog := fs.String("usage-log", "", "File to append a JSON usage record per request to, - for stdout")
+	traceCalls := fs.Bool("trace", false, "Log every call into llama.cpp with its parameters and duration")
+	debugAddr := fs.String("debug-addr", "", "Address to serve /debug/vars and /debug/pprof on, empty for none")
+	fs.Parse(args)
+
+	if *traceCalls {
+		bindings.SetTraceLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	if *modelPath == "" {
+		log.Fatal("Please provide -model flag")
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(*modelPath), ".gguf")
+	}
+
+	cpu, err := cpuParams(*cpus, *cpuStrict, *priority)
+	if err != nil {
+		log.Fatal(err)
+	}
+	overrides, err := bindings.ParseTensorOverrides(*overrideTensor)
+	if err != nil {
+		log.Fatal(err)
+	}
+	layers, err := offloadLayers(*gpuLayers, *modelPath, *ctxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fallback, err := bindings.ParseGPUFallback(*gpuFallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	split, err := bindings.ParseSplitMode(*splitMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shares, err := parseTensorSplit(*tensorSplit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verify, err := bindings.ParseVerification(*draftVerify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	interruption, err := bindings.ParseInterruption(*interrupt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := bindings.DefaultGenerateOptions()
+	opts.MaxTokens = *defaultTokens
+	opts.Temperature = float32(*temperature)
+	opts.Interrupt = interruption
+
+	cfg := server.Config{
+		ModelName: *name,
+		Defaults:  opts,
+		Limits:    server.Limits{MaxTokens: *maxTokens, MaxContext: *maxContext, MaxDuration: *maxDuration, MaxRequestBytes: *maxRequest},
+		Ollama:    *ollama,
+		UI:        *ui,
+		StateDir:  *stateDir,
+		Slots:     *slots,
+		Scheduler: bindings.SchedulerOptions{MaxPromptTokens: *promptStep, PromptCacheSize: int64(*promptCache) << 20},
+
+		WarmSystemPrompt: *warmSystem,
+
+		EmbedBatchWindow: *embedWindow,
+		EmbedCacheSize:   *embedCache,
+		JobRetention:     *jobRetention,
+		WebSocketOrigins: splitList(*wsOrigins),
+
+		Speculative: bindings.SpeculativeOptions{Tokens: *draftTokens, MinProbability: float32(*draftMinP), Verify: verify, AcceptProbability: float32(*draftAcceptP)},
+	}
+
+	ps := server.DefaultProfiles
+	if *profiles != "" {
+		if ps, err = server.LoadProfiles(*profiles); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if p, ok := ps.Lookup(*name); ok {
+		// Flags given on the command line win over the profile
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "temperature":
+				p.Temperature = nil
+			case "default-max-tokens":
+				p.MaxTokens = nil
+			}
+		})
+		cfg.Profile = p
+	}
+
+	switch *usageLog {
+	case "":
+	case "-":
+		cfg.Sink = server.NewJSONSink(os.Stdout)
+	default:
+		sink, f, err := server.NewFileSink(*usageLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		cfg.Sink = sink
+	}
+
+	// Listen while the model loads so that /health and /ready can answer
+	srv := server.New(nil, cfg)
+	errc := make(chan error, 1)
+	go func() { errc <- http.ListenAndServe(*addr, srv) }()
+	if *debugAddr != "" {
+		// expvar and pprof register their handlers on the default mux
+		bindings.PublishExpvar("alpaca")
+		go func() { errc <- http.ListenAndServe(*debugAddr, nil) }()
+	}
+	log.Printf("Loading %s, listening on %s", *name, *addr)
+
+	bindings.Init()
+	defer bindings.Free()
+
+	model, err := bindings.LoadModelWithParams(*modelPath, bindings.ModelParams{
+		TensorOverrides: overrides,
+		ExpertsUsed:     *experts,
+		SplitMode:       split,
+		MainGPU:         *mainGPU,
+		TensorSplit:     shares,
+		GPULayers:       layers,
+		Fallback:        fallback,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	ctx, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: *ctxSize, Sequences: *slots, BatchSize: *batchSize, UBatchSize: *ubatchSize, SmallSWACache: *smallSWA, CPU: cpu})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ctx.Free()
+
+	if *draftPath != "" {
+		draftModel, err := bindings.LoadModel(*draftPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer draftModel.Free()
+
+		draft, err := bindings.NewContext(draftModel, bindings.ContextParams{ContextSize: *ctxSize})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer draft.Free()
+		srv.SetDraft(draft)
+	}
+	if err := srv.SetContext(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Serving %s (%s) on %s", *name, model.Summary(), *addr)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-sigc:
+	}
+	if err := srv.SaveState(); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+	// Stops the scheduler before the context is freed
+	srv.SetContext(nil)
+}
+
+// priorities maps the values of the -priority flag
+var priorities = map[string]bindings.Priority{
+	"low":      bindings.PriorityLow,
+	"normal":   bindings.PriorityNormal,
+	"medium":   bindings.PriorityMedium,
+	"high":     bindings.PriorityHigh,
+	"realtime": bindings.PriorityRealtime,
+}
+
+// cpuParams builds the thread placement from the flags, nil when they ask
+// for nothing beyond the defaults
+func cpuParams(cpus string, strict bool, priority string) (*bindings.CPUParams, error) {
+	prio, ok := priorities[priority]
+	if !ok {
+		return nil, fmt.Errorf("unknown priority %q", priority)
+	}
+	if cpus == "" && !strict && prio == bindings.PriorityNormal {
+		return nil, nil
+	}
+
+	p := &bindings.CPUParams{Strict: strict, Priority: prio}
+	for _, part := range strings.Split(cpus, ",") {
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", cpus)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu list %q", cpus)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			p.CPUs = append(p.CPUs, cpu)
+		}
+	}
+	return p, nil
+}
+
+// parseTensorSplit parses the shares of -tensor-split, separated by commas
+// or slashes as llama.cpp takes them
+func parseTensorSplit(s string) ([]float32, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var shares []float32
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '/' }) {
+		share, err := strconv.ParseFloat(part, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tensor split %q", s)
+		}
+		shares = append(shares, float32(share))
+	}
+	return shares, nil
+}
+
+// splitList splits a comma-separated flag, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// offloadLayers returns the ModelParams.GPULayers of -gpu-layers, planning
+// the offload for a context of ctxSize tokens with auto
+func offloadLayers(flag, modelPath string, ctxSize int) (int, error) {
+	switch flag {
+	case "all":
+		return 0, nil
+	case "none":
+		return bindings.GPULayersNone, nil
+	case "auto":
+		bindings.Init()
+		plan, err := bindings.PlanOffload(modelPath, bindings.OffloadOptions{ContextSize: ctxSize})
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("Offloading %d of %d layers, %s of %s free GPU memory", max(plan.Layers, 0), plan.Total,
+			bindings.FormatBytes(plan.GPUBytes), bindings.FormatBytes(plan.FreeMemory))
+		return plan.Layers, nil
+	}
+	n, err := strconv.Atoi(flag)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid -gpu-layers %q, want a count, all, none or auto", flag)
+	}
+	return n, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/fetch"
+)
+
+// models manages the model cache
+func models(args []string) {
+	if len(args) == 0 {
+		modelsUsage()
+	}
+	switch args[0] {
+	case "list":
+		listModels(args[1:])
+	case "rm":
+		removeModels(args[1:])
+	case "prune":
+		pruneModels(args[1:])
+	default:
+		modelsUsage()
+	}
+}
+
+func modelsUsage() {
+	fmt.Fprintln(os.Stderr, "usage: alpaca models list|rm|prune [flags]")
+	os.Exit(2)
+}
+
+// cacheFlags adds the -dir flag and returns the cache it selects once the
+// flags are parsed
+func cacheFlags(fs *flag.FlagSet) func() *fetch.Cache {
+	dir := fs.String("dir", "", "Model cache directory, defaults to $ALPACA_MODELS or the user cache directory")
+	return func() *fetch.Cache {
+		if *dir == "" {
+			var err error
+			if *dir, err = fetch.DefaultDir(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return &fetch.Cache{Dir: *dir}
+	}
+}
+
+// listModels prints the cached models and their total size
+func listModels(args []string) {
+	fs := flag.NewFlagSet("models list", flag.ExitOnError)
+	cache := cacheFlags(fs)
+	fs.Parse(args)
+
+	c := cache()
+	cached, err := c.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED\t")
+	var total int64
+	for _, m := range cached {
+		note := ""
+		if m.Partial {
+			note = "partial"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Name, bindings.FormatBytes(m.Size), m.ModTime.Format(time.DateTime), note)
+		total += m.Size
+	}
+	tw.Flush()
+	fmt.Printf("%d models, %s in %s\n", len(cached), bindings.FormatBytes(total), c.Dir)
+}
+
+// removeModels deletes the named models
+func removeModels(args []string) {
+	fs := flag.NewFlagSet("models rm", flag.ExitOnError)
+	cache := cacheFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		log.Fatal("Please name the models to remove")
+	}
+	c := cache()
+	for _, name := range fs.Args() {
+		if err := c.Remove(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// pruneModels deletes the models matching any of the flags
+func pruneModels(args []string) {
+	fs := flag.NewFlagSet("models prune", flag.ExitOnError)
+	cache := cacheFlags(fs)
+	lockPath := fs.String("lock", "", "Remove models this lockfile doesn't list")
+	olderThan := fs.Duration("older-than", 0, "Remove models not modified for this long, e.g. 720h")
+	partial := fs.Bool("partial", false, "Remove unfinished downloads")
+	dryRun := fs.Bool("n", false, "Print what would be removed without removing it")
+	fs.Parse(args)
+
+	if *lockPath == "" && *olderThan == 0 && !*partial {
+		log.Fatal("Please provide -lock, -older-than or -partial flag")
+	}
+	var lock *fetch.Lock
+	if *lockPath != "" {
+		var err error
+		if lock, err = fetch.LoadLock(*lockPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var freed int64
+	removed, err := cache().PruneFunc(func(m fetch.CachedModel) bool {
+		remove := *partial && m.Partial || *olderThan > 0 && time.Since(m.ModTime) > *olderThan
+		if lock != nil {
+			if _, locked := lock.Find(m.Name); !locked {
+				remove = true
+			}
+		}
+		if remove {
+			freed += m.Size
+			fmt.Println(m.Name)
+		}
+		return remove && !*dryRun
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*dryRun {
+		fmt.Printf("Removed %d models, %s\n", len(removed), bindings.FormatBytes(freed))
+	}
+}
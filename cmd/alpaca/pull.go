@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/matthiase/alpaca/fetch"
+)
+
+// pull syncs the model cache to a lockfile
+func pull(args []string) {
+	fs := flag.NewFlagSet("pull", flag.ExitOnError)
+	lockPath := fs.String("lock", fetch.LockFile, "Lockfile pinning model names to URLs and digests")
+	cacheDir := cacheFlags(fs)
+	prune := fs.Bool("prune", false, "Remove cached models the lockfile doesn't list")
+	fs.Parse(args)
+
+	lock, err := fetch.LoadLock(*lockPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache := cacheDir()
+
+	// Names on the command line pull only those models
+	models := lock.Models
+	if fs.NArg() > 0 {
+		models = nil
+		for _, name := range fs.Args() {
+			m, ok := lock.Find(name)
+			if !ok {
+				log.Fatalf("%s is not in %s", name, *lockPath)
+			}
+			models = append(models, m)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var last time.Time
+	progress := func(name string, done, total int64) {
+		if time.Since(last) < time.Second && done != total {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s: %d/%d MB", name, done>>20, total>>20)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s: %d MB", name, done>>20)
+		}
+	}
+	for _, m := range models {
+		path, err := cache.Pull(ctx, m, progress)
+		if !last.IsZero() {
+			fmt.Fprintln(os.Stderr)
+			last = time.Time{}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\t%s\n", m.Name, path)
+	}
+
+	if *prune {
+		removed, err := cache.Prune(lock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range removed {
+			log.Printf("Removed %s", name)
+		}
+	}
+}
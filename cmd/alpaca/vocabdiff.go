@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// vocabDiff reports whether vectors embedded by one model can be searched
+// in an index built with another, and exits with 1 when they can't
+func vocabDiff(args []string) {
+	fs := flag.NewFlagSet("vocab-diff", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "Also fail when the models only differ in quantization")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: alpaca vocab-diff [-strict] index-model.gguf query-model.gguf")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	r, err := bindings.CompareEmbeddingModels(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.Vocab.Same() {
+		fmt.Println("tokenizers: same")
+	} else {
+		fmt.Println("tokenizers: different")
+	}
+	fmt.Printf("embedding size: %d, %d\n", r.Size[0], r.Size[1])
+	fmt.Printf("vectors: %s\n", r.Verdict)
+	for _, reason := range r.Reasons {
+		fmt.Printf("  %s\n", reason)
+	}
+
+	if r.Verdict == bindings.EmbeddingsIncompatible || *strict && r.Verdict != bindings.EmbeddingsCompatible {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,160 @@
+package eval
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Task is a multiple-choice question: the model is expected to find the
+// ending at index Label the most likely continuation of Context
+type Task struct {
+	Context string
+	Endings []string
+	Label   int
+}
+
+// Load reads tasks from a file, as JSON lines if the name ends in .jsonl or
+// .json and in the llama.cpp HellaSwag text format otherwise
+func Load(path string) ([]Task, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch filepath.Ext(path) {
+	case ".jsonl", ".json":
+		return LoadJSONL(f)
+	}
+	return LoadHellaSwag(f)
+}
+
+// LoadHellaSwag reads the text format used by llama.cpp's perplexity tool:
+// six lines per task holding the context, the index of the correct ending
+// and the four endings. Endings are joined to the context with a space.
+func LoadHellaSwag(r io.Reader) ([]Task, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		lines = append(lines, strings.TrimRight(sc.Text(), "\r"))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines)%6 != 0 {
+		return nil, fmt.Errorf("hellaswag data has %d lines, expected a multiple of 6", len(lines))
+	}
+
+	tasks := make([]Task, 0, len(lines)/6)
+	for i := 0; i < len(lines); i += 6 {
+		label, err := strconv.Atoi(strings.TrimSpace(lines[i+1]))
+		if err != nil || label < 0 || label > 3 {
+			return nil, fmt.Errorf("line %d: invalid label %q", i+2, lines[i+1])
+		}
+		task := Task{Context: lines[i], Label: label}
+		for _, ending := range lines[i+2 : i+6] {
+			task.Endings = append(task.Endings, " "+ending)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// jsonTask covers the field names used by common benchmark exports, such as
+// HellaSwag's ctx/endings/label and MMLU-style question/choices/answer
+type jsonTask struct {
+	Ctx      string          `json:"ctx"`
+	Context  string          `json:"context"`
+	Question string          `json:"question"`
+	Endings  []string        `json:"endings"`
+	Choices  []string        `json:"choices"`
+	Label    json.RawMessage `json:"label"`
+	Answer   json.RawMessage `json:"answer"`
+}
+
+// LoadJSONL reads one task per line. The context is taken from ctx, context
+// or question, the endings from endings or choices and the correct index
+// from label or answer, which may be a number, a numeric string or a letter
+// (A for the first ending). Endings that don't start with whitespace are
+// joined to the context with a space.
+func LoadJSONL(r io.Reader) ([]Task, error) {
+	var tasks []Task
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var jt jsonTask
+		if err := json.Unmarshal([]byte(line), &jt); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		task := Task{Context: firstNonEmpty(jt.Ctx, jt.Context, jt.Question)}
+		endings := jt.Endings
+		if len(endings) == 0 {
+			endings = jt.Choices
+		}
+		if len(endings) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least two endings", n)
+		}
+		for _, ending := range endings {
+			if !strings.HasPrefix(ending, " ") && !strings.HasPrefix(ending, "\n") {
+				ending = " " + ending
+			}
+			task.Endings = append(task.Endings, ending)
+		}
+
+		raw := jt.Label
+		if len(raw) == 0 {
+			raw = jt.Answer
+		}
+		label, err := parseLabel(raw)
+		if err != nil || label < 0 || label >= len(task.Endings) {
+			return nil, fmt.Errorf("line %d: invalid label %s", n, raw)
+		}
+		task.Label = label
+
+		tasks = append(tasks, task)
+	}
+	return tasks, sc.Err()
+}
+
+func parseLabel(raw json.RawMessage) (int, error) {
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, err
+	}
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	if len(s) == 1 && s[0] >= 'A' && s[0] <= 'Z' {
+		return int(s[0] - 'A'), nil
+	}
+	return 0, fmt.Errorf("invalid label %q", s)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
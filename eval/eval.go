@@ -0,0 +1,117 @@
+// Package eval runs multiple-choice benchmarks such as HellaSwag against a
+// model by scoring every ending of a task and checking whether the correct
+// one is the most likely. Running the same data against a model before and
+// after quantization shows how much accuracy the quantization costs.
+package eval
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Options controls a benchmark run
+type Options struct {
+	Limit int // number of tasks to run, 0 runs all of them
+
+	// Progress is called after each task with the number of tasks done and
+	// the report so far
+	Progress func(done, total int, report *Report)
+}
+
+// Report summarizes a benchmark run
+type Report struct {
+	Tasks       int           // number of tasks scored
+	Correct     int           // tasks whose correct ending has the highest log-probability
+	CorrectNorm int           // tasks whose correct ending has the highest log-probability per byte
+	Duration    time.Duration // wall time of the run
+}
+
+// Accuracy returns the fraction of tasks answered correctly
+func (r *Report) Accuracy() float64 {
+	if r.Tasks == 0 {
+		return 0
+	}
+	return float64(r.Correct) / float64(r.Tasks)
+}
+
+// AccuracyNorm returns the fraction of tasks answered correctly when
+// log-probabilities are normalized by the length of the ending
+func (r *Report) AccuracyNorm() float64 {
+	if r.Tasks == 0 {
+		return 0
+	}
+	return float64(r.CorrectNorm) / float64(r.Tasks)
+}
+
+// StdErr returns the standard error of Accuracy
+func (r *Report) StdErr() float64 {
+	if r.Tasks < 2 {
+		return 0
+	}
+	p := r.Accuracy()
+	return math.Sqrt(p * (1 - p) / float64(r.Tasks-1))
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("tasks: %d  acc: %.2f%% ± %.2f%%  acc_norm: %.2f%%  time: %s",
+		r.Tasks, 100*r.Accuracy(), 100*r.StdErr(), 100*r.AccuracyNorm(), r.Duration.Round(time.Millisecond))
+}
+
+// Run scores every task with c. The endings of a task are scored in
+// parallel sequences when the context was created with
+// ContextParams.Sequences above 1. When ctx is cancelled the report covers
+// the tasks completed so far and ctx's error is returned with it.
+func Run(ctx context.Context, c *bindings.Context, tasks []Task, opts Options) (*Report, error) {
+	if opts.Limit > 0 && opts.Limit < len(tasks) {
+		tasks = tasks[:opts.Limit]
+	}
+
+	report := &Report{}
+	start := time.Now()
+	defer func() { report.Duration = time.Since(start) }()
+
+	for i, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		scores, err := c.ScoreMany(task.Context, task.Endings)
+		if err != nil {
+			return report, fmt.Errorf("task %d: %w", i, err)
+		}
+
+		normalized := make([]float64, len(scores))
+		for j, score := range scores {
+			normalized[j] = score / float64(max(len(task.Endings[j]), 1))
+		}
+
+		report.Tasks++
+		if argmax(scores) == task.Label {
+			report.Correct++
+		}
+		if argmax(normalized) == task.Label {
+			report.CorrectNorm++
+		}
+
+		if opts.Progress != nil {
+			report.Duration = time.Since(start)
+			opts.Progress(i+1, len(tasks), report)
+		}
+	}
+
+	return report, nil
+}
+
+func argmax(values []float64) int {
+	best := 0
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,180 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// KLOptions controls CompareKL
+type KLOptions struct {
+	ChunkSize int // tokens per chunk, 0 uses the smaller context size capped at 512
+	MaxChunks int // 0 processes the whole text
+
+	// Progress is called after each chunk
+	Progress func(done, total int)
+}
+
+// KLReport holds token-level statistics of how far a test model's next-token
+// distributions are from a reference model's
+type KLReport struct {
+	Tokens int // number of positions compared
+
+	MeanKLD   float64 // mean KL divergence of the test model from the reference, in nats
+	MedianKLD float64
+	P99KLD    float64 // 99th percentile
+	MaxKLD    float64
+
+	SameTop float64 // fraction of positions where both models predict the same most likely token
+
+	PerplexityRef  float64 // perplexity of the reference model on the text
+	PerplexityTest float64 // perplexity of the test model on the text
+}
+
+func (r *KLReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tokens:          %d\n", r.Tokens)
+	fmt.Fprintf(&b, "PPL(ref):        %.4f\n", r.PerplexityRef)
+	fmt.Fprintf(&b, "PPL(test):       %.4f\n", r.PerplexityTest)
+	fmt.Fprintf(&b, "mean KLD:        %.6f\n", r.MeanKLD)
+	fmt.Fprintf(&b, "median KLD:      %.6f\n", r.MedianKLD)
+	fmt.Fprintf(&b, "99%% KLD:         %.6f\n", r.P99KLD)
+	fmt.Fprintf(&b, "max KLD:         %.6f\n", r.MaxKLD)
+	fmt.Fprintf(&b, "same top token:  %.2f%%\n", 100*r.SameTop)
+	return b.String()
+}
+
+// CompareKL runs text through a reference model and a test model, typically
+// the same model before and after quantization, and compares their
+// next-token distributions. Like llama-perplexity the text is split into
+// chunks that each start with BOS, and only the second half of every chunk
+// is scored so that each prediction has some context. Both models must use
+// the same vocabulary.
+func CompareKL(ctx context.Context, ref, test *bindings.Context, text string, opts KLOptions) (*KLReport, error) {
+	if ref.Model().VocabSize() != test.Model().VocabSize() {
+		return nil, errors.New("models have different vocabularies")
+	}
+
+	chunk := opts.ChunkSize
+	if chunk <= 0 {
+		chunk = min(ref.Size(), test.Size(), 512)
+	}
+	tokens, err := ref.Model().Tokenize(text, true, false)
+	if err != nil {
+		return nil, err
+	}
+	nChunks := len(tokens) / chunk
+	if opts.MaxChunks > 0 {
+		nChunks = min(nChunks, opts.MaxChunks)
+	}
+	if nChunks == 0 {
+		return nil, fmt.Errorf("text has %d tokens, need at least %d", len(tokens), chunk)
+	}
+
+	var (
+		klds            []float64
+		same            int
+		nllRef, nllTest float64
+	)
+	bos := ref.Model().BOS()
+	for i := range nChunks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		input := append([]bindings.Token(nil), tokens[i*chunk:(i+1)*chunk]...)
+		if bos >= 0 {
+			input[0] = bos
+		}
+		if err := ref.EvalAll(input); err != nil {
+			return nil, err
+		}
+		if err := test.EvalAll(input); err != nil {
+			return nil, err
+		}
+
+		for pos := chunk / 2; pos < chunk-1; pos++ {
+			p := logSoftmax(ref.Logits(pos))
+			q := logSoftmax(test.Logits(pos))
+			next := input[pos+1]
+
+			klds = append(klds, klDivergence(p, q))
+			if argmax32(p) == argmax32(q) {
+				same++
+			}
+			nllRef -= float64(p[next])
+			nllTest -= float64(q[next])
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(i+1, nChunks)
+		}
+	}
+
+	n := len(klds)
+	report := &KLReport{
+		Tokens:         n,
+		SameTop:        float64(same) / float64(n),
+		PerplexityRef:  math.Exp(nllRef / float64(n)),
+		PerplexityTest: math.Exp(nllTest / float64(n)),
+	}
+	var sum float64
+	for _, kld := range klds {
+		sum += kld
+	}
+	report.MeanKLD = sum / float64(n)
+	sort.Float64s(klds)
+	report.MedianKLD = percentile(klds, 0.5)
+	report.P99KLD = percentile(klds, 0.99)
+	report.MaxKLD = klds[n-1]
+
+	return report, nil
+}
+
+// klDivergence returns KL(p || q) for distributions given as log-probabilities
+func klDivergence(p, q []float32) float64 {
+	var kld float64
+	for i := range p {
+		kld += math.Exp(float64(p[i])) * float64(p[i]-q[i])
+	}
+	return max(kld, 0)
+}
+
+// logSoftmax returns the log-probabilities of logits
+func logSoftmax(logits []float32) []float32 {
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+	logSum := float32(math.Log(sum))
+
+	out := make([]float32, len(logits))
+	for i, l := range logits {
+		out[i] = l - maxLogit - logSum
+	}
+	return out
+}
+
+func argmax32(values []float32) int {
+	best := 0
+	for i, v := range values {
+		if v > values[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// percentile returns the value at fraction f of sorted values
+func percentile(sorted []float64, f float64) float64 {
+	return sorted[min(int(f*float64(len(sorted))), len(sorted)-1)]
+}
@@ -0,0 +1,294 @@
+// Command docqa answers a question about a document far longer than the
+// model's context, such as a 200-page report. The document is split into
+// chunks by token count and the chunks most similar to the question are
+// retrieved with an embedding model. The chat model takes notes on each of
+// them, several at once in the sequences of one context, the notes are
+// merged in rounds until they fit in one prompt, and the answer is
+// generated from them with context shifting.
+//
+// It exercises textsplit, prompt, EmbedMany, the Scheduler and infinite
+// generation together: with -expect it fails unless the answer contains the
+// expected text, so it can run as an integration test on a known document.
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/prompt"
+	"github.com/matthiase/alpaca/textsplit"
+)
+
+// none is what the model answers for an excerpt that says nothing about
+// the question
+const none = "NONE"
+
+// room is the number of tokens left for the reply in every prompt, on top
+// of the chat template's
+const room = 64
+
+var (
+	notePrompt   = prompt.Must(prompt.Parse("Take notes on what the excerpt of a longer document says about the question, quoting the facts and figures it gives. Reply with the notes only. If the excerpt says nothing about the question, reply with " + none + ".\n\nQuestion: {{.question}}\n\nExcerpt:\n{{.excerpt}}"))
+	mergePrompt  = prompt.Must(prompt.Parse("Merge these notes taken on consecutive parts of one document into a single set of notes about the question. Keep every fact and figure that bears on it and drop repetitions. Reply with the notes only.\n\nQuestion: {{.question}}\n\nNotes:\n{{.notes}}"))
+	answerPrompt = prompt.Must(prompt.Parse("Answer the question using only the notes taken on a document. If they don't contain the answer, say so.\n\nNotes:\n{{.notes}}\n\nQuestion: {{.question}}"))
+)
+
+func main() {
+	modelPath := flag.String("model", "", "Path to GGUF chat model")
+	embedPath := flag.String("embed-model", "", "Path to GGUF embedding model")
+	docPath := flag.String("doc", "", "Text file of the document to answer questions about")
+	question := flag.String("question", "", "Question to answer")
+	expect := flag.String("expect", "", "Fail unless the answer contains this text, case-insensitively")
+	ctxSize := flag.Int("ctx", 8192, "Chat context size, shared by the parallel sequences")
+	parallel := flag.Int("parallel", 4, "Chunks read at once")
+	chunkSize := flag.Int("chunk", 512, "Tokens per chunk")
+	topK := flag.Int("k", 16, "Number of chunks retrieved")
+	noteTokens := flag.Int("note-tokens", 256, "Tokens of the notes on a chunk or a group of notes")
+	answerTokens := flag.Int("answer-tokens", 1024, "Tokens of the answer, which may exceed the room left in the context")
+	flag.Parse()
+
+	if *modelPath == "" || *embedPath == "" || *docPath == "" || *question == "" {
+		log.Fatal("Please provide -model, -embed-model, -doc and -question flags")
+	}
+	data, err := os.ReadFile(*docPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	model, err := bindings.LoadModel(*modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	// Chunks are counted in the chat model's tokens, which read them
+	chunks, err := textsplit.Split(model, string(data), textsplit.Options{ChunkSize: *chunkSize, Overlap: *chunkSize / 8})
+	if err != nil {
+		log.Fatal(err)
+	}
+	chunks = slices.DeleteFunc(chunks, func(c textsplit.Chunk) bool { return strings.TrimSpace(c.Text) == "" })
+	total := 0
+	for _, c := range chunks {
+		total += c.Tokens
+	}
+	log.Printf("Split %d tokens into %d chunks", total, len(chunks))
+
+	picked, err := retrieve(*embedPath, chunks, *question, *topK, *chunkSize, *parallel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Retrieved %d chunks", len(picked))
+
+	c, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: *ctxSize, Sequences: max(*parallel, 1)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Free()
+
+	notes, err := takeNotes(c, picked, *question, *noteTokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	text, err := answer(c, notes, *question, *answerTokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *expect != "" && !strings.Contains(strings.ToLower(text), strings.ToLower(*expect)) {
+		log.Fatalf("The answer doesn't contain %q", *expect)
+	}
+}
+
+// retrieve returns the k chunks most similar to the question, in the order
+// of the document so that notes on them follow it
+func retrieve(embedPath string, chunks []textsplit.Chunk, question string, k, chunkSize, parallel int) ([]textsplit.Chunk, error) {
+	embedModel, err := bindings.LoadModel(embedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer embedModel.Free()
+
+	// The embedding model's tokenizer may need more tokens for a chunk
+	n := max(parallel, 1) * (chunkSize + chunkSize/2)
+	c, err := bindings.NewContext(embedModel, bindings.ContextParams{ContextSize: n, BatchSize: n, UBatchSize: n, Sequences: max(parallel, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Free()
+
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+	embeddings, err := c.EmbedMany(texts, bindings.EmbedOptions{})
+	if err != nil {
+		return nil, err
+	}
+	query, err := c.Embed(question, bindings.EmbedOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Embeddings are normalized, so the dot product is the cosine similarity
+	scores := make([]float32, len(chunks))
+	for i, embedding := range embeddings {
+		for j := range min(len(query), len(embedding)) {
+			scores[i] += query[j] * embedding[j]
+		}
+	}
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(scores[b], scores[a]) })
+	order = order[:min(k, len(order))]
+	slices.Sort(order)
+
+	picked := make([]textsplit.Chunk, len(order))
+	for i, j := range order {
+		picked[i] = chunks[j]
+	}
+	return picked, nil
+}
+
+// takeNotes has the model take notes on every chunk, in parallel on the
+// context's sequences, and merges them in rounds until they fit in one
+// prompt of a sequence
+func takeNotes(c *bindings.Context, chunks []textsplit.Chunk, question string, maxTokens int) (string, error) {
+	sched, err := bindings.NewScheduler(c)
+	if err != nil {
+		return "", err
+	}
+	// The answer is generated on the context itself
+	defer sched.Close()
+	budget := sched.SlotSize() - maxTokens - room
+
+	excerpts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		excerpts[i] = chunk.Text
+	}
+	notes, err := mapPrompts(sched, c.Model(), notePrompt, "excerpt", excerpts, question, budget, maxTokens)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Took notes on %d of %d chunks", len(notes), len(chunks))
+
+	for round := 1; ; round++ {
+		joined := strings.Join(notes, "\n\n")
+		tokens, err := c.Model().Tokenize(joined, false, false)
+		if err != nil {
+			return "", err
+		}
+		if len(tokens) <= budget || len(notes) <= 1 {
+			return joined, nil
+		}
+		groups, err := textsplit.Split(c.Model(), joined, textsplit.Options{ChunkSize: budget})
+		if err != nil {
+			return "", err
+		}
+		if len(groups) >= len(notes) {
+			return "", errors.New("notes don't fit in a prompt, -note-tokens must be smaller")
+		}
+		texts := make([]string, len(groups))
+		for i, g := range groups {
+			texts[i] = g.Text
+		}
+		if notes, err = mapPrompts(sched, c.Model(), mergePrompt, "notes", texts, question, budget, maxTokens); err != nil {
+			return "", err
+		}
+		log.Printf("Merged the notes into %d in round %d", len(notes), round)
+	}
+}
+
+// mapPrompts renders tmpl with each of texts as the variable name and
+// generates the replies at once, leaving out the NONE ones. Texts are cut
+// to fit the prompt in budget tokens.
+func mapPrompts(sched *bindings.Scheduler, model *bindings.Model, tmpl *prompt.Template, name string, texts []string, question string, budget, maxTokens int) ([]string, error) {
+	opts := bindings.DefaultGenerateOptions()
+	opts.Temperature = 0
+	opts.MaxTokens = maxTokens
+
+	replies := make([]string, len(texts))
+	errs := make([]error, len(texts))
+	var wg sync.WaitGroup
+	for i, text := range texts {
+		wg.Go(func() {
+			content, err := tmpl.ExecuteWithOptions(map[string]any{"question": question, name: text}, prompt.Options{
+				Tokenizer: model,
+				MaxTokens: budget,
+				Truncate:  []string{name},
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			p, err := model.ApplyChatTemplate([]bindings.ChatMessage{{Role: bindings.RoleUser, Content: content}}, true)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			res, err := sched.Generate(context.Background(), p, opts)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			replies[i] = strings.TrimSpace(res.Text)
+		})
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(replies, func(r string) bool {
+		return r == "" || strings.EqualFold(strings.Trim(r, ". "), none)
+	}), nil
+}
+
+// answer streams the answer to the question from the notes. The prompt is
+// kept when the context fills up, and the oldest half of the answer is
+// shifted out instead.
+func answer(c *bindings.Context, notes, question string, maxTokens int) (string, error) {
+	if notes == "" {
+		notes = "(none)"
+	}
+	content, err := answerPrompt.Execute(map[string]any{"notes": notes, "question": question})
+	if err != nil {
+		return "", err
+	}
+	p, err := c.Model().ApplyChatTemplate([]bindings.ChatMessage{{Role: bindings.RoleUser, Content: content}}, true)
+	if err != nil {
+		return "", err
+	}
+	tokens, err := c.Model().Tokenize(p, true, true)
+	if err != nil {
+		return "", err
+	}
+
+	opts := bindings.DefaultGenerateOptions()
+	opts.Temperature = 0
+	opts.MaxTokens = maxTokens
+	opts.Infinite = true
+	opts.KeepTokens = len(tokens)
+	opts.OnToken = func(piece string) {
+		fmt.Print(piece)
+	}
+	res, err := c.Generate(context.Background(), p, opts)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Answered from a %d-token prompt in %d tokens, %d shifted out", res.PromptTokens, res.CompletionTokens, res.ShiftedTokens)
+	return res.Text, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/eval"
+)
+
+func main() {
+	modelPath := flag.String("model", "", "Path to GGUF model")
+	dataPath := flag.String("data", "", "Benchmark data, HellaSwag text or JSON lines")
+	limit := flag.Int("limit", 0, "Number of tasks to run, 0 runs all")
+	parallel := flag.Int("parallel", 4, "Number of endings scored in parallel")
+	flag.Parse()
+
+	if *modelPath == "" || *dataPath == "" {
+		log.Fatal("Please provide -model and -data flags")
+	}
+
+	tasks, err := eval.Load(*dataPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	model, err := bindings.LoadModel(*modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	// One sequence holds the context, the others score endings
+	ctx, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: 2048, Sequences: *parallel + 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ctx.Free()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := eval.Run(runCtx, ctx, tasks, eval.Options{
+		Limit: *limit,
+		Progress: func(done, total int, report *eval.Report) {
+			fmt.Printf("\r%d/%d  acc: %.2f%%  acc_norm: %.2f%%", done, total, 100*report.Accuracy(), 100*report.AccuracyNorm())
+		},
+	})
+	fmt.Println()
+	if err != nil {
+		log.Print(err)
+	}
+	fmt.Println(report)
+}
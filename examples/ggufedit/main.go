@@ -0,0 +1,156 @@
+// Command ggufedit prints or edits the metadata of a GGUF file. Without -out
+// it lists the metadata; with it, the file is copied to -out with the keys
+// given by -set and -delete changed and the tensor data left as it is.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// list collects the values of a repeated flag
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(v string) error { *l = append(*l, v); return nil }
+
+func main() {
+	modelPath := flag.String("model", "", "Path to GGUF model")
+	outPath := flag.String("out", "", "Path of the edited copy")
+	templatePath := flag.String("chat-template", "", "File with a chat template to store in tokenizer.chat_template")
+	var sets, deletes list
+	flag.Var(&sets, "set", "key=value to set, may be repeated")
+	flag.Var(&deletes, "delete", "Key to delete, may be repeated")
+	flag.Parse()
+
+	if *modelPath == "" {
+		log.Fatal("Please provide -model flag")
+	}
+
+	if *outPath == "" {
+		if len(sets) > 0 || len(deletes) > 0 || *templatePath != "" {
+			log.Fatal("Please provide -out flag")
+		}
+		f, err := gguf.Open(*modelPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, kv := range f.Metadata {
+			fmt.Printf("%s = %s\n", kv.Key, format(kv.Value))
+		}
+		fmt.Printf("%d tensors\n", len(f.Tensors))
+		return
+	}
+
+	err := gguf.Edit(*modelPath, *outPath, func(f *gguf.File) error {
+		for _, s := range sets {
+			key, value, ok := strings.Cut(s, "=")
+			if !ok {
+				return fmt.Errorf("-set %q is not key=value", s)
+			}
+			v, err := parse(f, key, value)
+			if err != nil {
+				return err
+			}
+			if err := f.Set(key, v); err != nil {
+				return err
+			}
+		}
+		for _, key := range deletes {
+			f.Delete(key)
+		}
+		if *templatePath != "" {
+			tmpl, err := os.ReadFile(*templatePath)
+			if err != nil {
+				return err
+			}
+			return f.Set("tokenizer.chat_template", string(tmpl))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parse converts value to the type key already has, or keeps it a string
+// for new keys
+func parse(f *gguf.File, key, value string) (any, error) {
+	old, ok := f.Get(key)
+	if !ok {
+		return value, nil
+	}
+	var v any
+	var err error
+	switch old.(type) {
+	case string:
+		v = value
+	case bool:
+		v, err = strconv.ParseBool(value)
+	case uint8:
+		v, err = parseUint[uint8](value, 8)
+	case uint16:
+		v, err = parseUint[uint16](value, 16)
+	case uint32:
+		v, err = parseUint[uint32](value, 32)
+	case uint64:
+		v, err = parseUint[uint64](value, 64)
+	case int8:
+		v, err = parseInt[int8](value, 8)
+	case int16:
+		v, err = parseInt[int16](value, 16)
+	case int32:
+		v, err = parseInt[int32](value, 32)
+	case int64:
+		v, err = parseInt[int64](value, 64)
+	case float32:
+		var x float64
+		x, err = strconv.ParseFloat(value, 32)
+		v = float32(x)
+	case float64:
+		v, err = strconv.ParseFloat(value, 64)
+	default:
+		return nil, fmt.Errorf("%s is an array and can't be set", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return v, nil
+}
+
+func parseUint[T uint8 | uint16 | uint32 | uint64](s string, bits int) (T, error) {
+	x, err := strconv.ParseUint(s, 10, bits)
+	return T(x), err
+}
+
+func parseInt[T int8 | int16 | int32 | int64](s string, bits int) (T, error) {
+	x, err := strconv.ParseInt(s, 10, bits)
+	return T(x), err
+}
+
+// format prints a value, shortening long strings and arrays such as the
+// vocabulary
+func format(v any) string {
+	switch v := v.(type) {
+	case string:
+		if len(v) > 80 {
+			return strconv.Quote(v[:80]) + "..."
+		}
+		return strconv.Quote(v)
+	case []string:
+		return fmt.Sprintf("[%d strings]", len(v))
+	case []any:
+		return fmt.Sprintf("[%d arrays]", len(v))
+	}
+	s := fmt.Sprint(v)
+	if len(s) > 80 {
+		return s[:80] + "..."
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/eval"
+)
+
+func main() {
+	refPath := flag.String("ref", "", "Path to the reference GGUF model, e.g. F16")
+	testPath := flag.String("test", "", "Path to the GGUF model to compare, e.g. a quantization of -ref")
+	textPath := flag.String("text", "", "Path to a text file to evaluate")
+	chunk := flag.Int("chunk", 512, "Tokens per chunk")
+	limit := flag.Int("limit", 0, "Number of chunks to evaluate, 0 evaluates all")
+	flag.Parse()
+
+	if *refPath == "" || *testPath == "" || *textPath == "" {
+		log.Fatal("Please provide -ref, -test and -text flags")
+	}
+
+	text, err := os.ReadFile(*textPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	params := bindings.ContextParams{ContextSize: *chunk, BatchSize: *chunk}
+	ref, err := load(*refPath, params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ref.Model().Free()
+	defer ref.Free()
+
+	test, err := load(*testPath, params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer test.Model().Free()
+	defer test.Free()
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := eval.CompareKL(runCtx, ref, test, string(text), eval.KLOptions{
+		ChunkSize: *chunk,
+		MaxChunks: *limit,
+		Progress: func(done, total int) {
+			fmt.Printf("\rchunk %d/%d", done, total)
+		},
+	})
+	fmt.Println()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(report)
+}
+
+func load(path string, params bindings.ContextParams) (*bindings.Context, error) {
+	model, err := bindings.LoadModel(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := bindings.NewContext(model, params)
+	if err != nil {
+		model.Free()
+		return nil, err
+	}
+	return ctx, nil
+}
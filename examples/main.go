@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -10,6 +11,10 @@ import (
 
 func main() {
 	modelPath := flag.String("model", "", "Path to GGUF model")
+	prompt := flag.String("prompt", "", "Optional prompt to generate a completion for")
+	maxTokens := flag.Int("max-tokens", 128, "Maximum number of tokens to generate")
+	negativePrompt := flag.String("negative-prompt", "", "Optional negative prompt for classifier-free guidance")
+	cfgScale := flag.Float64("cfg-scale", 1.5, "Guidance strength used with -negative-prompt")
 	flag.Parse()
 
 	if *modelPath == "" {
@@ -32,4 +37,33 @@ func main() {
 	fmt.Printf("✓ Model loaded successfully!\n")
 	fmt.Printf("  Vocabulary size: %d\n", model.VocabSize())
 	fmt.Printf("  Context size: %d\n", model.ContextSize())
+
+	if *prompt == "" {
+		return
+	}
+
+	// Generate a completion
+	ctx, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: 2048})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ctx.Free()
+
+	opts := bindings.DefaultGenerateOptions()
+	opts.MaxTokens = *maxTokens
+	opts.NegativePrompt = *negativePrompt
+	opts.GuidanceScale = float32(*cfgScale)
+	opts.OnToken = func(piece string) {
+		fmt.Print(piece)
+	}
+
+	fmt.Println()
+	result, err := ctx.Generate(context.Background(), *prompt, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n\n  Prompt tokens: %d\n", result.PromptTokens)
+	fmt.Printf("  Completion tokens: %d\n", result.CompletionTokens)
+	fmt.Printf("  Finish reason: %s\n", result.FinishReason)
 }
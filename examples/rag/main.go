@@ -0,0 +1,186 @@
+// Command rag answers questions about a folder of markdown files: the files
+// are split into chunks, embedded with an embedding model and kept in memory,
+// and the chunks closest to each question are given to a chat model as
+// context for its answer.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/textsplit"
+)
+
+// document is an embedded chunk of a file
+type document struct {
+	path      string
+	text      string
+	embedding []float32
+}
+
+// index is a brute-force vector index, plenty for a folder of notes
+type index struct {
+	docs []document
+}
+
+// search returns the k documents most similar to the query embedding.
+// Embeddings are normalized, so the dot product is the cosine similarity.
+func (idx *index) search(query []float32, k int) []document {
+	type hit struct {
+		doc   document
+		score float32
+	}
+	hits := make([]hit, len(idx.docs))
+	for i, doc := range idx.docs {
+		var dot float32
+		for j := range query {
+			dot += query[j] * doc.embedding[j]
+		}
+		hits[i] = hit{doc, dot}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+
+	docs := make([]document, 0, k)
+	for _, h := range hits[:min(k, len(hits))] {
+		docs = append(docs, h.doc)
+	}
+	return docs
+}
+
+func main() {
+	embedPath := flag.String("embed-model", "", "Path to GGUF embedding model")
+	chatPath := flag.String("chat-model", "", "Path to GGUF chat model")
+	docsDir := flag.String("docs", "", "Folder of markdown files to answer questions about")
+	question := flag.String("question", "", "Question to answer, questions are read from stdin if empty")
+	chunkSize := flag.Int("chunk", 256, "Tokens per chunk")
+	topK := flag.Int("k", 4, "Number of chunks given to the chat model")
+	flag.Parse()
+
+	if *embedPath == "" || *chatPath == "" || *docsDir == "" {
+		log.Fatal("Please provide -embed-model, -chat-model and -docs flags")
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	embedModel, err := bindings.LoadModel(*embedPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer embedModel.Free()
+
+	// Room for the special tokens the chunk counts leave out
+	embedCtx, err := bindings.NewContext(embedModel, bindings.ContextParams{ContextSize: *chunkSize + 16, BatchSize: *chunkSize + 16, UBatchSize: *chunkSize + 16})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer embedCtx.Free()
+
+	idx, err := ingest(embedCtx, *docsDir, *chunkSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Indexed %d chunks\n", len(idx.docs))
+
+	chatModel, err := bindings.LoadModel(*chatPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chatModel.Free()
+
+	chatCtx, err := bindings.NewContext(chatModel, bindings.ContextParams{ContextSize: 4096})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chatCtx.Free()
+
+	ask := func(q string) {
+		if err := answer(embedCtx, chatCtx, idx, q, *topK); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if *question != "" {
+		ask(*question)
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("> ")
+	for scanner.Scan() {
+		if q := strings.TrimSpace(scanner.Text()); q != "" {
+			ask(q)
+		}
+		fmt.Print("> ")
+	}
+}
+
+// ingest splits and embeds every markdown file under dir
+func ingest(c *bindings.Context, dir string, chunkSize int) (*index, error) {
+	idx := &index{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".md") {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		chunks, err := textsplit.Split(c.Model(), string(data), textsplit.Options{ChunkSize: chunkSize, Overlap: chunkSize / 8})
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if strings.TrimSpace(chunk.Text) == "" {
+				continue
+			}
+			embedding, err := c.Embed(chunk.Text, bindings.EmbedOptions{})
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			idx.docs = append(idx.docs, document{path: path, text: chunk.Text, embedding: embedding})
+		}
+		return nil
+	})
+	return idx, err
+}
+
+// answer retrieves the chunks closest to the question and streams the chat
+// model's reply
+func answer(embedCtx, chatCtx *bindings.Context, idx *index, question string, k int) error {
+	query, err := embedCtx.Embed(question, bindings.EmbedOptions{})
+	if err != nil {
+		return err
+	}
+
+	var notes strings.Builder
+	for _, doc := range idx.search(query, k) {
+		fmt.Fprintf(&notes, "From %s:\n%s\n\n", doc.path, strings.TrimSpace(doc.text))
+	}
+	messages := []bindings.ChatMessage{
+		{Role: bindings.RoleSystem, Content: "Answer the question using only the following notes. If they don't contain the answer, say so.\n\n" + notes.String()},
+		{Role: bindings.RoleUser, Content: question},
+	}
+	prompt, err := chatCtx.Model().ApplyChatTemplate(messages, true)
+	if err != nil {
+		return err
+	}
+
+	opts := bindings.DefaultGenerateOptions()
+	opts.MaxTokens = 512
+	opts.OnToken = func(piece string) {
+		fmt.Print(piece)
+	}
+	_, err = chatCtx.Generate(context.Background(), prompt, opts)
+	fmt.Println()
+	return err
+}
@@ -0,0 +1,100 @@
+// Command reproduce checks that a model gives bit-identical outputs in
+// deterministic mode: it generates from the same prompt several times and
+// compares the text and the log-probability of every token, exiting with
+// status 1 at the first difference.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// run is the outcome of one generation
+type run struct {
+	text     string
+	tokens   []bindings.Token
+	logprobs []float32
+}
+
+func main() {
+	modelPath := flag.String("model", "", "Path to GGUF model")
+	prompt := flag.String("prompt", "The capital of France is", "Prompt to generate from")
+	runs := flag.Int("runs", 3, "Number of generations to compare")
+	maxTokens := flag.Int("max-tokens", 64, "Tokens generated per run")
+	temperature := flag.Float64("temperature", 0.8, "Sampling temperature, the seed is fixed")
+	flag.Parse()
+
+	if *modelPath == "" {
+		log.Fatal("Please provide -model flag")
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	model, err := bindings.LoadModel(*modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	ctx, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: 2048, Deterministic: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ctx.Free()
+
+	opts := bindings.DefaultGenerateOptions()
+	opts.MaxTokens = *maxTokens
+	opts.Temperature = float32(*temperature)
+
+	var first run
+	for i := range *runs {
+		var r run
+		opts.OnTokenInfo = func(info bindings.TokenInfo) {
+			r.tokens = append(r.tokens, info.Token)
+			r.logprobs = append(r.logprobs, info.Logprob)
+		}
+		result, err := ctx.Generate(context.Background(), *prompt, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.text = result.Text
+
+		if i == 0 {
+			first = r
+			fmt.Printf("run 1: %d tokens: %q\n", len(r.tokens), r.text)
+			continue
+		}
+		if diff := compare(first, r); diff != "" {
+			fmt.Printf("run %d differs from run 1: %s\n", i+1, diff)
+			os.Exit(1)
+		}
+		fmt.Printf("run %d: identical\n", i+1)
+	}
+}
+
+// compare describes the first difference between two runs, "" if they are
+// bit-identical
+func compare(a, b run) string {
+	for i := range min(len(a.tokens), len(b.tokens)) {
+		if a.tokens[i] != b.tokens[i] {
+			return fmt.Sprintf("token %d is %d instead of %d", i, b.tokens[i], a.tokens[i])
+		}
+		if math.Float32bits(a.logprobs[i]) != math.Float32bits(b.logprobs[i]) {
+			return fmt.Sprintf("logprob of token %d is %v instead of %v", i, b.logprobs[i], a.logprobs[i])
+		}
+	}
+	if len(a.tokens) != len(b.tokens) {
+		return fmt.Sprintf("%d tokens instead of %d", len(b.tokens), len(a.tokens))
+	}
+	if a.text != b.text {
+		return "the text differs"
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+// Command tui is an interactive terminal chat. It streams replies as they
+// are generated, shows a spinner while the prompt is evaluated and a footer
+// with generation speed after each reply. It only uses ANSI escape codes, so
+// the terminal's own scrollback keeps the conversation.
+//
+// It is deliberately not built on Bubble Tea or another TUI framework: the
+// examples live in the library's module, and keeping them to the standard
+// library keeps go.mod free of dependencies.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+const (
+	bold      = "\x1b[1m"
+	dim       = "\x1b[2m"
+	cyan      = "\x1b[36m"
+	reset     = "\x1b[0m"
+	clearLine = "\r\x1b[K" // return to the start of the line and erase it
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// spinner animates on the current line until the first piece of the reply
+type spinner struct {
+	once sync.Once
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startSpinner() *spinner {
+	s := &spinner{done: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(80 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Printf("%s%s%s thinking%s", clearLine, cyan, spinnerFrames[i%len(spinnerFrames)], reset)
+			select {
+			case <-s.done:
+				fmt.Print(clearLine)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return s
+}
+
+// stop erases the spinner, it may be called more than once
+func (s *spinner) stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+	})
+}
+
+func main() {
+	modelPath := flag.String("model", "", "Path to GGUF model")
+	system := flag.String("system", "You are a helpful assistant.", "System prompt")
+	ctxSize := flag.Int("ctx", 4096, "Context size")
+	flag.Parse()
+
+	if *modelPath == "" {
+		log.Fatal("Please provide -model flag")
+	}
+
+	bindings.Init()
+	defer bindings.Free()
+
+	fmt.Print(dim + "Loading model..." + reset)
+	model, err := bindings.LoadModel(*modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer model.Free()
+
+	ctx, err := bindings.NewContext(model, bindings.ContextParams{ContextSize: *ctxSize})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ctx.Free()
+	fmt.Print(clearLine)
+
+	var (
+		spin    *spinner
+		firstAt time.Time
+		started bool
+	)
+	opts := bindings.DefaultGenerateOptions()
+	opts.OnToken = func(piece string) {
+		if !started {
+			spin.stop()
+			firstAt = time.Now()
+			started = true
+			fmt.Print(bold + "assistant: " + reset)
+		}
+		fmt.Print(piece)
+	}
+
+	session, err := bindings.NewSession(ctx, bindings.SessionOptions{SystemPrompt: *system, GenerateOptions: opts})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(dim + "Type a message, /reset to start over, /history to show the conversation, /quit to exit." + reset)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	for {
+		fmt.Print(bold + "you: " + reset)
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		input := strings.TrimSpace(scanner.Text())
+		switch input {
+		case "":
+			continue
+		case "/quit", "/exit":
+			return
+		case "/reset":
+			session.Reset()
+			fmt.Println(dim + "Conversation cleared." + reset)
+			continue
+		case "/history":
+			printHistory(session.Messages())
+			continue
+		}
+
+		// Ctrl-C stops the reply instead of exiting
+		genCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		spin, started = startSpinner(), false
+		start := time.Now()
+		result, err := session.SendContext(genCtx, input)
+		spin.stop()
+		stop()
+		if err != nil {
+			fmt.Printf("%serror: %v%s\n", clearLine, err, reset)
+			continue
+		}
+		fmt.Println()
+
+		prompt := time.Duration(0)
+		speed := 0.0
+		if started {
+			prompt = firstAt.Sub(start)
+			if elapsed := time.Since(firstAt).Seconds(); elapsed > 0 {
+				speed = float64(result.CompletionTokens) / elapsed
+			}
+		}
+		fmt.Printf("%s%d tokens · %.1f tok/s · prompt %s · context %d/%d · %s%s\n\n",
+			dim, result.CompletionTokens, speed, prompt.Round(time.Millisecond),
+			session.Tokens(), ctx.Size(), result.FinishReason, reset)
+	}
+}
+
+func printHistory(messages []bindings.ChatMessage) {
+	for _, msg := range messages {
+		fmt.Printf("%s%s:%s %s\n", bold, msg.Role, reset, msg.Content)
+	}
+	fmt.Println()
+}
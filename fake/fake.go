@@ -0,0 +1,170 @@
+// Package fake provides deterministic in-memory implementations of the
+// bindings interfaces, so code built on alpaca can be unit tested without a
+// model file.
+package fake
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Generator replies with canned text. Replies are split into words that act
+// as tokens, so MaxTokens, Stop and OnToken behave as with a real model.
+type Generator struct {
+	// Replies maps prompts to their completion. Prompts without an entry get
+	// Default, or the prompt itself when Default is empty.
+	Replies map[string]string
+	Default string
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+// Generate implements bindings.Generator
+func (g *Generator) Generate(ctx context.Context, prompt string, opts bindings.GenerateOptions) (*bindings.GenerateResult, error) {
+	g.mu.Lock()
+	g.prompts = append(g.prompts, prompt)
+	g.mu.Unlock()
+
+	reply, ok := g.Replies[prompt]
+	if !ok {
+		reply = g.Default
+		if reply == "" {
+			reply = prompt
+		}
+	}
+
+	result := &bindings.GenerateResult{
+		PromptTokens: len(tokens(prompt)),
+		FinishReason: bindings.FinishStop,
+	}
+	if opts.Echo {
+		result.Prompt = prompt
+	}
+
+	text := ""
+	for _, piece := range tokens(reply) {
+		if ctx.Err() != nil {
+			result.FinishReason = bindings.FinishCancel
+			break
+		}
+		if opts.MaxTokens > 0 && result.CompletionTokens == opts.MaxTokens {
+			result.FinishReason = bindings.FinishLength
+			break
+		}
+		result.CompletionTokens++
+		if stop := stopIndex(text+piece, opts.Stop); stop >= 0 {
+			if opts.OnToken != nil && stop > len(text) {
+				opts.OnToken(piece[:stop-len(text)])
+			}
+			text = (text + piece)[:stop]
+			break
+		}
+		if opts.OnToken != nil {
+			opts.OnToken(piece)
+		}
+		text += piece
+	}
+	result.Text = text
+
+	return result, nil
+}
+
+// Prompts returns the prompts Generate was called with, in order
+func (g *Generator) Prompts() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.prompts...)
+}
+
+// tokens splits text into words, each keeping the whitespace before it
+func tokens(text string) []string {
+	var out []string
+	start := 0
+	for i, r := range text {
+		if i > start && (r == ' ' || r == '\n' || r == '\t') && !isSpace(text[i-1]) {
+			out = append(out, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		out = append(out, text[start:])
+	}
+	return out
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\t'
+}
+
+// stopIndex returns where the first stop sequence starts in text, or -1
+func stopIndex(text string, stop []string) int {
+	first := -1
+	for _, s := range stop {
+		if i := strings.Index(text, s); s != "" && i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// Embedder returns bag-of-words embeddings: every word is hashed to one of
+// Dimensions components. Texts sharing words are similar, which is enough to
+// test retrieval code.
+type Embedder struct {
+	Dimensions int // 0 uses 64
+}
+
+// Embed implements bindings.Embedder
+func (e *Embedder) Embed(text string, opts bindings.EmbedOptions) ([]float32, error) {
+	n := e.Dimensions
+	if n <= 0 {
+		n = 64
+	}
+	if opts.Dimensions > 0 && opts.Dimensions < n {
+		n = opts.Dimensions
+	}
+
+	embd := make([]float32, n)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		h.Write([]byte(strings.Trim(word, ".,;:!?\"'()")))
+		embd[h.Sum32()%uint32(n)]++
+	}
+
+	var sum float64
+	switch opts.Normalize {
+	case bindings.NormalizeNone:
+		return embd, nil
+	case bindings.NormalizeMaxAbs:
+		for _, x := range embd {
+			sum = max(sum, float64(x))
+		}
+		sum /= 32760
+	case bindings.NormalizeTaxicab:
+		for _, x := range embd {
+			sum += float64(x)
+		}
+	default:
+		for _, x := range embd {
+			sum += float64(x) * float64(x)
+		}
+		sum = math.Sqrt(sum)
+	}
+	if sum > 0 {
+		for i := range embd {
+			embd[i] = float32(float64(embd[i]) / sum)
+		}
+	}
+	return embd, nil
+}
+
+var (
+	_ bindings.Generator = (*Generator)(nil)
+	_ bindings.Embedder  = (*Embedder)(nil)
+)
@@ -0,0 +1,327 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/gguf"
+)
+
+// Progress reports the bytes of a model downloaded so far. total is -1 when
+// the server doesn't say.
+type Progress func(name string, done, total int64)
+
+// Cache is a directory of downloaded models. Each model is stored as
+// <name>.gguf next to a <name>.gguf.sha256 file recording the digest it was
+// verified against, so later syncs don't hash it again.
+type Cache struct {
+	Dir string
+
+	// Client downloads the models, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// DefaultDir returns $ALPACA_MODELS, or alpaca/models in the user's cache
+// directory
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("ALPACA_MODELS"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "alpaca", "models"), nil
+}
+
+// Path returns where the named model is stored
+func (c *Cache) Path(name string) string {
+	return filepath.Join(c.Dir, name+".gguf")
+}
+
+// Sync downloads every model of the lockfile that is missing from the cache
+// or doesn't match its pinned digest
+func (c *Cache) Sync(ctx context.Context, l *Lock, progress Progress) error {
+	for _, m := range l.Models {
+		if _, err := c.Pull(ctx, m, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pull downloads a model unless the cache already has it and returns its
+// path. An interrupted download is resumed if the server supports ranges,
+// as S3 and Google Cloud Storage do.
+func (c *Cache) Pull(ctx context.Context, m LockedModel, progress Progress) (string, error) {
+	path := c.Path(m.Name)
+	if c.cached(m) {
+		return path, nil
+	}
+	if Offline() {
+		return "", fmt.Errorf("%s: %w: it is not cached at %s with its pinned digest, copy the file there or unset ALPACA_OFFLINE", m.Name, ErrOffline, path)
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return "", err
+	}
+
+	part := path + ".part"
+	if err := c.download(ctx, m, part, progress); err != nil {
+		return "", fmt.Errorf("%s: %w", m.Name, err)
+	}
+	if err := check(part, m); err != nil {
+		os.Remove(part)
+		return "", fmt.Errorf("%s: %w", m.Name, err)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%s  %s\n", strings.ToLower(m.SHA256), filepath.Base(path))
+	if err := os.WriteFile(path+".sha256", []byte(sum), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// CachedModel is a model file in the cache
+type CachedModel struct {
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+
+	// Partial marks an unfinished download
+	Partial bool
+}
+
+// List returns the models in the cache, unfinished downloads included,
+// sorted by name
+func (c *Cache) List() ([]CachedModel, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var models []CachedModel
+	for _, e := range entries {
+		file := e.Name()
+		base, partial := strings.CutSuffix(file, ".part")
+		name, ok := strings.CutSuffix(base, ".gguf")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, CachedModel{
+			Name:    name,
+			Path:    filepath.Join(c.Dir, file),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Partial: partial,
+		})
+	}
+	return models, nil
+}
+
+// Remove deletes a model from the cache along with its digest and any
+// unfinished download
+func (c *Cache) Remove(name string) error {
+	path := c.Path(name)
+	found := false
+	for _, file := range []string{path, path + ".sha256", path + ".part"} {
+		err := os.Remove(file)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not in the cache", name)
+	}
+	return nil
+}
+
+// Prune removes the models, partial downloads included, that the lockfile
+// doesn't list, and returns their names
+func (c *Cache) Prune(l *Lock) ([]string, error) {
+	return c.PruneFunc(func(m CachedModel) bool {
+		_, locked := l.Find(m.Name)
+		return !locked
+	})
+}
+
+// PruneFunc removes the cached models for which remove returns true and
+// returns their names
+func (c *Cache) PruneFunc(remove func(CachedModel) bool) ([]string, error) {
+	models, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, m := range models {
+		if !remove(m) {
+			continue
+		}
+		if !m.Partial {
+			err = c.Remove(m.Name)
+		} else if err = os.Remove(m.Path); errors.Is(err, os.ErrNotExist) {
+			// Removed along with the complete model
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, m.Name)
+	}
+	return removed, nil
+}
+
+// cached reports whether the cache holds the pinned file. The file isn't
+// hashed again: its recorded digest must match the lock and its tensors must
+// all be there.
+func (c *Cache) cached(m LockedModel) bool {
+	path := c.Path(m.Name)
+	sum, err := os.ReadFile(path + ".sha256")
+	if err != nil || !strings.HasPrefix(string(sum), strings.ToLower(m.SHA256)+" ") {
+		return false
+	}
+	return gguf.Verify(path) == nil
+}
+
+// download fetches the model into part, picking up where an earlier attempt
+// stopped, and checks its digest
+func (c *Cache) download(ctx context.Context, m LockedModel, part string, progress Progress) error {
+	if Offline() {
+		return ErrOffline
+	}
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	done, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	req, err := newRequest(ctx, m.URL)
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", done))
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && done > 0:
+		if total >= 0 {
+			total += done
+		}
+	case resp.StatusCode == http.StatusOK:
+		// The server sent the whole file, so start over
+		if done > 0 {
+			if err := restart(f, h); err != nil {
+				return err
+			}
+			done = 0
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial download is no prefix of the file
+		f.Close()
+		os.Remove(part)
+		return errors.New("discarded a partial download longer than the file, try again")
+	default:
+		return fmt.Errorf("GET %s: %s", m.URL, resp.Status)
+	}
+
+	w := io.MultiWriter(f, h)
+	if progress != nil {
+		w = &progressWriter{w: w, name: m.Name, done: done, total: total, progress: progress}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(m.SHA256) {
+		f.Close()
+		os.Remove(part)
+		return fmt.Errorf("downloaded file has SHA256 %s, want %s", got, m.SHA256)
+	}
+	return f.Close()
+}
+
+// restart empties a partial download
+func restart(f *os.File, h hash.Hash) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	h.Reset()
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// check verifies a downloaded file's structure and quantization type
+func check(path string, m LockedModel) error {
+	if err := gguf.Verify(path); err != nil {
+		return err
+	}
+	if m.Quant == "" {
+		return nil
+	}
+	f, err := gguf.Open(path)
+	if err != nil {
+		return err
+	}
+	want, _ := bindings.ParseFileType(m.Quant)
+	v, _ := f.Get("general.file_type")
+	ft, ok := v.(uint32)
+	// llama-quantize sets 1024 when it guessed the type of older files
+	if !ok || bindings.FileType(ft&^1024) != want {
+		return fmt.Errorf("file type is %v, want %s", v, m.Quant)
+	}
+	return nil
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	w           io.Writer
+	name        string
+	done, total int64
+	progress    Progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	p.progress(p.name, p.done, p.total)
+	return n, err
+}
@@ -0,0 +1,93 @@
+// Package fetch downloads models into a local cache as pinned by a lockfile,
+// so that everyone on a team runs the same files.
+package fetch
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// LockFile is the name of the lockfile alpaca pull reads by default
+const LockFile = "alpaca.lock"
+
+// Lock pins model names to the files they are downloaded from. It is stored
+// as JSON:
+//
+//	{"models": [{"name": "llama-3-8b", "url": "https://...", "sha256": "...", "quant": "Q4_K_M"}]}
+type Lock struct {
+	Models []LockedModel `json:"models"`
+}
+
+// LockedModel is one model of a lockfile
+type LockedModel struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+
+	// Quant is the quantization type as llama-quantize names it, checked
+	// against the file's general.file_type; empty skips the check
+	Quant string `json:"quant,omitempty"`
+}
+
+// LoadLock reads and validates a lockfile
+func LoadLock(path string) (*Lock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Lock
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := l.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &l, nil
+}
+
+// Find returns the locked model with the given name
+func (l *Lock) Find(name string) (LockedModel, bool) {
+	for _, m := range l.Models {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return LockedModel{}, false
+}
+
+func (l *Lock) validate() error {
+	names := make(map[string]bool, len(l.Models))
+	for i, m := range l.Models {
+		if m.Name == "" {
+			return fmt.Errorf("model %d has no name", i)
+		}
+		if strings.ContainsAny(m.Name, `/\`) || m.Name == "." || m.Name == ".." {
+			return fmt.Errorf("model name %q can't be used as a file name", m.Name)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("model %q is listed twice", m.Name)
+		}
+		names[m.Name] = true
+		if m.URL == "" {
+			return fmt.Errorf("model %q has no url", m.Name)
+		}
+		if b, err := hex.DecodeString(m.SHA256); err != nil || len(b) != 32 {
+			return fmt.Errorf("model %q has an invalid sha256", m.Name)
+		}
+		if m.Quant != "" {
+			if _, err := bindings.ParseFileType(m.Quant); err != nil {
+				return fmt.Errorf("model %q: %w", m.Name, err)
+			}
+		}
+	}
+	if len(l.Models) == 0 {
+		return errors.New("no models are listed")
+	}
+	return nil
+}
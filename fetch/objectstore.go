@@ -0,0 +1,140 @@
+package fetch
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// newRequest returns the GET request for a model URL. Next to http and
+// https URLs it takes s3://bucket/key and gs://bucket/object, which are
+// turned into requests to the storage's HTTP API:
+//
+//   - s3 requests are signed with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+//     and AWS_SESSION_TOKEN for AWS_REGION (us-east-1 by default), or left
+//     anonymous without credentials. AWS_ENDPOINT_URL_S3 points them at
+//     another S3-compatible service, such as MinIO.
+//   - gs requests carry GOOGLE_OAUTH_ACCESS_TOKEN as a bearer token, or
+//     are anonymous without it.
+func newRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return s3Request(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "gs":
+		return gcsRequest(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	}
+	return http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+}
+
+// gcsRequest returns the request for an object of Google Cloud Storage
+func gcsRequest(ctx context.Context, bucket, object string) (*http.Request, error) {
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("gs://%s/%s names no object", bucket, object)
+	}
+	u := &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + bucket + "/" + object}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// s3Request returns the request for an object of S3, signed with
+// Signature Version 4 when credentials are set
+func s3Request(ctx context.Context, bucket, key string) (*http.Request, error) {
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3://%s/%s names no object", bucket, key)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// AWS takes the bucket in the host name, other services in the path
+	path := "/" + key
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com"}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_S3"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("AWS_ENDPOINT_URL_S3: %w", err)
+		}
+		u.Scheme, u.Host = e.Scheme, e.Host
+		path = "/" + bucket + "/" + key
+	}
+	u.Path, u.RawPath = path, s3Escape(path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id != "" && secret != "" {
+		signS3(req, id, secret, os.Getenv("AWS_SESSION_TOKEN"), region, time.Now().UTC())
+	}
+	return req, nil
+}
+
+// signS3 signs a request without a body with AWS Signature Version 4. The
+// Range header a resumed download adds later is left out of the signature.
+func signS3(req *http.Request, id, secret, token, region string, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"host:" + req.URL.Host, "x-amz-content-sha256:" + payload, "x-amz-date:" + stamp}
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		headers = append(headers, "x-amz-security-token:"+token)
+		signed += ";x-amz-security-token"
+	}
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		strings.Join(headers, "\n") + "\n", signed, payload}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", id, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes a path as S3 signs it: every byte but the
+// unreserved characters of RFC 3986 and the slashes
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := range len(path) {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,33 @@
+package fetch
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// ErrOffline is returned when a model would have to be downloaded while
+// downloads are disabled
+var ErrOffline = errors.New("offline mode forbids downloads")
+
+// offline disables every network access of the package
+var offline atomic.Bool
+
+func init() {
+	if os.Getenv("ALPACA_OFFLINE") != "" {
+		offline.Store(true)
+	}
+}
+
+// SetOffline disables downloads, for air-gapped deployments that must
+// never reach the network: Pull and Sync then only return models already
+// in the cache and fail with ErrOffline for the others. Setting
+// ALPACA_OFFLINE in the environment disables them from the start.
+func SetOffline(on bool) {
+	offline.Store(on)
+}
+
+// Offline reports whether downloads are disabled
+func Offline() bool {
+	return offline.Load()
+}
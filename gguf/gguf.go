@@ -0,0 +1,320 @@
+// Package gguf reads and rewrites the headers of GGUF model files in pure
+// Go, without llama.cpp. Metadata such as a broken chat template or a wrong
+// rope base can be fixed with Edit, which writes a new file and copies the
+// tensor data unchanged.
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// magic starts every GGUF file, "GGUF" in little-endian order
+const magic = 0x46554747
+
+// DefaultAlignment is the alignment of tensor data when the file doesn't set
+// general.alignment
+const DefaultAlignment = 32
+
+// Type is the type of a metadata value
+type Type uint32
+
+const (
+	TypeUint8 Type = iota
+	TypeInt8
+	TypeUint16
+	TypeInt16
+	TypeUint32
+	TypeInt32
+	TypeFloat32
+	TypeBool
+	TypeString
+	TypeArray
+	TypeUint64
+	TypeInt64
+	TypeFloat64
+)
+
+// KV is a metadata entry. Values are uint8, int8, uint16, int16, uint32,
+// int32, float32, bool, string, uint64, int64 or float64, or a slice of one
+// of them for arrays. Arrays of arrays are []any.
+type KV struct {
+	Key   string
+	Value any
+}
+
+// TensorInfo describes a tensor. Offset is relative to the start of the
+// tensor data.
+type TensorInfo struct {
+	Name   string
+	Dims   []uint64
+	Type   uint32 // ggml_type
+	Offset uint64
+}
+
+// File is the header of a GGUF file
+type File struct {
+	Version  uint32
+	Metadata []KV // in file order
+	Tensors  []TensorInfo
+
+	// DataOffset is where the tensor data starts in the file that was read
+	DataOffset int64
+}
+
+// Open reads the header of the GGUF file at path
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read parses a GGUF header: the metadata and the tensor descriptions, but
+// not the tensor data
+func Read(r io.Reader) (*File, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	if d.u32() != magic {
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, errors.New("not a GGUF file")
+	}
+	f := &File{Version: d.u32()}
+	if d.err == nil && (f.Version < 2 || f.Version > 3) {
+		return nil, fmt.Errorf("unsupported GGUF version %d", f.Version)
+	}
+
+	nTensors, nKV := d.u64(), d.u64()
+	for i := uint64(0); i < nKV && d.err == nil; i++ {
+		key := d.string()
+		f.Metadata = append(f.Metadata, KV{Key: key, Value: d.value(Type(d.u32()))})
+	}
+	for i := uint64(0); i < nTensors && d.err == nil; i++ {
+		t := TensorInfo{Name: d.string()}
+		nDims := d.u32()
+		if d.err != nil {
+			break
+		}
+		if nDims > 8 {
+			return nil, fmt.Errorf("tensor %q has %d dimensions", t.Name, nDims)
+		}
+		for range nDims {
+			t.Dims = append(t.Dims, d.u64())
+		}
+		t.Type, t.Offset = d.u32(), d.u64()
+		f.Tensors = append(f.Tensors, t)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("reading GGUF header: %w", d.err)
+	}
+
+	align, err := f.Alignment()
+	if err != nil {
+		return nil, err
+	}
+	f.DataOffset = pad(d.n, align)
+	return f, nil
+}
+
+// Get returns the value of a metadata key
+func (f *File) Get(key string) (any, bool) {
+	for _, kv := range f.Metadata {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// String returns the value of a string metadata key
+func (f *File) String(key string) (string, bool) {
+	v, ok := f.Get(key)
+	s, isString := v.(string)
+	return s, ok && isString
+}
+
+// Set sets a metadata key, adding it after the others if it is new. The
+// value must be of one of the types listed for KV.
+func (f *File) Set(key string, value any) error {
+	if _, err := typeOf(value); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	for i, kv := range f.Metadata {
+		if kv.Key == key {
+			f.Metadata[i].Value = value
+			return nil
+		}
+	}
+	f.Metadata = append(f.Metadata, KV{Key: key, Value: value})
+	return nil
+}
+
+// Delete removes a metadata key
+func (f *File) Delete(key string) {
+	for i, kv := range f.Metadata {
+		if kv.Key == key {
+			f.Metadata = append(f.Metadata[:i], f.Metadata[i+1:]...)
+			return
+		}
+	}
+}
+
+// Alignment returns the alignment of the tensor data
+func (f *File) Alignment() (int64, error) {
+	v, ok := f.Get("general.alignment")
+	if !ok {
+		return DefaultAlignment, nil
+	}
+	align, isUint32 := v.(uint32)
+	if !isUint32 || align == 0 || align&(align-1) != 0 {
+		return 0, fmt.Errorf("invalid general.alignment %v", v)
+	}
+	return int64(align), nil
+}
+
+// pad rounds n up to a multiple of align
+func pad(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+// decoder reads little-endian values, remembering the first error and the
+// number of bytes read
+type decoder struct {
+	r   *bufio.Reader
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return d.buf[:n]
+	}
+	_, d.err = io.ReadFull(d.r, d.buf[:n])
+	d.n += int64(n)
+	return d.buf[:n]
+}
+
+func (d *decoder) u8() uint8   { return d.read(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.read(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.read(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.read(8)) }
+
+// maxString bounds string lengths so that a corrupt file can't make the
+// decoder allocate without limit
+const maxString = 1 << 30
+
+func (d *decoder) string() string {
+	n := d.u64()
+	if d.err != nil {
+		return ""
+	}
+	if n > maxString {
+		d.err = fmt.Errorf("string of %d bytes", n)
+		return ""
+	}
+	// The string grows as it is read, so a length past the end of the
+	// file fails when the data runs out instead of allocating it up front
+	var b strings.Builder
+	read, err := io.CopyN(&b, d.r, int64(n))
+	d.n += read
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = err
+	return b.String()
+}
+
+func (d *decoder) value(t Type) any {
+	switch t {
+	case TypeUint8:
+		return d.u8()
+	case TypeInt8:
+		return int8(d.u8())
+	case TypeUint16:
+		return d.u16()
+	case TypeInt16:
+		return int16(d.u16())
+	case TypeUint32:
+		return d.u32()
+	case TypeInt32:
+		return int32(d.u32())
+	case TypeFloat32:
+		return math.Float32frombits(d.u32())
+	case TypeBool:
+		return d.u8() != 0
+	case TypeString:
+		return d.string()
+	case TypeUint64:
+		return d.u64()
+	case TypeInt64:
+		return int64(d.u64())
+	case TypeFloat64:
+		return math.Float64frombits(d.u64())
+	case TypeArray:
+		return d.array()
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("unknown value type %d", t)
+	}
+	return nil
+}
+
+func (d *decoder) array() any {
+	t, n := Type(d.u32()), d.u64()
+	if d.err != nil {
+		return nil
+	}
+	if n > maxString {
+		d.err = fmt.Errorf("array of %d elements", n)
+		return nil
+	}
+	switch t {
+	case TypeUint8:
+		return readArray(d, n, d.u8)
+	case TypeInt8:
+		return readArray(d, n, func() int8 { return int8(d.u8()) })
+	case TypeUint16:
+		return readArray(d, n, d.u16)
+	case TypeInt16:
+		return readArray(d, n, func() int16 { return int16(d.u16()) })
+	case TypeUint32:
+		return readArray(d, n, d.u32)
+	case TypeInt32:
+		return readArray(d, n, func() int32 { return int32(d.u32()) })
+	case TypeFloat32:
+		return readArray(d, n, func() float32 { return math.Float32frombits(d.u32()) })
+	case TypeBool:
+		return readArray(d, n, func() bool { return d.u8() != 0 })
+	case TypeString:
+		return readArray(d, n, d.string)
+	case TypeUint64:
+		return readArray(d, n, d.u64)
+	case TypeInt64:
+		return readArray(d, n, func() int64 { return int64(d.u64()) })
+	case TypeFloat64:
+		return readArray(d, n, func() float64 { return math.Float64frombits(d.u64()) })
+	case TypeArray:
+		return readArray(d, n, d.array)
+	}
+	d.err = fmt.Errorf("unknown array element type %d", t)
+	return nil
+}
+
+func readArray[T any](d *decoder, n uint64, next func() T) []T {
+	values := make([]T, 0, min(n, 1<<16))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		values = append(values, next())
+	}
+	return values
+}
@@ -0,0 +1,303 @@
+package gguf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// builder writes GGUF bytes by hand, independently of the encoder, so that
+// the tests check the reader against the format rather than the writer
+type builder struct {
+	bytes.Buffer
+}
+
+// put writes values in little-endian order, strings with their length
+func (b *builder) put(values ...any) *builder {
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			binary.Write(b, binary.LittleEndian, uint64(len(s)))
+			b.WriteString(s)
+			continue
+		}
+		if err := binary.Write(b, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return b
+}
+
+// start writes the magic, the version and the counts of a header
+func start(version uint32, tensors, kvs uint64) *builder {
+	b := &builder{}
+	return b.put(uint32(magic), version, tensors, kvs)
+}
+
+var tensorData = make([]byte, 96)
+
+// testFile returns a version 3 file holding a value of every type, arrays of
+// every element type and two tensors, the header Read should return and the
+// length of that header before its padding
+func testFile() ([]byte, *File, int) {
+	b := start(3, 2, 18)
+	b.put("general.architecture", uint32(TypeString), "llama")
+	b.put("u8", uint32(TypeUint8), uint8(200))
+	b.put("i8", uint32(TypeInt8), int8(-100))
+	b.put("u16", uint32(TypeUint16), uint16(60000))
+	b.put("i16", uint32(TypeInt16), int16(-30000))
+	b.put("u32", uint32(TypeUint32), uint32(4_000_000_000))
+	b.put("i32", uint32(TypeInt32), int32(-2_000_000_000))
+	b.put("f32", uint32(TypeFloat32), float32(0.5))
+	b.put("bool", uint32(TypeBool), true)
+	b.put("u64", uint32(TypeUint64), uint64(math.MaxUint64))
+	b.put("i64", uint32(TypeInt64), int64(math.MinInt64))
+	b.put("f64", uint32(TypeFloat64), math.Pi)
+	b.put("empty", uint32(TypeString), "")
+	b.put("tokens", uint32(TypeArray), uint32(TypeString), uint64(3), "<s>", "</s>", "日本")
+	b.put("scores", uint32(TypeArray), uint32(TypeFloat32), uint64(2), float32(-1), float32(2.5))
+	b.put("flags", uint32(TypeArray), uint32(TypeBool), uint64(2), false, true)
+	b.put("nested", uint32(TypeArray), uint32(TypeArray), uint64(2),
+		uint32(TypeInt8), uint64(2), int8(-1), int8(1),
+		uint32(TypeUint64), uint64(0))
+	b.put("general.alignment", uint32(TypeUint32), uint32(64))
+
+	b.put("token_embd.weight", uint32(2), uint64(8), uint64(2), uint32(0), uint64(0))
+	b.put("output_norm.weight", uint32(1), uint64(8), uint32(1), uint64(64))
+	header := b.Len()
+	b.Write(make([]byte, pad(int64(header), 64)-int64(header)))
+	b.Write(tensorData)
+
+	want := &File{
+		Version: 3,
+		Metadata: []KV{
+			{"general.architecture", "llama"},
+			{"u8", uint8(200)},
+			{"i8", int8(-100)},
+			{"u16", uint16(60000)},
+			{"i16", int16(-30000)},
+			{"u32", uint32(4_000_000_000)},
+			{"i32", int32(-2_000_000_000)},
+			{"f32", float32(0.5)},
+			{"bool", true},
+			{"u64", uint64(math.MaxUint64)},
+			{"i64", int64(math.MinInt64)},
+			{"f64", math.Pi},
+			{"empty", ""},
+			{"tokens", []string{"<s>", "</s>", "日本"}},
+			{"scores", []float32{-1, 2.5}},
+			{"flags", []bool{false, true}},
+			{"nested", []any{[]int8{-1, 1}, []uint64{}}},
+			{"general.alignment", uint32(64)},
+		},
+		Tensors: []TensorInfo{
+			{Name: "token_embd.weight", Dims: []uint64{8, 2}, Type: 0, Offset: 0},
+			{Name: "output_norm.weight", Dims: []uint64{8}, Type: 1, Offset: 64},
+		},
+		DataOffset: pad(int64(header), 64),
+	}
+	return b.Bytes(), want, header
+}
+
+func TestRead(t *testing.T) {
+	data, want, _ := testFile()
+	got, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%#v\nwant\n%#v", got, want)
+	}
+
+	if s, ok := got.String("general.architecture"); !ok || s != "llama" {
+		t.Errorf("String(general.architecture) = %q, %v", s, ok)
+	}
+	if _, ok := got.String("u8"); ok {
+		t.Error("String returned a uint8 value")
+	}
+	if _, ok := got.Get("missing"); ok {
+		t.Error("Get found a missing key")
+	}
+}
+
+func TestReadVersion2(t *testing.T) {
+	data := start(2, 0, 1).put("general.architecture", uint32(TypeString), "gpt2").Bytes()
+	f, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != 2 || f.DataOffset != pad(int64(len(data)), DefaultAlignment) {
+		t.Errorf("version %d, data at %d", f.Version, f.DataOffset)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	// The padding before the tensor data isn't read, so only cutting the
+	// header short is an error
+	data, _, header := testFile()
+	for n := range header {
+		_, err := Read(bytes.NewReader(data[:n]))
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("reading %d of %d bytes: %v, want EOF", n, len(data), err)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not GGUF", []byte("GGML\x03\x00\x00\x00"), "not a GGUF file"},
+		{"version 1", start(1, 0, 0).Bytes(), "unsupported GGUF version 1"},
+		{"version 4", start(4, 0, 0).Bytes(), "unsupported GGUF version 4"},
+		{"unknown type", start(3, 0, 1).put("k", uint32(13), uint8(0)).Bytes(), "unknown value type 13"},
+		{"unknown element type", start(3, 0, 1).put("k", uint32(TypeArray), uint32(99), uint64(1)).Bytes(), "unknown array element type 99"},
+		{"too many dimensions", start(3, 1, 0).put("t", uint32(9)).Bytes(), `tensor "t" has 9 dimensions`},
+		{"alignment not a power of two", start(3, 0, 1).put("general.alignment", uint32(TypeUint32), uint32(48)).Bytes(), "invalid general.alignment 48"},
+		{"alignment zero", start(3, 0, 1).put("general.alignment", uint32(TypeUint32), uint32(0)).Bytes(), "invalid general.alignment 0"},
+		{"alignment of the wrong type", start(3, 0, 1).put("general.alignment", uint32(TypeUint64), uint64(32)).Bytes(), "invalid general.alignment 32"},
+	}
+	for _, tt := range tests {
+		_, err := Read(bytes.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestReadHuge checks that counts and lengths a corrupt file makes up fail
+// without the reader allocating for them
+func TestReadHuge(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"string length", start(3, 0, 1).put(uint64(math.MaxUint64)).Bytes()},
+		{"string length in bounds", start(3, 0, 1).put(uint64(maxString)).Bytes()},
+		{"string value length", start(3, 0, 1).put("k", uint32(TypeString), uint64(maxString)).Bytes()},
+		{"array length", start(3, 0, 1).put("k", uint32(TypeArray), uint32(TypeUint64), uint64(math.MaxUint64)).Bytes()},
+		{"array length in bounds", start(3, 0, 1).put("k", uint32(TypeArray), uint32(TypeUint64), uint64(maxString)).Bytes()},
+		{"array of strings", start(3, 0, 1).put("k", uint32(TypeArray), uint32(TypeString), uint64(maxString), uint64(maxString)).Bytes()},
+		{"nested array length", start(3, 0, 1).put("k", uint32(TypeArray), uint32(TypeArray), uint64(2), uint32(TypeInt64), uint64(maxString)).Bytes()},
+		{"metadata count", start(3, 0, math.MaxUint64).Bytes()},
+		{"tensor count", start(3, math.MaxUint64, 0).Bytes()},
+		{"tensor name", start(3, 1, 0).put(uint64(maxString)).Bytes()},
+	}
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Read(bytes.NewReader(tt.data))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 8<<20 {
+			t.Errorf("%s: allocated %d bytes reading %d", tt.name, n, len(tt.data))
+		}
+	}
+}
+
+// TestWrite checks that writing a header that was read reproduces the file
+func TestWrite(t *testing.T) {
+	data, _, _ := testFile()
+	f, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := f.Write(&out, bytes.NewReader(data[f.DataOffset:])); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("wrote %d bytes differing from the %d read", out.Len(), len(data))
+	}
+}
+
+func TestSet(t *testing.T) {
+	_, f, _ := testFile()
+	if err := f.Set("u8", uint8(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("tokenizer.chat_template", "{{ messages }}"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.Get("u8"); v != uint8(1) {
+		t.Errorf("u8 is %v after setting it", v)
+	}
+	if last := f.Metadata[len(f.Metadata)-1]; last.Key != "tokenizer.chat_template" {
+		t.Errorf("a new key was added as %q, not last", last.Key)
+	}
+	f.Delete("u8")
+	f.Delete("missing")
+	if _, ok := f.Get("u8"); ok {
+		t.Error("u8 is still set after deleting it")
+	}
+
+	for _, v := range []any{1, []int{1}, map[string]string{}, []any{"not an array"}, nil} {
+		if err := f.Set("bad", v); err == nil {
+			t.Errorf("Set accepted %T", v)
+		}
+	}
+	if err := f.Set("nested", []any{[]string{"a"}, []uint8{1}}); err != nil {
+		t.Errorf("Set rejected an array of arrays: %v", err)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	data, _, _ := testFile()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "model.gguf")
+	dst := filepath.Join(dir, "fixed.gguf")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A long value moves the tensor data, which is copied unchanged
+	template := strings.Repeat("{{ message.content }}", 20)
+	err := Edit(src, dst, func(f *File) error {
+		f.Delete("u8")
+		return f.Set("tokenizer.chat_template", template)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := f.String("tokenizer.chat_template"); s != template {
+		t.Errorf("the edited file has the chat template %q", s)
+	}
+	if _, ok := f.Get("u8"); ok {
+		t.Error("the deleted key is still in the edited file")
+	}
+	edited, _ := os.ReadFile(dst)
+	if !bytes.Equal(edited[f.DataOffset:], tensorData) {
+		t.Error("the tensor data changed")
+	}
+	if err := Verify(dst); err != nil {
+		t.Errorf("the edited file doesn't verify: %v", err)
+	}
+
+	for name, edit := range map[string]func(*File) error{
+		"tensors":   func(f *File) error { f.Tensors[0].Offset = 128; return nil },
+		"alignment": func(f *File) error { return f.Set("general.alignment", uint32(32)) },
+		"error":     func(f *File) error { return errors.New("refused") },
+	} {
+		if err := Edit(src, filepath.Join(dir, name+".gguf"), edit); err == nil {
+			t.Errorf("editing the %s didn't fail", name)
+		}
+	}
+	if err := Edit(src, src, func(*File) error { return nil }); err == nil {
+		t.Error("a file was edited in place")
+	}
+}
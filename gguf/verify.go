@@ -0,0 +1,232 @@
+package gguf
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrTruncated is returned by Verify when the file is shorter than its
+// header says, as after an interrupted download
+var ErrTruncated = errors.New("gguf file is truncated")
+
+// VerifyOptions configures VerifyWithOptions
+type VerifyOptions struct {
+	// SHA256 is the expected hex digest of the whole file
+	SHA256 string
+
+	// Manifest is the path of a checksum file in the format sha256sum
+	// writes, one "<digest>  <name>" line per file. The digest listed for
+	// the file's base name is checked; a file missing from the manifest is
+	// an error.
+	Manifest string
+}
+
+// Verify checks that the file at path is a well-formed GGUF file whose
+// tensors all lie within it, without loading the tensor data
+func Verify(path string) error {
+	return VerifyWithOptions(path, VerifyOptions{})
+}
+
+// VerifyWithOptions is Verify that also checks the file's digest
+func VerifyWithOptions(path string, opts VerifyOptions) error {
+	want := strings.ToLower(opts.SHA256)
+	if opts.Manifest != "" {
+		sum, err := manifestSum(opts.Manifest, filepath.Base(path))
+		if err != nil {
+			return err
+		}
+		if want != "" && want != sum {
+			return errors.New("SHA256 and manifest digests differ")
+		}
+		want = sum
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	h, err := Read(f)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.check(st.Size()); err != nil {
+		return err
+	}
+
+	if want == "" {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d := sha256.New()
+	if _, err := io.Copy(d, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(d.Sum(nil)); got != want {
+		return fmt.Errorf("SHA256 is %s, want %s", got, want)
+	}
+	return nil
+}
+
+// check validates the header against a file of the given size
+func (f *File) check(size int64) error {
+	keys := make(map[string]bool, len(f.Metadata))
+	for _, kv := range f.Metadata {
+		if keys[kv.Key] {
+			return fmt.Errorf("duplicate metadata key %q", kv.Key)
+		}
+		keys[kv.Key] = true
+	}
+	if _, ok := f.String("general.architecture"); !ok {
+		return errors.New("general.architecture is not set")
+	}
+
+	align, err := f.Alignment()
+	if err != nil {
+		return err
+	}
+	if f.DataOffset > size {
+		return ErrTruncated
+	}
+	dataSize := uint64(size - f.DataOffset)
+
+	type span struct {
+		name       string
+		start, end uint64
+	}
+	spans := make([]span, 0, len(f.Tensors))
+	names := make(map[string]bool, len(f.Tensors))
+	for _, t := range f.Tensors {
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tensor %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.Offset%uint64(align) != 0 {
+			return fmt.Errorf("tensor %q is not aligned to %d bytes", t.Name, align)
+		}
+		n, err := t.Size()
+		if err != nil {
+			return err
+		}
+		end := t.Offset + n
+		if end < t.Offset || end > dataSize {
+			return fmt.Errorf("%w: tensor %q ends at byte %d of %d", ErrTruncated, t.Name, end, dataSize)
+		}
+		spans = append(spans, span{t.Name, t.Offset, end})
+	}
+
+	slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return fmt.Errorf("tensors %q and %q overlap", spans[i-1].name, spans[i].name)
+		}
+	}
+	return nil
+}
+
+// Size returns the number of bytes the tensor's data takes up
+func (t TensorInfo) Size() (uint64, error) {
+	bt, ok := blockTypes[t.Type]
+	if !ok {
+		return 0, fmt.Errorf("tensor %q has unknown type %d", t.Name, t.Type)
+	}
+	if len(t.Dims) == 0 || t.Dims[0]%bt.size != 0 {
+		return 0, fmt.Errorf("tensor %q has %v elements, not whole blocks of %d", t.Name, t.Dims, bt.size)
+	}
+	n := t.Dims[0] / bt.size * bt.bytes
+	for _, dim := range t.Dims[1:] {
+		if dim != 0 && n > ^uint64(0)/dim {
+			return 0, fmt.Errorf("tensor %q is too large", t.Name)
+		}
+		n *= dim
+	}
+	return n, nil
+}
+
+// blockType is the layout of a ggml type: blocks of size elements stored in
+// bytes bytes
+type blockType struct {
+	size, bytes uint64
+}
+
+// blockTypes maps the ggml types that can appear in GGUF files to their
+// layout
+var blockTypes = map[uint32]blockType{
+	0:  {1, 4},     // F32
+	1:  {1, 2},     // F16
+	2:  {32, 18},   // Q4_0
+	3:  {32, 20},   // Q4_1
+	6:  {32, 22},   // Q5_0
+	7:  {32, 24},   // Q5_1
+	8:  {32, 34},   // Q8_0
+	9:  {32, 36},   // Q8_1
+	10: {256, 84},  // Q2_K
+	11: {256, 110}, // Q3_K
+	12: {256, 144}, // Q4_K
+	13: {256, 176}, // Q5_K
+	14: {256, 210}, // Q6_K
+	15: {256, 292}, // Q8_K
+	16: {256, 66},  // IQ2_XXS
+	17: {256, 74},  // IQ2_XS
+	18: {256, 98},  // IQ3_XXS
+	19: {256, 50},  // IQ1_S
+	20: {32, 18},   // IQ4_NL
+	21: {256, 110}, // IQ3_S
+	22: {256, 82},  // IQ2_S
+	23: {256, 136}, // IQ4_XS
+	24: {1, 1},     // I8
+	25: {1, 2},     // I16
+	26: {1, 4},     // I32
+	27: {1, 8},     // I64
+	28: {1, 8},     // F64
+	29: {256, 56},  // IQ1_M
+	30: {1, 2},     // BF16
+	34: {256, 54},  // TQ1_0
+	35: {256, 66},  // TQ2_0
+	39: {32, 17},   // MXFP4
+}
+
+// manifestSum returns the digest a sha256sum file lists for name
+func manifestSum(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		sum, file, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok {
+			continue
+		}
+		// sha256sum marks binary mode with a '*' before the name
+		file = strings.TrimPrefix(strings.TrimLeft(file, " "), "*")
+		if filepath.Base(file) == name {
+			return strings.ToLower(sum), nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s is not listed in %s", name, path)
+}
@@ -0,0 +1,157 @@
+package gguf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTest writes the header f and the tensor data to a file in a
+// temporary directory and returns its path
+func writeTest(t *testing.T, f *File, data []byte) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := f.Write(&b, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	data, _, header := testFile()
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(path); err != nil {
+		t.Fatalf("a valid file doesn't verify: %v", err)
+	}
+
+	// Cutting the file in the header, the padding after it or the tensor
+	// data is reported as truncation
+	for _, n := range []int{0, 3, header / 2, header + 1, len(data) - len(tensorData) + 70} {
+		if err := os.WriteFile(path, data[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(path); !errors.Is(err, ErrTruncated) {
+			t.Errorf("cut at %d of %d bytes: got %v, want ErrTruncated", n, len(data), err)
+		}
+	}
+	if err := Verify(filepath.Join(t.TempDir(), "missing.gguf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*File)
+		want string
+	}{
+		{"misaligned tensor", func(f *File) { f.Tensors[1].Offset = 32 }, `tensor "output_norm.weight" is not aligned to 64 bytes`},
+		{"overlapping tensors", func(f *File) { f.Tensors[1].Offset = 0 }, `tensors "token_embd.weight" and "output_norm.weight" overlap`},
+		{"duplicate tensor", func(f *File) { f.Tensors[1].Name = f.Tensors[0].Name }, `duplicate tensor "token_embd.weight"`},
+		{"tensor past the end", func(f *File) { f.Tensors[1].Offset = 128 }, `tensor "output_norm.weight" ends at byte 144 of 96`},
+		{"unknown tensor type", func(f *File) { f.Tensors[0].Type = 4 }, `tensor "token_embd.weight" has unknown type 4`},
+		{"duplicate key", func(f *File) { f.Metadata = append(f.Metadata, f.Metadata[1]) }, `duplicate metadata key "u8"`},
+		{"no architecture", func(f *File) { f.Delete("general.architecture") }, "general.architecture is not set"},
+		{"architecture not a string", func(f *File) { f.Set("general.architecture", uint32(1)) }, "general.architecture is not set"},
+	}
+	for _, tt := range tests {
+		data, f, _ := testFile()
+		tt.edit(f)
+		path := writeTest(t, f, data[f.DataOffset:])
+		err := Verify(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	data, _, _ := testFile()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "model.gguf")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := sha256.Sum256(data)
+	sum := hex.EncodeToString(d[:])
+	wrong := strings.Repeat("0", 64)
+
+	manifests := 0
+	manifest := func(content string) string {
+		manifests++
+		p := filepath.Join(dir, fmt.Sprintf("SHA256SUMS.%d", manifests))
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name string
+		opts VerifyOptions
+		want string // "" for no error
+	}{
+		{"digest", VerifyOptions{SHA256: sum}, ""},
+		{"upper-case digest", VerifyOptions{SHA256: strings.ToUpper(sum)}, ""},
+		{"wrong digest", VerifyOptions{SHA256: wrong}, "SHA256 is " + sum + ", want " + wrong},
+		{"manifest", VerifyOptions{Manifest: manifest(wrong + "  other.gguf\n" + sum + "  model.gguf\n")}, ""},
+		{"binary mode manifest", VerifyOptions{Manifest: manifest(sum + " *models/model.gguf\n")}, ""},
+		{"manifest and digest", VerifyOptions{SHA256: sum, Manifest: manifest(sum + "  model.gguf\n")}, ""},
+		{"wrong manifest digest", VerifyOptions{Manifest: manifest(wrong + "  model.gguf\n")}, "SHA256 is " + sum},
+		{"manifest and digest differ", VerifyOptions{SHA256: sum, Manifest: manifest(wrong + "  model.gguf\n")}, "SHA256 and manifest digests differ"},
+		{"file not in the manifest", VerifyOptions{Manifest: manifest(sum + "  other.gguf\n")}, "model.gguf is not listed in"},
+		{"missing manifest", VerifyOptions{Manifest: filepath.Join(dir, "missing")}, "no such file"},
+	}
+	for _, tt := range tests {
+		err := VerifyWithOptions(path, tt.opts)
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTensorSize(t *testing.T) {
+	tests := []struct {
+		name string
+		t    TensorInfo
+		want uint64
+		err  string
+	}{
+		{"F32", TensorInfo{Type: 0, Dims: []uint64{4096, 32000}}, 4096 * 32000 * 4, ""},
+		{"F16 vector", TensorInfo{Type: 1, Dims: []uint64{4096}}, 8192, ""},
+		{"Q4_0", TensorInfo{Type: 2, Dims: []uint64{4096, 4096}}, 4096 / 32 * 18 * 4096, ""},
+		{"Q4_K", TensorInfo{Type: 12, Dims: []uint64{4096, 11008, 1}}, 4096 / 256 * 144 * 11008, ""},
+		{"empty", TensorInfo{Type: 0, Dims: []uint64{8, 0}}, 0, ""},
+		{"partial block", TensorInfo{Name: "w", Type: 2, Dims: []uint64{48, 2}}, 0, `tensor "w" has [48 2] elements, not whole blocks of 32`},
+		{"no dimensions", TensorInfo{Name: "w", Type: 0}, 0, "not whole blocks"},
+		{"unknown type", TensorInfo{Name: "w", Type: 5, Dims: []uint64{32}}, 0, `tensor "w" has unknown type 5`},
+		{"overflow", TensorInfo{Name: "w", Type: 0, Dims: []uint64{1 << 32, 1 << 31}}, 0, `tensor "w" is too large`},
+		{"overflow in a later dimension", TensorInfo{Name: "w", Type: 1, Dims: []uint64{2, math.MaxUint32, math.MaxUint32, 2}}, 0, `tensor "w" is too large`},
+	}
+	for _, tt := range tests {
+		got, err := tt.t.Size()
+		if tt.err == "" && (err != nil || got != tt.want) {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got %d, %v, want %q", tt.name, got, err, tt.err)
+		}
+	}
+}
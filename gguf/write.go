@@ -0,0 +1,293 @@
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Edit writes a copy of the GGUF file at src to dst with the header changed
+// by edit. Tensor data is copied byte for byte, so edit may change metadata
+// but not the tensors or the alignment.
+func Edit(src, dst string, edit func(*File) error) error {
+	if same, err := sameFile(src, dst); err != nil || same {
+		if err == nil {
+			err = errors.New("the edited file must not replace its source")
+		}
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := Read(in)
+	if err != nil {
+		return err
+	}
+	align, _ := f.Alignment()
+	tensors := append([]TensorInfo(nil), f.Tensors...)
+	if err := edit(f); err != nil {
+		return err
+	}
+	if a, err := f.Alignment(); err != nil || a != align {
+		return errors.New("the alignment of tensor data can't be changed")
+	}
+	if !sameTensors(tensors, f.Tensors) {
+		return errors.New("tensors can't be changed")
+	}
+
+	if _, err := in.Seek(f.DataOffset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := f.Write(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// Write writes the header followed by the tensor data read from data, which
+// must be the data section of a file with the same tensors and alignment
+func (f *File) Write(w io.Writer, data io.Reader) error {
+	align, err := f.Alignment()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	e.u32(magic)
+	e.u32(3)
+	e.u64(uint64(len(f.Tensors)))
+	e.u64(uint64(len(f.Metadata)))
+	for _, kv := range f.Metadata {
+		t, err := typeOf(kv.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", kv.Key, err)
+		}
+		e.string(kv.Key)
+		e.u32(uint32(t))
+		e.value(kv.Value)
+	}
+	for _, t := range f.Tensors {
+		e.string(t.Name)
+		e.u32(uint32(len(t.Dims)))
+		for _, dim := range t.Dims {
+			e.u64(dim)
+		}
+		e.u32(t.Type)
+		e.u64(t.Offset)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	if _, err := bw.Write(make([]byte, pad(e.n, align)-e.n)); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(bw, data); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// typeOf returns the GGUF type of a metadata value
+func typeOf(v any) (Type, error) {
+	switch v := v.(type) {
+	case uint8:
+		return TypeUint8, nil
+	case int8:
+		return TypeInt8, nil
+	case uint16:
+		return TypeUint16, nil
+	case int16:
+		return TypeInt16, nil
+	case uint32:
+		return TypeUint32, nil
+	case int32:
+		return TypeInt32, nil
+	case float32:
+		return TypeFloat32, nil
+	case bool:
+		return TypeBool, nil
+	case string:
+		return TypeString, nil
+	case uint64:
+		return TypeUint64, nil
+	case int64:
+		return TypeInt64, nil
+	case float64:
+		return TypeFloat64, nil
+	case []uint8, []int8, []uint16, []int16, []uint32, []int32, []float32, []bool, []string, []uint64, []int64, []float64:
+		return TypeArray, nil
+	case []any:
+		for _, elem := range v {
+			if t, err := typeOf(elem); err != nil || t != TypeArray {
+				return 0, errors.New("arrays of arrays may only hold arrays")
+			}
+		}
+		return TypeArray, nil
+	}
+	return 0, fmt.Errorf("unsupported metadata value of type %T", v)
+}
+
+// encoder writes little-endian values, remembering the first error and the
+// number of bytes written
+type encoder struct {
+	w   io.Writer
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	var n int
+	n, e.err = e.w.Write(b)
+	e.n += int64(n)
+}
+
+func (e *encoder) u8(v uint8) { e.write([]byte{v}) }
+
+func (e *encoder) u16(v uint16) {
+	binary.LittleEndian.PutUint16(e.buf[:2], v)
+	e.write(e.buf[:2])
+}
+
+func (e *encoder) u32(v uint32) {
+	binary.LittleEndian.PutUint32(e.buf[:4], v)
+	e.write(e.buf[:4])
+}
+
+func (e *encoder) u64(v uint64) {
+	binary.LittleEndian.PutUint64(e.buf[:8], v)
+	e.write(e.buf[:8])
+}
+
+func (e *encoder) string(s string) {
+	e.u64(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *encoder) value(v any) {
+	switch v := v.(type) {
+	case uint8:
+		e.u8(v)
+	case int8:
+		e.u8(uint8(v))
+	case uint16:
+		e.u16(v)
+	case int16:
+		e.u16(uint16(v))
+	case uint32:
+		e.u32(v)
+	case int32:
+		e.u32(uint32(v))
+	case float32:
+		e.u32(math.Float32bits(v))
+	case bool:
+		e.bool(v)
+	case string:
+		e.string(v)
+	case uint64:
+		e.u64(v)
+	case int64:
+		e.u64(uint64(v))
+	case float64:
+		e.u64(math.Float64bits(v))
+	case []uint8:
+		writeArray(e, TypeUint8, v, e.u8)
+	case []int8:
+		writeArray(e, TypeInt8, v, func(x int8) { e.u8(uint8(x)) })
+	case []uint16:
+		writeArray(e, TypeUint16, v, e.u16)
+	case []int16:
+		writeArray(e, TypeInt16, v, func(x int16) { e.u16(uint16(x)) })
+	case []uint32:
+		writeArray(e, TypeUint32, v, e.u32)
+	case []int32:
+		writeArray(e, TypeInt32, v, func(x int32) { e.u32(uint32(x)) })
+	case []float32:
+		writeArray(e, TypeFloat32, v, func(x float32) { e.u32(math.Float32bits(x)) })
+	case []bool:
+		writeArray(e, TypeBool, v, e.bool)
+	case []string:
+		writeArray(e, TypeString, v, e.string)
+	case []uint64:
+		writeArray(e, TypeUint64, v, e.u64)
+	case []int64:
+		writeArray(e, TypeInt64, v, func(x int64) { e.u64(uint64(x)) })
+	case []float64:
+		writeArray(e, TypeFloat64, v, func(x float64) { e.u64(math.Float64bits(x)) })
+	case []any:
+		// nested arrays carry their own element type and length
+		writeArray(e, TypeArray, v, e.value)
+	}
+}
+
+func writeArray[T any](e *encoder, t Type, values []T, write func(T)) {
+	e.u32(uint32(t))
+	e.u64(uint64(len(values)))
+	for _, v := range values {
+		write(v)
+	}
+}
+
+// sameTensors reports whether two lists describe the same tensors
+func sameTensors(a, b []TensorInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type || a[i].Offset != b[i].Offset || len(a[i].Dims) != len(b[i].Dims) {
+			return false
+		}
+		for j := range a[i].Dims {
+			if a[i].Dims[j] != b[i].Dims[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameFile reports whether two paths name the same file
+func sameFile(a, b string) (bool, error) {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	sb, err := os.Stat(b)
+	if errors.Is(err, os.ErrNotExist) {
+		absA, _ := filepath.Abs(a)
+		absB, _ := filepath.Abs(b)
+		return absA == absB, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(sa, sb), nil
+}
@@ -0,0 +1,63 @@
+package grammar
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// cacheSize is how many schema conversions and compiled grammars are kept.
+// Servers see the same few schemas and tool sets over and over.
+const cacheSize = 256
+
+var (
+	schemas  = newCache[string](cacheSize)
+	compiled = newCache[*Grammar](cacheSize)
+)
+
+// cache is an LRU cache of values keyed by a hash of their source
+type cache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *cacheEntry[V], most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry[V any] struct {
+	key   [sha256.Size]byte
+	value V
+}
+
+func newCache[V any](size int) *cache[V] {
+	return &cache[V]{size: size, order: list.New(), entries: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+// get returns the value for src, calling build for it if it isn't cached.
+// Errors aren't cached.
+func (c *cache[V]) get(src []byte, build func() (V, error)) (V, error) {
+	key := sha256.Sum256(src)
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry[V]).value, nil
+	}
+	c.mu.Unlock()
+
+	v, err := build()
+	if err != nil {
+		return v, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: v})
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+		}
+	}
+	return v, nil
+}
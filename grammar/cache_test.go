@@ -0,0 +1,99 @@
+package grammar
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := newCache[string](2)
+	builds := 0
+	get := func(src string) string {
+		t.Helper()
+		v, err := c.get([]byte(src), func() (string, error) {
+			builds++
+			return "built " + src, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if v := get("a"); v != "built a" || builds != 1 {
+		t.Fatalf("got %q after %d builds", v, builds)
+	}
+	get("a")
+	get("b")
+	if builds != 2 {
+		t.Fatalf("%d builds of 2 sources", builds)
+	}
+
+	// a is used more recently than b, which is evicted first
+	get("a")
+	get("c")
+	get("a")
+	if builds != 3 {
+		t.Errorf("a was built again after being used (%d builds)", builds)
+	}
+	get("b")
+	if builds != 4 {
+		t.Errorf("b was still cached beyond the size of the cache (%d builds)", builds)
+	}
+	if c.order.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("the cache holds %d entries in its list and %d in its map", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	c := newCache[string](2)
+	fail := errors.New("bad source")
+	for range 2 {
+		if _, err := c.get([]byte("x"), func() (string, error) { return "", fail }); err != fail {
+			t.Fatalf("got %v, want the build error", err)
+		}
+	}
+	if len(c.entries) != 0 {
+		t.Error("a failed build was cached")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := newCache[int](4)
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				n := (i + j) % 8
+				v, err := c.get([]byte(strconv.Itoa(n)), func() (int, error) { return n, nil })
+				if err != nil || v != n {
+					t.Errorf("got %d, %v for %d", v, err, n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if c.order.Len() > 4 || c.order.Len() != len(c.entries) {
+		t.Errorf("the cache holds %d entries in its list and %d in its map", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	src := `root ::= "cached"`
+	a, err := Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Compile(src)
+	if a != b {
+		t.Error("the same grammar was compiled twice")
+	}
+	if _, err := Compile(`root ::= missing`); err == nil {
+		t.Error("no error for an undefined rule")
+	}
+}
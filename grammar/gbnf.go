@@ -0,0 +1,558 @@
+package grammar
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Grammar is a GBNF grammar that parsed and passed the checks llama.cpp
+// makes when it loads one. Compiling a grammar once, e.g. at startup,
+// reports its mistakes with their position up front rather than when a
+// request first uses it.
+type Grammar struct {
+	src   string
+	names []string // in the order they are defined
+	rules map[string]*rule
+}
+
+// SyntaxError is a mistake in a grammar, at a 1-based line and column
+type SyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("grammar:%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// rule is a rule of a grammar: name ::= alternatives
+type rule struct {
+	pos  int
+	alts []sequence
+}
+
+// sequence is one alternative of a rule or group
+type sequence []item
+
+// item is an element of a sequence. Only whether its repetitions allow it
+// to be left out matters to the checks.
+type item struct {
+	pos      int
+	optional bool
+
+	// One of literal (possibly empty), class, ref or group is set, or any
+	// for . and token for <...>
+	literal *string
+	class   bool
+	ref     string
+	group   []sequence
+	any     bool
+	token   bool
+}
+
+// Compile parses a GBNF grammar and checks that it has a root rule, that
+// every rule it refers to is defined and that none is left-recursive. The
+// most recently compiled grammars are cached.
+func Compile(src string) (*Grammar, error) {
+	return compiled.get([]byte(src), func() (*Grammar, error) {
+		return compile(src)
+	})
+}
+
+func compile(src string) (*Grammar, error) {
+	p := &parser{src: src}
+	g, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// MustCompile is Compile, panicking on errors. It is meant for grammars in
+// package variables.
+func MustCompile(src string) *Grammar {
+	g, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// String returns the grammar's source, as SamplingParams.Grammar takes it
+func (g *Grammar) String() string {
+	return g.src
+}
+
+// Rules returns the names of the grammar's rules in the order they are
+// defined
+func (g *Grammar) Rules() []string {
+	return slices.Clone(g.names)
+}
+
+// parser reads GBNF the way llama.cpp's grammar parser does
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(pos int, format string, args ...any) *SyntaxError {
+	line := 1 + strings.Count(p.src[:pos], "\n")
+	col := 1 + utf8.RuneCountInString(p.src[strings.LastIndexByte(p.src[:pos], '\n')+1:pos])
+	return &SyntaxError{Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// space skips blanks and comments, and newlines if newlines is set
+func (p *parser) space(newlines bool) {
+	for !p.eof() {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.src[p.pos] != '\r' && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case newlines && (c == '\r' || c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func (p *parser) name() (string, error) {
+	start := p.pos
+	for !p.eof() && isWordChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf(start, "expecting a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *parser) parse() (*Grammar, error) {
+	g := &Grammar{src: p.src, rules: make(map[string]*rule)}
+	p.space(true)
+	for !p.eof() {
+		start := p.pos
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		p.space(false)
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return nil, p.errorf(p.pos, "expecting ::= after %s", name)
+		}
+		p.pos += 3
+		p.space(true)
+		alts, err := p.alternatives(false)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "\r\n"):
+			p.pos += 2
+		case p.peek() == '\r' || p.peek() == '\n':
+			p.pos++
+		case !p.eof():
+			return nil, p.errorf(p.pos, "expecting newline or end of input, found %q", p.peekRune())
+		}
+		p.space(true)
+
+		// As in llama.cpp a rule defined again replaces the earlier one
+		if _, ok := g.rules[name]; !ok {
+			g.names = append(g.names, name)
+		}
+		g.rules[name] = &rule{pos: start, alts: alts}
+	}
+	return g, nil
+}
+
+func (p *parser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *parser) alternatives(nested bool) ([]sequence, error) {
+	var alts []sequence
+	for {
+		seq, err := p.sequence(nested)
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+		if p.peek() != '|' {
+			return alts, nil
+		}
+		p.pos++
+		p.space(true)
+	}
+}
+
+func (p *parser) sequence(nested bool) (sequence, error) {
+	var seq sequence
+	for !p.eof() {
+		start := p.pos
+		var it item
+		switch c := p.src[p.pos]; {
+		case c == '"':
+			p.pos++
+			var lit strings.Builder
+			for p.peek() != '"' {
+				if p.eof() {
+					return nil, p.errorf(start, "unterminated string")
+				}
+				r, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+				lit.WriteRune(r)
+			}
+			p.pos++
+			s := lit.String()
+			it = item{literal: &s}
+		case c == '[':
+			p.pos++
+			if p.peek() == '^' {
+				p.pos++
+			}
+			for p.peek() != ']' {
+				if p.eof() {
+					return nil, p.errorf(start, "unterminated character class")
+				}
+				lo, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+				if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+					p.pos++
+					rangePos := p.pos
+					hi, err := p.char()
+					if err != nil {
+						return nil, err
+					}
+					if hi < lo {
+						return nil, p.errorf(rangePos, "character range %q-%q is reversed", lo, hi)
+					}
+				}
+			}
+			p.pos++
+			it = item{class: true}
+		case isWordChar(c):
+			name, _ := p.name()
+			it = item{ref: name}
+		case c == '(':
+			p.pos++
+			p.space(true)
+			group, err := p.alternatives(true)
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ')' {
+				return nil, p.errorf(p.pos, "expecting ) to close the group opened at %s", p.position(start))
+			}
+			p.pos++
+			it = item{group: group}
+		case c == '.':
+			p.pos++
+			it = item{any: true}
+		case c == '<' || c == '!' && strings.HasPrefix(p.src[p.pos+1:], "<"):
+			if c == '!' {
+				p.pos++
+			}
+			if err := p.tokenRef(); err != nil {
+				return nil, err
+			}
+			it = item{token: true}
+		case c == '*' || c == '+' || c == '?':
+			if len(seq) == 0 {
+				return nil, p.errorf(start, "expecting an item before %c", c)
+			}
+			p.pos++
+			if c != '+' {
+				seq[len(seq)-1].optional = true
+			}
+			p.space(nested)
+			continue
+		case c == '{':
+			if len(seq) == 0 {
+				return nil, p.errorf(start, "expecting an item before {")
+			}
+			lo, err := p.bounds()
+			if err != nil {
+				return nil, err
+			}
+			if lo == 0 {
+				seq[len(seq)-1].optional = true
+			}
+			p.space(nested)
+			continue
+		default:
+			return seq, nil
+		}
+		it.pos = start
+		seq = append(seq, it)
+		p.space(nested)
+	}
+	return seq, nil
+}
+
+// position formats an offset as line:column
+func (p *parser) position(pos int) string {
+	e := p.errorf(pos, "")
+	return fmt.Sprintf("%d:%d", e.Line, e.Column)
+}
+
+// char reads a character of a string or class, decoding escapes
+func (p *parser) char() (rune, error) {
+	start := p.pos
+	if p.src[p.pos] != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r == utf8.RuneError && size == 1 {
+			return 0, p.errorf(start, "invalid UTF-8")
+		}
+		p.pos += size
+		return r, nil
+	}
+	p.pos++
+	if p.eof() {
+		return 0, p.errorf(start, "unexpected end of input in escape")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	digits := 0
+	switch c {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'n':
+		return '\n', nil
+	case '\\', '"', '[', ']':
+		return rune(c), nil
+	default:
+		return 0, p.errorf(start, "unknown escape \\%c", c)
+	}
+	if p.pos+digits > len(p.src) {
+		return 0, p.errorf(start, "expecting %d hex digits after \\%c", digits, c)
+	}
+	v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32)
+	if err != nil {
+		return 0, p.errorf(start, "expecting %d hex digits after \\%c", digits, c)
+	}
+	p.pos += digits
+	return rune(v), nil
+}
+
+// tokenRef reads a token reference, <name> or <[id]>, optionally negated
+// with a ! in front of the <
+func (p *parser) tokenRef() error {
+	start := p.pos
+	end := strings.IndexByte(p.src[p.pos:], '>')
+	if end < 0 {
+		return p.errorf(start, "unterminated token reference")
+	}
+	inner := p.src[p.pos+1 : p.pos+end]
+	if id, ok := strings.CutPrefix(inner, "["); ok {
+		id, ok = strings.CutSuffix(id, "]")
+		if _, err := strconv.ParseUint(id, 10, 32); !ok || err != nil {
+			return p.errorf(start, "invalid token id in <%s>", inner)
+		}
+	} else if inner == "" {
+		return p.errorf(start, "empty token reference")
+	}
+	p.pos += end + 1
+	return nil
+}
+
+// bounds reads a repetition {m}, {m,} or {m,n} and returns m
+func (p *parser) bounds() (int, error) {
+	start := p.pos
+	p.pos++
+	p.space(true)
+	number := func() (int, bool) {
+		begin := p.pos
+		for !p.eof() && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		n, err := strconv.Atoi(p.src[begin:p.pos])
+		return n, err == nil
+	}
+	lo, ok := number()
+	if !ok {
+		return 0, p.errorf(p.pos, "expecting the least number of repetitions")
+	}
+	p.space(true)
+	if p.peek() == ',' {
+		p.pos++
+		p.space(true)
+		if p.peek() != '}' {
+			hi, ok := number()
+			if !ok {
+				return 0, p.errorf(p.pos, "expecting the most number of repetitions")
+			}
+			if hi < lo {
+				return 0, p.errorf(start, "repetition {%d,%d} has its bounds reversed", lo, hi)
+			}
+		}
+		p.space(true)
+	}
+	if p.peek() != '}' {
+		return 0, p.errorf(p.pos, "expecting } to close the repetition")
+	}
+	p.pos++
+	return lo, nil
+}
+
+// check reports undefined rules, a missing root rule and left recursion,
+// which llama.cpp rejects as well
+func (g *Grammar) check() error {
+	p := &parser{src: g.src}
+	if _, ok := g.rules["root"]; !ok {
+		return &SyntaxError{Line: 1, Column: 1, Msg: "grammar has no root rule"}
+	}
+	for _, name := range g.names {
+		var err error
+		walk(g.rules[name].alts, func(it *item) {
+			if it.ref != "" && err == nil {
+				if _, ok := g.rules[it.ref]; !ok {
+					err = p.errorf(it.pos, "undefined rule %s", it.ref)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	nullable := g.nullable()
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return p.errorf(g.rules[name].pos, "rule %s is left-recursive", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, ref := range leftmost(g.rules[name].alts, nullable) {
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, name := range g.names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls fn for every item of alts, descending into groups
+func walk(alts []sequence, fn func(*item)) {
+	for _, seq := range alts {
+		for i := range seq {
+			fn(&seq[i])
+			walk(seq[i].group, fn)
+		}
+	}
+}
+
+// nullable returns the rules that can match the empty string
+func (g *Grammar) nullable() map[string]bool {
+	nullable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, name := range g.names {
+			if !nullable[name] && alternativesNullable(g.rules[name].alts, nullable) {
+				nullable[name], changed = true, true
+			}
+		}
+	}
+	return nullable
+}
+
+func alternativesNullable(alts []sequence, nullable map[string]bool) bool {
+	for _, seq := range alts {
+		if sequenceNullable(seq, nullable) {
+			return true
+		}
+	}
+	return false
+}
+
+func sequenceNullable(seq sequence, nullable map[string]bool) bool {
+	for _, it := range seq {
+		if !itemNullable(it, nullable) {
+			return false
+		}
+	}
+	return true
+}
+
+func itemNullable(it item, nullable map[string]bool) bool {
+	switch {
+	case it.optional:
+		return true
+	case it.literal != nil:
+		return *it.literal == ""
+	case it.ref != "":
+		return nullable[it.ref]
+	case it.group != nil:
+		return alternativesNullable(it.group, nullable)
+	}
+	return false
+}
+
+// leftmost returns the rules alts may start with: those referred to before
+// anything that can't match the empty string
+func leftmost(alts []sequence, nullable map[string]bool) []string {
+	var refs []string
+	for _, seq := range alts {
+		for _, it := range seq {
+			if it.ref != "" {
+				refs = append(refs, it.ref)
+			}
+			refs = append(refs, leftmost(it.group, nullable)...)
+			if !itemNullable(it, nullable) {
+				break
+			}
+		}
+	}
+	return refs
+}
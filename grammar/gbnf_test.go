@@ -0,0 +1,90 @@
+package grammar
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name, src string
+		rules     []string
+	}{
+		{"one rule", `root ::= "yes" | "no"`, []string{"root"}},
+		{"rules in definition order", "root ::= greeting \" \" name\nname ::= [A-Z] [a-z]*\ngreeting ::= \"hi\" | \"hello\"\n", []string{"root", "name", "greeting"}},
+		{"comments and blank lines", "# a greeting\n\nroot ::= \"hi\" # trailing comment\n\n", []string{"root"}},
+		{"alternatives and groups across lines", "root ::= (\n  \"a\" |\n  \"b\"\n)+\n", []string{"root"}},
+		{"CRLF line endings", "root ::= item\r\nitem ::= \"x\"\r\n", []string{"root", "item"}},
+		{"repetitions", `root ::= "a"{2} "b"{1,} "c"{0,3} "d"? "e"* "f"+`, []string{"root"}},
+		{"escapes", `root ::= "\x41é\U0001F600\n\t\\\"" [^\]\[]`, []string{"root"}},
+		{"any character and tokens", `root ::= . <think> !<[123]> <|im_end|>`, []string{"root"}},
+		{"right recursion", "root ::= \"(\" root \")\" | \"\"\n", []string{"root"}},
+		{"redefined rule", "root ::= \"a\"\nroot ::= \"b\"\n", []string{"root"}},
+	}
+	for _, tt := range tests {
+		g, err := compile(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := g.Rules(); !slices.Equal(got, tt.rules) {
+			t.Errorf("%s: rules %v, want %v", tt.name, got, tt.rules)
+		}
+		if g.String() != tt.src {
+			t.Errorf("%s: String() = %q", tt.name, g.String())
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src       string
+		line, col int
+		msg       string
+	}{
+		{``, 1, 1, "grammar has no root rule"},
+		{`item ::= "x"`, 1, 1, "grammar has no root rule"},
+		{`root = "x"`, 1, 6, "expecting ::= after root"},
+		{`::= "x"`, 1, 1, "expecting a name"},
+		{"root ::= \"x\"\n  \"y\"", 2, 3, "expecting a name"},
+		{`root ::= "x`, 1, 10, "unterminated string"},
+		{`root ::= [a-z`, 1, 10, "unterminated character class"},
+		{`root ::= [z-a]`, 1, 13, `character range 'z'-'a' is reversed`},
+		{"root ::= (\"a\"\n  | \"b\"", 2, 8, "expecting ) to close the group opened at 1:10"},
+		{`root ::= * "a"`, 1, 10, "expecting an item before *"},
+		{`root ::= {2}`, 1, 10, "expecting an item before {"},
+		{`root ::= "a"{3,1}`, 1, 13, "repetition {3,1} has its bounds reversed"},
+		{`root ::= "a"{,2}`, 1, 14, "expecting the least number of repetitions"},
+		{`root ::= "a"{2`, 1, 15, "expecting } to close the repetition"},
+		{`root ::= "\q"`, 1, 11, `unknown escape \q`},
+		{`root ::= "\x4"`, 1, 11, `expecting 2 hex digits after \x`},
+		{`root ::= <think`, 1, 10, "unterminated token reference"},
+		{`root ::= <>`, 1, 10, "empty token reference"},
+		{`root ::= "a" )`, 1, 14, `expecting newline or end of input, found ')'`},
+		{"root ::= item\nitem ::= \"a\" itme", 2, 14, "undefined rule itme"},
+		{"root ::= expr\nexpr ::= expr \"+\" term | term\nterm ::= [0-9]", 2, 1, "rule expr is left-recursive"},
+		{"root ::= a\na ::= b? a \"x\"\nb ::= \"y\"", 2, 1, "rule a is left-recursive"},
+		{"root ::= \"\xff\"", 1, 11, "invalid UTF-8"},
+	}
+	for _, tt := range tests {
+		_, err := compile(tt.src)
+		var serr *SyntaxError
+		if !errors.As(err, &serr) {
+			t.Errorf("compile(%q) = %v, want a SyntaxError", tt.src, err)
+			continue
+		}
+		if serr.Line != tt.line || serr.Column != tt.col || serr.Msg != tt.msg {
+			t.Errorf("compile(%q) = %v, want %d:%d: %s", tt.src, err, tt.line, tt.col, tt.msg)
+		}
+	}
+}
+
+func TestMustCompile(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("MustCompile didn't panic on an invalid grammar")
+		}
+	}()
+	MustCompile(`root ::= missing`)
+}
@@ -0,0 +1,47 @@
+package grammar
+
+import "strings"
+
+// primitives are the rules for JSON values shared by JSON and the grammars
+// produced by FromJSONSchema. Values are followed by optional whitespace, at
+// most one newline and 20 indentation characters so that the model can't
+// pad the output forever.
+var primitives = map[string]string{
+	"space":         `| " " | "\n" [ \t]{0,20}`,
+	"boolean":       `("true" | "false") space`,
+	"null":          `"null" space`,
+	"char":          `[^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})`,
+	"string":        `"\"" char* "\"" space`,
+	"integral-part": `[0] | [1-9] [0-9]{0,15}`,
+	"decimal-part":  `[0-9]{1,16}`,
+	"integer":       `("-"? integral-part) space`,
+	"number":        `("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space`,
+	"value":         `object | array | string | number | boolean | null`,
+	"object":        `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":         `"[" space ( value ("," space value)* )? "]" space`,
+}
+
+// primitiveDeps lists the rules each primitive refers to
+var primitiveDeps = map[string][]string{
+	"boolean": {"space"},
+	"null":    {"space"},
+	"string":  {"char", "space"},
+	"integer": {"integral-part", "space"},
+	"number":  {"integral-part", "decimal-part", "space"},
+	"value":   {"object", "array", "string", "number", "boolean", "null"},
+	"object":  {"string", "value", "space"},
+	"array":   {"value", "space"},
+}
+
+// JSON is a grammar matching any JSON object, the equivalent of the
+// json_object response format of the OpenAI API
+var JSON = jsonGrammar()
+
+func jsonGrammar() string {
+	var b strings.Builder
+	b.WriteString("root ::= object\n")
+	for _, name := range []string{"object", "value", "array", "string", "char", "number", "integral-part", "decimal-part", "boolean", "null", "space"} {
+		b.WriteString(name + " ::= " + primitives[name] + "\n")
+	}
+	return b.String()
+}
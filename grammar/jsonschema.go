@@ -0,0 +1,550 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+)
+
+// formats are the string formats FromJSONSchema understands, besides
+// date-time which combines date and time
+var formats = map[string]string{
+	"date": `[0-9]{4} "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`,
+	"time": `( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]{3} )? ( "Z" | [+-] ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`,
+	"uuid": `[0-9a-fA-F]{8} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{12}`,
+}
+
+// FromJSONSchema converts a JSON schema into a GBNF grammar matching the
+// JSON documents it describes. It supports the subset used for structured
+// outputs: type (including lists of types), properties and required, items,
+// prefixItems, minItems and maxItems, enum, const, anyOf and oneOf, $ref to
+// definitions in the same schema, minLength, maxLength, pattern and the
+// date, time, date-time and uuid formats. Properties appear in the order
+// they are declared. Objects with properties accept no other keys, numeric
+// bounds are not enforced, and a pattern must not match a quote or
+// backslash or the output may not be valid JSON.
+// Conversions of the most recent schemas are cached.
+func FromJSONSchema(schema []byte) (string, error) {
+	return schemas.get(schema, func() (string, error) {
+		return fromJSONSchema(schema)
+	})
+}
+
+func fromJSONSchema(schema []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(schema))
+	dec.UseNumber()
+	root, err := decodeOrdered(dec)
+	if err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+
+	c := &schemaConverter{root: root, rules: map[string]string{}, refs: map[string]string{}}
+	body, err := c.expr(root, "root")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("root ::= " + body + "\n")
+	for _, name := range c.order {
+		b.WriteString(name + " ::= " + c.rules[name] + "\n")
+	}
+	return b.String(), nil
+}
+
+// object is a JSON object that remembers the order of its keys
+type object struct {
+	keys   []string
+	values map[string]any
+}
+
+func (o *object) get(key string) (any, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// decodeOrdered decodes the next JSON value, with objects as *object
+func decodeOrdered(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		o := &object{values: map[string]any{}}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			k := key.(string)
+			if _, dup := o.values[k]; !dup {
+				o.keys = append(o.keys, k)
+			}
+			o.values[k] = v
+		}
+		_, err := dec.Token()
+		return o, err
+	case json.Delim('['):
+		var list []any
+		for dec.More() {
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// schemaConverter collects the rules of a grammar in the order they are
+// added
+type schemaConverter struct {
+	root  any
+	rules map[string]string
+	order []string
+	refs  map[string]string // $ref to the rule that matches it
+}
+
+// add adds a rule named after name, with a numeric suffix if a different
+// rule already has the name, and returns the name used
+func (c *schemaConverter) add(name, body string) string {
+	name = ruleName(name)
+	unique := name
+	for i := 1; ; i++ {
+		existing, ok := c.rules[unique]
+		if !ok {
+			break
+		}
+		if existing == body {
+			return unique
+		}
+		unique = name + strconv.Itoa(i)
+	}
+	c.rules[unique] = body
+	c.order = append(c.order, unique)
+	return unique
+}
+
+// primitive adds a primitive rule and the rules it depends on
+func (c *schemaConverter) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		c.rules[name] = primitives[name]
+		c.order = append(c.order, name)
+		for _, dep := range primitiveDeps[name] {
+			c.primitive(dep)
+		}
+	}
+	return name
+}
+
+// rule adds a rule for the schema s and returns its name
+func (c *schemaConverter) rule(s any, name string) (string, error) {
+	body, err := c.expr(s, name)
+	if err != nil {
+		return "", err
+	}
+	// A rule that only refers to another can be replaced by it
+	if _, ok := c.rules[body]; ok {
+		return body, nil
+	}
+	return c.add(name, body), nil
+}
+
+// expr returns the body of a rule matching the schema s
+func (c *schemaConverter) expr(s any, name string) (string, error) {
+	switch s := s.(type) {
+	case bool:
+		if !s {
+			return "", errors.New("schema false matches nothing")
+		}
+		return c.primitive("value"), nil
+	case *object:
+		return c.objectSchema(s, name)
+	}
+	return "", fmt.Errorf("schema %s must be an object", name)
+}
+
+func (c *schemaConverter) objectSchema(s *object, name string) (string, error) {
+	if ref, ok := s.get("$ref"); ok {
+		return c.ref(ref, name)
+	}
+	if v, ok := s.get("const"); ok {
+		return c.literal(v) + " " + c.primitive("space"), nil
+	}
+	if v, ok := s.get("enum"); ok {
+		values, ok := v.([]any)
+		if !ok || len(values) == 0 {
+			return "", fmt.Errorf("enum of %s must be a non-empty list", name)
+		}
+		alts := make([]string, len(values))
+		for i, v := range values {
+			alts[i] = c.literal(v)
+		}
+		return "(" + strings.Join(alts, " | ") + ") " + c.primitive("space"), nil
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if v, ok := s.get(key); ok {
+			subs, ok := v.([]any)
+			if !ok || len(subs) == 0 {
+				return "", fmt.Errorf("%s of %s must be a non-empty list", key, name)
+			}
+			return c.alternatives(subs, name)
+		}
+	}
+	if _, ok := s.get("allOf"); ok {
+		return "", fmt.Errorf("allOf is not supported (in %s)", name)
+	}
+
+	typ, _ := s.get("type")
+	if types, ok := typ.([]any); ok {
+		alts := make([]string, len(types))
+		for i, t := range types {
+			typed := &object{keys: s.keys, values: map[string]any{}}
+			for k, v := range s.values {
+				typed.values[k] = v
+			}
+			typed.values["type"] = t
+			r, err := c.rule(typed, fmt.Sprintf("%s-%v", name, t))
+			if err != nil {
+				return "", err
+			}
+			alts[i] = r
+		}
+		return strings.Join(alts, " | "), nil
+	}
+	if typ == nil {
+		switch {
+		case has(s, "properties"):
+			typ = "object"
+		case has(s, "items"), has(s, "prefixItems"):
+			typ = "array"
+		default:
+			return c.primitive("value"), nil
+		}
+	}
+
+	switch typ {
+	case "object":
+		return c.objectType(s, name)
+	case "array":
+		return c.arrayType(s, name)
+	case "string":
+		return c.stringType(s, name)
+	case "integer", "number", "boolean", "null":
+		return c.primitive(typ.(string)), nil
+	}
+	return "", fmt.Errorf("unsupported type %v (in %s)", typ, name)
+}
+
+// alternatives matches any of the schemas subs
+func (c *schemaConverter) alternatives(subs []any, name string) (string, error) {
+	alts := make([]string, len(subs))
+	for i, sub := range subs {
+		r, err := c.rule(sub, name+"-"+strconv.Itoa(i))
+		if err != nil {
+			return "", err
+		}
+		alts[i] = r
+	}
+	return strings.Join(alts, " | "), nil
+}
+
+// ref resolves a reference into the schema's definitions. The rule name is
+// recorded before the definition is converted so recursive schemas work.
+func (c *schemaConverter) ref(v any, name string) (string, error) {
+	ref, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("$ref of %s must be a string", name)
+	}
+	if r, ok := c.refs[ref]; ok {
+		return r, nil
+	}
+
+	var target any = c.root
+	path, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return "", fmt.Errorf("only references within the schema are supported, not %q", ref)
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		o, ok := target.(*object)
+		if !ok {
+			return "", fmt.Errorf("unresolved reference %q", ref)
+		}
+		if target, ok = o.get(part); !ok {
+			return "", fmt.Errorf("unresolved reference %q", ref)
+		}
+	}
+
+	ruleName := ref[strings.LastIndex(ref, "/")+1:]
+	if ruleName == "" || ruleName == "#" {
+		ruleName = "root"
+	}
+	// Reserve the name with a placeholder no other rule can equal, then fill
+	// in the body
+	r := c.add("ref-"+ruleName, "<"+ref+">")
+	c.refs[ref] = r
+	body, err := c.expr(target, r)
+	if err != nil {
+		return "", err
+	}
+	c.rules[r] = body
+	return r, nil
+}
+
+func (c *schemaConverter) objectType(s *object, name string) (string, error) {
+	props, _ := s.get("properties")
+	properties, _ := props.(*object)
+	if properties == nil || len(properties.keys) == 0 {
+		// A map: any keys, with values matching additionalProperties
+		extra, ok := s.get("additionalProperties")
+		if !ok || extra == true {
+			return c.primitive("object"), nil
+		}
+		if extra == false {
+			return `"{" ` + c.primitive("space") + ` "}" space`, nil
+		}
+		value, err := c.rule(extra, name+"-value")
+		if err != nil {
+			return "", err
+		}
+		kv := c.add(name+"-kv", c.primitive("string")+` ":" space `+value)
+		return `"{" space ( ` + kv + ` ( "," space ` + kv + ` )* )? "}" space`, nil
+	}
+
+	required := map[string]bool{}
+	if v, ok := s.get("required"); ok {
+		list, _ := v.([]any)
+		for _, r := range list {
+			if k, ok := r.(string); ok {
+				required[k] = true
+			}
+		}
+	}
+
+	// Required properties come first in declaration order, followed by the
+	// optional ones
+	var req, opt []string
+	for _, key := range properties.keys {
+		propSchema, _ := properties.get(key)
+		value, err := c.rule(propSchema, name+"-"+key)
+		if err != nil {
+			return "", err
+		}
+		kv := c.add(name+"-"+key+"-kv", c.literal(key)+` space ":" space `+value)
+		if required[key] {
+			req = append(req, kv)
+		} else {
+			opt = append(opt, kv)
+		}
+	}
+	c.primitive("space")
+
+	body := `"{" space `
+	if len(req) > 0 {
+		body += strings.Join(req, ` "," space `)
+		// Each optional property may follow with a comma
+		for _, kv := range opt {
+			body += ` ( "," space ` + kv + ` )?`
+		}
+	} else {
+		// The first property present has no comma before it: rest-i matches
+		// any subset of the properties from i on, starting with one of them
+		next := ""
+		for i := len(opt) - 1; i >= 0; i-- {
+			alt := opt[i]
+			for _, kv := range opt[i+1:] {
+				alt += ` ( "," space ` + kv + ` )?`
+			}
+			if next != "" {
+				alt += " | " + next
+			}
+			next = c.add(fmt.Sprintf("%s-rest-%d", name, i), alt)
+		}
+		body += `( ` + next + ` )?`
+	}
+	return body + ` "}" space`, nil
+}
+
+func (c *schemaConverter) arrayType(s *object, name string) (string, error) {
+	if v, ok := s.get("prefixItems"); ok {
+		items, ok := v.([]any)
+		if !ok {
+			return "", fmt.Errorf("prefixItems of %s must be a list", name)
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			r, err := c.rule(item, name+"-"+strconv.Itoa(i))
+			if err != nil {
+				return "", err
+			}
+			parts[i] = r
+		}
+		body := `"[" ` + c.primitive("space")
+		if len(parts) > 0 {
+			body += " " + strings.Join(parts, ` "," space `)
+		}
+		return body + ` "]" space`, nil
+	}
+
+	lo, hi, err := bounds(s, "minItems", "maxItems")
+	if err != nil {
+		return "", err
+	}
+	c.primitive("space")
+	if hi == 0 {
+		return `"[" space "]" space`, nil
+	}
+
+	var item string
+	if v, ok := s.get("items"); ok {
+		if item, err = c.rule(v, name+"-item"); err != nil {
+			return "", err
+		}
+	} else {
+		item = c.primitive("value")
+	}
+
+	var rest string
+	switch {
+	case hi < 0:
+		rest = fmt.Sprintf(`( "," space %s ){%d,}`, item, max(lo-1, 0))
+	default:
+		rest = fmt.Sprintf(`( "," space %s ){%d,%d}`, item, max(lo-1, 0), hi-1)
+	}
+	list := item + " " + rest
+	if lo == 0 {
+		list = "( " + list + " )?"
+	}
+	return `"[" space ` + list + ` "]" space`, nil
+}
+
+func (c *schemaConverter) stringType(s *object, name string) (string, error) {
+	if v, ok := s.get("pattern"); ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("pattern of %s must be a string", name)
+		}
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if err := writeGroup(&b, re); err != nil {
+			return "", err
+		}
+		return `"\"" ` + b.String() + ` "\"" ` + c.primitive("space"), nil
+	}
+
+	if format, _ := s.values["format"].(string); format == "date-time" || formats[format] != "" {
+		body := formats[format]
+		if format == "date-time" {
+			body = c.add("date", formats["date"]) + ` "T" ` + c.add("time", formats["time"])
+		}
+		r := c.add(format, body)
+		return `"\"" ` + r + ` "\"" ` + c.primitive("space"), nil
+	}
+
+	lo, hi, err := bounds(s, "minLength", "maxLength")
+	if err != nil {
+		return "", err
+	}
+	if lo == 0 && hi < 0 {
+		return c.primitive("string"), nil
+	}
+	c.primitive("char")
+	c.primitive("space")
+	if hi < 0 {
+		return fmt.Sprintf(`"\"" char{%d,} "\"" space`, lo), nil
+	}
+	return fmt.Sprintf(`"\"" char{%d,%d} "\"" space`, lo, hi), nil
+}
+
+// literal matches the JSON encoding of v
+func (c *schemaConverter) literal(v any) string {
+	data, _ := json.Marshal(plain(v))
+	return Quote(string(data))
+}
+
+// plain converts an *object back into a map for encoding
+func plain(v any) any {
+	switch v := v.(type) {
+	case *object:
+		m := make(map[string]any, len(v.values))
+		for k, x := range v.values {
+			m[k] = plain(x)
+		}
+		return m
+	case []any:
+		out := make([]any, len(v))
+		for i, x := range v {
+			out[i] = plain(x)
+		}
+		return out
+	}
+	return v
+}
+
+// bounds reads a pair of length constraints, with -1 for no upper bound
+func bounds(s *object, minKey, maxKey string) (lo, hi int, err error) {
+	hi = -1
+	for _, b := range []struct {
+		key string
+		dst *int
+	}{{minKey, &lo}, {maxKey, &hi}} {
+		v, ok := s.get(b.key)
+		if !ok {
+			continue
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return 0, 0, fmt.Errorf("%s must be a number", b.key)
+		}
+		i, err := strconv.Atoi(n.String())
+		if err != nil || i < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", b.key)
+		}
+		*b.dst = i
+	}
+	if hi >= 0 && lo > hi {
+		return 0, 0, fmt.Errorf("%s is greater than %s", minKey, maxKey)
+	}
+	return lo, hi, nil
+}
+
+func has(s *object, key string) bool {
+	_, ok := s.get(key)
+	return ok
+}
+
+// ruleName replaces the characters GBNF doesn't allow in rule names
+func ruleName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	if b.Len() == 0 {
+		return "rule"
+	}
+	return b.String()
+}
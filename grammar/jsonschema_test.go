@@ -0,0 +1,264 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	spaceRule   = `space ::= | " " | "\n" [ \t]{0,20}`
+	charRule    = `char ::= [^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})`
+	stringRule  = `string ::= "\"" char* "\"" space`
+	integerRule = `integer ::= ("-"? integral-part) space` + "\n" + `integral-part ::= [0] | [1-9] [0-9]{0,15}`
+	nullRule    = `null ::= "null" space`
+)
+
+func TestFromJSONSchema(t *testing.T) {
+	tests := []struct {
+		name, schema string
+		want         []string // the rules, one per line
+	}{
+		{
+			"required and optional properties",
+			`{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["name"]}`,
+			[]string{
+				`root ::= "{" space root-name-kv ( "," space root-age-kv )? "}" space`,
+				stringRule, charRule, spaceRule,
+				`root-name-kv ::= "\"name\"" space ":" space string`,
+				integerRule,
+				`root-age-kv ::= "\"age\"" space ":" space integer`,
+			},
+		},
+		{
+			"required properties in declaration order",
+			`{"properties": {"b": {"type": "boolean"}, "a": {"type": "null"}}, "required": ["a", "b"]}`,
+			[]string{
+				`root ::= "{" space root-b-kv "," space root-a-kv "}" space`,
+				`boolean ::= ("true" | "false") space`, spaceRule,
+				`root-b-kv ::= "\"b\"" space ":" space boolean`,
+				nullRule,
+				`root-a-kv ::= "\"a\"" space ":" space null`,
+			},
+		},
+		{
+			"only optional properties",
+			`{"type": "object", "properties": {"b": {"type": "boolean"}, "a": {"type": "null"}}}`,
+			[]string{
+				`root ::= "{" space ( root-rest-0 )? "}" space`,
+				`boolean ::= ("true" | "false") space`, spaceRule,
+				`root-b-kv ::= "\"b\"" space ":" space boolean`,
+				nullRule,
+				`root-a-kv ::= "\"a\"" space ":" space null`,
+				`root-rest-1 ::= root-a-kv`,
+				`root-rest-0 ::= root-b-kv ( "," space root-a-kv )? | root-rest-1`,
+			},
+		},
+		{
+			"recursive $ref",
+			`{"$defs": {"node": {"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#/$defs/node"}, {"type": "null"}]}}, "required": ["next"]}}, "$ref": "#/$defs/node"}`,
+			[]string{
+				`root ::= ref-node`,
+				`ref-node ::= "{" space ref-node-next-kv "}" space`,
+				nullRule, spaceRule,
+				`ref-node-next ::= ref-node | null`,
+				`ref-node-next-kv ::= "\"next\"" space ":" space ref-node-next`,
+			},
+		},
+		{
+			"shared $ref",
+			`{"properties": {"from": {"$ref": "#/definitions/point"}, "to": {"$ref": "#/definitions/point"}}, "required": ["from", "to"], "definitions": {"point": {"type": "array", "prefixItems": [{"type": "integer"}, {"type": "integer"}]}}}`,
+			[]string{
+				`root ::= "{" space root-from-kv "," space root-to-kv "}" space`,
+				`ref-point ::= "[" space integer "," space integer "]" space`,
+				integerRule, spaceRule,
+				`root-from-kv ::= "\"from\"" space ":" space ref-point`,
+				`root-to-kv ::= "\"to\"" space ":" space ref-point`,
+			},
+		},
+		{
+			"anyOf",
+			`{"anyOf": [{"type": "integer"}, {"type": "string", "maxLength": 3}]}`,
+			[]string{
+				`root ::= integer | root-1`,
+				integerRule, spaceRule, charRule,
+				`root-1 ::= "\"" char{0,3} "\"" space`,
+			},
+		},
+		{
+			"enum",
+			`{"enum": ["red", "green", 1, null]}`,
+			[]string{
+				`root ::= ("\"red\"" | "\"green\"" | "1" | "null") space`,
+				spaceRule,
+			},
+		},
+		{
+			"const",
+			`{"const": {"a": [1, "x"]}}`,
+			[]string{
+				`root ::= "{\"a\":[1,\"x\"]}" space`,
+				spaceRule,
+			},
+		},
+		{
+			"minItems and maxItems",
+			`{"type": "array", "items": {"type": "integer"}, "minItems": 1, "maxItems": 3}`,
+			[]string{
+				`root ::= "[" space integer ( "," space integer ){0,2} "]" space`,
+				spaceRule, integerRule,
+			},
+		},
+		{
+			"minItems only",
+			`{"type": "array", "items": {"type": "string"}, "minItems": 2}`,
+			[]string{
+				`root ::= "[" space string ( "," space string ){1,} "]" space`,
+				spaceRule, stringRule, charRule,
+			},
+		},
+		{
+			"optional items",
+			`{"type": "array", "items": {"type": "null"}, "maxItems": 2}`,
+			[]string{
+				`root ::= "[" space ( null ( "," space null ){0,1} )? "]" space`,
+				spaceRule, nullRule,
+			},
+		},
+		{
+			"no items",
+			`{"type": "array", "maxItems": 0}`,
+			[]string{
+				`root ::= "[" space "]" space`,
+				spaceRule,
+			},
+		},
+		{
+			"any items",
+			`{"type": "array", "minItems": 1}`,
+			[]string{
+				`root ::= "[" space value ( "," space value ){0,} "]" space`,
+				spaceRule,
+				`value ::= object | array | string | number | boolean | null`,
+				`object ::= "{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+				stringRule, charRule,
+				`array ::= "[" space ( value ("," space value)* )? "]" space`,
+				`number ::= ("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space`,
+				`integral-part ::= [0] | [1-9] [0-9]{0,15}`,
+				`decimal-part ::= [0-9]{1,16}`,
+				`boolean ::= ("true" | "false") space`,
+				nullRule,
+			},
+		},
+		{
+			"additionalProperties schema",
+			`{"type": "object", "additionalProperties": {"type": "integer"}}`,
+			[]string{
+				`root ::= "{" space ( root-kv ( "," space root-kv )* )? "}" space`,
+				integerRule, spaceRule, stringRule, charRule,
+				`root-kv ::= string ":" space integer`,
+			},
+		},
+		{
+			"additionalProperties false",
+			`{"type": "object", "additionalProperties": false}`,
+			[]string{
+				`root ::= "{" space "}" space`,
+				spaceRule,
+			},
+		},
+		{
+			"pattern",
+			`{"type": "string", "pattern": "^[a-z]+-[0-9]{2}$"}`,
+			[]string{
+				`root ::= "\"" (([a-z])+ "-" ([0-9]){2}) "\"" space`,
+				spaceRule,
+			},
+		},
+		{
+			"minLength and maxLength",
+			`{"type": "string", "minLength": 2, "maxLength": 5}`,
+			[]string{
+				`root ::= "\"" char{2,5} "\"" space`,
+				charRule, spaceRule,
+			},
+		},
+		{
+			"list of types",
+			`{"type": ["string", "null"]}`,
+			[]string{
+				`root ::= string | null`,
+				stringRule, charRule, spaceRule, nullRule,
+			},
+		},
+		{
+			"date-time",
+			`{"type": "string", "format": "date-time"}`,
+			[]string{
+				`root ::= "\"" date-time "\"" space`,
+				`date ::= ` + formats["date"],
+				`time ::= ` + formats["time"],
+				`date-time ::= date "T" time`,
+				spaceRule,
+			},
+		},
+		{
+			"property names that aren't rule names",
+			`{"properties": {"first name": {"type": "null"}}, "required": ["first name"]}`,
+			[]string{
+				`root ::= "{" space root-first-name-kv "}" space`,
+				nullRule, spaceRule,
+				`root-first-name-kv ::= "\"first name\"" space ":" space null`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromJSONSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Join(tt.want, "\n") + "\n"; got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+			if _, err := Compile(got); err != nil {
+				t.Errorf("the grammar doesn't compile: %v", err)
+			}
+		})
+	}
+}
+
+func TestFromJSONSchemaErrors(t *testing.T) {
+	tests := []struct {
+		schema, want string
+	}{
+		{`{"type": "object"`, "invalid schema"},
+		{`false`, "matches nothing"},
+		{`[]`, "must be an object"},
+		{`{"allOf": [{"type": "string"}]}`, "allOf is not supported"},
+		{`{"enum": []}`, "must be a non-empty list"},
+		{`{"anyOf": {}}`, "must be a non-empty list"},
+		{`{"$ref": "#/$defs/missing"}`, "unresolved reference"},
+		{`{"$ref": "https://example.com/schema.json"}`, "only references within the schema"},
+		{`{"type": "date"}`, "unsupported type"},
+		{`{"type": "array", "minItems": 3, "maxItems": 2}`, "minItems is greater than maxItems"},
+		{`{"type": "string", "maxLength": -1}`, "non-negative integer"},
+		{`{"type": "string", "minLength": "2"}`, "must be a number"},
+		{`{"type": "string", "pattern": "a\\b"}`, "unsupported regex"},
+	}
+	for _, tt := range tests {
+		_, err := FromJSONSchema([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("FromJSONSchema(%s) = %v, want an error containing %q", tt.schema, err, tt.want)
+		}
+	}
+}
+
+func TestJSONGrammar(t *testing.T) {
+	g, err := Compile(JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := g.Rules(); rules[0] != "root" || len(rules) != 12 {
+		t.Errorf("JSON has the rules %v", rules)
+	}
+}
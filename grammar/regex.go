@@ -0,0 +1,187 @@
+// Package grammar produces GBNF grammars, the format llama.cpp uses to
+// constrain generation, from higher-level descriptions of the output.
+package grammar
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// FromRegex converts a regular expression in Go (RE2) syntax into a GBNF
+// grammar whose root rule matches the same strings. The whole output must
+// match, so leading ^ and trailing $ anchors are implied. Backreferences
+// don't exist in RE2; line anchors and word boundaries are not supported.
+func FromRegex(pattern string) (string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("root ::= ")
+	if err := writeRegex(&b, re); err != nil {
+		return "", err
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+func writeRegex(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return fmt.Errorf("regex %q can never match", re.String())
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText:
+		b.WriteString(`""`)
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			for i, r := range re.Rune {
+				if i > 0 {
+					b.WriteString(" ")
+				}
+				writeClass(b, foldRanges(r))
+			}
+			return nil
+		}
+		b.WriteString(Quote(string(re.Rune)))
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return fmt.Errorf("regex %q can never match", re.String())
+		}
+		writeClass(b, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		b.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		writeClass(b, []rune{0, unicode.MaxRune})
+	case syntax.OpCapture:
+		return writeGroup(b, re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest:
+		if err := writeGroup(b, re.Sub[0]); err != nil {
+			return err
+		}
+		b.WriteString(map[syntax.Op]string{syntax.OpStar: "*", syntax.OpPlus: "+", syntax.OpQuest: "?"}[re.Op])
+	case syntax.OpRepeat:
+		if err := writeGroup(b, re.Sub[0]); err != nil {
+			return err
+		}
+		switch {
+		case re.Max < 0:
+			fmt.Fprintf(b, "{%d,}", re.Min)
+		case re.Min == re.Max:
+			fmt.Fprintf(b, "{%d}", re.Min)
+		default:
+			fmt.Fprintf(b, "{%d,%d}", re.Min, re.Max)
+		}
+	case syntax.OpConcat:
+		n := 0
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpBeginText || sub.Op == syntax.OpEndText {
+				continue
+			}
+			if n > 0 {
+				b.WriteString(" ")
+			}
+			n++
+			if err := writeRegex(b, sub); err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			b.WriteString(`""`)
+		}
+	case syntax.OpAlternate:
+		b.WriteString("(")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			if err := writeRegex(b, sub); err != nil {
+				return err
+			}
+		}
+		b.WriteString(")")
+	default:
+		return fmt.Errorf("unsupported regex construct %q", re.String())
+	}
+	return nil
+}
+
+// writeGroup writes re in parentheses so a repetition applies to all of it
+func writeGroup(b *strings.Builder, re *syntax.Regexp) error {
+	b.WriteString("(")
+	if err := writeRegex(b, re); err != nil {
+		return err
+	}
+	b.WriteString(")")
+	return nil
+}
+
+// foldRanges returns the rune ranges matching r in any case
+func foldRanges(r rune) []rune {
+	ranges := []rune{r, r}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		ranges = append(ranges, f, f)
+	}
+	return ranges
+}
+
+// writeClass writes a character class from lo-hi rune pairs
+func writeClass(b *strings.Builder, ranges []rune) {
+	b.WriteString("[")
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		b.WriteString(escapeClassRune(lo))
+		if hi != lo {
+			b.WriteString("-")
+			b.WriteString(escapeClassRune(hi))
+		}
+	}
+	b.WriteString("]")
+}
+
+func escapeClassRune(r rune) string {
+	switch r {
+	case ']', '[', '\\':
+		return `\` + string(r)
+	case '-', '^':
+		// GBNF has no escapes for these
+		return fmt.Sprintf(`\x%02X`, r)
+	}
+	return escapeRune(r)
+}
+
+func escapeRune(r rune) string {
+	switch r {
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	}
+	switch {
+	case r < 0x20 || r == 0x7f:
+		return fmt.Sprintf(`\x%02X`, r)
+	case !unicode.IsPrint(r) && r <= 0xffff:
+		return fmt.Sprintf(`\u%04X`, r)
+	case !unicode.IsPrint(r):
+		return fmt.Sprintf(`\U%08X`, r)
+	}
+	return string(r)
+}
+
+// Quote returns s as a GBNF string literal
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteString(`"`)
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteString(`\` + string(r))
+		default:
+			b.WriteString(escapeRune(r))
+		}
+	}
+	b.WriteString(`"`)
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package grammar
+
+import "testing"
+
+func TestFromRegex(t *testing.T) {
+	tests := []struct {
+		pattern, want string
+	}{
+		{`abc`, `"abc"`},
+		{`^[a-z]+@(foo|bar)\.com$`, `([a-z])+ "@" (("foo" | "bar")) ".com"`},
+		{`(?i)ab`, `[Aa] [Bb]`},
+		{`a.c?`, `"a" [^\n] ("c")?`},
+		{`\d{3}-\d{4}`, `([0-9]){3} "-" ([0-9]){4}`},
+		{`x{2,}y{1,3}`, `("x"){2,} ("y"){1,3}`},
+		{`[^"\\]`, `[\x00-!#-\[\]-\U0010FFFF]`},
+		{`[-^a]`, `[\x2D\x5Ea]`},
+		{`"\n\t`, `"\"\n\t"`},
+		{`(?s).`, `[\x00-\U0010FFFF]`},
+		{`^$`, `""`},
+	}
+	for _, tt := range tests {
+		got, err := FromRegex(tt.pattern)
+		if err != nil {
+			t.Errorf("FromRegex(%q): %v", tt.pattern, err)
+			continue
+		}
+		if want := "root ::= " + tt.want + "\n"; got != want {
+			t.Errorf("FromRegex(%q) = %q, want %q", tt.pattern, got, want)
+		}
+		if _, err := Compile(got); err != nil {
+			t.Errorf("grammar of %q doesn't compile: %v", tt.pattern, err)
+		}
+	}
+}
+
+func TestFromRegexErrors(t *testing.T) {
+	for _, pattern := range []string{`(`, `a\b`, `(?m)^a`, `[^\x00-\x{10FFFF}]`} {
+		if g, err := FromRegex(pattern); err == nil {
+			t.Errorf("FromRegex(%q) = %q, want an error", pattern, g)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`plain`, `"plain"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"line\nbreak\r\ttab", `"line\nbreak\r\ttab"`},
+		{"\x00\x7f", `"\x00\x7F"`},
+		{"\u200bzero width", `"\u200Bzero width"`},
+		{"é ü 日本", `"é ü 日本"`},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+		if _, err := Compile("root ::= " + Quote(tt.in) + "\n"); err != nil {
+			t.Errorf("Quote(%q) doesn't compile: %v", tt.in, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Command buildllama fetches the pinned llama.cpp revision and builds
+// libllama for the bindings. It is run by go generate in the bindings
+// package and by make build:
+//
+//	go generate ./bindings
+//	go run ./internal/buildllama -backend cuda
+//
+// With -prebuilt the CPU libraries published with the llama.cpp release are
+// downloaded instead, so neither cmake nor a full build is needed, and
+// checked against the SHA-256 pinned in buildinfo. The source is still
+// checked out for its headers. -sums prints the digests to pin after
+// changing buildinfo.LlamaCppVersion.
+//
+// When ALPACA_LLAMA_LIB names a directory, the prebuilt libraries are
+// installed there, and a directory already holding libllama is used as it
+// is instead of building.
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/matthiase/alpaca/buildinfo"
+)
+
+func main() {
+	dir := flag.String("dir", "llama.cpp", "Directory holding the llama.cpp checkout")
+	backend := flag.String("backend", envOr("ALPACA_BACKEND", "cpu"), "Backend to build, one of "+fmt.Sprint(buildinfo.Backends()))
+	jobs := flag.Int("j", runtime.NumCPU(), "Parallel build jobs")
+	prebuilt := flag.Bool("prebuilt", false, "Download the release's prebuilt CPU libraries instead of building")
+	lib := flag.String("lib", os.Getenv("ALPACA_LLAMA_LIB"), "Directory of prebuilt or installed libraries, used instead of building")
+	sums := flag.Bool("sums", false, "Print the SHA-256 of every prebuilt archive of the release and exit")
+	flag.Parse()
+
+	if *sums {
+		if err := printSums(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flags, err := buildinfo.CMakeFlags(*backend, runtime.GOOS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(*dir, "CMakeLists.txt")); err != nil {
+		if err := fetch(*dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	build := filepath.Join(*dir, "build")
+	if *prebuilt {
+		if *lib == "" {
+			*lib = filepath.Join(build, "bin")
+		}
+		if err := download(*lib); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *lib != "" {
+		if !hasLibrary(*lib) {
+			log.Fatalf("%s holds no llama library; unset ALPACA_LLAMA_LIB to build one or add -prebuilt to download it there", *lib)
+		}
+		fmt.Printf("Using the llama.cpp libraries in %s\n", *lib)
+		return
+	}
+	if err := run("cmake", append([]string{"-S", *dir, "-B", build}, flags...)...); err != nil {
+		log.Fatal(err)
+	}
+	if err := run("cmake", "--build", build, "--config", "Release", "-j", strconv.Itoa(*jobs)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Built llama.cpp %s (%s) in %s\n", buildinfo.LlamaCppVersion, *backend, filepath.Join(build, "bin"))
+}
+
+// fetch checks out the pinned revision, through the submodule when the
+// directory is one and with a shallow clone otherwise
+func fetch(dir string) error {
+	if err := run("git", "submodule", "update", "--init", "--depth", "1", dir); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, "CMakeLists.txt")); err == nil {
+			return nil
+		}
+	}
+	// git clone refuses to clone into a non-empty directory
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		os.Remove(dir)
+	}
+	return run("git", "clone", "--depth", "1", "--branch", buildinfo.LlamaCppVersion, buildinfo.LlamaCppRepository, dir)
+}
+
+// download extracts the shared libraries of the prebuilt release into dir
+func download(dir string) error {
+	url, want, err := buildinfo.PrebuiltURL(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	if want == "" {
+		return fmt.Errorf("no SHA-256 is pinned for %s/%s in buildinfo, run go run ./internal/buildllama -sums", runtime.GOOS, runtime.GOARCH)
+	}
+	tmp, size, sum, err := fetchArchive(url)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if sum != want {
+		return fmt.Errorf("%s has SHA-256 %s, want %s", url, sum, want)
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	n := 0
+	for _, f := range archive.File {
+		name := filepath.Base(f.Name)
+		if f.FileInfo().IsDir() || !isLibrary(name) {
+			continue
+		}
+		if err := extract(f, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no libraries found in %s", url)
+	}
+	fmt.Printf("Installed %d prebuilt libraries of llama.cpp %s in %s\n", n, buildinfo.LlamaCppVersion, dir)
+	return nil
+}
+
+// fetchArchive downloads url into a temporary file, as zip needs random
+// access, and returns it with its size and hex SHA-256
+func fetchArchive(url string) (*os.File, int64, string, error) {
+	fmt.Println("+ download", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, "", fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp("", "llama-*.zip")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, "", err
+	}
+	return tmp, size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// printSums prints the prebuiltPlatforms entries of buildinfo with the
+// digests of the release's archives
+func printSums() error {
+	for _, platform := range buildinfo.PrebuiltPlatforms() {
+		goos, goarch, _ := strings.Cut(platform, "/")
+		url, _, err := buildinfo.PrebuiltURL(goos, goarch)
+		if err != nil {
+			return err
+		}
+		tmp, _, sum, err := fetchArchive(url)
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+		fmt.Printf("%q: %s\n", platform, sum)
+	}
+	return nil
+}
+
+// hasLibrary reports whether dir holds libllama
+func hasLibrary(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "libllama.") || strings.HasPrefix(e.Name(), "llama.") {
+			if isLibrary(e.Name()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isLibrary(name string) bool {
+	return strings.HasSuffix(name, ".dylib") || strings.HasSuffix(name, ".dll") || strings.HasSuffix(name, ".lib") ||
+		strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.")
+}
+
+func extract(f *zip.File, path string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Println("+", cmd.String())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
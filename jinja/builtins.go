@@ -0,0 +1,751 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var globals map[string]function
+
+var filters map[string]func(v any, args []any, kwargs map[string]any) (any, error)
+
+var tests map[string]func(v any, args []any) bool
+
+func init() {
+	globals = map[string]function{
+		"raise_exception": func(args []any, _ map[string]any) (any, error) {
+			msg := "raise_exception called"
+			if len(args) > 0 {
+				msg = toString(args[0])
+			}
+			return nil, &TemplateError{Message: msg}
+		},
+		"namespace": func(args []any, kwargs map[string]any) (any, error) {
+			ns := &namespace{vals: newDict()}
+			if len(args) > 0 {
+				if d, ok := args[0].(*dict); ok {
+					for _, k := range d.keys {
+						ns.vals.set(k, d.vals[k])
+					}
+				}
+			}
+			for _, k := range sortedKeys(kwargs) {
+				ns.vals.set(k, kwargs[k])
+			}
+			return ns, nil
+		},
+		"range": func(args []any, _ map[string]any) (any, error) {
+			var bounds []int64
+			for _, a := range args {
+				n, ok := a.(int64)
+				if !ok {
+					return nil, errors.New("jinja: range() arguments must be integers")
+				}
+				bounds = append(bounds, n)
+			}
+			start, stop, step := int64(0), int64(0), int64(1)
+			switch len(bounds) {
+			case 1:
+				stop = bounds[0]
+			case 2:
+				start, stop = bounds[0], bounds[1]
+			case 3:
+				start, stop, step = bounds[0], bounds[1], bounds[2]
+			default:
+				return nil, errors.New("jinja: range() takes 1 to 3 arguments")
+			}
+			if step == 0 {
+				return nil, errors.New("jinja: range() step must not be zero")
+			}
+			var out []any
+			for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+				out = append(out, i)
+			}
+			return out, nil
+		},
+		// evalCall evaluates dict() calls itself to keep the order of the
+		// keyword arguments; this handles the rest
+		"dict": func(_ []any, kwargs map[string]any) (any, error) {
+			return normalize(kwargs), nil
+		},
+		"strftime_now": func(args []any, _ map[string]any) (any, error) {
+			if len(args) == 0 {
+				return nil, errors.New("jinja: strftime_now() takes a format")
+			}
+			return strftime(time.Now(), toString(args[0])), nil
+		},
+	}
+
+	filters = map[string]func(any, []any, map[string]any) (any, error){
+		"length": filterLength,
+		"count":  filterLength,
+		"trim": func(v any, _ []any, _ map[string]any) (any, error) {
+			return strings.TrimSpace(toString(v)), nil
+		},
+		"upper": func(v any, _ []any, _ map[string]any) (any, error) {
+			return strings.ToUpper(toString(v)), nil
+		},
+		"lower": func(v any, _ []any, _ map[string]any) (any, error) {
+			return strings.ToLower(toString(v)), nil
+		},
+		"capitalize": func(v any, _ []any, _ map[string]any) (any, error) {
+			return capitalize(toString(v)), nil
+		},
+		"title": func(v any, _ []any, _ map[string]any) (any, error) {
+			return title(toString(v)), nil
+		},
+		"string": func(v any, _ []any, _ map[string]any) (any, error) {
+			return toString(v), nil
+		},
+		"safe": func(v any, _ []any, _ map[string]any) (any, error) {
+			return v, nil
+		},
+		"e": func(v any, _ []any, _ map[string]any) (any, error) {
+			return escape(toString(v)), nil
+		},
+		"escape": func(v any, _ []any, _ map[string]any) (any, error) {
+			return escape(toString(v)), nil
+		},
+		"int": func(v any, _ []any, _ map[string]any) (any, error) {
+			switch n := v.(type) {
+			case int64:
+				return n, nil
+			case float64:
+				return int64(n), nil
+			case string:
+				i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+				if err != nil {
+					return int64(0), nil
+				}
+				return i, nil
+			}
+			return int64(0), nil
+		},
+		"float": func(v any, _ []any, _ map[string]any) (any, error) {
+			if f, ok := toFloat(v); ok {
+				return f, nil
+			}
+			if s, ok := v.(string); ok {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+					return f, nil
+				}
+			}
+			return 0.0, nil
+		},
+		"abs": func(v any, _ []any, _ map[string]any) (any, error) {
+			switch n := v.(type) {
+			case int64:
+				if n < 0 {
+					return -n, nil
+				}
+				return n, nil
+			case float64:
+				return math.Abs(n), nil
+			}
+			return nil, fmt.Errorf("jinja: bad operand for abs: %s", typeName(v))
+		},
+		"round": func(v any, args []any, kwargs map[string]any) (any, error) {
+			f, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("jinja: cannot round %s", typeName(v))
+			}
+			precision := int64(0)
+			if p, ok := argOr(args, kwargs, 0, "precision").(int64); ok {
+				precision = p
+			}
+			scale := math.Pow(10, float64(precision))
+			return math.Round(f*scale) / scale, nil
+		},
+		"default": filterDefault,
+		"d":       filterDefault,
+		"first": func(v any, _ []any, _ map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil || len(items) == 0 {
+				return undefined{}, err
+			}
+			return items[0], nil
+		},
+		"last": func(v any, _ []any, _ map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil || len(items) == 0 {
+				return undefined{}, err
+			}
+			return items[len(items)-1], nil
+		},
+		"list": func(v any, _ []any, _ map[string]any) (any, error) {
+			items, err := iterate(v)
+			return append([]any{}, items...), err
+		},
+		"reverse": func(v any, _ []any, _ map[string]any) (any, error) {
+			if s, ok := v.(string); ok {
+				runes := []rune(s)
+				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+					runes[i], runes[j] = runes[j], runes[i]
+				}
+				return string(runes), nil
+			}
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]any, len(items))
+			for i, item := range items {
+				out[len(items)-1-i] = item
+			}
+			return out, nil
+		},
+		"join": func(v any, args []any, kwargs map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			sep := ""
+			if s, ok := argOr(args, kwargs, 0, "d").(string); ok {
+				sep = s
+			}
+			attr, _ := argOr(args, kwargs, 1, "attribute").(string)
+			parts := make([]string, len(items))
+			for i, item := range items {
+				if attr != "" {
+					item = getAttr(item, attr)
+				}
+				parts[i] = toString(item)
+			}
+			return strings.Join(parts, sep), nil
+		},
+		"replace": func(v any, args []any, _ map[string]any) (any, error) {
+			if len(args) < 2 {
+				return nil, errors.New("jinja: replace takes two arguments")
+			}
+			n := -1
+			if len(args) > 2 {
+				if c, ok := args[2].(int64); ok {
+					n = int(c)
+				}
+			}
+			return strings.Replace(toString(v), toString(args[0]), toString(args[1]), n), nil
+		},
+		"indent": func(v any, args []any, kwargs map[string]any) (any, error) {
+			width := 4
+			if w, ok := argOr(args, kwargs, 0, "width").(int64); ok {
+				width = int(w)
+			}
+			first := truthy(argOr(args, kwargs, 1, "first"))
+			pad := strings.Repeat(" ", width)
+			lines := strings.Split(toString(v), "\n")
+			for i := range lines {
+				if (i > 0 || first) && lines[i] != "" {
+					lines[i] = pad + lines[i]
+				}
+			}
+			return strings.Join(lines, "\n"), nil
+		},
+		"tojson": func(v any, args []any, kwargs map[string]any) (any, error) {
+			indent := 0
+			if n, ok := argOr(args, kwargs, 0, "indent").(int64); ok {
+				indent = int(n)
+			}
+			return toJSON(v, indent)
+		},
+		"items": func(v any, _ []any, _ map[string]any) (any, error) {
+			return dictItems(v, false)
+		},
+		"dictsort": func(v any, _ []any, _ map[string]any) (any, error) {
+			return dictItems(v, true)
+		},
+		"selectattr": func(v any, args []any, _ map[string]any) (any, error) {
+			return selectAttr(v, args, true)
+		},
+		"rejectattr": func(v any, args []any, _ map[string]any) (any, error) {
+			return selectAttr(v, args, false)
+		},
+		"select": func(v any, args []any, _ map[string]any) (any, error) {
+			return selectItems(v, args, true)
+		},
+		"reject": func(v any, args []any, _ map[string]any) (any, error) {
+			return selectItems(v, args, false)
+		},
+		"map": func(v any, args []any, kwargs map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]any, len(items))
+			if attr, ok := kwargs["attribute"].(string); ok {
+				for i, item := range items {
+					out[i] = getAttr(item, attr)
+					if isUndefined(out[i]) && kwargs["default"] != nil {
+						out[i] = kwargs["default"]
+					}
+				}
+				return out, nil
+			}
+			if len(args) == 0 {
+				return nil, errors.New("jinja: map requires a filter or attribute")
+			}
+			f, ok := filters[toString(args[0])]
+			if !ok {
+				return nil, fmt.Errorf("jinja: unknown filter %q", toString(args[0]))
+			}
+			for i, item := range items {
+				if out[i], err = f(item, args[1:], nil); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		},
+		"unique": func(v any, _ []any, _ map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			var out []any
+			for _, item := range items {
+				if ok, _ := contains(out, item); !ok {
+					out = append(out, item)
+				}
+			}
+			return out, nil
+		},
+		"sort": func(v any, args []any, kwargs map[string]any) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			out := append([]any(nil), items...)
+			reverse := truthy(argOr(args, kwargs, 0, "reverse"))
+			attr, _ := kwargs["attribute"].(string)
+			var sortErr error
+			sort.SliceStable(out, func(i, j int) bool {
+				a, b := out[i], out[j]
+				if attr != "" {
+					a, b = getAttr(a, attr), getAttr(b, attr)
+				}
+				c, err := compare(a, b)
+				if err != nil {
+					sortErr = err
+				}
+				if reverse {
+					return c > 0
+				}
+				return c < 0
+			})
+			return out, sortErr
+		},
+		"wordcount": func(v any, _ []any, _ map[string]any) (any, error) {
+			return int64(len(strings.Fields(toString(v)))), nil
+		},
+	}
+
+	tests = map[string]func(any, []any) bool{
+		"defined":   func(v any, _ []any) bool { return !isUndefined(v) },
+		"undefined": func(v any, _ []any) bool { return isUndefined(v) },
+		"none":      func(v any, _ []any) bool { return v == nil },
+		"boolean": func(v any, _ []any) bool {
+			_, ok := v.(bool)
+			return ok
+		},
+		"true":  func(v any, _ []any) bool { return v == true },
+		"false": func(v any, _ []any) bool { return v == false },
+		"string": func(v any, _ []any) bool {
+			_, ok := v.(string)
+			return ok
+		},
+		"number": func(v any, _ []any) bool {
+			switch v.(type) {
+			case int64, float64:
+				return true
+			}
+			return false
+		},
+		"integer": func(v any, _ []any) bool {
+			_, ok := v.(int64)
+			return ok
+		},
+		"float": func(v any, _ []any) bool {
+			_, ok := v.(float64)
+			return ok
+		},
+		"mapping": func(v any, _ []any) bool {
+			_, ok := v.(*dict)
+			return ok
+		},
+		"sequence": func(v any, _ []any) bool {
+			switch v.(type) {
+			case []any, tuple, string:
+				return true
+			}
+			return false
+		},
+		"iterable": func(v any, _ []any) bool {
+			switch v.(type) {
+			case []any, tuple, string, *dict:
+				return true
+			}
+			return false
+		},
+		"callable": func(v any, _ []any) bool {
+			_, ok := v.(function)
+			return ok
+		},
+		"equalto": testEqual,
+		"eq":      testEqual,
+		"==":      testEqual,
+		"ne": func(v any, args []any) bool {
+			return len(args) > 0 && !equal(v, args[0])
+		},
+		"in": func(v any, args []any) bool {
+			if len(args) == 0 {
+				return false
+			}
+			ok, _ := contains(args[0], v)
+			return ok
+		},
+		"odd": func(v any, _ []any) bool {
+			n, ok := v.(int64)
+			return ok && n%2 != 0
+		},
+		"even": func(v any, _ []any) bool {
+			n, ok := v.(int64)
+			return ok && n%2 == 0
+		},
+		"divisibleby": func(v any, args []any) bool {
+			n, ok := v.(int64)
+			if !ok || len(args) == 0 {
+				return false
+			}
+			d, ok := args[0].(int64)
+			return ok && d != 0 && n%d == 0
+		},
+		"lower": func(v any, _ []any) bool {
+			s, ok := v.(string)
+			return ok && s == strings.ToLower(s)
+		},
+		"upper": func(v any, _ []any) bool {
+			s, ok := v.(string)
+			return ok && s == strings.ToUpper(s)
+		},
+	}
+}
+
+func testEqual(v any, args []any) bool {
+	return len(args) > 0 && equal(v, args[0])
+}
+
+// argOr returns the positional argument at i or the keyword argument name
+func argOr(args []any, kwargs map[string]any, i int, name string) any {
+	if i < len(args) {
+		return args[i]
+	}
+	if v, ok := kwargs[name]; ok {
+		return v
+	}
+	return undefined{}
+}
+
+func filterLength(v any, _ []any, _ map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return int64(len([]rune(v))), nil
+	case []any:
+		return int64(len(v)), nil
+	case tuple:
+		return int64(len(v)), nil
+	case *dict:
+		return int64(len(v.keys)), nil
+	case undefined, nil:
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("jinja: %s has no length", typeName(v))
+}
+
+func filterDefault(v any, args []any, kwargs map[string]any) (any, error) {
+	def := argOr(args, kwargs, 0, "default_value")
+	if isUndefined(def) {
+		def = ""
+	}
+	boolean := truthy(argOr(args, kwargs, 1, "boolean"))
+	if isUndefined(v) || (boolean && !truthy(v)) {
+		return def, nil
+	}
+	return v, nil
+}
+
+// dictItems returns the (key, value) tuples of a dict, in insertion order or
+// sorted by key
+func dictItems(v any, sorted bool) (any, error) {
+	d, ok := v.(*dict)
+	if !ok {
+		if isUndefined(v) || v == nil {
+			return []any{}, nil
+		}
+		return nil, fmt.Errorf("jinja: %s has no items", typeName(v))
+	}
+	keys := d.keys
+	if sorted {
+		keys = sortedKeys(d.vals)
+	}
+	out := make([]any, len(keys))
+	for i, k := range keys {
+		out[i] = tuple{k, d.vals[k]}
+	}
+	return out, nil
+}
+
+func selectAttr(v any, args []any, keep bool) (any, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("jinja: selectattr requires an attribute name")
+	}
+	attr := toString(args[0])
+	var out []any
+	for _, item := range items {
+		if runTest(getAttr(item, attr), args[1:]) == keep {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func selectItems(v any, args []any, keep bool) (any, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	var out []any
+	for _, item := range items {
+		if runTest(item, args) == keep {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+// runTest applies the test named by args[0] (truthiness when absent)
+func runTest(v any, args []any) bool {
+	if len(args) == 0 {
+		return truthy(v)
+	}
+	t, ok := tests[toString(args[0])]
+	if !ok {
+		return false
+	}
+	return t(v, args[1:])
+}
+
+// callMethod implements the Python methods templates call on strings,
+// lists and dicts
+func callMethod(obj any, name string, args []any, kwargs map[string]any) (any, error) {
+	switch o := obj.(type) {
+	case string:
+		return stringMethod(o, name, args)
+	case *dict:
+		switch name {
+		case "items":
+			return dictItems(o, false)
+		case "keys":
+			return iterate(o)
+		case "values":
+			out := make([]any, len(o.keys))
+			for i, k := range o.keys {
+				out[i] = o.vals[k]
+			}
+			return out, nil
+		case "get":
+			if len(args) == 0 {
+				return nil, errors.New("jinja: get() takes a key")
+			}
+			if v, ok := o.get(toString(args[0])); ok {
+				return v, nil
+			}
+			if len(args) > 1 {
+				return args[1], nil
+			}
+			return nil, nil
+		}
+	case []any, tuple:
+		items, _ := iterate(o)
+		switch name {
+		case "index":
+			for i, item := range items {
+				if len(args) > 0 && equal(item, args[0]) {
+					return int64(i), nil
+				}
+			}
+			return nil, errors.New("jinja: item not in list")
+		case "count":
+			n := int64(0)
+			for _, item := range items {
+				if len(args) > 0 && equal(item, args[0]) {
+					n++
+				}
+			}
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("jinja: %s has no method %q", typeName(obj), name)
+}
+
+func stringMethod(s, name string, args []any) (any, error) {
+	arg := func(i int) string {
+		if i < len(args) && args[i] != nil {
+			return toString(args[i])
+		}
+		return ""
+	}
+
+	switch name {
+	case "strip", "lstrip", "rstrip":
+		cutset := arg(0)
+		trim := map[string]func(string, string) string{"strip": strings.Trim, "lstrip": strings.TrimLeft, "rstrip": strings.TrimRight}[name]
+		if cutset == "" {
+			trimSpace := map[string]func(string) string{"strip": strings.TrimSpace, "lstrip": func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) }, "rstrip": func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) }}[name]
+			return trimSpace(s), nil
+		}
+		return trim(s, cutset), nil
+	case "upper":
+		return strings.ToUpper(s), nil
+	case "lower":
+		return strings.ToLower(s), nil
+	case "title":
+		return title(s), nil
+	case "capitalize":
+		return capitalize(s), nil
+	case "startswith":
+		return strings.HasPrefix(s, arg(0)), nil
+	case "endswith":
+		return strings.HasSuffix(s, arg(0)), nil
+	case "replace":
+		n := -1
+		if len(args) > 2 {
+			if c, ok := args[2].(int64); ok {
+				n = int(c)
+			}
+		}
+		return strings.Replace(s, arg(0), arg(1), n), nil
+	case "split", "rsplit":
+		var parts []string
+		if arg(0) == "" {
+			parts = strings.Fields(s)
+		} else {
+			parts = strings.Split(s, arg(0))
+			if len(args) > 1 {
+				if n, ok := args[1].(int64); ok && n >= 0 && int(n)+1 < len(parts) {
+					if name == "split" {
+						parts = append(parts[:n:n], strings.Join(parts[n:], arg(0)))
+					} else {
+						cut := len(parts) - int(n)
+						parts = append([]string{strings.Join(parts[:cut], arg(0))}, parts[cut:]...)
+					}
+				}
+			}
+		}
+		out := make([]any, len(parts))
+		for i, p := range parts {
+			out[i] = p
+		}
+		return out, nil
+	case "find":
+		return int64(strings.Index(s, arg(0))), nil
+	case "count":
+		return int64(strings.Count(s, arg(0))), nil
+	case "join":
+		if len(args) == 0 {
+			return nil, errors.New("jinja: join() takes an iterable")
+		}
+		items, err := iterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = toString(item)
+		}
+		return strings.Join(parts, s), nil
+	case "format":
+		out := s
+		for _, a := range args {
+			out = strings.Replace(out, "{}", toString(a), 1)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("jinja: string has no method %q", name)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(strings.ToLower(s))
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func title(s string) string {
+	r := []rune(s)
+	prev := ' '
+	for i, c := range r {
+		if unicode.IsLetter(prev) {
+			r[i] = unicode.ToLower(c)
+		} else {
+			r[i] = unicode.ToUpper(c)
+		}
+		prev = c
+	}
+	return string(r)
+}
+
+func escape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;").Replace(s)
+}
+
+// strftime supports the format directives used by chat templates
+func strftime(t time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
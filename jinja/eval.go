@@ -0,0 +1,673 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// undefined is the value of names and attributes that don't exist. It
+// renders as an empty string and is falsy.
+type undefined struct{}
+
+// namespace is a mutable object created by namespace(), the only way for a
+// loop body to change a value visible outside the loop
+type namespace struct {
+	vals *dict
+}
+
+// function is a callable value: a global, a macro or a bound method
+type function func(args []any, kwargs map[string]any) (any, error)
+
+// loopInfo is the value of the loop variable inside a for loop
+type loopInfo struct {
+	index  int
+	length int
+	items  []any
+}
+
+func (l *loopInfo) attr(name string) any {
+	switch name {
+	case "index":
+		return int64(l.index + 1)
+	case "index0":
+		return int64(l.index)
+	case "revindex":
+		return int64(l.length - l.index)
+	case "revindex0":
+		return int64(l.length - l.index - 1)
+	case "first":
+		return l.index == 0
+	case "last":
+		return l.index == l.length-1
+	case "length":
+		return int64(l.length)
+	case "previtem":
+		if l.index > 0 {
+			return l.items[l.index-1]
+		}
+	case "nextitem":
+		if l.index+1 < l.length {
+			return l.items[l.index+1]
+		}
+	}
+	return undefined{}
+}
+
+var (
+	errBreak    = errors.New("break outside of loop")
+	errContinue = errors.New("continue outside of loop")
+)
+
+// scope holds the variables visible at a point in the template
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: map[string]any{}, parent: parent}
+}
+
+func (s *scope) lookup(name string) any {
+	for sc := s; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v
+		}
+	}
+	return undefined{}
+}
+
+// renderer executes the node tree
+type renderer struct {
+	out strings.Builder
+}
+
+func (r *renderer) exec(nodes []node, sc *scope) error {
+	for _, n := range nodes {
+		if err := r.execNode(n, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *renderer) execNode(n node, sc *scope) error {
+	switch n := n.(type) {
+	case *textNode:
+		r.out.WriteString(n.text)
+	case *outputNode:
+		v, err := eval(n.expr, sc)
+		if err != nil {
+			return err
+		}
+		r.out.WriteString(toString(v))
+	case *ifNode:
+		for i, cond := range n.conds {
+			v, err := eval(cond, sc)
+			if err != nil {
+				return err
+			}
+			if truthy(v) {
+				return r.exec(n.bodies[i], sc)
+			}
+		}
+		return r.exec(n.elseBody, sc)
+	case *forNode:
+		return r.execFor(n, sc)
+	case *setNode:
+		return r.execSet(n, sc)
+	case *macroNode:
+		sc.vars[n.name] = r.macro(n, sc)
+	case *blockNode:
+		return r.exec(n.body, sc)
+	case *breakNode:
+		return errBreak
+	case *continueNode:
+		return errContinue
+	default:
+		return fmt.Errorf("jinja: unknown node %T", n)
+	}
+	return nil
+}
+
+func (r *renderer) execFor(n *forNode, sc *scope) error {
+	iter, err := eval(n.iter, sc)
+	if err != nil {
+		return err
+	}
+	items, err := iterate(iter)
+	if err != nil {
+		return err
+	}
+
+	// Filtering happens before the loop variable is computed, so that
+	// loop.last refers to the last item that passes the condition
+	if n.cond != nil {
+		var kept []any
+		for _, item := range items {
+			inner := newScope(sc)
+			if err := bindTargets(inner, n.targets, item); err != nil {
+				return err
+			}
+			ok, err := eval(n.cond, inner)
+			if err != nil {
+				return err
+			}
+			if truthy(ok) {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+
+	if len(items) == 0 {
+		return r.exec(n.elseBody, sc)
+	}
+
+	loop := &loopInfo{length: len(items), items: items}
+	for i, item := range items {
+		loop.index = i
+		inner := newScope(sc)
+		inner.vars["loop"] = loop
+		if err := bindTargets(inner, n.targets, item); err != nil {
+			return err
+		}
+		err := r.exec(n.body, inner)
+		if err == errBreak {
+			break
+		}
+		if err != nil && err != errContinue {
+			return err
+		}
+	}
+	return nil
+}
+
+func bindTargets(sc *scope, targets []string, item any) error {
+	if len(targets) == 1 {
+		sc.vars[targets[0]] = item
+		return nil
+	}
+	var values []any
+	switch v := item.(type) {
+	case []any:
+		values = v
+	case tuple:
+		values = v
+	}
+	if len(values) != len(targets) {
+		return fmt.Errorf("jinja: cannot unpack %s into %d variables", typeName(item), len(targets))
+	}
+	for i, name := range targets {
+		sc.vars[name] = values[i]
+	}
+	return nil
+}
+
+func (r *renderer) execSet(n *setNode, sc *scope) error {
+	var value any
+	if n.value != nil {
+		var err error
+		if value, err = eval(n.value, sc); err != nil {
+			return err
+		}
+	} else {
+		inner := &renderer{}
+		if err := inner.exec(n.body, sc); err != nil {
+			return err
+		}
+		value = inner.out.String()
+	}
+
+	if n.attr == "" {
+		sc.vars[n.name] = value
+		return nil
+	}
+	ns, ok := sc.lookup(n.name).(*namespace)
+	if !ok {
+		return fmt.Errorf("jinja: cannot set attribute %q on %s", n.attr, n.name)
+	}
+	ns.vals.set(n.attr, value)
+	return nil
+}
+
+func (r *renderer) macro(n *macroNode, defScope *scope) function {
+	return func(args []any, kwargs map[string]any) (any, error) {
+		sc := newScope(defScope)
+		for i, param := range n.params {
+			switch {
+			case i < len(args):
+				sc.vars[param] = args[i]
+			case hasKey(kwargs, param):
+				sc.vars[param] = kwargs[param]
+			case n.defaults[i] != nil:
+				v, err := eval(n.defaults[i], sc)
+				if err != nil {
+					return nil, err
+				}
+				sc.vars[param] = v
+			default:
+				sc.vars[param] = undefined{}
+			}
+		}
+		inner := &renderer{}
+		if err := inner.exec(n.body, sc); err != nil {
+			return nil, err
+		}
+		return inner.out.String(), nil
+	}
+}
+
+func hasKey(m map[string]any, k string) bool {
+	_, ok := m[k]
+	return ok
+}
+
+func eval(e expr, sc *scope) (any, error) {
+	switch e := e.(type) {
+	case *literalExpr:
+		return e.value, nil
+	case *nameExpr:
+		if v := sc.lookup(e.name); !isUndefined(v) {
+			return v, nil
+		}
+		if fn, ok := globals[e.name]; ok {
+			return fn, nil
+		}
+		return undefined{}, nil
+	case *attrExpr:
+		obj, err := eval(e.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		return getAttr(obj, e.name), nil
+	case *indexExpr:
+		obj, err := eval(e.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		index, err := eval(e.index, sc)
+		if err != nil {
+			return nil, err
+		}
+		return getItem(obj, index), nil
+	case *sliceExpr:
+		return evalSlice(e, sc)
+	case *callExpr:
+		return evalCall(e, sc)
+	case *filterExpr:
+		value, err := eval(e.value, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := evalArgs(e.args, e.kwargs, sc)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := filters[e.name]
+		if !ok {
+			return nil, fmt.Errorf("jinja: unknown filter %q", e.name)
+		}
+		return f(value, args, kwargs)
+	case *testExpr:
+		value, err := eval(e.value, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, _, err := evalArgs(e.args, nil, sc)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := tests[e.name]
+		if !ok {
+			return nil, fmt.Errorf("jinja: unknown test %q", e.name)
+		}
+		return t(value, args) != e.negate, nil
+	case *binaryExpr:
+		return evalBinary(e, sc)
+	case *unaryExpr:
+		v, err := eval(e.value, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "not":
+			return !truthy(v), nil
+		case "-":
+			switch n := v.(type) {
+			case int64:
+				return -n, nil
+			case float64:
+				return -n, nil
+			}
+			return nil, fmt.Errorf("jinja: bad operand for unary -: %s", typeName(v))
+		}
+		return v, nil
+	case *condExpr:
+		cond, err := eval(e.cond, sc)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return eval(e.then, sc)
+		}
+		return eval(e.otherwise, sc)
+	case *listExpr:
+		items := make([]any, len(e.items))
+		for i, item := range e.items {
+			v, err := eval(item, sc)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		if e.tuple {
+			return tuple(items), nil
+		}
+		return items, nil
+	case *dictExpr:
+		d := newDict()
+		for i := range e.keys {
+			k, err := eval(e.keys[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := eval(e.values[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			d.set(toString(k), v)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("jinja: unknown expression %T", e)
+}
+
+func evalArgs(exprs []expr, kws []kwarg, sc *scope) ([]any, map[string]any, error) {
+	args := make([]any, len(exprs))
+	for i, a := range exprs {
+		v, err := eval(a, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		args[i] = v
+	}
+	kwargs := make(map[string]any, len(kws))
+	for _, kw := range kws {
+		v, err := eval(kw.value, sc)
+		if err != nil {
+			return nil, nil, err
+		}
+		kwargs[kw.name] = v
+	}
+	return args, kwargs, nil
+}
+
+func evalCall(e *callExpr, sc *scope) (any, error) {
+	// dict() keeps its keyword arguments in order, which the kwargs map of a
+	// function loses
+	if name, ok := e.fn.(*nameExpr); ok && name.name == "dict" && len(e.args) == 0 && isUndefined(sc.lookup(name.name)) {
+		d := newDict()
+		for _, kw := range e.kwargs {
+			v, err := eval(kw.value, sc)
+			if err != nil {
+				return nil, err
+			}
+			d.set(kw.name, v)
+		}
+		return d, nil
+	}
+
+	args, kwargs, err := evalArgs(e.args, e.kwargs, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Methods are resolved on the receiver rather than looked up as attributes
+	if attr, ok := e.fn.(*attrExpr); ok {
+		obj, err := eval(attr.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		if fn, ok := getAttr(obj, attr.name).(function); ok {
+			return fn(args, kwargs)
+		}
+		return callMethod(obj, attr.name, args, kwargs)
+	}
+
+	fn, err := eval(e.fn, sc)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fn.(function)
+	if !ok {
+		return nil, fmt.Errorf("jinja: %s is not callable", typeName(fn))
+	}
+	return f(args, kwargs)
+}
+
+func evalSlice(e *sliceExpr, sc *scope) (any, error) {
+	obj, err := eval(e.obj, sc)
+	if err != nil {
+		return nil, err
+	}
+	var bounds [3]*int64
+	for i, part := range []expr{e.start, e.stop, e.step} {
+		if part == nil {
+			continue
+		}
+		v, err := eval(part, sc)
+		if err != nil {
+			return nil, err
+		}
+		if isNone(v) {
+			continue
+		}
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("jinja: slice indices must be integers")
+		}
+		bounds[i] = &n
+	}
+
+	switch v := obj.(type) {
+	case []any:
+		idx := sliceIndices(len(v), bounds)
+		out := make([]any, 0, len(idx))
+		for _, i := range idx {
+			out = append(out, v[i])
+		}
+		return out, nil
+	case tuple:
+		idx := sliceIndices(len(v), bounds)
+		out := make(tuple, 0, len(idx))
+		for _, i := range idx {
+			out = append(out, v[i])
+		}
+		return out, nil
+	case string:
+		runes := []rune(v)
+		idx := sliceIndices(len(runes), bounds)
+		out := make([]rune, 0, len(idx))
+		for _, i := range idx {
+			out = append(out, runes[i])
+		}
+		return string(out), nil
+	}
+	return nil, fmt.Errorf("jinja: cannot slice %s", typeName(obj))
+}
+
+// sliceIndices returns the indices selected by a Python slice
+func sliceIndices(n int, bounds [3]*int64) []int {
+	step := 1
+	if bounds[2] != nil && *bounds[2] != 0 {
+		step = int(*bounds[2])
+	}
+	clamp := func(b *int64, def int) int {
+		if b == nil {
+			return def
+		}
+		i := int(*b)
+		if i < 0 {
+			i += n
+		}
+		if step > 0 {
+			return max(0, min(i, n))
+		}
+		return max(-1, min(i, n-1))
+	}
+
+	var idx []int
+	if step > 0 {
+		for i := clamp(bounds[0], 0); i < clamp(bounds[1], n); i += step {
+			idx = append(idx, i)
+		}
+	} else {
+		for i := clamp(bounds[0], n-1); i > clamp(bounds[1], -1); i += step {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+func evalBinary(e *binaryExpr, sc *scope) (any, error) {
+	left, err := eval(e.left, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "and":
+		if !truthy(left) {
+			return left, nil
+		}
+		return eval(e.right, sc)
+	case "or":
+		if truthy(left) {
+			return left, nil
+		}
+		return eval(e.right, sc)
+	}
+
+	right, err := eval(e.right, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		return contains(right, left)
+	case "not in":
+		ok, err := contains(right, left)
+		return !ok, err
+	case "~":
+		return toString(left) + toString(right), nil
+	case "<", ">", "<=", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case ">":
+			return c > 0, nil
+		case "<=":
+			return c <= 0, nil
+		}
+		return c >= 0, nil
+	case "+":
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []any:
+			if r, ok := right.([]any); ok {
+				return append(append([]any(nil), l...), r...), nil
+			}
+		case tuple:
+			if r, ok := right.(tuple); ok {
+				return append(append(tuple(nil), l...), r...), nil
+			}
+		}
+	}
+	return arithmetic(e.op, left, right)
+}
+
+func arithmetic(op string, left, right any) (any, error) {
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "//":
+			if ri == 0 {
+				return nil, errors.New("jinja: division by zero")
+			}
+			return floorDiv(li, ri), nil
+		case "%":
+			if ri == 0 {
+				return nil, errors.New("jinja: division by zero")
+			}
+			return li - floorDiv(li, ri)*ri, nil
+		case "**":
+			if ri >= 0 {
+				return int64(math.Pow(float64(li), float64(ri))), nil
+			}
+		}
+	}
+	if s, ok := left.(string); ok && op == "*" && rInt {
+		return strings.Repeat(s, max(0, int(ri))), nil
+	}
+
+	lf, lok := toFloat(left)
+	rf, rok := toFloat(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("jinja: unsupported operand types for %s: %s and %s", op, typeName(left), typeName(right))
+	}
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, errors.New("jinja: division by zero")
+		}
+		return lf / rf, nil
+	case "//":
+		if rf == 0 {
+			return nil, errors.New("jinja: division by zero")
+		}
+		return math.Floor(lf / rf), nil
+	case "%":
+		if rf == 0 {
+			return nil, errors.New("jinja: division by zero")
+		}
+		return lf - math.Floor(lf/rf)*rf, nil
+	case "**":
+		return math.Pow(lf, rf), nil
+	}
+	return nil, fmt.Errorf("jinja: unknown operator %s", op)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,286 @@
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segText segmentKind = iota
+	segExpr
+	segStmt
+)
+
+// segment is a piece of template source: literal text, the inside of a
+// {{ ... }} tag or the inside of a {% ... %} tag
+type segment struct {
+	kind    segmentKind
+	content string
+	line    int
+}
+
+// scan splits the source into segments, applying the whitespace control
+// modifiers and the trim_blocks/lstrip_blocks behaviour chat templates are
+// written for
+func scan(src string) ([]segment, error) {
+	var segs []segment
+	line := 1
+	trimNext := false    // strip all leading whitespace of the next text
+	trimNewline := false // strip one leading newline of the next text
+
+	addText := func(text string) {
+		if trimNext {
+			text = strings.TrimLeft(text, " \t\r\n")
+		} else if trimNewline {
+			if strings.HasPrefix(text, "\r\n") {
+				text = text[2:]
+			} else if strings.HasPrefix(text, "\n") {
+				text = text[1:]
+			}
+		}
+		trimNext, trimNewline = false, false
+		if text != "" {
+			segs = append(segs, segment{kind: segText, content: text, line: line})
+		}
+	}
+
+	for len(src) > 0 {
+		start := indexTag(src)
+		if start < 0 {
+			addText(src)
+			break
+		}
+
+		text := src[:start]
+		open := src[start : start+2]
+		bodyStart := start + 2
+
+		stripLeft := bodyStart < len(src) && src[bodyStart] == '-'
+		keepLeft := bodyStart < len(src) && src[bodyStart] == '+'
+		if stripLeft || keepLeft {
+			bodyStart++
+		}
+
+		closeTag := "#}"
+		switch open {
+		case "{{":
+			closeTag = "}}"
+		case "{%":
+			closeTag = "%}"
+		}
+
+		end := strings.Index(src[bodyStart:], closeTag)
+		if end < 0 {
+			return nil, fmt.Errorf("jinja: line %d: unclosed %s tag", line+strings.Count(text, "\n"), open)
+		}
+		body := src[bodyStart : bodyStart+end]
+		consumed := bodyStart + end + 2
+		stripRight := strings.HasSuffix(body, "-")
+		if stripRight || strings.HasSuffix(body, "+") {
+			body = body[:len(body)-1]
+		}
+
+		block := open != "{{"
+		if stripLeft {
+			text = strings.TrimRight(text, " \t\r\n")
+		} else if block && !keepLeft {
+			text = lstripBlock(text)
+		}
+		addText(text)
+		line += strings.Count(src[:start], "\n")
+
+		switch {
+		case open == "{%" && strings.TrimSpace(body) == "raw":
+			n, raw, err := scanRaw(src[consumed:])
+			if err != nil {
+				return nil, fmt.Errorf("jinja: line %d: %w", line, err)
+			}
+			segs = append(segs, segment{kind: segText, content: raw, line: line})
+			consumed += n
+		case open == "{{":
+			segs = append(segs, segment{kind: segExpr, content: body, line: line})
+		case open == "{%":
+			segs = append(segs, segment{kind: segStmt, content: body, line: line})
+		}
+
+		line += strings.Count(src[start:consumed], "\n")
+		src = src[consumed:]
+
+		trimNext = stripRight
+		trimNewline = block && !stripRight
+	}
+
+	return segs, nil
+}
+
+// indexTag returns the position of the next tag opening in s
+func indexTag(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '{' && (s[i+1] == '{' || s[i+1] == '%' || s[i+1] == '#') {
+			return i
+		}
+	}
+	return -1
+}
+
+// lstripBlock removes the spaces and tabs between the start of the line and
+// a block tag
+func lstripBlock(text string) string {
+	i := strings.LastIndexByte(text, '\n')
+	tail := text[i+1:]
+	if strings.Trim(tail, " \t") == "" {
+		return text[:i+1]
+	}
+	return text
+}
+
+// scanRaw finds the {% endraw %} tag and returns the number of bytes
+// consumed and the raw text before it
+func scanRaw(s string) (int, string, error) {
+	for i := 0; i < len(s); {
+		j := strings.Index(s[i:], "{%")
+		if j < 0 {
+			break
+		}
+		j += i
+		k := strings.Index(s[j:], "%}")
+		if k < 0 {
+			break
+		}
+		inner := strings.Trim(s[j+2:j+k], "-+ \t\r\n")
+		if inner == "endraw" {
+			return j + k + 2, s[:j], nil
+		}
+		i = j + 2
+	}
+	return 0, "", fmt.Errorf("missing endraw")
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokInt
+	tokFloat
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+}
+
+// tokenize splits the inside of a tag into expression tokens
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isNameStart(c):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokName, val: s[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '_') {
+				j++
+			}
+			kind := tokInt
+			if j+1 < len(s) && s[j] == '.' && s[j+1] >= '0' && s[j+1] <= '9' {
+				kind = tokFloat
+				j++
+				for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+					j++
+				}
+			}
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				k := j + 1
+				if k < len(s) && (s[k] == '+' || s[k] == '-') {
+					k++
+				}
+				if k < len(s) && s[k] >= '0' && s[k] <= '9' {
+					kind = tokFloat
+					j = k
+					for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+						j++
+					}
+				}
+			}
+			toks = append(toks, token{kind: kind, val: strings.ReplaceAll(s[i:j], "_", "")})
+			i = j
+		case c == '\'' || c == '"':
+			str, n, err := scanString(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: tokString, val: str})
+			i += n
+		default:
+			op := ""
+			for _, candidate := range []string{"**", "//", "==", "!=", "<=", ">="} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%~()[]{},:.|=<>", rune(c)) {
+					return nil, fmt.Errorf("unexpected character %q", c)
+				}
+				op = string(c)
+			}
+			toks = append(toks, token{kind: tokOp, val: op})
+			i += len(op)
+		}
+	}
+
+	return append(toks, token{kind: tokEOF}), nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || c >= '0' && c <= '9'
+}
+
+// scanString reads a quoted string literal and returns its value and length
+func scanString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '\'', '"':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
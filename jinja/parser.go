@@ -0,0 +1,827 @@
+package jinja
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// node is a statement in a parsed template
+type node interface{}
+
+type textNode struct{ text string }
+
+type outputNode struct{ expr expr }
+
+type ifNode struct {
+	conds    []expr
+	bodies   [][]node
+	elseBody []node
+}
+
+type forNode struct {
+	targets  []string
+	iter     expr
+	cond     expr
+	body     []node
+	elseBody []node
+}
+
+type setNode struct {
+	name  string
+	attr  string // set when assigning to namespace.attr
+	value expr   // nil for a block set
+	body  []node
+}
+
+type macroNode struct {
+	name     string
+	params   []string
+	defaults []expr
+	body     []node
+}
+
+type blockNode struct{ body []node }
+
+type breakNode struct{}
+
+type continueNode struct{}
+
+// expr is an expression in a parsed template
+type expr interface{}
+
+type literalExpr struct{ value any }
+
+type nameExpr struct{ name string }
+
+type attrExpr struct {
+	obj  expr
+	name string
+}
+
+type indexExpr struct {
+	obj   expr
+	index expr
+}
+
+type sliceExpr struct {
+	obj               expr
+	start, stop, step expr
+}
+
+type callExpr struct {
+	fn     expr
+	args   []expr
+	kwargs []kwarg
+}
+
+type filterExpr struct {
+	value  expr
+	name   string
+	args   []expr
+	kwargs []kwarg
+}
+
+type testExpr struct {
+	value  expr
+	name   string
+	args   []expr
+	negate bool
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+type unaryExpr struct {
+	op    string
+	value expr
+}
+
+type condExpr struct {
+	cond, then, otherwise expr
+}
+
+// listExpr is a list literal, or a tuple when tuple is set
+type listExpr struct {
+	items []expr
+	tuple bool
+}
+
+type dictExpr struct{ keys, values []expr }
+
+type kwarg struct {
+	name  string
+	value expr
+}
+
+// parser builds the node tree from the scanned segments
+type parser struct {
+	segs []segment
+	pos  int
+}
+
+func parseTemplate(src string) ([]node, error) {
+	segs, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{segs: segs}
+	nodes, end, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, p.errorf("unexpected {%% %s %%}", end)
+	}
+	return nodes, nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := 0
+	if p.pos > 0 && p.pos <= len(p.segs) {
+		line = p.segs[p.pos-1].line
+	}
+	return fmt.Errorf("jinja: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// parseBody parses nodes until a statement it doesn't own (endif, else, ...)
+// or the end of the template, and returns the keyword that ended it
+func (p *parser) parseBody(ends ...string) ([]node, string, error) {
+	var nodes []node
+	for p.pos < len(p.segs) {
+		seg := p.segs[p.pos]
+		p.pos++
+
+		switch seg.kind {
+		case segText:
+			nodes = append(nodes, &textNode{text: seg.content})
+		case segExpr:
+			ts, err := p.tokens(seg.content)
+			if err != nil {
+				return nil, "", err
+			}
+			e, err := ts.parseExpr()
+			if err != nil {
+				return nil, "", p.errorf("%v", err)
+			}
+			if err := ts.expectEOF(); err != nil {
+				return nil, "", p.errorf("%v", err)
+			}
+			nodes = append(nodes, &outputNode{expr: e})
+		case segStmt:
+			ts, err := p.tokens(seg.content)
+			if err != nil {
+				return nil, "", err
+			}
+			keyword := ts.next()
+			if keyword.kind != tokName {
+				return nil, "", p.errorf("expected statement name")
+			}
+			for _, end := range ends {
+				if keyword.val == end {
+					p.pos--
+					return nodes, keyword.val, nil
+				}
+			}
+			n, err := p.parseStatement(keyword.val, ts)
+			if err != nil {
+				return nil, "", err
+			}
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	if len(ends) > 0 {
+		return nil, "", p.errorf("missing {%% %s %%}", ends[len(ends)-1])
+	}
+	return nodes, "", nil
+}
+
+func (p *parser) tokens(content string) (*tokenStream, error) {
+	toks, err := tokenize(content)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return &tokenStream{toks: toks}, nil
+}
+
+// endStatement consumes the statement that ended a body and returns its tokens
+func (p *parser) endStatement() *tokenStream {
+	seg := p.segs[p.pos]
+	p.pos++
+	ts, _ := p.tokens(seg.content)
+	ts.next()
+	return ts
+}
+
+func (p *parser) parseStatement(keyword string, ts *tokenStream) (node, error) {
+	switch keyword {
+	case "if":
+		return p.parseIf(ts)
+	case "for":
+		return p.parseFor(ts)
+	case "set":
+		return p.parseSet(ts)
+	case "macro":
+		return p.parseMacro(ts)
+	case "break":
+		return &breakNode{}, nil
+	case "continue":
+		return &continueNode{}, nil
+	case "generation":
+		body, _, err := p.parseBody("endgeneration")
+		if err != nil {
+			return nil, err
+		}
+		p.endStatement()
+		return &blockNode{body: body}, nil
+	default:
+		return nil, p.errorf("unknown statement %q", keyword)
+	}
+}
+
+func (p *parser) parseIf(ts *tokenStream) (node, error) {
+	n := &ifNode{}
+	cond, err := ts.parseExpr()
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+
+	for {
+		body, end, err := p.parseBody("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		n.conds = append(n.conds, cond)
+		n.bodies = append(n.bodies, body)
+
+		endTs := p.endStatement()
+		switch end {
+		case "elif":
+			if cond, err = endTs.parseExpr(); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			continue
+		case "else":
+			if n.elseBody, _, err = p.parseBody("endif"); err != nil {
+				return nil, err
+			}
+			p.endStatement()
+		}
+		return n, nil
+	}
+}
+
+func (p *parser) parseFor(ts *tokenStream) (node, error) {
+	n := &forNode{}
+	for {
+		name := ts.next()
+		if name.kind != tokName {
+			return nil, p.errorf("expected loop variable")
+		}
+		n.targets = append(n.targets, name.val)
+		if !ts.acceptOp(",") {
+			break
+		}
+	}
+	if !ts.acceptName("in") {
+		return nil, p.errorf("expected 'in' in for loop")
+	}
+
+	var err error
+	if n.iter, err = ts.parseOr(); err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	if ts.acceptName("if") {
+		if n.cond, err = ts.parseOr(); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+	}
+	ts.acceptName("recursive")
+
+	body, end, err := p.parseBody("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	p.endStatement()
+	if end == "else" {
+		if n.elseBody, _, err = p.parseBody("endfor"); err != nil {
+			return nil, err
+		}
+		p.endStatement()
+	}
+	return n, nil
+}
+
+func (p *parser) parseSet(ts *tokenStream) (node, error) {
+	name := ts.next()
+	if name.kind != tokName {
+		return nil, p.errorf("expected variable name")
+	}
+	n := &setNode{name: name.val}
+	if ts.acceptOp(".") {
+		attr := ts.next()
+		if attr.kind != tokName {
+			return nil, p.errorf("expected attribute name")
+		}
+		n.attr = attr.val
+	}
+
+	if ts.acceptOp("=") {
+		var err error
+		if n.value, err = ts.parseTuple(); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return n, nil
+	}
+
+	body, _, err := p.parseBody("endset")
+	if err != nil {
+		return nil, err
+	}
+	p.endStatement()
+	n.body = body
+	return n, nil
+}
+
+func (p *parser) parseMacro(ts *tokenStream) (node, error) {
+	name := ts.next()
+	if name.kind != tokName || !ts.acceptOp("(") {
+		return nil, p.errorf("expected macro name and parameters")
+	}
+	n := &macroNode{name: name.val}
+	for !ts.acceptOp(")") {
+		param := ts.next()
+		if param.kind != tokName {
+			return nil, p.errorf("expected parameter name")
+		}
+		var def expr
+		if ts.acceptOp("=") {
+			var err error
+			if def, err = ts.parseExpr(); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		}
+		n.params = append(n.params, param.val)
+		n.defaults = append(n.defaults, def)
+		ts.acceptOp(",")
+	}
+
+	body, _, err := p.parseBody("endmacro")
+	if err != nil {
+		return nil, err
+	}
+	p.endStatement()
+	n.body = body
+	return n, nil
+}
+
+// tokenStream parses expressions from the tokens of a single tag
+type tokenStream struct {
+	toks []token
+	pos  int
+}
+
+func (ts *tokenStream) peek() token {
+	return ts.toks[ts.pos]
+}
+
+func (ts *tokenStream) next() token {
+	t := ts.toks[ts.pos]
+	if t.kind != tokEOF {
+		ts.pos++
+	}
+	return t
+}
+
+func (ts *tokenStream) isOp(op string) bool {
+	t := ts.peek()
+	return t.kind == tokOp && t.val == op
+}
+
+func (ts *tokenStream) isName(name string) bool {
+	t := ts.peek()
+	return t.kind == tokName && t.val == name
+}
+
+func (ts *tokenStream) acceptOp(op string) bool {
+	if ts.isOp(op) {
+		ts.pos++
+		return true
+	}
+	return false
+}
+
+func (ts *tokenStream) acceptName(name string) bool {
+	if ts.isName(name) {
+		ts.pos++
+		return true
+	}
+	return false
+}
+
+func (ts *tokenStream) expectOp(op string) error {
+	if !ts.acceptOp(op) {
+		return fmt.Errorf("expected %q, found %q", op, ts.peek().val)
+	}
+	return nil
+}
+
+func (ts *tokenStream) expectEOF() error {
+	if t := ts.peek(); t.kind != tokEOF {
+		return fmt.Errorf("unexpected %q", t.val)
+	}
+	return nil
+}
+
+// parseTuple parses an expression, or a tuple when it is followed by commas
+func (ts *tokenStream) parseTuple() (expr, error) {
+	first, err := ts.parseExpr()
+	if err != nil || !ts.isOp(",") {
+		return first, err
+	}
+	items := []expr{first}
+	for ts.acceptOp(",") {
+		if ts.peek().kind == tokEOF || ts.isOp(")") {
+			break
+		}
+		item, err := ts.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return &listExpr{items: items, tuple: true}, nil
+}
+
+func (ts *tokenStream) parseExpr() (expr, error) {
+	value, err := ts.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !ts.acceptName("if") {
+		return value, nil
+	}
+	cond, err := ts.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	var otherwise expr = &literalExpr{value: undefined{}}
+	if ts.acceptName("else") {
+		if otherwise, err = ts.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return &condExpr{cond: cond, then: value, otherwise: otherwise}, nil
+}
+
+func (ts *tokenStream) parseOr() (expr, error) {
+	left, err := ts.parseAnd()
+	for err == nil && ts.acceptName("or") {
+		var right expr
+		if right, err = ts.parseAnd(); err == nil {
+			left = &binaryExpr{op: "or", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parseAnd() (expr, error) {
+	left, err := ts.parseNot()
+	for err == nil && ts.acceptName("and") {
+		var right expr
+		if right, err = ts.parseNot(); err == nil {
+			left = &binaryExpr{op: "and", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parseNot() (expr, error) {
+	if ts.acceptName("not") {
+		value, err := ts.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "not", value: value}, nil
+	}
+	return ts.parseCompare()
+}
+
+func (ts *tokenStream) parseCompare() (expr, error) {
+	left, err := ts.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch t := ts.peek(); {
+		case t.kind == tokOp && (t.val == "==" || t.val == "!=" || t.val == "<" || t.val == ">" || t.val == "<=" || t.val == ">="):
+			op = t.val
+			ts.pos++
+		case ts.isName("in"):
+			op = "in"
+			ts.pos++
+		case ts.isName("not") && ts.toks[ts.pos+1].kind == tokName && ts.toks[ts.pos+1].val == "in":
+			op = "not in"
+			ts.pos += 2
+		default:
+			return left, nil
+		}
+		right, err := ts.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (ts *tokenStream) parseConcat() (expr, error) {
+	left, err := ts.parseAdd()
+	for err == nil && ts.acceptOp("~") {
+		var right expr
+		if right, err = ts.parseAdd(); err == nil {
+			left = &binaryExpr{op: "~", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parseAdd() (expr, error) {
+	left, err := ts.parseMul()
+	for err == nil && (ts.isOp("+") || ts.isOp("-")) {
+		op := ts.next().val
+		var right expr
+		if right, err = ts.parseMul(); err == nil {
+			left = &binaryExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parseMul() (expr, error) {
+	left, err := ts.parsePow()
+	for err == nil && (ts.isOp("*") || ts.isOp("/") || ts.isOp("//") || ts.isOp("%")) {
+		op := ts.next().val
+		var right expr
+		if right, err = ts.parsePow(); err == nil {
+			left = &binaryExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parsePow() (expr, error) {
+	left, err := ts.parseUnary()
+	for err == nil && ts.acceptOp("**") {
+		var right expr
+		if right, err = ts.parseUnary(); err == nil {
+			left = &binaryExpr{op: "**", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (ts *tokenStream) parseUnary() (expr, error) {
+	if ts.isOp("-") || ts.isOp("+") {
+		op := ts.next().val
+		value, err := ts.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, value: value}, nil
+	}
+	return ts.parsePostfix()
+}
+
+func (ts *tokenStream) parsePostfix() (expr, error) {
+	e, err := ts.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case ts.acceptOp("."):
+			name := ts.next()
+			if name.kind != tokName && name.kind != tokInt {
+				return nil, fmt.Errorf("expected attribute name")
+			}
+			e = &attrExpr{obj: e, name: name.val}
+		case ts.acceptOp("["):
+			if e, err = ts.parseSubscript(e); err != nil {
+				return nil, err
+			}
+		case ts.acceptOp("("):
+			args, kwargs, err := ts.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, kwargs: kwargs}
+		case ts.acceptOp("|"):
+			name := ts.next()
+			if name.kind != tokName {
+				return nil, fmt.Errorf("expected filter name")
+			}
+			f := &filterExpr{value: e, name: name.val}
+			if ts.acceptOp("(") {
+				if f.args, f.kwargs, err = ts.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			e = f
+		case ts.acceptName("is"):
+			t := &testExpr{value: e, negate: ts.acceptName("not")}
+			name := ts.next()
+			if name.kind != tokName {
+				return nil, fmt.Errorf("expected test name")
+			}
+			t.name = name.val
+			if ts.acceptOp("(") {
+				if t.args, _, err = ts.parseArgs(); err != nil {
+					return nil, err
+				}
+			} else if ts.startsTestArg() {
+				arg, err := ts.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				t.args = []expr{arg}
+			}
+			e = t
+		default:
+			return e, nil
+		}
+	}
+}
+
+// startsTestArg reports whether a test is followed by an argument written
+// without parentheses, as in "x is divisibleby 3"
+func (ts *tokenStream) startsTestArg() bool {
+	t := ts.peek()
+	switch t.kind {
+	case tokString, tokInt, tokFloat:
+		return true
+	case tokName:
+		switch t.val {
+		case "and", "or", "else", "if", "in", "is", "not":
+			return false
+		}
+		return true
+	case tokOp:
+		return t.val == "[" || t.val == "{"
+	}
+	return false
+}
+
+func (ts *tokenStream) parseSubscript(obj expr) (expr, error) {
+	var parts [3]expr
+	n := 0
+	isSlice := false
+	for {
+		if ts.isOp(":") || ts.isOp("]") {
+			// empty part
+		} else {
+			part, err := ts.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			parts[n] = part
+		}
+		if ts.acceptOp("]") {
+			break
+		}
+		if err := ts.expectOp(":"); err != nil {
+			return nil, err
+		}
+		isSlice = true
+		if n++; n > 2 {
+			return nil, fmt.Errorf("too many parts in slice")
+		}
+	}
+	if isSlice {
+		return &sliceExpr{obj: obj, start: parts[0], stop: parts[1], step: parts[2]}, nil
+	}
+	return &indexExpr{obj: obj, index: parts[0]}, nil
+}
+
+func (ts *tokenStream) parseArgs() ([]expr, []kwarg, error) {
+	var args []expr
+	var kwargs []kwarg
+	for !ts.acceptOp(")") {
+		if t := ts.peek(); t.kind == tokName && ts.toks[ts.pos+1].kind == tokOp && ts.toks[ts.pos+1].val == "=" {
+			ts.pos += 2
+			value, err := ts.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs = append(kwargs, kwarg{name: t.val, value: value})
+		} else {
+			value, err := ts.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, value)
+		}
+		if !ts.acceptOp(",") {
+			if err := ts.expectOp(")"); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	return args, kwargs, nil
+}
+
+func (ts *tokenStream) parsePrimary() (expr, error) {
+	t := ts.next()
+	switch t.kind {
+	case tokName:
+		switch t.val {
+		case "true", "True":
+			return &literalExpr{value: true}, nil
+		case "false", "False":
+			return &literalExpr{value: false}, nil
+		case "none", "None":
+			return &literalExpr{value: nil}, nil
+		}
+		return &nameExpr{name: t.val}, nil
+	case tokString:
+		s := t.val
+		for ts.peek().kind == tokString {
+			s += ts.next().val
+		}
+		return &literalExpr{value: s}, nil
+	case tokInt:
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literalExpr{value: n}, nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literalExpr{value: f}, nil
+	case tokOp:
+		switch t.val {
+		case "(":
+			if ts.acceptOp(")") {
+				return &listExpr{tuple: true}, nil
+			}
+			e, err := ts.parseTuple()
+			if err != nil {
+				return nil, err
+			}
+			return e, ts.expectOp(")")
+		case "[":
+			l := &listExpr{}
+			for !ts.acceptOp("]") {
+				item, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				l.items = append(l.items, item)
+				if !ts.acceptOp(",") {
+					if err := ts.expectOp("]"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return l, nil
+		case "{":
+			d := &dictExpr{}
+			for !ts.acceptOp("}") {
+				key, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if err := ts.expectOp(":"); err != nil {
+					return nil, err
+				}
+				value, err := ts.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, key)
+				d.values = append(d.values, value)
+				if !ts.acceptOp(",") {
+					if err := ts.expectOp("}"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return d, nil
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", strings.TrimSpace(t.val))
+}
@@ -0,0 +1,59 @@
+// Package jinja renders the subset of Jinja2 used by the chat templates
+// embedded in GGUF models.
+//
+// Templates are rendered the way Hugging Face transformers renders them:
+// trim_blocks and lstrip_blocks are enabled, undefined values are falsy and
+// render as empty strings, and tojson matches Python's json.dumps output.
+// Dicts keep their keys in insertion order, so JSON objects passed as
+// variables, and structs, which go through their JSON encoding, render with
+// their keys in order. The keys of Go maps are sorted.
+package jinja
+
+// TemplateError is returned when a template calls raise_exception
+type TemplateError struct {
+	Message string
+}
+
+func (e *TemplateError) Error() string {
+	return "jinja: " + e.Message
+}
+
+// Template is a parsed template
+type Template struct {
+	nodes []node
+}
+
+// Parse parses template source
+func Parse(src string) (*Template, error) {
+	nodes, err := parseTemplate(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+// Render executes the template with the given variables. Values may be any
+// of the Go types encoding/json produces, or anything that marshals to JSON.
+func (t *Template) Render(vars map[string]any) (string, error) {
+	root := newScope(nil)
+	for k, v := range vars {
+		root.vars[k] = normalize(v)
+	}
+	r := &renderer{}
+	if err := r.exec(t.nodes, root); err != nil {
+		if err == errBreak || err == errContinue {
+			return "", &TemplateError{Message: err.Error()}
+		}
+		return "", err
+	}
+	return r.out.String(), nil
+}
+
+// Render parses and executes a template in one step
+func Render(src string, vars map[string]any) (string, error) {
+	t, err := Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return t.Render(vars)
+}
@@ -0,0 +1,272 @@
+package jinja
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// The chat templates of the Hugging Face repos of the models, as embedded in
+// their GGUF conversions
+
+const llama3Template = `{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}`
+
+const qwen25Template = `{%- if tools %}
+    {{- '<|im_start|>system\n' }}
+    {%- if messages[0]['role'] == 'system' %}
+        {{- messages[0]['content'] }}
+    {%- else %}
+        {{- 'You are Qwen, created by Alibaba Cloud. You are a helpful assistant.' }}
+    {%- endif %}
+    {{- "\n\n# Tools\n\nYou may call one or more functions to assist with the user query.\n\nYou are provided with function signatures within <tools></tools> XML tags:\n<tools>" }}
+    {%- for tool in tools %}
+        {{- "\n" }}
+        {{- tool | tojson }}
+    {%- endfor %}
+    {{- "\n</tools>\n\nFor each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call><|im_end|>\n" }}
+{%- else %}
+    {%- if messages[0]['role'] == 'system' %}
+        {{- '<|im_start|>system\n' + messages[0]['content'] + '<|im_end|>\n' }}
+    {%- else %}
+        {{- '<|im_start|>system\nYou are Qwen, created by Alibaba Cloud. You are a helpful assistant.<|im_end|>\n' }}
+    {%- endif %}
+{%- endif %}
+{%- for message in messages %}
+    {%- if (message.role == "user") or (message.role == "system" and not loop.first) or (message.role == "assistant" and not message.tool_calls) %}
+        {{- '<|im_start|>' + message.role + '\n' + message.content + '<|im_end|>' + '\n' }}
+    {%- elif message.role == "assistant" %}
+        {{- '<|im_start|>' + message.role }}
+        {%- if message.content %}
+            {{- '\n' + message.content }}
+        {%- endif %}
+        {%- for tool_call in message.tool_calls %}
+            {%- if tool_call.function is defined %}
+                {%- set tool_call = tool_call.function %}
+            {%- endif %}
+            {{- '\n<tool_call>\n{"name": "' }}
+            {{- tool_call.name }}
+            {{- '", "arguments": ' }}
+            {{- tool_call.arguments | tojson }}
+            {{- '}\n</tool_call>' }}
+        {%- endfor %}
+        {{- '<|im_end|>\n' }}
+    {%- elif message.role == "tool" %}
+        {%- if (loop.index0 == 0) or (messages[loop.index0 - 1].role != "tool") %}
+            {{- '<|im_start|>user' }}
+        {%- endif %}
+        {{- '\n<tool_response>\n' }}
+        {{- message.content }}
+        {{- '\n</tool_response>' }}
+        {%- if loop.last or (messages[loop.index0 + 1].role != "tool") %}
+            {{- '<|im_end|>\n' }}
+        {%- endif %}
+    {%- endif %}
+{%- endfor %}
+{%- if add_generation_prompt %}
+    {{- '<|im_start|>assistant\n' }}
+{%- endif %}
+`
+
+const mistralTemplate = `{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}`
+
+const gemmaTemplate = `{{ bos_token }}{% if messages[0]['role'] == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if (message['role'] == 'assistant') %}{% set role = 'model' %}{% else %}{% set role = message['role'] %}{% endif %}{{ '<start_of_turn>' + role + '\n' + message['content'] | trim + '<end_of_turn>\n' }}{% endfor %}{% if add_generation_prompt %}{{'<start_of_turn>model\n'}}{% endif %}`
+
+const (
+	chatMessages = `[
+		{"role": "user", "content": "Hi"},
+		{"role": "assistant", "content": "Hello!"},
+		{"role": "user", "content": "How are you? "}
+	]`
+	systemMessages = `[
+		{"role": "system", "content": "You are a llama."},
+		{"role": "user", "content": "Hi"}
+	]`
+	toolMessages = `[
+		{"role": "user", "content": "What's the weather in Paris?"},
+		{"role": "assistant", "content": "", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": {"location": "Paris", "format": "celsius"}}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "22"}
+	]`
+	// The properties aren't sorted, like those of most schemas
+	weatherTools = `[
+		{"type": "function", "function": {
+			"name": "get_weather",
+			"description": "Get the current weather",
+			"parameters": {
+				"type": "object",
+				"properties": {"location": {"type": "string"}, "format": {"type": "string", "enum": ["celsius", "fahrenheit"]}},
+				"required": ["location"]
+			}
+		}}
+	]`
+)
+
+const qwenSystem = "<|im_start|>system\nYou are Qwen, created by Alibaba Cloud. You are a helpful assistant."
+
+// TestChatTemplates renders templates of popular models and compares the
+// prompts with those transformers' apply_chat_template produces
+func TestChatTemplates(t *testing.T) {
+	tests := []struct {
+		name, tmpl string
+		bos        string
+		messages   string
+		tools      string
+		want       string
+		wantErr    string
+	}{
+		{
+			name:     "Llama 3",
+			tmpl:     llama3Template,
+			bos:      "<|begin_of_text|>",
+			messages: chatMessages,
+			want: "<|begin_of_text|><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHow are you?<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			name:     "Llama 3 system prompt",
+			tmpl:     llama3Template,
+			bos:      "<|begin_of_text|>",
+			messages: systemMessages,
+			want: "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nYou are a llama.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			name:     "Qwen2.5",
+			tmpl:     qwen25Template,
+			messages: systemMessages,
+			want: "<|im_start|>system\nYou are a llama.<|im_end|>\n" +
+				"<|im_start|>user\nHi<|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:     "Qwen2.5 tools",
+			tmpl:     qwen25Template,
+			messages: toolMessages,
+			tools:    weatherTools,
+			want: qwenSystem + "\n\n# Tools\n\nYou may call one or more functions to assist with the user query.\n\n" +
+				"You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n" +
+				`{"type": "function", "function": {"name": "get_weather", "description": "Get the current weather", "parameters": {"type": "object", "properties": {"location": {"type": "string"}, "format": {"type": "string", "enum": ["celsius", "fahrenheit"]}}, "required": ["location"]}}}` +
+				"\n</tools>\n\nFor each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n" +
+				"<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call><|im_end|>\n" +
+				"<|im_start|>user\nWhat's the weather in Paris?<|im_end|>\n" +
+				"<|im_start|>assistant\n<tool_call>\n" +
+				`{"name": "get_weather", "arguments": {"location": "Paris", "format": "celsius"}}` +
+				"\n</tool_call><|im_end|>\n" +
+				"<|im_start|>user\n<tool_response>\n22\n</tool_response><|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:     "Mistral",
+			tmpl:     mistralTemplate,
+			bos:      "<s>",
+			messages: chatMessages,
+			want:     "<s>[INST] Hi [/INST]Hello!</s>[INST] How are you?  [/INST]",
+		},
+		{
+			name:     "Mistral system prompt",
+			tmpl:     mistralTemplate,
+			bos:      "<s>",
+			messages: systemMessages,
+			wantErr:  "Conversation roles must alternate user/assistant/user/assistant/...",
+		},
+		{
+			name:     "Gemma",
+			tmpl:     gemmaTemplate,
+			bos:      "<bos>",
+			messages: chatMessages,
+			want: "<bos><start_of_turn>user\nHi<end_of_turn>\n" +
+				"<start_of_turn>model\nHello!<end_of_turn>\n" +
+				"<start_of_turn>user\nHow are you?<end_of_turn>\n" +
+				"<start_of_turn>model\n",
+		},
+		{
+			name:     "Gemma system prompt",
+			tmpl:     gemmaTemplate,
+			bos:      "<bos>",
+			messages: systemMessages,
+			wantErr:  "System role not supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]any{
+				"messages":              json.RawMessage(tt.messages),
+				"add_generation_prompt": true,
+				"bos_token":             tt.bos,
+				"eos_token":             "</s>",
+			}
+			if tt.tools != "" {
+				vars["tools"] = json.RawMessage(tt.tools)
+			}
+			got, err := Render(tt.tmpl, vars)
+			if tt.wantErr != "" {
+				var terr *TemplateError
+				if !errors.As(err, &terr) || terr.Message != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	vars := map[string]any{
+		"obj":   json.RawMessage(`{"b": 1, "a": [1, 2.5, "x"], "c": {"z": null, "y": true}}`),
+		"goMap": map[string]any{"b": 1, "a": 2},
+		"tool": struct {
+			Name   string `json:"name"`
+			Strict bool   `json:"strict"`
+		}{"f", true},
+	}
+	tests := []struct {
+		src, want string
+	}{
+		// Dicts keep their keys in insertion order
+		{`{{ obj | tojson }}`, `{"b": 1, "a": [1, 2.5, "x"], "c": {"z": null, "y": true}}`},
+		{`{{ obj }}`, `{'b': 1, 'a': [1, 2.5, 'x'], 'c': {'z': None, 'y': True}}`},
+		{`{% for k in obj %}{{ k }}{% endfor %}`, `bac`},
+		{`{% for k, v in obj.items() %}{{ k }}={{ v | tojson }};{% endfor %}`, `b=1;a=[1, 2.5, "x"];c={"z": null, "y": true};`},
+		{`{{ obj.keys() | list }} {{ obj.c.values() | list }}`, `['b', 'a', 'c'] [None, True]`},
+		{`{{ obj | dictsort }}`, `[('a', [1, 2.5, 'x']), ('b', 1), ('c', {'z': None, 'y': True})]`},
+		{`{{ {"y": 1, "x": 2} | tojson }}`, `{"y": 1, "x": 2}`},
+		{`{{ dict(y=1, x=2) | tojson }}`, `{"y": 1, "x": 2}`},
+		{`{{ obj | tojson(indent=2) }}`, "{\n  \"b\": 1,\n  \"a\": [\n    1,\n    2.5,\n    \"x\"\n  ],\n  \"c\": {\n    \"z\": null,\n    \"y\": true\n  }\n}"},
+		// Go maps have no order to keep; structs keep that of their fields
+		{`{{ goMap | tojson }}`, `{"a": 2, "b": 1}`},
+		{`{{ tool | tojson }}`, `{"name": "f", "strict": true}`},
+		{`{{ obj == {"c": {"y": true, "z": none}, "a": [1, 2.5, "x"], "b": 1} }}`, `True`},
+
+		// Tuples render in parentheses and otherwise behave like lists
+		{`{{ (1, "a") }}`, `(1, 'a')`},
+		{`{{ (1,) }} {{ () }}`, `(1,) ()`},
+		{`{% set t = 1, 2 %}{{ t }}`, `(1, 2)`},
+		{`{{ obj.items() | list | first }}`, `('b', 1)`},
+		{`{{ (1, 2) | tojson }}`, `[1, 2]`},
+		{`{{ (1, 2) == (1, 2) }} {{ (1, 2) == [1, 2] }}`, `True False`},
+		{`{{ (1, 2) + (3,) }} {{ (1, 2, 3)[1:] }} {{ (1, 2)[-1] }}`, `(1, 2, 3) (2, 3) 2`},
+		{`{{ (1, 2) | length }} {{ 2 in (1, 2) }} {{ (1, 2).index(2) }}`, `2 True 1`},
+		{`{% for a, b in [(1, 2), (3, 4)] %}{{ a + b }}{% endfor %}`, `37`},
+		{`{{ (1, 2) is sequence }} {{ (1, 2) is iterable }}`, `True True`},
+	}
+	for _, tt := range tests {
+		got, err := Render(tt.src, vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
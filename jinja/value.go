@@ -0,0 +1,579 @@
+package jinja
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dict is a mapping that keeps its keys in insertion order, like Python's
+type dict struct {
+	keys []string
+	vals map[string]any
+}
+
+func newDict() *dict {
+	return &dict{vals: map[string]any{}}
+}
+
+func (d *dict) get(k string) (any, bool) {
+	v, ok := d.vals[k]
+	return v, ok
+}
+
+// set replaces the value of k, or adds k after the other keys
+func (d *dict) set(k string, v any) {
+	if _, ok := d.vals[k]; !ok {
+		d.keys = append(d.keys, k)
+	}
+	d.vals[k] = v
+}
+
+// tuple is a sequence that renders the way Python's tuples do
+type tuple []any
+
+// normalize converts Go values into the types the renderer works with:
+// nil, bool, int64, float64, string, []any, tuple and *dict
+func normalize(v any) any {
+	switch v := v.(type) {
+	case nil, bool, int64, float64, string, undefined, function, *namespace, *dict, tuple:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = normalize(item)
+		}
+		return out
+	case map[string]any:
+		// Go maps have no order, so their keys are sorted
+		out := newDict()
+		for _, k := range sortedKeys(v) {
+			out.set(k, normalize(v[k]))
+		}
+		return out
+	case []string:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = item
+		}
+		return out
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = normalize(item)
+		}
+		return out
+	case func(args []any, kwargs map[string]any) (any, error):
+		return function(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+
+	// Structs and other containers go through their JSON representation,
+	// which keeps struct fields and the keys of raw JSON in order
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	out, err := decodeJSON(dec)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return out
+}
+
+// decodeJSON reads the next value from dec, keeping the keys of objects in
+// the order they appear
+func decodeJSON(dec *json.Decoder) (any, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		if t == '[' {
+			out := []any{}
+			for dec.More() {
+				item, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, item)
+			}
+			_, err := dec.Token()
+			return out, err
+		}
+		out := newDict()
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			item, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			out.set(k.(string), item)
+		}
+		_, err := dec.Token()
+		return out, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		f, _ := t.Float64()
+		return f, nil
+	}
+	return t, nil
+}
+
+func isUndefined(v any) bool {
+	_, ok := v.(undefined)
+	return ok
+}
+
+func isNone(v any) bool {
+	return v == nil
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "none"
+	case undefined:
+		return "undefined"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case tuple:
+		return "tuple"
+	case *dict:
+		return "dict"
+	case *namespace:
+		return "namespace"
+	case function:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case tuple:
+		return len(v) > 0
+	case *dict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// toString renders a value the way Python's str() does
+func toString(v any) string {
+	switch v := v.(type) {
+	case undefined:
+		return ""
+	case string:
+		return v
+	}
+	return repr(v)
+}
+
+// repr renders a value the way Python's repr() does
+func repr(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case undefined:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return formatFloat(v)
+	case string:
+		return "'" + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), "'", `\'`) + "'"
+	case []any:
+		return "[" + reprItems(v) + "]"
+	case tuple:
+		if len(v) == 1 {
+			return "(" + repr(v[0]) + ",)"
+		}
+		return "(" + reprItems(v) + ")"
+	case *dict:
+		parts := make([]string, len(v.keys))
+		for i, k := range v.keys {
+			parts[i] = repr(k) + ": " + repr(v.vals[k])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+func reprItems(items []any) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = repr(item)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".en") {
+		s += ".0"
+	}
+	return s
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func equal(a, b any) bool {
+	if af, ok := toFloat(a); ok {
+		if _, isBool := a.(bool); !isBool {
+			bf, ok := toFloat(b)
+			_, bIsBool := b.(bool)
+			return ok && !bIsBool && af == bf
+		}
+	}
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		return ok && equalItems(a, b)
+	case tuple:
+		b, ok := b.(tuple)
+		return ok && equalItems(a, b)
+	case *dict:
+		b, ok := b.(*dict)
+		if !ok || len(a.keys) != len(b.keys) {
+			return false
+		}
+		for k, v := range a.vals {
+			if bv, ok := b.vals[k]; !ok || !equal(v, bv) {
+				return false
+			}
+		}
+		return true
+	case undefined:
+		return isUndefined(b)
+	case *namespace, function:
+		return false
+	}
+	return a == b
+}
+
+func equalItems(a, b []any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(a, b any) (int, error) {
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs), nil
+		}
+	}
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if !aok || !bok {
+		return 0, fmt.Errorf("jinja: cannot compare %s and %s", typeName(a), typeName(b))
+	}
+	switch {
+	case af < bf:
+		return -1, nil
+	case af > bf:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func contains(container, item any) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("jinja: 'in <string>' requires string as left operand")
+		}
+		return strings.Contains(c, s), nil
+	case []any:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case tuple:
+		return contains([]any(c), item)
+	case *dict:
+		s, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c.get(s)
+		return found, nil
+	case undefined, nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("jinja: argument of type %s is not iterable", typeName(container))
+}
+
+// iterate returns the items a for loop visits
+func iterate(v any) ([]any, error) {
+	switch v := v.(type) {
+	case []any:
+		return v, nil
+	case tuple:
+		return v, nil
+	case *dict:
+		items := make([]any, len(v.keys))
+		for i, k := range v.keys {
+			items[i] = k
+		}
+		return items, nil
+	case string:
+		items := make([]any, 0, len(v))
+		for _, r := range v {
+			items = append(items, string(r))
+		}
+		return items, nil
+	case undefined, nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("jinja: %s is not iterable", typeName(v))
+}
+
+func getAttr(obj any, name string) any {
+	switch o := obj.(type) {
+	case *dict:
+		if v, ok := o.get(name); ok {
+			return v
+		}
+	case *namespace:
+		if v, ok := o.vals.get(name); ok {
+			return v
+		}
+	case *loopInfo:
+		return o.attr(name)
+	case []any, tuple:
+		if i, err := strconv.Atoi(name); err == nil {
+			return getItem(o, int64(i))
+		}
+	}
+	return undefined{}
+}
+
+func getItem(obj any, index any) any {
+	switch o := obj.(type) {
+	case *dict:
+		if k, ok := index.(string); ok {
+			if v, ok := o.get(k); ok {
+				return v
+			}
+		}
+		return undefined{}
+	case tuple:
+		return getItem([]any(o), index)
+	case []any:
+		i, ok := index.(int64)
+		if !ok {
+			return undefined{}
+		}
+		if i < 0 {
+			i += int64(len(o))
+		}
+		if i < 0 || i >= int64(len(o)) {
+			return undefined{}
+		}
+		return o[i]
+	case string:
+		i, ok := index.(int64)
+		if !ok {
+			return undefined{}
+		}
+		runes := []rune(o)
+		if i < 0 {
+			i += int64(len(runes))
+		}
+		if i < 0 || i >= int64(len(runes)) {
+			return undefined{}
+		}
+		return string(runes[i])
+	}
+	if s, ok := index.(string); ok {
+		return getAttr(obj, s)
+	}
+	return undefined{}
+}
+
+// toJSON serializes a value like Python's json.dumps: ", " and ": "
+// separators, no escaping of non-ASCII characters and optional indentation
+func toJSON(v any, indent int) (string, error) {
+	var b strings.Builder
+	if err := writeJSON(&b, v, indent, 0); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeJSON(b *strings.Builder, v any, indent, depth int) error {
+	newline := func(d int) {
+		if indent > 0 {
+			b.WriteString("\n" + strings.Repeat(" ", indent*d))
+		}
+	}
+	sep := ", "
+	if indent > 0 {
+		sep = ","
+	}
+
+	switch v := v.(type) {
+	case nil, undefined:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("jinja: cannot serialize %v as JSON", v)
+		}
+		b.WriteString(formatFloat(v))
+	case string:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		b.WriteString(strings.TrimSuffix(buf.String(), "\n"))
+	case []any:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(sep)
+			}
+			newline(depth + 1)
+			if err := writeJSON(b, item, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteString("]")
+	case tuple:
+		return writeJSON(b, []any(v), indent, depth)
+	case *dict:
+		if len(v.keys) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+		b.WriteString("{")
+		for i, k := range v.keys {
+			if i > 0 {
+				b.WriteString(sep)
+			}
+			newline(depth + 1)
+			if err := writeJSON(b, k, indent, depth+1); err != nil {
+				return err
+			}
+			b.WriteString(": ")
+			if err := writeJSON(b, v.vals[k], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteString("}")
+	case *namespace:
+		return writeJSON(b, v.vals, indent, depth)
+	default:
+		return fmt.Errorf("jinja: cannot serialize %s as JSON", typeName(v))
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+// Package jsonstream parses JSON as it is generated and reports each value
+// as soon as it is complete, so that a UI can render a structured reply
+// field by field instead of waiting for the whole document.
+package jsonstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kind tells what an Event completed
+type Kind string
+
+const (
+	Field   Kind = "field"   // a member of an object
+	Element Kind = "element" // an element of an array
+	Value   Kind = "value"   // the whole document
+)
+
+// Event reports a complete value
+type Event struct {
+	Kind Kind `json:"kind"`
+
+	// Path is the JSON Pointer (RFC 6901) of the value, e.g. "/items/0/name",
+	// "" for the whole document
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// state is what the parser expects next
+type state int
+
+const (
+	stateValue   state = iota // a value
+	stateFirst                // a value or the end of an empty array
+	stateKey                  // a key or the end of an empty object
+	stateNextKey              // a key after a comma
+	stateColon                // the colon after a key
+	stateNext                 // a comma or the end of the container
+	stateString               // inside a string
+	stateLiteral              // inside a number, true, false or null
+	stateEnd                  // after the document
+)
+
+// frame is an object or array being parsed
+type frame struct {
+	array bool
+	start int    // offset of the opening bracket
+	key   string // key of the current member of an object
+	index int    // index of the current element of an array
+}
+
+// Parser parses one JSON document written to it in pieces. Events are
+// reported in the order values end, so the members of an object come
+// before the object.
+type Parser struct {
+	emit  func(Event)
+	buf   []byte
+	stack []frame
+	state state
+	start int  // offset of the string or literal being parsed
+	key   bool // the string being parsed is a key
+	esc   bool // the last character of the string was a backslash
+	err   error
+}
+
+// NewParser returns a parser calling emit with every complete value
+func NewParser(emit func(Event)) *Parser {
+	return &Parser{emit: emit}
+}
+
+// Write parses more of the document. After it returns an error, writes fail
+// with the same error.
+func (p *Parser) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	for _, c := range b {
+		p.buf = append(p.buf, c)
+		if err := p.step(c, len(p.buf)-1); err != nil {
+			p.err = err
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// WriteString is Write for a string, e.g. a piece passed to
+// GenerateOptions.OnToken
+func (p *Parser) WriteString(s string) (int, error) {
+	return p.Write([]byte(s))
+}
+
+// Close ends the document, reporting a trailing number, and fails if it
+// is incomplete
+func (p *Parser) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.state == stateLiteral {
+		if err := p.literal(len(p.buf)); err != nil {
+			p.err = err
+			return err
+		}
+	}
+	if p.state != stateEnd {
+		p.err = fmt.Errorf("unexpected end of JSON at offset %d", len(p.buf))
+	}
+	return p.err
+}
+
+// Err returns the error the document failed with, if any
+func (p *Parser) Err() error {
+	return p.err
+}
+
+// step parses character c at offset i
+func (p *Parser) step(c byte, i int) error {
+	switch p.state {
+	case stateString:
+		switch {
+		case p.esc:
+			p.esc = false
+		case c == '\\':
+			p.esc = true
+		case c == '"':
+			return p.endString(i + 1)
+		case c < 0x20:
+			return p.unexpected(c, i)
+		}
+		return nil
+	case stateLiteral:
+		if !isDelimiter(c) {
+			return nil
+		}
+		if err := p.literal(i); err != nil {
+			return err
+		}
+		// The delimiter is parsed in the state the literal left
+	}
+
+	if isSpace(c) {
+		return nil
+	}
+	switch p.state {
+	case stateValue, stateFirst:
+		switch {
+		case c == '{':
+			p.stack = append(p.stack, frame{start: i})
+			p.state = stateKey
+		case c == '[':
+			p.stack = append(p.stack, frame{array: true, start: i})
+			p.state = stateFirst
+		case c == ']' && p.state == stateFirst:
+			return p.close(i, true)
+		case c == '"':
+			p.state, p.start, p.key = stateString, i, false
+		case c == '-' || c >= '0' && c <= '9' || c == 't' || c == 'f' || c == 'n':
+			p.state, p.start = stateLiteral, i
+		default:
+			return p.unexpected(c, i)
+		}
+	case stateKey, stateNextKey:
+		switch {
+		case c == '"':
+			p.state, p.start, p.key = stateString, i, true
+		case c == '}' && p.state == stateKey:
+			return p.close(i, false)
+		default:
+			return p.unexpected(c, i)
+		}
+	case stateColon:
+		if c != ':' {
+			return p.unexpected(c, i)
+		}
+		p.state = stateValue
+	case stateNext:
+		top := &p.stack[len(p.stack)-1]
+		switch {
+		case c == ',' && top.array:
+			top.index++
+			p.state = stateValue
+		case c == ',':
+			p.state = stateNextKey
+		case c == ']' || c == '}':
+			return p.close(i, c == ']')
+		default:
+			return p.unexpected(c, i)
+		}
+	default:
+		return p.unexpected(c, i)
+	}
+	return nil
+}
+
+// endString ends the string that started at p.start before end
+func (p *Parser) endString(end int) error {
+	if !p.key {
+		if !json.Valid(p.buf[p.start:end]) {
+			return fmt.Errorf("invalid string at offset %d", p.start)
+		}
+		return p.complete(p.start, end)
+	}
+	var key string
+	if err := json.Unmarshal(p.buf[p.start:end], &key); err != nil {
+		return fmt.Errorf("invalid key at offset %d: %w", p.start, err)
+	}
+	p.stack[len(p.stack)-1].key = key
+	p.state = stateColon
+	return nil
+}
+
+// literal ends the number or literal that started at p.start before end
+func (p *Parser) literal(end int) error {
+	if !json.Valid(p.buf[p.start:end]) {
+		return fmt.Errorf("invalid literal %q at offset %d", p.buf[p.start:end], p.start)
+	}
+	return p.complete(p.start, end)
+}
+
+// close ends the innermost container with the bracket at i
+func (p *Parser) close(i int, array bool) error {
+	if len(p.stack) == 0 || p.stack[len(p.stack)-1].array != array {
+		return p.unexpected(p.buf[i], i)
+	}
+	start := p.stack[len(p.stack)-1].start
+	p.stack = p.stack[:len(p.stack)-1]
+	return p.complete(start, i+1)
+}
+
+// complete reports the value from start to end, a member or element of the
+// innermost container, or the document
+func (p *Parser) complete(start, end int) error {
+	value := json.RawMessage(p.buf[start:end:end])
+	if len(p.stack) == 0 {
+		p.state = stateEnd
+		p.emit(Event{Kind: Value, Value: value})
+		return nil
+	}
+	kind := Field
+	if p.stack[len(p.stack)-1].array {
+		kind = Element
+	}
+	p.state = stateNext
+	p.emit(Event{Kind: kind, Path: p.path(), Value: value})
+	return nil
+}
+
+// path returns the JSON Pointer of the current member or element
+func (p *Parser) path() string {
+	var b strings.Builder
+	for _, f := range p.stack {
+		b.WriteByte('/')
+		if f.array {
+			b.WriteString(strconv.Itoa(f.index))
+		} else {
+			b.WriteString(pointerEscaper.Replace(f.key))
+		}
+	}
+	return b.String()
+}
+
+// pointerEscaper escapes a key as a JSON Pointer reference token
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func (p *Parser) unexpected(c byte, i int) error {
+	return fmt.Errorf("invalid character %q at offset %d", c, i)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDelimiter(c byte) bool {
+	return isSpace(c) || c == ',' || c == ']' || c == '}'
+}
@@ -0,0 +1,173 @@
+package jsonstream
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parse parses doc written in two pieces cut at offset cut, returning the
+// events as "kind path value" lines
+func parse(doc string, cut int) ([]string, error) {
+	var events []string
+	p := NewParser(func(e Event) {
+		events = append(events, string(e.Kind)+" "+e.Path+" "+string(e.Value))
+	})
+	if _, err := p.WriteString(doc[:cut]); err != nil {
+		return events, err
+	}
+	if _, err := p.WriteString(doc[cut:]); err != nil {
+		return events, err
+	}
+	return events, p.Close()
+}
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name, doc string
+		want      []string
+	}{
+		{
+			"nested object",
+			`{"a": 1, "b": [true, {"c": null}], "d": "x"}`,
+			[]string{
+				`field /a 1`,
+				`element /b/0 true`,
+				`field /b/1/c null`,
+				`element /b/1 {"c": null}`,
+				`field /b [true, {"c": null}]`,
+				`field /d "x"`,
+				`value  {"a": 1, "b": [true, {"c": null}], "d": "x"}`,
+			},
+		},
+		{
+			"array of arrays",
+			"[[], [1, -2.5e3], {}]\n",
+			[]string{
+				`element /0 []`,
+				`element /1/0 1`,
+				`element /1/1 -2.5e3`,
+				`element /1 [1, -2.5e3]`,
+				`element /2 {}`,
+				`value  [[], [1, -2.5e3], {}]`,
+			},
+		},
+		{
+			"escaped strings and pointer keys",
+			`{"a/b~c": "q\"}\\", "é": "\n"}`,
+			[]string{
+				`field /a~1b~0c "q\"}\\"`,
+				`field /é "\n"`,
+				`value  {"a/b~c": "q\"}\\", "é": "\n"}`,
+			},
+		},
+		{"top-level number", " 42 ", []string{`value  42`}},
+		{"top-level number at the end", "-0.5", []string{`value  -0.5`}},
+		{"top-level string", `"hi"`, []string{`value  "hi"`}},
+		{"top-level literal", "false", []string{`value  false`}},
+		{"number before a closing bracket", `{"n":10}`, []string{`field /n 10`, `value  {"n":10}`}},
+	}
+	for _, tt := range tests {
+		for cut := range len(tt.doc) + 1 {
+			got, err := parse(tt.doc, cut)
+			if err != nil {
+				t.Errorf("%s cut at %d: %v", tt.name, cut, err)
+				break
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s cut at %d: got\n%s\nwant\n%s", tt.name, cut, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+				break
+			}
+		}
+	}
+}
+
+// TestParserPartial checks that a document cut short at any offset reports
+// only the values complete before the cut, and fails on Close
+func TestParserPartial(t *testing.T) {
+	doc := `{"name": "alpaca", "tags": ["a", "b"], "size": 12, "ok": true}`
+	all, err := parse(doc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cut := range len(doc) {
+		var events []Event
+		p := NewParser(func(e Event) { events = append(events, e) })
+		if _, err := p.WriteString(doc[:cut]); err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		// A number is only complete once something follows it
+		if cut == strings.Index(doc, "12,")+2 {
+			if len(events) != 4 {
+				t.Errorf("cut after 12: %d events, want 4", len(events))
+			}
+		}
+		for i, e := range events {
+			if !json.Valid(e.Value) {
+				t.Errorf("cut at %d: event %d has invalid value %s", cut, i, e.Value)
+			}
+			if got := string(e.Kind) + " " + e.Path + " " + string(e.Value); got != all[i] {
+				t.Errorf("cut at %d: event %d is %s, want %s", cut, i, got, all[i])
+			}
+		}
+		if err := p.Close(); err == nil {
+			t.Errorf("cut at %d: Close accepted %q", cut, doc[:cut])
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	docs := []string{
+		``,
+		`   `,
+		`{`,
+		`}`,
+		`[1,]`,
+		`[1 2]`,
+		`{"a" 1}`,
+		`{"a": 1,}`,
+		`{1: 2}`,
+		`{"a": 1]`,
+		`[1}`,
+		`[tru]`,
+		`[nul, 1]`,
+		`01`,
+		`1.`,
+		`-`,
+		`+1`,
+		`"unterminated`,
+		"\"control\x01\"",
+		`{"\q": 1}`,
+		`["\q"]`,
+		`1 2`,
+		`{} {}`,
+		`[1]]`,
+		`[1{}]`,
+	}
+	for _, doc := range docs {
+		if json.Valid([]byte(doc)) {
+			t.Fatalf("%q is valid JSON", doc)
+		}
+		for cut := range len(doc) + 1 {
+			if _, err := parse(doc, cut); err == nil {
+				t.Errorf("no error for %q cut at %d", doc, cut)
+				break
+			}
+		}
+	}
+}
+
+func TestParserStopsAfterError(t *testing.T) {
+	p := NewParser(func(Event) {})
+	_, err := p.WriteString(`[1,,`)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if _, again := p.WriteString(`2]`); again != err {
+		t.Errorf("Write after an error returned %v, want %v", again, err)
+	}
+	if p.Close() != err || p.Err() != err {
+		t.Error("Close and Err don't return the first error")
+	}
+}
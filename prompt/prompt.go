@@ -0,0 +1,212 @@
+// Package prompt builds prompts from text/template templates, with helpers
+// for few-shot examples and for fitting variables such as retrieved
+// documents into a token budget.
+package prompt
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Tokenizer counts tokens, it is implemented by *bindings.Model
+type Tokenizer interface {
+	Tokenize(text string, addSpecial, parseSpecial bool) ([]bindings.Token, error)
+}
+
+// Example is a few-shot example: an input and the output expected for it
+type Example struct {
+	Input  string
+	Output string
+}
+
+// Template is a parsed prompt template
+type Template struct {
+	tmpl *template.Template
+}
+
+// Options configures ExecuteWithOptions
+type Options struct {
+	Tokenizer Tokenizer // counts the tokens of the prompt, required with MaxTokens
+	MaxTokens int       // tokens the prompt may take, 0 for no limit
+
+	// Truncate names the string variables that may be shortened to fit in
+	// MaxTokens, in the order they are shortened. They are cut at the end.
+	Truncate []string
+}
+
+var funcs = template.FuncMap{
+	"examples": examples,
+	"trim":     strings.TrimSpace,
+}
+
+// Parse parses a prompt template. Variables are referenced as {{.name}} and
+// a missing one is an error. Next to the text/template builtins a template
+// can call:
+//
+//	examples  renders a []Example, each as "Input: ...\nOutput: ..." and
+//	          separated by blank lines; {{examples .shots "Q" "A"}} uses
+//	          other labels
+//	trim      removes leading and trailing white space
+func Parse(text string) (*Template, error) {
+	tmpl, err := template.New("prompt").Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Must returns t, panicking if err is not nil. It is meant for templates
+// parsed into package variables.
+func Must(t *Template, err error) *Template {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Execute renders the template with vars
+func (t *Template) Execute(vars map[string]any) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// ExecuteWithOptions renders the template with vars. A prompt longer than
+// MaxTokens is shortened first by dropping few-shot examples from the end of
+// the []Example variables, then by cutting the Truncate variables; if it
+// still doesn't fit, the error wraps bindings.ErrPromptTooLong. vars is not
+// modified.
+func (t *Template) ExecuteWithOptions(vars map[string]any, opts Options) (string, error) {
+	if opts.MaxTokens <= 0 {
+		return t.Execute(vars)
+	}
+	if opts.Tokenizer == nil {
+		return "", errors.New("a tokenizer is required to fit a prompt in MaxTokens")
+	}
+
+	vars = maps.Clone(vars)
+	prompt, n, err := t.render(vars, opts.Tokenizer)
+	if err != nil {
+		return "", err
+	}
+
+	// Drop examples one at a time, taking turns between the variables
+	// holding them, in alphabetical order so the result doesn't depend on
+	// the map's
+	shots := slices.Sorted(maps.Keys(vars))
+	shots = slices.DeleteFunc(shots, func(name string) bool {
+		_, ok := vars[name].([]Example)
+		return !ok
+	})
+	for n > opts.MaxTokens && len(shots) > 0 {
+		for _, name := range shots {
+			if e := vars[name].([]Example); len(e) > 0 {
+				vars[name] = e[:len(e)-1]
+			}
+		}
+		shots = slices.DeleteFunc(shots, func(name string) bool {
+			return len(vars[name].([]Example)) == 0
+		})
+		if prompt, n, err = t.render(vars, opts.Tokenizer); err != nil {
+			return "", err
+		}
+	}
+
+	for _, name := range opts.Truncate {
+		for n > opts.MaxTokens {
+			text, ok := vars[name].(string)
+			if !ok {
+				return "", fmt.Errorf("variable %s to truncate is not a string", name)
+			}
+			if text == "" {
+				break
+			}
+			have, err := count(opts.Tokenizer, text, false)
+			if err != nil {
+				return "", err
+			}
+			// Cutting may merge or split tokens at the cut, so the prompt
+			// is counted again and cut further if needed
+			keep := min(have-(n-opts.MaxTokens), have-1)
+			if vars[name], err = cut(opts.Tokenizer, text, keep); err != nil {
+				return "", err
+			}
+			if prompt, n, err = t.render(vars, opts.Tokenizer); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if n > opts.MaxTokens {
+		return "", fmt.Errorf("%w: %d tokens, limit %d", bindings.ErrPromptTooLong, n, opts.MaxTokens)
+	}
+	return prompt, nil
+}
+
+// render executes the template and counts the tokens of the prompt
+func (t *Template) render(vars map[string]any, tok Tokenizer) (string, int, error) {
+	prompt, err := t.Execute(vars)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := count(tok, prompt, true)
+	return prompt, n, err
+}
+
+// count returns the number of tokens of text. A whole prompt is tokenized
+// with special tokens, as Generate does.
+func count(tok Tokenizer, text string, prompt bool) (int, error) {
+	tokens, err := tok.Tokenize(text, prompt, prompt)
+	return len(tokens), err
+}
+
+// cut returns the longest prefix of text, ending at a character boundary,
+// of at most keep tokens
+func cut(tok Tokenizer, text string, keep int) (string, error) {
+	if keep <= 0 {
+		return "", nil
+	}
+	var bounds []int
+	for i := range text {
+		bounds = append(bounds, i)
+	}
+	bounds = append(bounds, len(text))
+	var err error
+	j := sort.Search(len(bounds), func(j int) bool {
+		n, e := count(tok, text[:bounds[j]], false)
+		if e != nil {
+			err = e
+		}
+		return e != nil || n > keep
+	})
+	if err != nil {
+		return "", err
+	}
+	return text[:bounds[j-1]], nil
+}
+
+// examples renders few-shot examples with the given input and output labels
+func examples(shots []Example, labels ...string) (string, error) {
+	input, output := "Input", "Output"
+	switch len(labels) {
+	case 0:
+	case 2:
+		input, output = labels[0], labels[1]
+	default:
+		return "", errors.New("examples takes an input and an output label")
+	}
+	parts := make([]string, len(shots))
+	for i, e := range shots {
+		parts[i] = fmt.Sprintf("%s: %s\n%s: %s", input, e.Input, output, e.Output)
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
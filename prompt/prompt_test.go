@@ -0,0 +1,209 @@
+package prompt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// words is a tokenizer with one token per word and one for the BOS token a
+// whole prompt starts with
+type words struct{}
+
+func (words) Tokenize(text string, addSpecial, parseSpecial bool) ([]bindings.Token, error) {
+	n := len(strings.Fields(text))
+	if addSpecial {
+		n++
+	}
+	return make([]bindings.Token, n), nil
+}
+
+var shots = []Example{
+	{"2+2", "4"},
+	{"3*3", "9"},
+	{"10-7", "3"},
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name, tmpl string
+		vars       map[string]any
+		want       string
+	}{
+		{"variables", "Translate to {{.lang}}: {{.text}}", map[string]any{"lang": "French", "text": "hello"}, "Translate to French: hello"},
+		{"examples", "{{examples .shots}}", map[string]any{"shots": shots[:2]}, "Input: 2+2\nOutput: 4\n\nInput: 3*3\nOutput: 9"},
+		{"examples with labels", `{{examples .shots "Q" "A"}}`, map[string]any{"shots": shots[:1]}, "Q: 2+2\nA: 4"},
+		{"no examples", "[{{examples .shots}}]", map[string]any{"shots": []Example(nil)}, "[]"},
+		{"trim", "<{{trim .doc}}>", map[string]any{"doc": "\n  text \n"}, "<text>"},
+		{"builtins", "{{range .items}}- {{.}}\n{{end}}", map[string]any{"items": []string{"a", "b"}}, "- a\n- b\n"},
+	}
+	for _, tt := range tests {
+		got, err := Must(Parse(tt.tmpl)).Execute(tt.vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	tests := []struct {
+		name, tmpl string
+		vars       map[string]any
+	}{
+		{"missing variable", "{{.missing}}", map[string]any{}},
+		{"one label", `{{examples .shots "Q"}}`, map[string]any{"shots": shots}},
+		{"not examples", "{{examples .shots}}", map[string]any{"shots": "text"}},
+	}
+	for _, tt := range tests {
+		if got, err := Must(Parse(tt.tmpl)).Execute(tt.vars); err == nil {
+			t.Errorf("%s: got %q, want an error", tt.name, got)
+		}
+	}
+
+	if _, err := Parse("{{.unclosed"); err == nil {
+		t.Error("Parse accepted an unclosed action")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Must didn't panic on a parse error")
+		}
+	}()
+	Must(Parse("{{end}}"))
+}
+
+func TestExecuteWithOptions(t *testing.T) {
+	fewShot := "{{examples .shots}}\nInput: {{.q}}"
+	tests := []struct {
+		name, tmpl string
+		vars       map[string]any
+		opts       Options
+		want       string
+	}{
+		{
+			"fits",
+			fewShot,
+			map[string]any{"shots": shots, "q": "1+1"},
+			Options{MaxTokens: 15},
+			"Input: 2+2\nOutput: 4\n\nInput: 3*3\nOutput: 9\n\nInput: 10-7\nOutput: 3\nInput: 1+1",
+		},
+		{
+			"no limit",
+			fewShot,
+			map[string]any{"shots": shots, "q": "1+1"},
+			Options{},
+			"Input: 2+2\nOutput: 4\n\nInput: 3*3\nOutput: 9\n\nInput: 10-7\nOutput: 3\nInput: 1+1",
+		},
+		{
+			"examples dropped from the end",
+			fewShot,
+			map[string]any{"shots": shots, "q": "1+1"},
+			Options{MaxTokens: 11},
+			"Input: 2+2\nOutput: 4\n\nInput: 3*3\nOutput: 9\nInput: 1+1",
+		},
+		{
+			"all examples dropped",
+			fewShot,
+			map[string]any{"shots": shots, "q": "1+1"},
+			Options{MaxTokens: 3},
+			"\nInput: 1+1",
+		},
+		{
+			"examples dropped in turns",
+			"{{examples .b}} {{examples .a}}",
+			map[string]any{"a": shots, "b": shots[:2]},
+			Options{MaxTokens: 13},
+			"Input: 2+2\nOutput: 4 Input: 2+2\nOutput: 4\n\nInput: 3*3\nOutput: 9",
+		},
+		{
+			"variable truncated",
+			"{{.doc}} Question: {{.q}}",
+			map[string]any{"doc": "one two three four five six", "q": "why"},
+			Options{MaxTokens: 6, Truncate: []string{"doc"}},
+			"one two three  Question: why",
+		},
+		{
+			"variables truncated in order",
+			"{{.a}}|{{.b}}",
+			map[string]any{"a": "a1 a2 a3", "b": "b1 b2 b3"},
+			Options{MaxTokens: 3, Truncate: []string{"b", "a"}},
+			"a1 |",
+		},
+		{
+			"examples dropped before truncating",
+			"{{.doc}}\n" + fewShot,
+			map[string]any{"doc": "some context", "shots": shots, "q": "1+1"},
+			Options{MaxTokens: 4, Truncate: []string{"doc"}},
+			"some \n\nInput: 1+1",
+		},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.Tokenizer = words{}
+		got, err := Must(Parse(tt.tmpl)).ExecuteWithOptions(tt.vars, opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if n, _ := count(words{}, got, true); opts.MaxTokens > 0 && n > opts.MaxTokens {
+			t.Errorf("%s: %d tokens, limit %d", tt.name, n, opts.MaxTokens)
+		}
+	}
+}
+
+func TestExecuteWithOptionsVars(t *testing.T) {
+	vars := map[string]any{"doc": "one two three", "shots": shots}
+	tmpl := Must(Parse("{{.doc}} {{examples .shots}}"))
+	if _, err := tmpl.ExecuteWithOptions(vars, Options{Tokenizer: words{}, MaxTokens: 2, Truncate: []string{"doc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if vars["doc"] != "one two three" || len(vars["shots"].([]Example)) != len(shots) {
+		t.Errorf("the variables were modified: %v", vars)
+	}
+}
+
+func TestExecuteWithOptionsErrors(t *testing.T) {
+	tmpl := Must(Parse("Answer briefly. {{.doc}}"))
+	vars := map[string]any{"doc": "a b c", "n": 3}
+
+	_, err := tmpl.ExecuteWithOptions(vars, Options{Tokenizer: words{}, MaxTokens: 2, Truncate: []string{"doc"}})
+	if !errors.Is(err, bindings.ErrPromptTooLong) {
+		t.Errorf("got %v, want ErrPromptTooLong", err)
+	}
+	if _, err := tmpl.ExecuteWithOptions(vars, Options{Tokenizer: words{}, MaxTokens: 4}); !errors.Is(err, bindings.ErrPromptTooLong) {
+		t.Errorf("got %v without Truncate, want ErrPromptTooLong", err)
+	}
+	if _, err := tmpl.ExecuteWithOptions(vars, Options{Tokenizer: words{}, MaxTokens: 3, Truncate: []string{"n"}}); err == nil {
+		t.Error("a number was truncated")
+	}
+	if _, err := tmpl.ExecuteWithOptions(vars, Options{MaxTokens: 3}); err == nil {
+		t.Error("no error without a tokenizer")
+	}
+}
+
+func TestCut(t *testing.T) {
+	tests := []struct {
+		text string
+		keep int
+		want string
+	}{
+		{"one two three", 2, "one two "},
+		{"one two three", 3, "one two three"},
+		{"one two three", 0, ""},
+		{"日本語 テキスト", 1, "日本語 "},
+	}
+	for _, tt := range tests {
+		got, err := cut(words{}, tt.text, tt.keep)
+		if err != nil || got != tt.want {
+			t.Errorf("cut(%q, %d) = %q, %v, want %q", tt.text, tt.keep, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package prompt
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Selector picks the few-shot examples of a pool whose inputs are the most
+// similar to the input at hand, as compared by their embeddings
+type Selector struct {
+	embedder   bindings.Embedder
+	pool       []Example
+	embeddings [][]float32
+}
+
+// NewSelector embeds the inputs of the examples in pool
+func NewSelector(embedder bindings.Embedder, pool []Example) (*Selector, error) {
+	if len(pool) == 0 {
+		return nil, errors.New("the pool of examples is empty")
+	}
+	s := &Selector{embedder: embedder, pool: slices.Clone(pool), embeddings: make([][]float32, len(pool))}
+	for i, e := range pool {
+		embedding, err := embedder.Embed(e.Input, bindings.EmbedOptions{})
+		if err != nil {
+			return nil, err
+		}
+		s.embeddings[i] = embedding
+	}
+	return s, nil
+}
+
+// Select returns the k examples most similar to input, the most similar
+// first, so that ExecuteWithOptions drops the least similar when the prompt
+// is too long
+func (s *Selector) Select(input string, k int) ([]Example, error) {
+	query, err := s.embedder.Embed(input, bindings.EmbedOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Embeddings are normalized, so the dot product is the cosine similarity
+	type hit struct {
+		example Example
+		score   float32
+	}
+	hits := make([]hit, len(s.pool))
+	for i, embedding := range s.embeddings {
+		var dot float32
+		for j := range min(len(query), len(embedding)) {
+			dot += query[j] * embedding[j]
+		}
+		hits[i] = hit{s.pool[i], dot}
+	}
+	slices.SortStableFunc(hits, func(a, b hit) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	examples := make([]Example, 0, max(0, min(k, len(hits))))
+	for _, h := range hits[:cap(examples)] {
+		examples = append(examples, h.example)
+	}
+	return examples, nil
+}
@@ -0,0 +1,89 @@
+package prompt
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/fake"
+)
+
+var pool = []Example{
+	{"what is the weather in Paris", "sunny"},
+	{"translate hello to French", "bonjour"},
+	{"what is the weather in Rome", "rainy"},
+	{"translate goodbye to German", "auf Wiedersehen"},
+	{"add two and three", "five"},
+}
+
+// failingEmbedder fails after embedding n texts
+type failingEmbedder struct{ n int }
+
+func (e *failingEmbedder) Embed(text string, opts bindings.EmbedOptions) ([]float32, error) {
+	if e.n == 0 {
+		return nil, errors.New("out of memory")
+	}
+	e.n--
+	return []float32{1}, nil
+}
+
+func TestSelect(t *testing.T) {
+	s, err := NewSelector(&fake.Embedder{}, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input string
+		k     int
+		want  []string // outputs
+	}{
+		{"what is the weather in Rome today", 2, []string{"rainy", "sunny"}},
+		{"translate thanks to French", 1, []string{"bonjour"}},
+		{"translate thanks to French", 2, []string{"bonjour", "auf Wiedersehen"}},
+		{"add two and three", 1, []string{"five"}},
+		{"add two and three", 0, []string{}},
+		{"add two and three", -1, []string{}},
+
+		// Ties keep the order of the pool
+		{"unrelated", 3, []string{"sunny", "bonjour", "rainy"}},
+		{"unrelated", 10, []string{"sunny", "bonjour", "rainy", "auf Wiedersehen", "five"}},
+	}
+	for _, tt := range tests {
+		examples, err := s.Select(tt.input, tt.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, e := range examples {
+			got = append(got, e.Output)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Select(%q, %d) = %q, want %q", tt.input, tt.k, got, tt.want)
+		}
+	}
+
+	// The selector keeps its own copy of the pool
+	p := slices.Clone(pool)
+	s, _ = NewSelector(&fake.Embedder{}, p)
+	p[0].Output = "changed"
+	if examples, _ := s.Select(pool[0].Input, 1); examples[0].Output != "sunny" {
+		t.Errorf("changing the pool changed the selector's example to %q", examples[0].Output)
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	if _, err := NewSelector(&fake.Embedder{}, nil); err == nil {
+		t.Error("no error for an empty pool")
+	}
+	if _, err := NewSelector(&failingEmbedder{n: 2}, pool); err == nil {
+		t.Error("no error when embedding the pool fails")
+	}
+	s, err := NewSelector(&failingEmbedder{n: len(pool)}, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Select("input", 1); err == nil {
+		t.Error("no error when embedding the input fails")
+	}
+}
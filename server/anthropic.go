@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+type anthropicMessage struct {
+	Role    string         `json:"role"`
+	Content messageContent `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        messageContent     `json:"system"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     *int               `json:"max_tokens"`
+	Temperature   *float32           `json:"temperature"`
+	TopP          *float32           `json:"top_p"`
+	StopSequences []string           `json:"stop_sequences"`
+	Stream        bool               `json:"stream"`
+}
+
+type anthropicContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	Role         string             `json:"role"`
+	Model        string             `json:"model"`
+	Content      []anthropicContent `json:"content"`
+	StopReason   *string            `json:"stop_reason"`
+	StopSequence *string            `json:"stop_sequence"`
+	Usage        anthropicUsage     `json:"usage"`
+}
+
+// writeAnthropicError reports err in the format of the Anthropic API
+func writeAnthropicError(w http.ResponseWriter, err error) {
+	typ := "api_error"
+	switch {
+	case errors.As(err, new(*requestError)):
+		typ = "invalid_request_error"
+	case errors.Is(err, errLoading):
+		typ = "overloaded_error"
+	}
+	writeJSON(w, errorStatus(err), map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": typ, "message": err.Error()},
+	})
+}
+
+// stopReason maps a finish reason to the stop_reason of the Anthropic API.
+// Generation doesn't tell a stop sequence from end-of-generation, so both
+// are reported as end_turn. Timeouts cut the reply short like max_tokens.
+func stopReason(reason bindings.FinishReason) string {
+	switch reason {
+	case bindings.FinishLength, bindings.FinishTimeout:
+		return "max_tokens"
+	case finishContentFilter:
+		return "refusal"
+	}
+	return "end_turn"
+}
+
+// handleMessages serves /v1/messages in the shape of the Anthropic Messages
+// API, streaming its sequence of typed events when asked to
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	var req anthropicRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+	if req.MaxTokens == nil {
+		writeAnthropicError(w, &requestError{param: "max_tokens", message: "max_tokens: field required"})
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeAnthropicError(w, &requestError{param: "messages", message: "messages: at least one message is required"})
+		return
+	}
+
+	var messages []bindings.ChatMessage
+	if req.System != "" {
+		messages = append(messages, bindings.ChatMessage{Role: bindings.RoleSystem, Content: string(req.System)})
+	}
+	for i, m := range req.Messages {
+		if m.Role != bindings.RoleUser && m.Role != bindings.RoleAssistant {
+			writeAnthropicError(w, &requestError{message: fmt.Sprintf("messages.%d.role: must be user or assistant", i)})
+			return
+		}
+		messages = append(messages, bindings.ChatMessage{Role: m.Role, Content: string(m.Content)})
+	}
+
+	sampling := &samplingRequest{
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxTokens,
+		Stop:        req.StopSequences,
+	}
+
+	messages, err := s.screen(messages)
+	if err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+	if err := s.lock(r); err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+	defer s.unlock()
+
+	prompt, err := s.ctx.Model().ApplyChatTemplate(s.withSystem(messages), true)
+	if err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+
+	msg := anthropicResponse{
+		ID:      newID("msg_"),
+		Type:    "message",
+		Role:    bindings.RoleAssistant,
+		Model:   s.cfg.ModelName,
+		Content: []anthropicContent{},
+	}
+
+	if !req.Stream {
+		result, err := s.generate(r, prompt, sampling, nil, false)
+		if err != nil {
+			writeAnthropicError(w, err)
+			return
+		}
+		reason := stopReason(result.FinishReason)
+		msg.Content = append(msg.Content, anthropicContent{Type: "text", Text: result.Text})
+		msg.StopReason = &reason
+		msg.Usage = anthropicUsage{InputTokens: result.PromptTokens, OutputTokens: result.CompletionTokens}
+		writeJSON(w, http.StatusOK, msg)
+		return
+	}
+
+	// message_start reports the input tokens, so they are counted up front.
+	// The events are only sent once generation has started so that invalid
+	// options can still be reported with a 400.
+	tokens, err := s.tokenize(prompt)
+	if err != nil {
+		writeAnthropicError(w, err)
+		return
+	}
+	msg.Usage.InputTokens = len(tokens)
+
+	stream := newEventStream(w)
+	start := func() {
+		if stream.started {
+			return
+		}
+		stream.sendEvent("message_start", map[string]any{"type": "message_start", "message": msg})
+		stream.sendEvent("content_block_start", map[string]any{
+			"type": "content_block_start", "index": 0, "content_block": anthropicContent{Type: "text"},
+		})
+		stream.sendEvent("ping", map[string]any{"type": "ping"})
+	}
+
+	result, err := s.generate(r, prompt, sampling, func(piece string) {
+		start()
+		stream.sendEvent("content_block_delta", map[string]any{
+			"type": "content_block_delta", "index": 0, "delta": map[string]string{"type": "text_delta", "text": piece},
+		})
+	}, true)
+	if err != nil {
+		if !stream.started {
+			writeAnthropicError(w, err)
+		} else {
+			stream.sendEvent("error", map[string]any{
+				"type": "error", "error": map[string]string{"type": "api_error", "message": err.Error()},
+			})
+		}
+		return
+	}
+
+	start()
+	stream.sendEvent("content_block_stop", map[string]any{"type": "content_block_stop", "index": 0})
+	stream.sendEvent("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason(result.FinishReason), "stop_sequence": nil},
+		"usage": map[string]int{"output_tokens": result.CompletionTokens},
+	})
+	stream.sendEvent("message_stop", map[string]any{"type": "message_stop"})
+}
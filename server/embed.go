@@ -0,0 +1,299 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// embedder coalesces embedding requests arriving within
+// Config.EmbedBatchWindow of each other into shared EmbedMany calls and
+// caches the embeddings of recent inputs
+type embedder struct {
+	mu      sync.Mutex
+	pending map[bindings.EmbedOptions][]*embedJob
+	cache   *embedCache
+}
+
+// embedJob is the uncached inputs of a request waiting to be embedded
+type embedJob struct {
+	inputs []string
+	out    []embedding
+	err    error
+	done   chan struct{}
+}
+
+// embedding is an embedding with the number of tokens of its input
+type embedding struct {
+	values []float32
+	tokens int
+}
+
+// handleEmbeddings serves /v1/embeddings
+func (s *Server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model          string          `json:"model"`
+		Input          json.RawMessage `json:"input"`
+		EncodingFormat string          `json:"encoding_format"`
+		Dimensions     int             `json:"dimensions"`
+	}
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	inputs, err := embedInputs(req.Input)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		writeError(w, &requestError{param: "encoding_format", message: "encoding_format must be float or base64"})
+		return
+	}
+
+	embeddings, err := s.embed(r, inputs, bindings.EmbedOptions{Normalize: bindings.NormalizeEuclidean, Dimensions: req.Dimensions})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data := make([]map[string]any, len(embeddings))
+	for i, e := range embeddings {
+		var v any = e
+		if req.EncodingFormat == "base64" {
+			v = encodeFloats(e)
+		}
+		data[i] = map[string]any{"object": "embedding", "index": i, "embedding": v}
+	}
+	tokens := recordOf(r).PromptTokens
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data":   data,
+		"model":  s.cfg.ModelName,
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
+
+// embedInputs parses an input field holding a string or a list of them
+func embedInputs(raw json.RawMessage) ([]string, error) {
+	var inputs []string
+	if err := json.Unmarshal(raw, &inputs); err != nil {
+		var one string
+		if err := json.Unmarshal(raw, &one); err != nil {
+			return nil, &requestError{param: "input", message: "input must be a string or a list of strings"}
+		}
+		inputs = []string{one}
+	}
+	return inputs, nil
+}
+
+// encodeFloats returns the little-endian float32s of e in base64, the
+// compact encoding the OpenAI SDKs ask for by default
+func encodeFloats(e []float32) string {
+	b := make([]byte, 4*len(e))
+	for i, x := range e {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// embed returns the embeddings of inputs, taking those it has seen recently
+// from the cache and evaluating the others together with those of requests
+// arriving at the same time. Their token counts are added to the record.
+func (s *Server) embed(r *http.Request, inputs []string, opts bindings.EmbedOptions) ([][]float32, error) {
+	if len(inputs) == 0 {
+		return nil, &requestError{param: "input", message: "input must not be empty"}
+	}
+	if opts.Dimensions < 0 {
+		return nil, &requestError{param: "dimensions", message: "dimensions must be positive"}
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	tokens := 0
+	job := &embedJob{done: make(chan struct{})}
+	var missing []int
+	for i, text := range inputs {
+		if e, ok := s.embedder.cache.get(opts, text); ok {
+			embeddings[i] = e.values
+			tokens += e.tokens
+			continue
+		}
+		missing = append(missing, i)
+		job.inputs = append(job.inputs, text)
+	}
+
+	if len(job.inputs) > 0 {
+		if err := s.submit(r, opts, job); err != nil {
+			return nil, err
+		}
+		for k, i := range missing {
+			e := job.out[k]
+			embeddings[i] = e.values
+			tokens += e.tokens
+			s.embedder.cache.put(opts, inputs[i], e)
+		}
+	}
+
+	rec := recordOf(r)
+	rec.Model = s.cfg.ModelName
+	rec.PromptTokens = tokens
+	return embeddings, nil
+}
+
+// submit embeds the inputs of job. The first request of a batch waits for
+// the batch window, then evaluates the inputs of every request that joined
+// meanwhile.
+func (s *Server) submit(r *http.Request, opts bindings.EmbedOptions, job *embedJob) error {
+	if s.cfg.EmbedBatchWindow <= 0 {
+		s.run(r, opts, []*embedJob{job})
+		return job.err
+	}
+
+	e := &s.embedder
+	e.mu.Lock()
+	e.pending[opts] = append(e.pending[opts], job)
+	leader := len(e.pending[opts]) == 1
+	e.mu.Unlock()
+
+	if leader {
+		time.Sleep(s.cfg.EmbedBatchWindow)
+		e.mu.Lock()
+		jobs := e.pending[opts]
+		delete(e.pending, opts)
+		e.mu.Unlock()
+		s.run(r, opts, jobs)
+	}
+	<-job.done
+	return job.err
+}
+
+// run embeds the inputs of jobs in one call. If that fails, the jobs are
+// tried one by one so that an invalid input fails only its own request.
+func (s *Server) run(r *http.Request, opts bindings.EmbedOptions, jobs []*embedJob) {
+	defer func() {
+		for _, job := range jobs {
+			close(job.done)
+		}
+	}()
+
+	if err := s.lock(r); err != nil {
+		for _, job := range jobs {
+			job.err = err
+		}
+		return
+	}
+	defer s.unlock()
+
+	var texts []string
+	for _, job := range jobs {
+		texts = append(texts, job.inputs...)
+	}
+	out, err := s.embedTexts(texts, opts)
+	if err == nil {
+		for _, job := range jobs {
+			job.out, out = out[:len(job.inputs)], out[len(job.inputs):]
+		}
+		return
+	}
+	if len(jobs) == 1 {
+		jobs[0].err = err
+		return
+	}
+	for _, job := range jobs {
+		job.out, job.err = s.embedTexts(job.inputs, opts)
+	}
+}
+
+// embedTexts evaluates texts on the model; the caller must hold the lock
+func (s *Server) embedTexts(texts []string, opts bindings.EmbedOptions) ([]embedding, error) {
+	out := make([]embedding, len(texts))
+	err := s.exclusive(func(ctx *bindings.Context) error {
+		if n := ctx.Model().EmbeddingSize(); opts.Dimensions > n {
+			return &requestError{param: "dimensions", message: fmt.Sprintf("dimensions must be at most %d", n)}
+		}
+		embeddings, err := ctx.EmbedMany(texts, opts)
+		if errors.Is(err, bindings.ErrPromptTooLong) {
+			return &requestError{param: "input", message: "input is too long"}
+		}
+		if err != nil {
+			return err
+		}
+		for i, text := range texts {
+			tokens, _ := ctx.Model().Tokenize(text, true, true)
+			out[i] = embedding{values: embeddings[i], tokens: len(tokens)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// embedCache is an LRU cache of embeddings keyed by a hash of the input and
+// the options. A nil cache holds nothing.
+type embedCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key [sha256.Size]byte
+	embedding
+}
+
+func newEmbedCache(size int) *embedCache {
+	if size <= 0 {
+		return nil
+	}
+	return &embedCache{size: size, order: list.New(), entries: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+func cacheKey(opts bindings.EmbedOptions, text string) [sha256.Size]byte {
+	return sha256.Sum256(fmt.Appendf(nil, "%d:%d:%s", opts.Normalize, opts.Dimensions, text))
+}
+
+func (c *embedCache) get(opts bindings.EmbedOptions, text string) (embedding, bool) {
+	if c == nil {
+		return embedding{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey(opts, text)]
+	if !ok {
+		return embedding{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).embedding, true
+}
+
+func (c *embedCache) put(opts bindings.EmbedOptions, text string, e embedding) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(opts, text)
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, embedding: e})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
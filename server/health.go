@@ -0,0 +1,60 @@
+package server
+
+import "net/http"
+
+// status is the body of /health and /ready
+type status struct {
+	Status     string `json:"status"` // "loading" or "ok"
+	Model      string `json:"model"`
+	Queue      int    `json:"queue"` // requests waiting for a slot
+	SlotsIdle  int    `json:"slots_idle"`
+	SlotsTotal int    `json:"slots_total"`
+
+	// DraftAcceptance is the share of draft tokens accepted so far, when
+	// decoding speculatively
+	DraftAcceptance *float64 `json:"draft_acceptance_rate,omitempty"`
+
+	// DraftAccepted is the mean number of tokens accepted per draft
+	DraftAccepted *float64 `json:"draft_accepted_per_step,omitempty"`
+}
+
+func (s *Server) status() status {
+	st := status{Status: "loading", Model: s.cfg.ModelName, Queue: int(s.waiting.Load()), SlotsTotal: 1}
+	if sched := s.sched.Load(); sched != nil {
+		st.Status = "ok"
+		st.Queue += sched.Queued()
+		st.SlotsTotal = sched.Slots()
+		st.SlotsIdle = sched.Slots() - sched.Active()
+	} else if s.loaded.Load() {
+		st.Status = "ok"
+		if !s.busy.Load() {
+			st.SlotsIdle = 1
+		}
+	}
+	if drafted := s.drafted.Load(); drafted > 0 {
+		rate := float64(s.accepted.Load()) / float64(drafted)
+		st.DraftAcceptance = &rate
+	}
+	if drafts := s.drafts.Load(); drafts > 0 {
+		perStep := float64(s.accepted.Load()) / float64(drafts)
+		st.DraftAccepted = &perStep
+	}
+	return st
+}
+
+// handleHealth is the liveness probe. It succeeds while the model is still
+// loading so that a slow load doesn't get the process restarted.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+// handleReady is the readiness probe. It fails with 503 until the model is
+// loaded, keeping traffic away until requests can be served.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	st := s.status()
+	code := http.StatusOK
+	if st.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
@@ -0,0 +1,95 @@
+//go:build !nollama
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// testModel loads the model named by ALPACA_TEST_MODEL, by default the one
+// make test downloads, and skips the test without it
+func testModel(t *testing.T) *bindings.Model {
+	t.Helper()
+	path := os.Getenv("ALPACA_TEST_MODEL")
+	if path == "" {
+		path = "../models/stories260K.gguf"
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Skipf("set ALPACA_TEST_MODEL to run this test: %v", err)
+	}
+	m, err := bindings.LoadModel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Free)
+	return m
+}
+
+func testServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	c, err := bindings.NewContext(testModel(t), bindings.ContextParams{ContextSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Free)
+	cfg.Defaults = bindings.DefaultGenerateOptions()
+	return New(c, cfg)
+}
+
+// complete sends a greedy completion request in conversation conv
+func complete(t *testing.T, s *Server, conv, prompt string) completionResponse {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"prompt": prompt, "max_tokens": 8, "temperature": 0})
+	r := httptest.NewRequest("POST", "/v1/completions", bytes.NewReader(body))
+	if conv != "" {
+		r.Header.Set(conversationHeader, conv)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp completionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCompletions(t *testing.T) {
+	s := testServer(t, Config{})
+	resp := complete(t, s, "", "Once upon a time")
+	if len(resp.Choices) != 1 || resp.Usage == nil || resp.Usage.CompletionTokens == 0 || resp.Usage.CompletionTokens > 8 {
+		t.Errorf("response %+v", resp)
+	}
+}
+
+func TestConversationState(t *testing.T) {
+	dir := t.TempDir()
+	s := testServer(t, Config{StateDir: dir})
+
+	a := "Once upon a time, there was a little girl"
+	complete(t, s, "a", a)
+	complete(t, s, "b", "The dog ran to the park and")
+	// Conversation a is restored from the file saved when b took over
+	resp := complete(t, s, "a", a)
+	if resp.Usage.PromptTokensDetails.CachedTokens == 0 {
+		t.Error("the restored conversation was evaluated again")
+	}
+
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	for _, conv := range []string{"a", "b"} {
+		if _, err := os.Stat(s.statePath(conv)); err != nil {
+			t.Errorf("conversation %s: %v", conv, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JobID identifies a background generation
+type JobID string
+
+// JobStatus is the state of a background generation, named as in the
+// OpenAI batch API
+type JobStatus string
+
+const (
+	JobInProgress JobStatus = "in_progress" // waiting for the model or generating
+	JobCompleted  JobStatus = "completed"   // the endpoint answered with a success status
+	JobFailed     JobStatus = "failed"      // the endpoint answered with an error
+	JobCancelled  JobStatus = "cancelled"   // Cancel was called before the job finished
+)
+
+// defaultJobRetention is how long finished jobs are kept without
+// Config.JobRetention
+const defaultJobRetention = time.Hour
+
+// jobEndpoints are the endpoints a job may run
+var jobEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/messages":         true,
+}
+
+var (
+	errUnknownJob = errors.New("job not found")
+	errJobRunning = errors.New("job is still in progress")
+)
+
+// Job describes a background generation
+type Job struct {
+	ID          JobID     `json:"id"`
+	Object      string    `json:"object"`
+	Endpoint    string    `json:"endpoint"`
+	Status      JobStatus `json:"status"`
+	CreatedAt   int64     `json:"created_at"`
+	CompletedAt int64     `json:"completed_at,omitempty"`
+}
+
+// job is a background generation and, once it is done, the response of its
+// endpoint
+type job struct {
+	Job
+	cancel context.CancelFunc
+	done   chan struct{}
+	status int
+	body   []byte
+}
+
+// jobs holds the background generations, finished ones until they expire
+type jobs struct {
+	mu   sync.Mutex
+	byID map[JobID]*job
+}
+
+// jobWriter keeps the response of a job's endpoint
+type jobWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobWriter) Header() http.Header { return w.header }
+
+func (w *jobWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *jobWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// StartGeneration runs a request to a generation endpoint in the
+// background, detached from any connection, and returns its ID to poll
+// Status and fetch the Result with. body is the request body as the
+// endpoint takes it, without streaming.
+func (s *Server) StartGeneration(endpoint string, body []byte) (JobID, error) {
+	if !jobEndpoints[endpoint] {
+		return "", &requestError{param: "endpoint", message: "endpoint must be /v1/chat/completions, /v1/completions or /v1/messages"}
+	}
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", &requestError{param: "body", message: "invalid request body: " + err.Error()}
+	}
+	if req.Stream {
+		return "", &requestError{param: "body", message: "jobs can't stream, stream must be false"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	j := &job{
+		Job:    Job{ID: JobID(newID("job_")), Object: "job", Endpoint: endpoint, Status: JobInProgress, CreatedAt: time.Now().Unix()},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	s.jobs.mu.Lock()
+	s.expireJobs()
+	s.jobs.byID[j.ID] = j
+	s.jobs.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		w := &jobWriter{header: make(http.Header)}
+		s.ServeHTTP(w, r)
+
+		s.jobs.mu.Lock()
+		defer s.jobs.mu.Unlock()
+		j.status, j.body = cmp.Or(w.status, http.StatusOK), w.body.Bytes()
+		switch {
+		case j.Status == JobCancelled:
+		case j.status >= http.StatusBadRequest:
+			j.Status = JobFailed
+		default:
+			j.Status = JobCompleted
+		}
+		j.CompletedAt = time.Now().Unix()
+		close(j.done)
+	}()
+	return j.ID, nil
+}
+
+// Status returns the state of a job
+func (s *Server) Status(id JobID) (Job, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	s.expireJobs()
+	j, ok := s.jobs.byID[id]
+	if !ok {
+		return Job{}, errUnknownJob
+	}
+	return j.Job, nil
+}
+
+// Result returns the status code and body the endpoint of a finished job
+// answered with. A cancelled job has the reply generated until then.
+func (s *Server) Result(id JobID) (int, []byte, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	s.expireJobs()
+	j, ok := s.jobs.byID[id]
+	if !ok {
+		return 0, nil, errUnknownJob
+	}
+	select {
+	case <-j.done:
+		return j.status, j.body, nil
+	default:
+		return 0, nil, errJobRunning
+	}
+}
+
+// Cancel stops a job. Cancelling a finished job changes nothing.
+func (s *Server) Cancel(id JobID) (Job, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	j, ok := s.jobs.byID[id]
+	if !ok {
+		return Job{}, errUnknownJob
+	}
+	if j.Status == JobInProgress {
+		j.Status = JobCancelled
+		j.cancel()
+	}
+	return j.Job, nil
+}
+
+// expireJobs forgets jobs finished longer than the retention ago; s.jobs.mu
+// must be held
+func (s *Server) expireJobs() {
+	retention := s.cfg.JobRetention
+	if retention <= 0 {
+		retention = defaultJobRetention
+	}
+	cutoff := time.Now().Add(-retention).Unix()
+	for id, j := range s.jobs.byID {
+		if j.CompletedAt != 0 && j.CompletedAt < cutoff {
+			delete(s.jobs.byID, id)
+		}
+	}
+}
+
+// handleCreateJob serves POST /v1/jobs, starting a job from an endpoint and
+// a request body in the shape of the lines of an OpenAI batch file
+func (s *Server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Endpoint string          `json:"endpoint"`
+		Body     json.RawMessage `json:"body"`
+	}
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	id, err := s.StartGeneration(req.Endpoint, req.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	job, err := s.Status(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleJob serves GET /v1/jobs/{id}
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.Status(JobID(r.PathValue("id")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleJobResult serves GET /v1/jobs/{id}/result, the response of the
+// job's endpoint as it would have been sent
+func (s *Server) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	status, body, err := s.Result(JobID(r.PathValue("id")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// handleCancelJob serves POST /v1/jobs/{id}/cancel
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.Cancel(JobID(r.PathValue("id")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
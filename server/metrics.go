@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// sample is a value of a metric, with its labels in the exposition format
+type sample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes a metric in the Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %g\n", name, s.labels, s.value)
+	}
+}
+
+// handleMetrics serves GET /metrics for Prometheus: the requests waiting,
+// the slots, the time spent in llama.cpp and how much the reuse of cached
+// prompts saves
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	st := s.status()
+	stats := bindings.ReadInferenceStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "alpaca_queue_requests", "gauge", "Requests waiting for a slot.", sample{value: float64(st.Queue)})
+	writeMetric(w, "alpaca_slots", "gauge", "Generation slots.", sample{value: float64(st.SlotsTotal)})
+	writeMetric(w, "alpaca_slots_idle", "gauge", "Generation slots without a generation.", sample{value: float64(st.SlotsIdle)})
+
+	phases := []struct {
+		name  string
+		stats bindings.PhaseStats
+	}{{"prefill", stats.Prefill}, {"decode", stats.Decode}, {"sample", stats.Sample}}
+	calls, tokens, seconds := make([]sample, len(phases)), make([]sample, len(phases)), make([]sample, len(phases))
+	for i, p := range phases {
+		labels := fmt.Sprintf("{phase=%q}", p.name)
+		calls[i] = sample{labels, float64(p.stats.Calls)}
+		tokens[i] = sample{labels, float64(p.stats.Tokens)}
+		seconds[i] = sample{labels, p.stats.Time.Seconds()}
+	}
+	writeMetric(w, "alpaca_inference_calls_total", "counter", "Calls into llama.cpp per phase of inference.", calls...)
+	writeMetric(w, "alpaca_inference_tokens_total", "counter", "Tokens processed per phase of inference.", tokens...)
+	writeMetric(w, "alpaca_inference_seconds_total", "counter", "Time spent in llama.cpp per phase of inference.", seconds...)
+
+	cache := stats.PromptCache
+	writeMetric(w, "alpaca_prompt_cache_hits_total", "counter", "Prompts that reused tokens held in the KV cache.", sample{value: float64(cache.Hits)})
+	writeMetric(w, "alpaca_prompt_cache_misses_total", "counter", "Prompts evaluated from the start.", sample{value: float64(cache.Misses)})
+	writeMetric(w, "alpaca_prompt_tokens_total", "counter", "Prompt tokens of all prompts.", sample{value: float64(cache.Tokens)})
+	writeMetric(w, "alpaca_prompt_cache_tokens_total", "counter", "Prompt tokens reused from the KV cache instead of evaluated.", sample{value: float64(cache.Saved)})
+
+	writeMetric(w, "alpaca_draft_tokens_total", "counter", "Tokens proposed by the draft model.", sample{value: float64(s.drafted.Load())})
+	writeMetric(w, "alpaca_draft_accepted_tokens_total", "counter", "Draft tokens the served model accepted.", sample{value: float64(s.accepted.Load())})
+	writeMetric(w, "alpaca_drafts_total", "counter", "Drafts the served model checked.", sample{value: float64(s.drafts.Load())})
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Filter screens text for Config.InputFilter and Config.OutputFilter. It
+// returns allow to let the text through unchanged; otherwise replacement is
+// used instead, and an empty replacement rejects an input.
+type Filter func(text string) (allow bool, replacement string)
+
+// finishContentFilter is the finish reason of replies stopped by
+// Config.OutputFilter, as in the OpenAI API
+const finishContentFilter bindings.FinishReason = "content_filter"
+
+// errFiltered is returned for requests rejected by Config.InputFilter
+var errFiltered = &requestError{code: "content_filter", message: "the request was rejected by the content filter"}
+
+// screen passes the content of the user messages through Config.InputFilter
+func (s *Server) screen(messages []bindings.ChatMessage) ([]bindings.ChatMessage, error) {
+	if s.cfg.InputFilter == nil {
+		return messages, nil
+	}
+	screened := make([]bindings.ChatMessage, len(messages))
+	for i, m := range messages {
+		if m.Role == bindings.RoleUser {
+			text, err := s.screenText(m.Content)
+			if err != nil {
+				return nil, err
+			}
+			m.Content = text
+		}
+		screened[i] = m
+	}
+	return screened, nil
+}
+
+// screenText passes a prompt through Config.InputFilter
+func (s *Server) screenText(text string) (string, error) {
+	if s.cfg.InputFilter == nil || text == "" {
+		return text, nil
+	}
+	allow, replacement := s.cfg.InputFilter(text)
+	switch {
+	case allow:
+		return text, nil
+	case replacement == "":
+		return "", errFiltered
+	}
+	return replacement, nil
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/grammar"
+)
+
+// ollamaVersion is reported by /api/version. Clients check it before using
+// newer endpoints such as /api/embed.
+const ollamaVersion = "0.5.0"
+
+// ollamaOptions are the model options of Ollama requests that map to the
+// overrides the OpenAI handlers accept
+type ollamaOptions struct {
+	Temperature *float32 `json:"temperature"`
+	TopP        *float32 `json:"top_p"`
+	NumPredict  *int     `json:"num_predict"` // -1 generates until the context is full
+	Stop        stopList `json:"stop"`
+	Seed        *int64   `json:"seed"`
+
+	FrequencyPenalty *float32 `json:"frequency_penalty"`
+	PresencePenalty  *float32 `json:"presence_penalty"`
+}
+
+func (o *ollamaOptions) sampling() *samplingRequest {
+	req := &samplingRequest{
+		Temperature:      o.Temperature,
+		TopP:             o.TopP,
+		Stop:             o.Stop,
+		Seed:             o.Seed,
+		FrequencyPenalty: o.FrequencyPenalty,
+		PresencePenalty:  o.PresencePenalty,
+	}
+	if o.NumPredict != nil && *o.NumPredict >= 0 {
+		req.MaxTokens = o.NumPredict
+	}
+	return req
+}
+
+// ollamaFormat is "json" or a JSON schema
+type ollamaFormat json.RawMessage
+
+func (f *ollamaFormat) UnmarshalJSON(data []byte) error {
+	*f = append((*f)[:0], data...)
+	return nil
+}
+
+// grammar returns the grammar enforcing the format, "" for none
+func (f ollamaFormat) grammar() (string, error) {
+	if len(f) == 0 || string(f) == "null" || string(f) == `""` {
+		return "", nil
+	}
+	if string(f) == `"json"` {
+		return grammar.JSON, nil
+	}
+	g, err := grammar.FromJSONSchema(f)
+	if err != nil {
+		return "", &requestError{param: "format", message: "unsupported format: " + err.Error()}
+	}
+	return g, nil
+}
+
+type ollamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	System  string        `json:"system"`
+	Raw     bool          `json:"raw"` // the prompt is used as is, without the chat template
+	Stream  *bool         `json:"stream"`
+	Format  ollamaFormat  `json:"format"`
+	Options ollamaOptions `json:"options"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream"`
+	Format   ollamaFormat    `json:"format"`
+	Options  ollamaOptions   `json:"options"`
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ollamaResponse is a streamed piece of a reply or, with Done set, the
+// final message with the statistics of the request. Durations are in
+// nanoseconds.
+type ollamaResponse struct {
+	Model     string         `json:"model"`
+	CreatedAt time.Time      `json:"created_at"`
+	Response  *string        `json:"response,omitempty"`
+	Message   *ollamaMessage `json:"message,omitempty"`
+	Done      bool           `json:"done"`
+
+	DoneReason         string `json:"done_reason,omitempty"`
+	TotalDuration      int64  `json:"total_duration,omitempty"`
+	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int    `json:"eval_count,omitempty"`
+	EvalDuration       int64  `json:"eval_duration,omitempty"`
+}
+
+// registerOllama adds the Ollama API to the server's routes
+func (s *Server) registerOllama() {
+	s.mux.HandleFunc("POST /api/generate", s.handleOllamaGenerate)
+	s.mux.HandleFunc("POST /api/chat", s.handleOllamaChat)
+	s.mux.HandleFunc("POST /api/embed", s.handleOllamaEmbed)
+	s.mux.HandleFunc("POST /api/embeddings", s.handleOllamaEmbeddings)
+	s.mux.HandleFunc("GET /api/tags", s.handleOllamaTags)
+	s.mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"version": ollamaVersion})
+	})
+}
+
+// writeOllamaError reports err in the format of the Ollama API
+func writeOllamaError(w http.ResponseWriter, err error) {
+	writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+}
+
+func (s *Server) handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"models": []map[string]any{
+			{"name": s.cfg.ModelName, "model": s.cfg.ModelName, "modified_at": time.Time{}, "size": 0, "digest": ""},
+		},
+	})
+}
+
+func (s *Server) handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	var req ollamaGenerateRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	var messages []bindings.ChatMessage
+	if req.System != "" {
+		messages = append(messages, bindings.ChatMessage{Role: bindings.RoleSystem, Content: req.System})
+	}
+	messages = append(messages, bindings.ChatMessage{Role: bindings.RoleUser, Content: req.Prompt})
+
+	messages, err := s.screen(messages)
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	s.ollamaReply(w, r, req.Stream, req.Format, &req.Options, func(model *bindings.Model) (string, error) {
+		if req.Raw {
+			return messages[len(messages)-1].Content, nil
+		}
+		return model.ApplyChatTemplate(s.withSystem(messages), true)
+	}, func(text string) ollamaResponse {
+		return ollamaResponse{Response: &text}
+	})
+}
+
+func (s *Server) handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	var req ollamaChatRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeOllamaError(w, &requestError{param: "messages", message: "messages must not be empty"})
+		return
+	}
+
+	messages := make([]bindings.ChatMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = bindings.ChatMessage{Role: m.Role, Content: m.Content}
+	}
+
+	messages, err := s.screen(messages)
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	s.ollamaReply(w, r, req.Stream, req.Format, &req.Options, func(model *bindings.Model) (string, error) {
+		return model.ApplyChatTemplate(s.withSystem(messages), true)
+	}, func(text string) ollamaResponse {
+		return ollamaResponse{Message: &ollamaMessage{Role: bindings.RoleAssistant, Content: text}}
+	})
+}
+
+// ollamaReply generates for /api/generate and /api/chat, which only differ
+// in how the prompt is built and where the text goes in a response.
+// Ollama streams unless told otherwise, as lines of JSON.
+func (s *Server) ollamaReply(w http.ResponseWriter, r *http.Request, stream *bool, format ollamaFormat, options *ollamaOptions,
+	prompt func(*bindings.Model) (string, error), response func(text string) ollamaResponse) {
+	start := time.Now()
+	req := options.sampling()
+	g, err := format.grammar()
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	req.grammar = g
+
+	if err := s.lock(r); err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	defer s.unlock()
+
+	text, err := prompt(s.ctx.Model())
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	streaming := stream == nil || *stream
+	started := false
+	send := func(resp ollamaResponse) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		resp.Model, resp.CreatedAt = s.cfg.ModelName, time.Now().UTC()
+		data, _ := json.Marshal(resp)
+		w.Write(append(data, '\n'))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	result, err := s.generate(r, text, req, func(piece string) {
+		send(response(piece))
+	}, streaming)
+	if err != nil {
+		if !started {
+			writeOllamaError(w, err)
+		}
+		return
+	}
+
+	final := response("")
+	if !streaming {
+		final = response(result.Text)
+	}
+	rec := recordOf(r)
+	final.Done = true
+	final.DoneReason = string(result.FinishReason)
+	final.TotalDuration = int64(time.Since(start))
+	final.PromptEvalCount = result.PromptTokens
+	final.PromptEvalDuration = int64(rec.Prompt)
+	final.EvalCount = result.CompletionTokens
+	final.EvalDuration = int64(rec.Generation)
+
+	if streaming {
+		send(final)
+		return
+	}
+	final.Model, final.CreatedAt = s.cfg.ModelName, time.Now().UTC()
+	writeJSON(w, http.StatusOK, final)
+}
+
+// handleOllamaEmbed serves /api/embed, which takes one or more inputs and
+// returns normalized embeddings
+func (s *Server) handleOllamaEmbed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string          `json:"model"`
+		Input json.RawMessage `json:"input"`
+	}
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	inputs, err := embedInputs(req.Input)
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	embeddings, err := s.embed(r, inputs, bindings.EmbedOptions{Normalize: bindings.NormalizeEuclidean})
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"model": s.cfg.ModelName, "embeddings": embeddings})
+}
+
+// handleOllamaEmbeddings serves the older /api/embeddings, which embeds a
+// single prompt without normalizing
+func (s *Server) handleOllamaEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model  string `json:"model"`
+		Prompt string `json:"prompt"`
+	}
+	if err := decodeRequest(r, &req); err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	embeddings, err := s.embed(r, []string{req.Prompt}, bindings.EmbedOptions{})
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"embedding": embeddings[0]})
+}
@@ -0,0 +1,585 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/jsonstream"
+)
+
+// chatMessage is a message of a response or a streamed delta
+type chatMessage struct {
+	Role      string     `json:"role,omitempty"`
+	Content   *string    `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+
+	// JSONEvents are the values of a JSON reply the content completes, sent
+	// with stream_options.json_events
+	JSONEvents []jsonstream.Event `json:"json_events,omitempty"`
+}
+
+// requestMessage is a message of the conversation sent with a request
+type requestMessage struct {
+	Role       string         `json:"role"`
+	Content    messageContent `json:"content"`
+	ToolCalls  []toolCall     `json:"tool_calls"`
+	ToolCallID string         `json:"tool_call_id"`
+}
+
+// messageContent is a string, null or a list of content parts of which only
+// text parts are supported
+type messageContent string
+
+func (c *messageContent) UnmarshalJSON(data []byte) error {
+	var text *string
+	if err := json.Unmarshal(data, &text); err == nil {
+		if text != nil {
+			*c = messageContent(*text)
+		}
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or a list of content parts")
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		if p.Type != "text" {
+			return fmt.Errorf("content parts of type %q are not supported", p.Type)
+		}
+		b.WriteString(p.Text)
+	}
+	*c = messageContent(b.String())
+	return nil
+}
+
+type chatRequest struct {
+	Model    string           `json:"model"`
+	Messages []requestMessage `json:"messages"`
+
+	ResponseFormat *responseFormat `json:"response_format"`
+	Tools          []tool          `json:"tools"`
+	ToolChoice     *toolChoice     `json:"tool_choice"`
+	StreamOptions  *streamOptions  `json:"stream_options"`
+	samplingRequest
+}
+
+type completionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        string         `json:"prompt"`
+	Suffix        string         `json:"suffix"`
+	StreamOptions *streamOptions `json:"stream_options"`
+	samplingRequest
+}
+
+// streamOptions is the stream_options field of streamed requests
+type streamOptions struct {
+	// IncludeUsage sends a last chunk with the token usage and no choices
+	IncludeUsage bool `json:"include_usage"`
+
+	// JSONEvents, an alpaca extension, sends a reply in a JSON response
+	// format in chunks ending where values do, each listing the values it
+	// completes
+	JSONEvents bool `json:"json_events"`
+}
+
+func (o *streamOptions) includeUsage() bool {
+	return o != nil && o.IncludeUsage
+}
+
+func (o *streamOptions) jsonEvents() bool {
+	return o != nil && o.JSONEvents
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"` // prompt tokens reused from the KV cache
+	} `json:"prompt_tokens_details"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *usage       `json:"usage,omitempty"`
+}
+
+type completionChoice struct {
+	Index        int     `json:"index"`
+	Text         string  `json:"text"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *usage             `json:"usage,omitempty"`
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data": []map[string]any{
+			{"id": s.cfg.ModelName, "object": "model", "created": 0, "owned_by": "alpaca"},
+		},
+	})
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req chatRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, &requestError{param: "messages", message: "messages must not be empty"})
+		return
+	}
+
+	g, err := req.ResponseFormat.grammar()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	req.grammar = g
+
+	tools, err := newToolSet(req.Tools, req.ToolChoice)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if tools != nil {
+		g, lazy, err := tools.grammar()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		switch {
+		case lazy && (g == "" || req.grammar != ""):
+			// The response format constrains the whole reply instead
+		case req.grammar != "":
+			writeError(w, &requestError{param: "response_format", message: "response_format can't be combined with a required tool call"})
+			return
+		case lazy:
+			req.grammar, req.grammarTriggers = g, []string{toolCallOpen}
+		default:
+			req.grammar = g
+		}
+	}
+
+	messages := make([]bindings.ChatMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = toolMessage(m)
+	}
+
+	messages, err = s.screen(messages)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.lock(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	defer s.unlock()
+
+	var prompt string
+	if tools != nil {
+		prompt, err = tools.prompt(s.ctx.Model(), s.withSystem(messages))
+	} else {
+		prompt, err = s.ctx.Model().ApplyChatTemplate(s.withSystem(messages), true)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, created := newID("chatcmpl-"), time.Now().Unix()
+	chunk := func(delta *chatMessage, finish *string) chatResponse {
+		return chatResponse{
+			ID: id, Object: "chat.completion.chunk", Created: created, Model: s.cfg.ModelName,
+			Choices: []chatChoice{{Delta: delta, FinishReason: finish}},
+		}
+	}
+
+	// The first chunk carries the role. It is only sent once generation has
+	// started so that invalid options can still be reported with a 400.
+	var stream *eventStream
+	if req.Stream {
+		stream = newEventStream(w)
+	}
+	sendRole := func() {
+		if !stream.started {
+			empty := ""
+			stream.send(chunk(&chatMessage{Role: bindings.RoleAssistant, Content: &empty}, nil))
+		}
+	}
+	// With json_events, content is held back until it completes a value.
+	// Parse errors, such as those of a reply cut off by a stop sequence,
+	// only end the events.
+	var parser *jsonstream.Parser
+	var pending strings.Builder
+	var events []jsonstream.Event
+	if req.Stream && req.StreamOptions.jsonEvents() && g != "" {
+		parser = jsonstream.NewParser(func(e jsonstream.Event) {
+			events = append(events, e)
+		})
+	}
+	sendContent := func(text string) {
+		sendRole()
+		if parser != nil {
+			pending.WriteString(text)
+			parser.WriteString(text)
+			if len(events) == 0 {
+				return
+			}
+			text = pending.String()
+			pending.Reset()
+		}
+		stream.send(chunk(&chatMessage{Content: &text, JSONEvents: events}, nil))
+		events = nil
+	}
+	flushContent := func() {
+		if parser == nil {
+			return
+		}
+		parser.Close()
+		if pending.Len() > 0 || len(events) > 0 {
+			text := pending.String()
+			stream.send(chunk(&chatMessage{Content: &text, JSONEvents: events}, nil))
+		}
+		parser = nil
+	}
+
+	// With tools, the start of the reply is held back until it is clear that
+	// it isn't a tool call, which is only sent once complete
+	var held strings.Builder
+	streamContent := tools == nil
+	result, err := s.generate(r, prompt, &req.samplingRequest, func(piece string) {
+		if streamContent {
+			sendContent(piece)
+			return
+		}
+		held.WriteString(piece)
+		if !mayBeToolCall(held.String()) {
+			streamContent = true
+			sendContent(held.String())
+		}
+	}, stream != nil)
+	if err != nil {
+		// Once streaming has started the status can't be changed
+		if stream == nil || !stream.started {
+			writeError(w, err)
+		} else {
+			stream.fail(err)
+		}
+		return
+	}
+
+	content, calls := result.Text, []toolCall(nil)
+	if tools != nil {
+		content, calls = tools.parse(result.Text)
+	}
+	finish := string(result.FinishReason)
+	if len(calls) > 0 && result.FinishReason == bindings.FinishStop {
+		finish = "tool_calls"
+	}
+
+	if stream != nil {
+		if !streamContent && len(calls) == 0 {
+			sendContent(held.String())
+		}
+		if !streamContent && content != "" && len(calls) > 0 {
+			sendContent(content)
+		}
+		flushContent()
+		for i, call := range calls {
+			call.Index = &i
+			sendRole()
+			stream.send(chunk(&chatMessage{ToolCalls: []toolCall{call}}, nil))
+		}
+		sendRole()
+		stream.send(chunk(&chatMessage{}, &finish))
+		if req.StreamOptions.includeUsage() {
+			final := chunk(nil, nil)
+			final.Choices, final.Usage = []chatChoice{}, usageOf(result)
+			stream.send(final)
+		}
+		stream.done()
+		return
+	}
+
+	msg := &chatMessage{Role: bindings.RoleAssistant, ToolCalls: calls}
+	if content != "" || len(calls) == 0 {
+		msg.Content = &content
+	}
+	writeJSON(w, http.StatusOK, chatResponse{
+		ID: id, Object: "chat.completion", Created: created, Model: s.cfg.ModelName,
+		Choices: []chatChoice{{
+			Message:      msg,
+			FinishReason: &finish,
+		}},
+		Usage: usageOf(result),
+	})
+}
+
+func (s *Server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	var req completionRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Prompt == "" && req.Suffix == "" {
+		writeError(w, &requestError{param: "prompt", message: "prompt must not be empty"})
+		return
+	}
+
+	prompt, err := s.screenText(req.Prompt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	suffix, err := s.screenText(req.Suffix)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := s.lock(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	defer s.unlock()
+
+	if req.Suffix != "" {
+		// Code completion between the text before and after the cursor
+		var ok bool
+		if prompt, ok = s.ctx.Model().FIMPrompt(prompt, suffix); !ok {
+			writeError(w, &requestError{param: "suffix", message: "the model does not support fill-in-the-middle, suffix must be empty"})
+			return
+		}
+	}
+
+	id, created := newID("cmpl-"), time.Now().Unix()
+	chunk := func(text string, finish *string) completionResponse {
+		return completionResponse{
+			ID: id, Object: "text_completion", Created: created, Model: s.cfg.ModelName,
+			Choices: []completionChoice{{Text: text, FinishReason: finish}},
+		}
+	}
+
+	var stream *eventStream
+	if req.Stream {
+		stream = newEventStream(w)
+	}
+
+	result, err := s.generate(r, prompt, &req.samplingRequest, func(piece string) {
+		stream.send(chunk(piece, nil))
+	}, stream != nil)
+	if err != nil {
+		if stream == nil || !stream.started {
+			writeError(w, err)
+		} else {
+			stream.fail(err)
+		}
+		return
+	}
+
+	finish := string(result.FinishReason)
+	if stream != nil {
+		stream.send(chunk("", &finish))
+		if req.StreamOptions.includeUsage() {
+			final := chunk("", nil)
+			final.Choices, final.Usage = []completionChoice{}, usageOf(result)
+			stream.send(final)
+		}
+		stream.done()
+		return
+	}
+
+	resp := chunk(result.Text, &finish)
+	resp.Usage = usageOf(result)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// tokenize converts a prompt into the tokens generation evaluates
+func (s *Server) tokenize(prompt string) ([]bindings.Token, error) {
+	return s.ctx.Model().TokenizeWithOptions(prompt, bindings.TokenizeOptions{
+		AddBOS:       s.cfg.Defaults.AddBOS,
+		AddEOS:       s.cfg.Defaults.AddEOS,
+		ParseSpecial: true,
+	})
+}
+
+// generate runs the prompt with the request's options. onToken is only
+// used when streaming. The caller must hold s.mu.
+func (s *Server) generate(r *http.Request, prompt string, req *samplingRequest, onToken func(string), streaming bool) (*bindings.GenerateResult, error) {
+	tokens, err := s.tokenize(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	sched := s.sched.Load()
+	nCtx := s.ctx.Size()
+	if sched != nil {
+		nCtx = sched.SlotSize()
+	}
+	opts, err := s.generateOptions(req, len(tokens), nCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.draft != nil && sched == nil {
+		spec := s.cfg.Speculative
+		spec.Draft = s.draft
+		if opts.Grammar != "" {
+			// Lenient verification may accept tokens the grammar forbids
+			spec.Verify, spec.AcceptProbability = bindings.VerifySampled, 0
+		}
+		opts.Speculative = &spec
+	}
+
+	opts.OnPrefill = req.onPrefill
+
+	// Config.OutputFilter stops generation through the context once it
+	// rejects the reply so far
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var reply strings.Builder
+	var filtered bool
+	var replacement string
+
+	// The first token ends prompt evaluation
+	start := time.Now()
+	var first time.Time
+	opts.OnToken = func(piece string) {
+		if first.IsZero() {
+			first = time.Now()
+		}
+		if filtered {
+			return
+		}
+		if s.cfg.OutputFilter != nil {
+			reply.WriteString(piece)
+			if allow, repl := s.cfg.OutputFilter(reply.String()); !allow {
+				filtered, replacement = true, repl
+				cancel()
+				return
+			}
+		}
+		if streaming {
+			onToken(piece)
+		}
+	}
+
+	var result *bindings.GenerateResult
+	if sched != nil {
+		result, err = sched.Generate(ctx, prompt, opts)
+	} else {
+		result, err = s.ctx.Generate(ctx, prompt, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filtered {
+		result.Text, result.FinishReason = replacement, finishContentFilter
+		if streaming && replacement != "" {
+			onToken(replacement)
+		}
+	}
+
+	rec := recordOf(r)
+	if first.IsZero() {
+		rec.Prompt = time.Since(start)
+	} else {
+		rec.Prompt, rec.Generation = first.Sub(start), time.Since(first)
+	}
+	recordResult(r, s.cfg.ModelName, result)
+	s.drafted.Add(int64(result.DraftTokens))
+	s.accepted.Add(int64(result.AcceptedTokens))
+	s.drafts.Add(int64(result.DraftSteps))
+	return result, nil
+}
+
+func usageOf(result *bindings.GenerateResult) *usage {
+	u := &usage{
+		PromptTokens:     result.PromptTokens,
+		CompletionTokens: result.CompletionTokens,
+		TotalTokens:      result.TotalTokens(),
+	}
+	u.PromptTokensDetails.CachedTokens = result.CachedTokens
+	return u
+}
+
+// eventStream writes server-sent events. Streams of the OpenAI API end with
+// a [DONE] message.
+type eventStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	return &eventStream{w: w}
+}
+
+func (e *eventStream) send(v any) {
+	e.sendEvent("", v)
+}
+
+// sendEvent sends v as an event of the given type, or an unnamed one
+func (e *eventStream) sendEvent(event string, v any) {
+	if !e.started {
+		e.w.Header().Set("Content-Type", "text/event-stream")
+		e.w.Header().Set("Cache-Control", "no-cache")
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+
+	if event != "" {
+		fmt.Fprintf(e.w, "event: %s\n", event)
+	}
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(e.w, "data: %s\n\n", data)
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// fail ends a stream that has started with an error chunk, so that clients
+// see why it ended before the terminating [DONE]
+func (e *eventStream) fail(err error) {
+	e.send(map[string]any{"error": apiErrorOf(err)})
+	e.done()
+}
+
+func (e *eventStream) done() {
+	fmt.Fprint(e.w, "data: [DONE]\n\n")
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/grammar"
+)
+
+// maxStop is the number of stop sequences a request may pass, as in the
+// OpenAI API
+const maxStop = 4
+
+// samplingRequest holds the request fields that override Config.Defaults.
+// Pointers tell fields that were left out from zero values.
+type samplingRequest struct {
+	Temperature         *float32 `json:"temperature"`
+	TopP                *float32 `json:"top_p"`
+	MaxTokens           *int     `json:"max_tokens"`
+	MaxCompletionTokens *int     `json:"max_completion_tokens"`
+	Stop                stopList `json:"stop"`
+	Seed                *int64   `json:"seed"`
+	Stream              bool     `json:"stream"`
+	FrequencyPenalty    *float32 `json:"frequency_penalty"`
+	PresencePenalty     *float32 `json:"presence_penalty"`
+
+	// LogitBias maps tokens to a bias between -100 and 100. Keys are token
+	// IDs of the model's vocabulary, or text whose tokens are all biased.
+	LogitBias map[string]float32 `json:"logit_bias"`
+
+	// grammar constrains the output, set from response_format or the
+	// tools. With grammarTriggers it only applies from one of them on.
+	grammar         string
+	grammarTriggers []string
+
+	// onPrefill reports the progress of prompt evaluation, if set
+	onPrefill func(done, total int)
+}
+
+// responseFormat is the response_format field of chat requests
+type responseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict bool            `json:"strict"`
+	} `json:"json_schema"`
+}
+
+// grammar returns the grammar enforcing the format, "" for plain text
+func (f *responseFormat) grammar() (string, error) {
+	if f == nil {
+		return "", nil
+	}
+
+	switch f.Type {
+	case "", "text":
+		return "", nil
+	case "json_object":
+		return grammar.JSON, nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return "", &requestError{param: "response_format.json_schema", message: "json_schema.schema is required"}
+		}
+		g, err := grammar.FromJSONSchema(f.JSONSchema.Schema)
+		if err != nil {
+			return "", &requestError{param: "response_format.json_schema", message: "unsupported schema: " + err.Error()}
+		}
+		return g, nil
+	}
+	return "", &requestError{param: "response_format.type", message: fmt.Sprintf("unknown response format %q", f.Type)}
+}
+
+// stopList is the stop field, which may be a string or a list of strings
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = stopList{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or a list of strings")
+	}
+	*s = many
+	return nil
+}
+
+// logitBias maps the logit_bias field of a request onto the model's tokens.
+// -100 bans a token as it does in the OpenAI API.
+func (s *Server) logitBias(req map[string]float32) (map[bindings.Token]float32, error) {
+	model := s.ctx.Model()
+	bias := make(map[bindings.Token]float32)
+	for key, b := range req {
+		if b < -100 || b > 100 {
+			return nil, &requestError{param: "logit_bias", message: "logit_bias values must be between -100 and 100"}
+		}
+		if b == -100 {
+			b = float32(math.Inf(-1))
+		}
+
+		var tokens []bindings.Token
+		if id, err := strconv.Atoi(key); err == nil {
+			if id < 0 || id >= model.VocabSize() {
+				return nil, &requestError{param: "logit_bias", message: fmt.Sprintf("token %d is not in the vocabulary", id)}
+			}
+			tokens = []bindings.Token{bindings.Token(id)}
+		} else if tokens, err = model.Tokenize(key, false, true); err != nil {
+			return nil, err
+		}
+		for _, t := range tokens {
+			bias[t] = b
+		}
+	}
+	return bias, nil
+}
+
+// generateOptions applies the overrides in req to the defaults and enforces
+// the limits for a prompt of promptTokens tokens in a context of nCtx
+func (s *Server) generateOptions(req *samplingRequest, promptTokens, nCtx int) (bindings.GenerateOptions, error) {
+	opts := s.cfg.Defaults
+	opts.Stop = append([]string(nil), opts.Stop...)
+
+	if t := req.Temperature; t != nil {
+		if *t < 0 || *t > 2 {
+			return opts, &requestError{param: "temperature", message: "temperature must be between 0 and 2"}
+		}
+		opts.Temperature = *t
+	}
+	if p := req.TopP; p != nil {
+		if *p <= 0 || *p > 1 {
+			return opts, &requestError{param: "top_p", message: "top_p must be greater than 0 and at most 1"}
+		}
+		opts.TopP = *p
+	}
+	if p := req.FrequencyPenalty; p != nil {
+		if *p < -2 || *p > 2 {
+			return opts, &requestError{param: "frequency_penalty", message: "frequency_penalty must be between -2 and 2"}
+		}
+		opts.FrequencyPenalty = *p
+	}
+	if p := req.PresencePenalty; p != nil {
+		if *p < -2 || *p > 2 {
+			return opts, &requestError{param: "presence_penalty", message: "presence_penalty must be between -2 and 2"}
+		}
+		opts.PresencePenalty = *p
+	}
+	if req.grammar != "" {
+		opts.Grammar, opts.Regex = req.grammar, ""
+		opts.GrammarTriggers = req.grammarTriggers
+	}
+	if req.Seed != nil {
+		// The API allows any integer, the sampler takes 32 bits of it
+		opts.Seed = uint32(*req.Seed)
+	}
+	if len(req.LogitBias) > 0 {
+		bias, err := s.logitBias(req.LogitBias)
+		if err != nil {
+			return opts, err
+		}
+		opts.LogitBias = bias
+	}
+	if len(req.Stop) > maxStop {
+		return opts, &requestError{param: "stop", message: fmt.Sprintf("at most %d stop sequences are allowed", maxStop)}
+	}
+	if len(req.Stop) > 0 {
+		opts.Stop = append(opts.Stop, req.Stop...)
+	}
+
+	// max_completion_tokens replaced max_tokens in the chat API, it wins
+	// when both are given
+	requested, param := req.MaxTokens, "max_tokens"
+	if req.MaxCompletionTokens != nil {
+		requested, param = req.MaxCompletionTokens, "max_completion_tokens"
+	}
+	if requested != nil {
+		if *requested < 1 {
+			return opts, &requestError{param: param, message: param + " must be at least 1"}
+		}
+		opts.MaxTokens = *requested
+	}
+	if limit := s.cfg.Limits.MaxTokens; limit > 0 && (opts.MaxTokens == 0 || opts.MaxTokens > limit) {
+		opts.MaxTokens = limit
+	}
+	if limit := s.cfg.Limits.MaxDuration; limit > 0 && (opts.MaxDuration == 0 || opts.MaxDuration > limit) {
+		opts.MaxDuration = limit
+	}
+
+	maxContext := nCtx
+	if limit := s.cfg.Limits.MaxContext; limit > 0 && limit < maxContext {
+		maxContext = limit
+	}
+	if promptTokens >= maxContext || (requested != nil && promptTokens+opts.MaxTokens > maxContext) {
+		return opts, &requestError{
+			code: "context_length_exceeded",
+			message: fmt.Sprintf("this model's maximum context length is %d tokens, the request needs %d (%d in the prompt, %d to generate)",
+				maxContext, promptTokens+opts.MaxTokens, promptTokens, opts.MaxTokens),
+		}
+	}
+	// Without an explicit request the completion is shortened to fit
+	if room := maxContext - promptTokens; opts.MaxTokens == 0 || opts.MaxTokens > room {
+		opts.MaxTokens = room
+	}
+
+	// The prompt was checked above and must not be truncated silently
+	opts.Truncate = bindings.TruncateError
+
+	return opts, nil
+}
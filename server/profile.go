@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Profile holds per-model defaults, applied whenever a request leaves the
+// corresponding field out. Nil fields keep Config.Defaults.
+type Profile struct {
+	// SystemPrompt is prepended to conversations without a system message
+	SystemPrompt string `json:"system_prompt,omitempty"`
+
+	// Stop is added to the stop sequences of every request, catching end of
+	// turn markers a model's template doesn't map to end-of-generation
+	Stop []string `json:"stop,omitempty"`
+
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	TopP          *float32 `json:"top_p,omitempty"`
+	MinP          *float32 `json:"min_p,omitempty"`
+	RepeatPenalty *float32 `json:"repeat_penalty,omitempty"`
+	MaxTokens     *int     `json:"max_tokens,omitempty"`
+}
+
+// Apply returns opts with the profile's defaults in place
+func (p Profile) Apply(opts bindings.GenerateOptions) bindings.GenerateOptions {
+	if p.Temperature != nil {
+		opts.Temperature = *p.Temperature
+	}
+	if p.TopK != nil {
+		opts.TopK = *p.TopK
+	}
+	if p.TopP != nil {
+		opts.TopP = *p.TopP
+	}
+	if p.MinP != nil {
+		opts.MinP = *p.MinP
+	}
+	if p.RepeatPenalty != nil {
+		opts.RepeatPenalty = *p.RepeatPenalty
+	}
+	if p.MaxTokens != nil {
+		opts.MaxTokens = *p.MaxTokens
+	}
+	opts.Stop = append(append([]string(nil), opts.Stop...), p.Stop...)
+	return opts
+}
+
+// Profiles maps model names to their profiles. A key matches every model
+// whose name contains it, ignoring case, and the longest matching key wins,
+// so "qwen2.5-coder" can refine "qwen".
+type Profiles map[string]Profile
+
+// DefaultProfiles are the settings recommended by the authors of common model
+// families
+var DefaultProfiles = Profiles{
+	"llama-3": {Stop: []string{"<|eot_id|>", "<|end_of_text|>"}, Temperature: ptr[float32](0.6), TopP: ptr[float32](0.9)},
+	"qwen":    {Stop: []string{"<|im_end|>", "<|endoftext|>"}, Temperature: ptr[float32](0.7), TopP: ptr[float32](0.8), TopK: ptr(20)},
+	"mistral": {Stop: []string{"</s>"}, Temperature: ptr[float32](0.7)},
+	"gemma":   {Stop: []string{"<end_of_turn>"}, Temperature: ptr[float32](1.0), TopK: ptr(64), TopP: ptr[float32](0.95)},
+	"phi-3":   {Stop: []string{"<|end|>", "<|endoftext|>"}},
+}
+
+// Lookup returns the profile for the named model
+func (ps Profiles) Lookup(model string) (Profile, bool) {
+	model = strings.ToLower(model)
+	best, found := "", false
+	for key := range ps {
+		if strings.Contains(model, strings.ToLower(key)) && (!found || len(key) > len(best)) {
+			best, found = key, true
+		}
+	}
+	return ps[best], found
+}
+
+// LoadProfiles reads profiles from a JSON file mapping model names to
+// profiles. They are merged over DefaultProfiles, replacing entries with the
+// same key.
+func LoadProfiles(path string) (Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded Profiles
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, err
+	}
+
+	ps := Profiles{}
+	for k, p := range DefaultProfiles {
+		ps[k] = p
+	}
+	for k, p := range loaded {
+		ps[k] = p
+	}
+	return ps, nil
+}
+
+// withSystem prepends the profile's system prompt to messages that don't
+// start with one
+func (s *Server) withSystem(messages []bindings.ChatMessage) []bindings.ChatMessage {
+	prompt := s.cfg.Profile.SystemPrompt
+	if prompt == "" || (len(messages) > 0 && messages[0].Role == bindings.RoleSystem) {
+		return messages
+	}
+	return append([]bindings.ChatMessage{{Role: bindings.RoleSystem, Content: prompt}}, messages...)
+}
+
+// systemPreamble returns the start of every chat prompt with the profile's
+// system prompt: what the chat template renders before the first user
+// message's content, found by rendering two that differ. It is "" without
+// a system prompt or when the template fails.
+func (s *Server) systemPreamble(model *bindings.Model) string {
+	if s.cfg.Profile.SystemPrompt == "" {
+		return ""
+	}
+	var prompts [2]string
+	for i, content := range []string{"a", "b"} {
+		p, err := model.ApplyChatTemplate(s.withSystem([]bindings.ChatMessage{{Role: bindings.RoleUser, Content: content}}), true)
+		if err != nil {
+			return ""
+		}
+		prompts[i] = p
+	}
+	n := 0
+	for n < len(prompts[0]) && n < len(prompts[1]) && prompts[0][n] == prompts[1][n] {
+		n++
+	}
+	return prompts[0][:n]
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
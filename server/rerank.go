@@ -0,0 +1,124 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// rerankDocument is a document to rerank, a string or an object with a text
+// field as Cohere clients send them
+type rerankDocument string
+
+func (d *rerankDocument) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*d = rerankDocument(text)
+		return nil
+	}
+	var obj struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.New("documents must be strings or objects with a text field")
+	}
+	*d = rerankDocument(obj.Text)
+	return nil
+}
+
+// rerankResult is a document's score in a /v1/rerank response
+type rerankResult struct {
+	Index          int               `json:"index"`
+	RelevanceScore float32           `json:"relevance_score"`
+	Document       map[string]string `json:"document,omitempty"`
+}
+
+// handleRerank serves /v1/rerank and /rerank in the shape of the Jina and
+// Cohere rerank APIs: the documents sorted by relevance to the query
+func (s *Server) handleRerank(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model           string           `json:"model"`
+		Query           string           `json:"query"`
+		Documents       []rerankDocument `json:"documents"`
+		TopN            int              `json:"top_n"`
+		ReturnDocuments bool             `json:"return_documents"`
+	}
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Query == "" {
+		writeError(w, &requestError{param: "query", message: "query must not be empty"})
+		return
+	}
+	if len(req.Documents) == 0 {
+		writeError(w, &requestError{param: "documents", message: "documents must not be empty"})
+		return
+	}
+	if req.TopN < 0 {
+		writeError(w, &requestError{param: "top_n", message: "top_n must be positive"})
+		return
+	}
+
+	docs := make([]string, len(req.Documents))
+	for i, d := range req.Documents {
+		docs[i] = string(d)
+	}
+
+	if err := s.lock(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	var scores []float32
+	tokens := 0
+	err := s.exclusive(func(ctx *bindings.Context) error {
+		var err error
+		scores, err = ctx.Rerank(req.Query, docs)
+		switch {
+		case errors.Is(err, bindings.ErrNotReranker):
+			return &requestError{param: "model", message: "the served model is not a reranker"}
+		case errors.Is(err, bindings.ErrPromptTooLong):
+			return &requestError{param: "documents", message: "query and document are too long"}
+		case err != nil:
+			return err
+		}
+		q, _ := ctx.Model().Tokenize(req.Query, false, false)
+		for _, doc := range docs {
+			d, _ := ctx.Model().Tokenize(doc, false, false)
+			tokens += len(q) + len(d)
+		}
+		return nil
+	})
+	s.unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rec := recordOf(r)
+	rec.Model = s.cfg.ModelName
+	rec.PromptTokens = tokens
+
+	results := make([]rerankResult, len(docs))
+	for i, score := range scores {
+		results[i] = rerankResult{Index: i, RelevanceScore: score}
+		if req.ReturnDocuments {
+			results[i].Document = map[string]string{"text": docs[i]}
+		}
+	}
+	slices.SortStableFunc(results, func(a, b rerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"model":   s.cfg.ModelName,
+		"results": results,
+		"usage":   map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
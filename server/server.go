@@ -0,0 +1,401 @@
+// Package server exposes a model over HTTP with an OpenAI-compatible API:
+// /v1/chat/completions, /v1/completions, /v1/embeddings and /v1/models, with
+// streaming through server-sent events. /v1/messages follows the Anthropic
+// Messages API, /v1/rerank the Jina and Cohere rerank APIs, and the Ollama
+// API can be enabled as well.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Config configures a Server
+type Config struct {
+	// ModelName is reported by /v1/models and in responses, defaults to
+	// "alpaca"
+	ModelName string
+
+	// Defaults are used for every field a request leaves out. Requests may
+	// override the sampling temperature, top_p, max_tokens, stop, seed, the
+	// frequency and presence penalties and the logit bias.
+	Defaults bindings.GenerateOptions
+
+	Limits Limits
+
+	// Profile holds defaults for the served model, such as a system prompt
+	// and its end of turn markers, applied on top of Defaults
+	Profile Profile
+
+	// UI serves a chat page at /, for trying out a deployment in a browser
+	UI bool
+
+	// Ollama also serves the Ollama API under /api, for clients written
+	// for it
+	Ollama bool
+
+	// Slots, when above 1, runs that many generations at once with
+	// continuous batching, each in a sequence of the context, which must
+	// have been created with at least as many. Conversation state and
+	// speculative decoding need a single slot.
+	Slots int
+
+	// Scheduler tunes how slots share decode steps, such as how much of
+	// new prompts is evaluated per step
+	Scheduler bindings.SchedulerOptions
+
+	// WarmSystemPrompt evaluates the profile's system prompt into idle
+	// slots ahead of requests, so that a new conversation's first token
+	// only waits for its own messages. It needs several slots and sets
+	// Scheduler.WarmPrompt unless that is set.
+	WarmSystemPrompt bool
+
+	// Speculative sets the draft length and threshold for speculative
+	// decoding, which is used once a draft context is set with SetDraft
+	Speculative bindings.SpeculativeOptions
+
+	// StateDir, if set, keeps the KV cache of every conversation on disk,
+	// keyed by the X-Conversation-ID request header, so that conversations
+	// and long system prompts survive restarts and other conversations
+	// using the model in between
+	StateDir string
+
+	// EmbedBatchWindow, if set, holds embedding requests for up to this
+	// long so that those arriving together are evaluated in shared batches,
+	// which raises the throughput of bulk ingestion. How many texts a decode
+	// holds is bounded by the batch size and the context's sequences.
+	EmbedBatchWindow time.Duration
+
+	// EmbedCacheSize keeps the embeddings of that many recent inputs, so
+	// that inputs seen again aren't evaluated again. 0 turns the cache off.
+	EmbedCacheSize int
+
+	// InputFilter, if set, screens the user messages of chat requests and
+	// the prompts of completions before generation. Rejected requests fail
+	// with status 400 and the content_filter error code.
+	InputFilter Filter
+
+	// OutputFilter, if set, screens the reply while it is generated,
+	// seeing the whole text so far after every token. Once it rejects it,
+	// generation stops with the content_filter finish reason and the reply
+	// becomes the replacement; when streaming, the text already sent stays
+	// and the replacement follows it.
+	OutputFilter Filter
+
+	// WebSocketOrigins lists the origins, such as "https://app.example.com",
+	// of other sites whose pages may open /v1/ws; "*" allows any. Browsers
+	// don't apply CORS to WebSockets, so without it only pages served by
+	// the server itself and clients sending no Origin, which browsers
+	// always do, may connect.
+	WebSocketOrigins []string
+
+	// JobRetention is how long the results of finished background jobs
+	// are kept for polling, 0 keeps them for an hour
+	JobRetention time.Duration
+
+	// Sink, if set, receives a Record with the token usage and latency of
+	// every request
+	Sink Sink
+}
+
+// Limits are upper bounds enforced on every request, whatever it asks for
+type Limits struct {
+	// MaxTokens caps the number of generated tokens, larger max_tokens
+	// values are lowered to it. 0 leaves it unbounded.
+	MaxTokens int
+
+	// MaxContext rejects requests whose prompt plus max_tokens exceed it.
+	// The context size always applies, 0 sets no further limit.
+	MaxContext int
+
+	// MaxDuration ends generations running longer than this, prompt
+	// evaluation included, with the "timeout" finish reason. 0 leaves them
+	// unbounded.
+	MaxDuration time.Duration
+
+	// MaxRequestBytes rejects request bodies larger than this with status
+	// 413 while they are read, so that a huge prompt is never buffered, let
+	// alone tokenized. 0 leaves them unbounded.
+	MaxRequestBytes int64
+}
+
+// Server serves a single model. With one slot requests are processed one at
+// a time since a context can only run one generation; with more they share
+// it through a bindings.Scheduler.
+type Server struct {
+	cfg     Config
+	mux     *http.ServeMux
+	handler http.Handler
+
+	// mu guards ctx, draft and conv. Requests hold it exclusively with one
+	// slot and shared with a scheduler, which serializes the context itself.
+	mu    sync.RWMutex
+	ctx   *bindings.Context
+	draft *bindings.Context
+	conv  string // conversation held by the KV cache of ctx
+	sched atomic.Pointer[bindings.Scheduler]
+
+	loaded  atomic.Bool
+	waiting atomic.Int32 // requests queued for the model
+	busy    atomic.Bool  // a request holds the model
+
+	embedder embedder
+	jobs     jobs
+
+	drafted  atomic.Int64 // draft tokens proposed since the start
+	accepted atomic.Int64 // draft tokens accepted since the start
+	drafts   atomic.Int64 // drafts since the start
+}
+
+// New creates a server generating with ctx. ctx may be nil to start serving
+// before the model is loaded: /health and /ready answer right away and other
+// requests fail with 503 until SetContext is called.
+func New(ctx *bindings.Context, cfg Config) *Server {
+	if cfg.ModelName == "" {
+		cfg.ModelName = "alpaca"
+	}
+	cfg.Defaults = cfg.Profile.Apply(cfg.Defaults)
+
+	s := &Server{cfg: cfg, ctx: ctx, mux: http.NewServeMux()}
+	s.embedder = embedder{pending: make(map[bindings.EmbedOptions][]*embedJob), cache: newEmbedCache(cfg.EmbedCacheSize)}
+	s.jobs.byID = make(map[JobID]*job)
+	s.loaded.Store(ctx != nil)
+	s.mux.HandleFunc("GET /health", s.handleHealth)
+	s.mux.HandleFunc("GET /ready", s.handleReady)
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+	s.mux.HandleFunc("POST /v1/chat/completions", s.handleChatCompletions)
+	s.mux.HandleFunc("POST /v1/completions", s.handleCompletions)
+	s.mux.HandleFunc("GET /v1/models", s.handleModels)
+	s.mux.HandleFunc("POST /v1/embeddings", s.handleEmbeddings)
+	s.mux.HandleFunc("POST /v1/rerank", s.handleRerank)
+	s.mux.HandleFunc("POST /rerank", s.handleRerank)
+	s.mux.HandleFunc("POST /v1/messages", s.handleMessages)
+	s.mux.HandleFunc("GET /v1/ws", s.handleWebSocket)
+	s.mux.HandleFunc("POST /v1/jobs", s.handleCreateJob)
+	s.mux.HandleFunc("GET /v1/jobs/{id}", s.handleJob)
+	s.mux.HandleFunc("GET /v1/jobs/{id}/result", s.handleJobResult)
+	s.mux.HandleFunc("POST /v1/jobs/{id}/cancel", s.handleCancelJob)
+	if cfg.Ollama {
+		s.registerOllama()
+	}
+	if cfg.UI {
+		s.mux.HandleFunc("GET /{$}", s.handleUI)
+	}
+
+	s.handler = s.mux
+	if cfg.Sink != nil {
+		s.handler = Middleware(cfg.Sink, s.mux)
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Handlers read timings back from the record, so there must be one even
+	// without the middleware
+	if _, ok := r.Context().Value(recordKey{}).(*Record); !ok {
+		r = r.WithContext(context.WithValue(r.Context(), recordKey{}, &Record{}))
+	}
+	if limit := s.cfg.Limits.MaxRequestBytes; limit > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// SetContext sets the context to generate with once the model is loaded and
+// marks the server ready. With several slots it starts scheduling on it.
+func (s *Server) SetContext(ctx *bindings.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.sched.Swap(nil); old != nil {
+		old.Close()
+	}
+	if ctx != nil && s.parallel() {
+		opts := s.cfg.Scheduler
+		if s.cfg.WarmSystemPrompt && opts.WarmPrompt == "" {
+			opts.WarmPrompt = s.systemPreamble(ctx.Model())
+		}
+		sched, err := bindings.NewSchedulerWithOptions(ctx, opts)
+		if err != nil {
+			return err
+		}
+		s.sched.Store(sched)
+	}
+	s.ctx = ctx
+	s.loaded.Store(ctx != nil)
+	if ctx != nil && s.cfg.StateDir != "" && !s.parallel() {
+		// Requests without a conversation ID pick up where they left off
+		s.conv = ""
+		s.restoreState()
+	}
+	return nil
+}
+
+// parallel reports whether requests share the model through a scheduler
+func (s *Server) parallel() bool {
+	return s.cfg.Slots > 1
+}
+
+// SetDraft sets the context of a draft model to decode speculatively with,
+// nil turns speculative decoding off
+func (s *Server) SetDraft(draft *bindings.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draft = draft
+}
+
+// errLoading is returned to requests arriving before the model is loaded
+var errLoading = errors.New("model is loading")
+
+// lock waits for the model, recording how long that took. It fails with
+// errLoading if the model isn't loaded yet; otherwise the caller must call
+// unlock.
+func (s *Server) lock(r *http.Request) error {
+	start := time.Now()
+	s.waiting.Add(1)
+	if s.parallel() {
+		s.mu.RLock()
+	} else {
+		s.mu.Lock()
+	}
+	s.waiting.Add(-1)
+	recordOf(r).Queue = time.Since(start)
+
+	if s.ctx == nil {
+		s.release()
+		return errLoading
+	}
+	if s.parallel() {
+		return nil
+	}
+	if err := s.switchConversation(conversationOf(r)); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.busy.Store(true)
+	return nil
+}
+
+func (s *Server) unlock() {
+	s.busy.Store(false)
+	s.release()
+}
+
+func (s *Server) release() {
+	if s.parallel() {
+		s.mu.RUnlock()
+	} else {
+		s.mu.Unlock()
+	}
+}
+
+// exclusive calls fn with the context while no generation runs on it
+func (s *Server) exclusive(fn func(*bindings.Context) error) error {
+	if sched := s.sched.Load(); sched != nil {
+		return sched.Do(fn)
+	}
+	return fn(s.ctx)
+}
+
+// apiError is the error body of the OpenAI API
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Param   string `json:"param,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// requestError is a problem with the request, reported with status 400
+// unless it sets another
+type requestError struct {
+	param   string
+	code    string
+	message string
+	status  int
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// decodeRequest reads the JSON body of a request into v
+func decodeRequest(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &requestError{code: "request_too_large", message: fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), status: http.StatusRequestEntityTooLarge}
+	case err != nil:
+		return &requestError{message: "invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// errorStatus returns the status code reporting err
+func errorStatus(err error) int {
+	var re *requestError
+	switch {
+	case errors.As(err, &re) && re.status != 0:
+		return re.status
+	case errors.As(err, &re):
+		return http.StatusBadRequest
+	case errors.Is(err, bindings.ErrInputTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, bindings.ErrNoDecoder), errors.Is(err, bindings.ErrNeedsEncode):
+		return http.StatusBadRequest
+	case errors.Is(err, errLoading):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errUnknownJob):
+		return http.StatusNotFound
+	case errors.Is(err, errJobRunning):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// apiErrorOf returns err in the format of the OpenAI API
+func apiErrorOf(err error) apiError {
+	body := apiError{Message: err.Error(), Type: "server_error"}
+	var re *requestError
+	switch {
+	case errors.As(err, &re):
+		body = apiError{Message: re.message, Type: "invalid_request_error", Param: re.param, Code: re.code}
+	case errors.Is(err, errLoading):
+		body.Type = "unavailable_error"
+	case errors.Is(err, errUnknownJob), errors.Is(err, errJobRunning):
+		body.Type = "invalid_request_error"
+	case errors.Is(err, bindings.ErrInputTooLarge):
+		body.Type, body.Code = "invalid_request_error", "request_too_large"
+	case errors.Is(err, bindings.ErrNoDecoder), errors.Is(err, bindings.ErrNeedsEncode):
+		body.Type, body.Code = "invalid_request_error", "model_not_supported"
+	}
+	return body
+}
+
+// writeError reports err in the format of the OpenAI API
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, errorStatus(err), map[string]any{"error": apiErrorOf(err)})
+}
+
+// newID returns a random identifier with the given prefix
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
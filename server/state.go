@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// conversationHeader names the conversation a request continues. With
+// Config.StateDir set, the KV cache of each conversation is kept on disk
+// while others use the model and across restarts.
+const conversationHeader = "X-Conversation-ID"
+
+// conversationOf returns the conversation ID of a request, "" for none
+func conversationOf(r *http.Request) string {
+	return r.Header.Get(conversationHeader)
+}
+
+// statePath returns the file holding the KV cache of a conversation. Names
+// are hashed together with the model name so that any ID makes a valid file
+// name and a different model never loads another's state.
+func (s *Server) statePath(conv string) string {
+	sum := sha256.Sum256([]byte(s.cfg.ModelName + "\x00" + conv))
+	return filepath.Join(s.cfg.StateDir, hex.EncodeToString(sum[:16])+".state")
+}
+
+// switchConversation saves the KV cache of the current conversation and
+// restores the one of conv, if it was saved before. The cache is left as is
+// for a new conversation, so a shared system prompt is still reused. It
+// must be called with mu held.
+func (s *Server) switchConversation(conv string) error {
+	if s.cfg.StateDir == "" || s.parallel() || conv == s.conv {
+		return nil
+	}
+	if err := s.saveState(); err != nil {
+		return err
+	}
+	s.conv = conv
+	s.restoreState()
+	return nil
+}
+
+func (s *Server) saveState() error {
+	if err := os.MkdirAll(s.cfg.StateDir, 0o755); err != nil {
+		return err
+	}
+	return s.ctx.SavePromptCache(s.statePath(s.conv))
+}
+
+// restoreState loads the saved KV cache of the current conversation. When
+// that fails the conversation is evaluated again, and a file that will
+// never load, e.g. one cut short by a crash or saved by a release with
+// another state format, is removed.
+func (s *Server) restoreState() {
+	path := s.statePath(s.conv)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	err := s.ctx.LoadPromptCache(path)
+	if err == nil {
+		return
+	}
+	remove := unloadable(err)
+	slog.Warn("restoring the conversation state failed, evaluating it again", "path", path, "error", err, "removed", remove)
+	if remove {
+		os.Remove(path)
+	}
+}
+
+// unloadable reports whether err, from LoadPromptCache, means the file can
+// never be loaded, rather than that reading it failed this time
+func unloadable(err error) bool {
+	return errors.Is(err, bindings.ErrStateIncompatible) || errors.Is(err, bindings.ErrStateCorrupt)
+}
+
+// SaveState writes the KV cache of the conversation using the model to
+// Config.StateDir, for calling on shutdown. The other conversations were
+// saved when they were switched away from. It waits for a running request
+// to finish and does nothing without a StateDir.
+func (s *Server) SaveState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.StateDir == "" || s.parallel() || s.ctx == nil {
+		return nil
+	}
+	return s.saveState()
+}
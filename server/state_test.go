@@ -0,0 +1,27 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+func TestUnloadable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: saved with another model", bindings.ErrStateIncompatible), true},
+		{fmt.Errorf("%w: conv.state is truncated", bindings.ErrStateCorrupt), true},
+		{&fs.PathError{Op: "open", Path: "conv.state", Err: fs.ErrPermission}, false},
+		{errors.New("prompt cache of 300 tokens does not fit in a context of 256"), false},
+	}
+	for _, tt := range tests {
+		if got := unloadable(tt.err); got != tt.want {
+			t.Errorf("unloadable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/grammar"
+)
+
+// Tool calls are written in the format of Hermes and Qwen models, which most
+// other models follow when the tools are described in the system prompt:
+//
+//	<tool_call>
+//	{"name": "get_weather", "arguments": {"city": "Paris"}}
+//	</tool_call>
+const (
+	toolCallOpen  = "<tool_call>"
+	toolCallClose = "</tool_call>"
+
+	// mistralToolCalls starts the list of calls Mistral models produce
+	mistralToolCalls = "[TOOL_CALLS]"
+)
+
+type tool struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type toolCall struct {
+	Index    *int             `json:"index,omitempty"` // only in streamed deltas
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"` // JSON encoded, as in the OpenAI API
+}
+
+// toolChoice is "none", "auto", "required" or the name of a function that
+// must be called
+type toolChoice struct {
+	mode     string
+	function string
+}
+
+func (c *toolChoice) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.mode); err == nil {
+		switch c.mode {
+		case "none", "auto", "required":
+			return nil
+		}
+		return fmt.Errorf("unknown tool_choice %q", c.mode)
+	}
+
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil || named.Function.Name == "" {
+		return fmt.Errorf("tool_choice must be a string or name a function")
+	}
+	c.mode, c.function = "function", named.Function.Name
+	return nil
+}
+
+// toolSet is the tools a request may call
+type toolSet struct {
+	tools  []tool
+	choice toolChoice
+}
+
+// newToolSet validates the tools of a request. It returns nil when no tool
+// may be called.
+func newToolSet(tools []tool, choice *toolChoice) (*toolSet, error) {
+	ts := &toolSet{tools: tools, choice: toolChoice{mode: "auto"}}
+	if choice != nil {
+		ts.choice = *choice
+	}
+	if len(tools) == 0 {
+		if ts.choice.mode == "required" || ts.choice.mode == "function" {
+			return nil, &requestError{param: "tool_choice", message: "tool_choice requires tools"}
+		}
+		return nil, nil
+	}
+	if ts.choice.mode == "none" {
+		return nil, nil
+	}
+
+	for i, t := range tools {
+		if t.Type != "function" || t.Function.Name == "" {
+			return nil, &requestError{param: fmt.Sprintf("tools[%d]", i), message: "tools must be functions with a name"}
+		}
+	}
+	if ts.choice.mode == "function" && ts.find(ts.choice.function) == nil {
+		return nil, &requestError{param: "tool_choice", message: fmt.Sprintf("tool_choice names unknown function %q", ts.choice.function)}
+	}
+	return ts, nil
+}
+
+func (ts *toolSet) find(name string) *tool {
+	for i := range ts.tools {
+		if ts.tools[i].Function.Name == name {
+			return &ts.tools[i]
+		}
+	}
+	return nil
+}
+
+// prompt formats the conversation with the tool definitions. Templates that
+// know about tools receive them as the tools variable; for all others they
+// are described in the system prompt. The templates render the tools through
+// their JSON encoding, which keeps the properties of the schemas in order.
+func (ts *toolSet) prompt(model *bindings.Model, messages []bindings.ChatMessage) (string, error) {
+	prompt, err := model.RenderChatTemplate(messages, true, map[string]any{"tools": ts.tools})
+	if err == nil && strings.Contains(prompt, ts.tools[0].Function.Name) {
+		return prompt, nil
+	}
+
+	var desc strings.Builder
+	desc.WriteString("You have access to the following tools:\n\n<tools>\n")
+	for _, t := range ts.tools {
+		data, _ := json.Marshal(t)
+		desc.Write(data)
+		desc.WriteString("\n")
+	}
+	desc.WriteString("</tools>\n\nTo call a tool, reply with a JSON object holding its name and arguments inside tool_call tags:\n")
+	desc.WriteString(toolCallOpen + "\n{\"name\": <function-name>, \"arguments\": <arguments-object>}\n" + toolCallClose)
+
+	withTools := make([]bindings.ChatMessage, 0, len(messages)+1)
+	if len(messages) > 0 && messages[0].Role == bindings.RoleSystem {
+		withTools = append(withTools, bindings.ChatMessage{Role: bindings.RoleSystem, Content: messages[0].Content + "\n\n" + desc.String()})
+		messages = messages[1:]
+	} else {
+		withTools = append(withTools, bindings.ChatMessage{Role: bindings.RoleSystem, Content: desc.String()})
+	}
+	// Templates without tool support rarely know the tool role
+	for _, m := range messages {
+		if m.Role == "tool" {
+			m = bindings.ChatMessage{Role: bindings.RoleUser, Content: "<tool_response>\n" + m.Content + "\n</tool_response>"}
+		}
+		withTools = append(withTools, writeToolCalls(m))
+	}
+	return model.ApplyChatTemplate(withTools, true)
+}
+
+// grammar returns the grammar of tool calls. When tool_choice requires a
+// call the reply must match it; otherwise it is lazy, the reply being free
+// until the model starts a call with toolCallOpen, so that calls to the
+// request's functions are valid whenever the model makes one.
+func (ts *toolSet) grammar() (g string, lazy bool, err error) {
+	lazy = ts.choice.mode != "required" && ts.choice.mode != "function"
+
+	// Written by hand so that the name comes before the arguments
+	var calls []string
+	for _, t := range ts.tools {
+		if ts.choice.mode == "function" && t.Function.Name != ts.choice.function {
+			continue
+		}
+		params := json.RawMessage(`{"type": "object"}`)
+		if len(t.Function.Parameters) > 0 {
+			params = t.Function.Parameters
+		}
+		name, _ := json.Marshal(t.Function.Name)
+		calls = append(calls, fmt.Sprintf(`{"type": "object", "properties": {"name": {"const": %s}, "arguments": %s}, "required": ["name", "arguments"]}`, name, params))
+	}
+	schema := []byte(`{"anyOf": [` + strings.Join(calls, ", ") + `]}`)
+
+	// The calls are the root of the schema grammar, which becomes one rule
+	g, err = grammar.FromJSONSchema(schema)
+	if err != nil && lazy {
+		// Calls are only parsed then, as without a grammar
+		return "", lazy, nil
+	}
+	if err != nil {
+		return "", false, &requestError{param: "tools", message: "unsupported parameters schema: " + err.Error()}
+	}
+	g = strings.Replace(g, "root ::=", "tool-call ::=", 1)
+	block := grammar.Quote(toolCallOpen+"\n") + " tool-call " + grammar.Quote("\n"+toolCallClose)
+	return "root ::= " + block + " ( " + grammar.Quote("\n") + " " + block + " )*\n" + g, lazy, nil
+}
+
+// parse extracts the tool calls from generated text and returns the
+// remaining content. Calls to functions that aren't in the set are left in
+// the content.
+func (ts *toolSet) parse(text string) (string, []toolCall) {
+	var calls []toolCall
+	add := func(raw string) bool {
+		var call struct {
+			Name       string          `json:"name"`
+			Arguments  json.RawMessage `json:"arguments"`
+			Parameters json.RawMessage `json:"parameters"` // Llama 3.1
+		}
+		if json.Unmarshal([]byte(raw), &call) != nil || ts.find(call.Name) == nil {
+			return false
+		}
+		args := call.Arguments
+		if len(args) == 0 {
+			args = call.Parameters
+		}
+		// Some models write the arguments as an encoded string already
+		var encoded string
+		if json.Unmarshal(args, &encoded) == nil {
+			args = json.RawMessage(encoded)
+		}
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		calls = append(calls, toolCall{
+			ID:       newID("call_"),
+			Type:     "function",
+			Function: toolCallFunction{Name: call.Name, Arguments: string(args)},
+		})
+		return true
+	}
+
+	trimmed := strings.TrimSpace(text)
+	switch {
+	case strings.Contains(text, toolCallOpen):
+		var content strings.Builder
+		rest := text
+		for {
+			before, after, found := strings.Cut(rest, toolCallOpen)
+			content.WriteString(before)
+			if !found {
+				break
+			}
+			raw, tail, _ := strings.Cut(after, toolCallClose)
+			if !add(strings.TrimSpace(raw)) {
+				content.WriteString(toolCallOpen + raw + toolCallClose)
+			}
+			rest = tail
+		}
+		return strings.TrimSpace(content.String()), calls
+	case strings.HasPrefix(trimmed, mistralToolCalls):
+		var list []json.RawMessage
+		if json.Unmarshal([]byte(strings.TrimPrefix(trimmed, mistralToolCalls)), &list) == nil {
+			for _, raw := range list {
+				add(string(raw))
+			}
+			if len(calls) > 0 {
+				return "", calls
+			}
+		}
+	case strings.HasPrefix(trimmed, "{") && add(trimmed):
+		return "", calls
+	}
+	return text, nil
+}
+
+// mayBeToolCall reports whether text, the start of a reply, is or could
+// become a tool call, in which case it mustn't be streamed as content yet
+func mayBeToolCall(text string) bool {
+	text = strings.TrimSpace(text)
+	for _, marker := range []string{toolCallOpen, mistralToolCalls, "{"} {
+		if strings.HasPrefix(text, marker) || strings.HasPrefix(marker, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// toolMessage converts a message of the request history, keeping its tool
+// calls for the chat template to render
+func toolMessage(m requestMessage) bindings.ChatMessage {
+	msg := bindings.ChatMessage{Role: m.Role, Content: string(m.Content), ToolCallID: m.ToolCallID}
+	for _, call := range m.ToolCalls {
+		msg.ToolCalls = append(msg.ToolCalls, bindings.ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return msg
+}
+
+// writeToolCalls appends the tool calls of a message to its content the way
+// the model is asked to produce them, for templates that don't know about
+// tools
+func writeToolCalls(m bindings.ChatMessage) bindings.ChatMessage {
+	content := m.Content
+	for _, call := range m.ToolCalls {
+		args := call.Arguments
+		if !json.Valid([]byte(args)) {
+			data, _ := json.Marshal(args)
+			args = string(data)
+		}
+		name, _ := json.Marshal(call.Name)
+		if content != "" {
+			content += "\n"
+		}
+		content += toolCallOpen + "\n{\"name\": " + string(name) + ", \"arguments\": " + args + "}\n" + toolCallClose
+	}
+	return bindings.ChatMessage{Role: m.Role, Content: content}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+func TestToolMessage(t *testing.T) {
+	m := requestMessage{
+		Role:    bindings.RoleAssistant,
+		Content: "Let me check.",
+		ToolCalls: []toolCall{
+			{ID: "call_1", Type: "function", Function: toolCallFunction{Name: "get_weather", Arguments: `{"location": "Paris"}`}},
+		},
+	}
+	got := toolMessage(m)
+	want := bindings.ChatMessage{
+		Role:      bindings.RoleAssistant,
+		Content:   "Let me check.",
+		ToolCalls: []bindings.ToolCall{{ID: "call_1", Name: "get_weather", Arguments: `{"location": "Paris"}`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("toolMessage = %+v, want %+v", got, want)
+	}
+
+	reply := toolMessage(requestMessage{Role: "tool", Content: "22", ToolCallID: "call_1"})
+	if reply.ToolCallID != "call_1" || reply.Content != "22" {
+		t.Errorf("tool reply converted to %+v", reply)
+	}
+}
+
+func TestWriteToolCalls(t *testing.T) {
+	m := bindings.ChatMessage{Role: bindings.RoleAssistant, Content: "Let me check.", ToolCalls: []bindings.ToolCall{
+		{Name: "get_weather", Arguments: `{"location": "Paris"}`},
+		{Name: "echo", Arguments: `not json`},
+	}}
+	want := "Let me check.\n" +
+		"<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"location\": \"Paris\"}}\n</tool_call>\n" +
+		"<tool_call>\n{\"name\": \"echo\", \"arguments\": \"not json\"}\n</tool_call>"
+	got := writeToolCalls(m)
+	if got.Content != want || got.ToolCalls != nil {
+		t.Errorf("writeToolCalls = %+v, want content %q", got, want)
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// indexHTML is a single-page chat client for /v1/chat/completions
+//
+//go:embed ui/index.html
+var indexHTML []byte
+
+func (s *Server) handleUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
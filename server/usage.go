@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Record describes a finished request, for billing and auditing. Requests
+// that don't generate have no model or token counts.
+type Record struct {
+	Time       time.Time // when the request arrived
+	Method     string
+	Path       string
+	RemoteAddr string
+	Status     int
+
+	Model            string
+	PromptTokens     int
+	CachedTokens     int // prompt tokens reused from the KV cache
+	CompletionTokens int
+	FinishReason     string
+	Seed             uint32 // the sampler's, to generate the same reply again
+
+	// DraftTokens and AcceptedTokens count the tokens of speculative
+	// decoding, DraftSteps the drafts
+	DraftTokens    int
+	AcceptedTokens int
+	DraftSteps     int
+
+	// Latency is the total time to handle the request. Queue is the part
+	// spent waiting for the model, Prompt the time from the start of
+	// generation until the first token and Generation the rest.
+	Latency    time.Duration
+	Queue      time.Duration
+	Prompt     time.Duration
+	Generation time.Duration
+}
+
+// MarshalJSON writes durations in milliseconds and leaves out empty fields
+func (r Record) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	// Any seed is valid, so generations are told apart by their finish
+	// reason
+	var seed *uint32
+	if r.FinishReason != "" {
+		seed = &r.Seed
+	}
+	return json.Marshal(struct {
+		Time             time.Time `json:"time"`
+		Method           string    `json:"method"`
+		Path             string    `json:"path"`
+		RemoteAddr       string    `json:"remote_addr"`
+		Status           int       `json:"status"`
+		Model            string    `json:"model,omitempty"`
+		PromptTokens     int       `json:"prompt_tokens,omitempty"`
+		CachedTokens     int       `json:"cached_tokens,omitempty"`
+		CompletionTokens int       `json:"completion_tokens,omitempty"`
+		FinishReason     string    `json:"finish_reason,omitempty"`
+		Seed             *uint32   `json:"seed,omitempty"`
+		DraftTokens      int       `json:"draft_tokens,omitempty"`
+		AcceptedTokens   int       `json:"accepted_tokens,omitempty"`
+		DraftSteps       int       `json:"draft_steps,omitempty"`
+		LatencyMs        float64   `json:"latency_ms"`
+		QueueMs          float64   `json:"queue_ms,omitempty"`
+		PromptMs         float64   `json:"prompt_ms,omitempty"`
+		GenerationMs     float64   `json:"generation_ms,omitempty"`
+	}{
+		r.Time, r.Method, r.Path, r.RemoteAddr, r.Status,
+		r.Model, r.PromptTokens, r.CachedTokens, r.CompletionTokens, r.FinishReason, seed, r.DraftTokens, r.AcceptedTokens, r.DraftSteps,
+		ms(r.Latency), ms(r.Queue), ms(r.Prompt), ms(r.Generation),
+	})
+}
+
+// Sink receives a Record for every request. It is called from the request's
+// goroutine after the response is written, so it must be safe for
+// concurrent use.
+type Sink interface {
+	Record(Record)
+}
+
+// SinkFunc adapts a function to a Sink
+type SinkFunc func(Record)
+
+func (f SinkFunc) Record(r Record) { f(r) }
+
+// JSONSink writes each record as a line of JSON
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink writes records to w, use os.Stdout for logging
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// NewFileSink appends records to the file at path, creating it if needed.
+// Close the returned file when done.
+func NewFileSink(path string) (*JSONSink, *os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewJSONSink(f), f, nil
+}
+
+func (s *JSONSink) Record(r Record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(data, '\n'))
+}
+
+type recordKey struct{}
+
+// Middleware reports every request handled by next to sink. The handlers of
+// a Server fill in the model, token usage and latency breakdown; for other
+// handlers only the request, status and latency are recorded.
+func Middleware(sink Sink, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &Record{Time: time.Now(), Method: r.Method, Path: r.URL.Path, RemoteAddr: r.RemoteAddr}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), recordKey{}, rec)))
+
+		rec.Status = sw.status
+		rec.Latency = time.Since(rec.Time)
+		sink.Record(*rec)
+	})
+}
+
+// recordOf returns the record of the request, or one that is discarded when
+// the request didn't go through Server.ServeHTTP
+func recordOf(r *http.Request) *Record {
+	if rec, ok := r.Context().Value(recordKey{}).(*Record); ok {
+		return rec
+	}
+	return &Record{}
+}
+
+// recordResult adds the usage of a generation to the record of the request
+func recordResult(r *http.Request, model string, result *bindings.GenerateResult) {
+	rec := recordOf(r)
+	rec.Model = model
+	rec.PromptTokens = result.PromptTokens
+	rec.CachedTokens = result.CachedTokens
+	rec.CompletionTokens = result.CompletionTokens
+	rec.FinishReason = string(result.FinishReason)
+	rec.Seed = result.Seed
+	rec.DraftTokens = result.DraftTokens
+	rec.AcceptedTokens = result.AcceptedTokens
+	rec.DraftSteps = result.DraftSteps
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streamed responses through the middleware
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack records the switch to the WebSocket protocol
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The parts of the WebSocket protocol (RFC 6455) a server needs: the
+// handshake, masked client frames with fragmentation, ping and close.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxMessageSize bounds a single message from a client
+const maxMessageSize = 16 << 20
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes of RFC 6455 section 7.4.1
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooLarge      = 1009
+)
+
+// wsError is a client violating the protocol, which fails the connection
+// with a close frame of the code
+type wsError struct {
+	code    uint16
+	message string
+}
+
+func (e *wsError) Error() string {
+	return "websocket: " + e.message
+}
+
+func protocolError(message string) error {
+	return &wsError{code: closeProtocolError, message: message}
+}
+
+var errMessageTooLarge = &wsError{code: closeTooLarge, message: "message too large"}
+
+// wsConn is a server-side WebSocket connection. Writes may come from any
+// goroutine, reads must come from one.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu     sync.Mutex // serializes writes
+	closed bool
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. Upgrades from pages of other origins than those allowed are
+// refused, as RFC 6455 expects of servers that browsers reach.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, origins []string) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, &requestError{message: "expected a websocket upgrade"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, &requestError{message: "unsupported websocket version"}
+	}
+	if origin := r.Header.Get("Origin"); !originAllowed(origin, r.Host, origins) {
+		return nil, &requestError{code: "origin_not_allowed", message: fmt.Sprintf("websocket connections from %s are not allowed", origin), status: http.StatusForbidden}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, &requestError{message: "missing Sec-WebSocket-Key"}
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// originAllowed reports whether a page of origin may open a connection to
+// host: requests without an origin don't come from a browser and pages of
+// the same host are the server's own
+func originAllowed(origin, host string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering pings
+// along the way. It returns io.EOF once the client closes the connection. A
+// client breaking the protocol gets a close frame saying how, and the
+// *wsError is returned.
+func (c *wsConn) readMessage() ([]byte, error) {
+	msg, err := c.readFrames()
+	var werr *wsError
+	if errors.As(err, &werr) {
+		c.writeClose(werr.code)
+	}
+	return msg, err
+}
+
+func (c *wsConn) readFrames() ([]byte, error) {
+	var msg []byte
+	fragmented := false
+	for {
+		fin, op, payload, err := c.readFrame(maxMessageSize - len(msg))
+		if err != nil {
+			return nil, err
+		}
+		if op >= opClose && (!fin || len(payload) > 125) {
+			return nil, protocolError("control frames must be whole and at most 125 bytes")
+		}
+
+		switch op {
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			if len(payload) == 1 {
+				return nil, protocolError("close frame with a 1-byte payload")
+			}
+			// The reply echoes the status code
+			c.writeFrame(opClose, payload[:min(len(payload), 2)])
+			return nil, io.EOF
+		case opText, opBinary:
+			if fragmented {
+				return nil, protocolError("new message before the end of a fragmented one")
+			}
+		case opContinuation:
+			if !fragmented {
+				return nil, protocolError("continuation frame without a fragmented message")
+			}
+		default:
+			return nil, protocolError(fmt.Sprintf("unknown opcode %#x", op))
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a frame whose payload may be at most limit bytes, which is
+// checked before anything is allocated for it
+func (c *wsConn) readFrame(limit int) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, protocolError("reserved bits set without an extension")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, protocolError("client frames must be masked")
+	}
+
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > uint64(limit) {
+		return false, 0, nil, errMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends a single unfragmented frame
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	head := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	if _, err := c.conn.Write(append(head, payload...)); err != nil {
+		return err
+	}
+	if op == opClose {
+		c.closed = true
+	}
+	return nil
+}
+
+func (c *wsConn) writeText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// writeClose starts the closing handshake with a status code
+func (c *wsConn) writeClose(code uint16) error {
+	return c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+func (c *wsConn) close() error {
+	c.writeClose(closeNormal)
+	return c.conn.Close()
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin, host string
+		allowed      []string
+		want         bool
+	}{
+		{"", "localhost:8080", nil, true},
+		{"http://localhost:8080", "localhost:8080", nil, true},
+		{"https://evil.example", "localhost:8080", nil, false},
+		{"https://app.example.com", "localhost:8080", []string{"https://app.example.com/"}, true},
+		{"https://APP.example.com", "localhost:8080", []string{"https://app.example.com"}, true},
+		{"https://other.example.com", "localhost:8080", []string{"https://app.example.com"}, false},
+		{"https://other.example.com", "localhost:8080", []string{"*"}, true},
+		{"null", "localhost:8080", nil, false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, tt.host, tt.allowed); got != tt.want {
+			t.Errorf("originAllowed(%q, %q, %q) = %v, want %v", tt.origin, tt.host, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+// clientFrame encodes a frame as a client sends it, masked
+func clientFrame(fin bool, op byte, payload []byte) []byte {
+	frame := serverFrame(fin, op, payload)
+	frame[1] |= 0x80
+	head, mask := len(frame)-len(payload), [4]byte{0x12, 0x34, 0x56, 0x78}
+	out := append(append(frame[:head:head], mask[:]...), payload...)
+	for i := range payload {
+		out[head+4+i] ^= mask[i%4]
+	}
+	return out
+}
+
+// serverFrame encodes a frame without a mask
+func serverFrame(fin bool, op byte, payload []byte) []byte {
+	b := op
+	if fin {
+		b |= 0x80
+	}
+	head := []byte{b}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = binary.BigEndian.AppendUint16(append(head, 126), uint16(n))
+	default:
+		head = binary.BigEndian.AppendUint64(append(head, 127), uint64(n))
+	}
+	return append(head, payload...)
+}
+
+func closePayload(code uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, code)
+}
+
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+// exchange sends frames to a server connection over a pipe and returns
+// the message its readMessage returned, the frames it sent back and the
+// error
+func exchange(t *testing.T, frames ...[]byte) ([]byte, []wsFrame, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	c := &wsConn{conn: server, r: bufio.NewReader(server)}
+
+	go func() {
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+	replies := make(chan []wsFrame)
+	go func() {
+		var out []wsFrame
+		r := bufio.NewReader(client)
+		for {
+			var head [2]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil {
+				break
+			}
+			if head[1]&0x80 != 0 {
+				t.Error("the server masked a frame")
+			}
+			payload := make([]byte, head[1]&0x7F)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				break
+			}
+			out = append(out, wsFrame{head[0] & 0x0F, payload})
+		}
+		replies <- out
+	}()
+
+	msg, err := c.readMessage()
+	server.Close()
+	return msg, <-replies, err
+}
+
+func TestReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		want    string
+		replies []wsFrame
+		close   uint16 // code of the close frame sent back, 0 for none
+	}{
+		{"text", [][]byte{clientFrame(true, opText, []byte("hello"))}, "hello", nil, 0},
+		{"binary", [][]byte{clientFrame(true, opBinary, []byte{0, 1, 2})}, "\x00\x01\x02", nil, 0},
+		{"16-bit length", [][]byte{clientFrame(true, opText, long)}, string(long), nil, 0},
+		{"empty", [][]byte{clientFrame(true, opText, nil)}, "", nil, 0},
+		{"fragmented", [][]byte{
+			clientFrame(false, opText, []byte("hel")),
+			clientFrame(false, opContinuation, []byte("l")),
+			clientFrame(true, opContinuation, []byte("o")),
+		}, "hello", nil, 0},
+		{"ping between fragments", [][]byte{
+			clientFrame(false, opText, []byte("hel")),
+			clientFrame(true, opPing, []byte("are you there")),
+			clientFrame(true, opPong, nil),
+			clientFrame(true, opContinuation, []byte("lo")),
+		}, "hello", []wsFrame{{opPong, []byte("are you there")}}, 0},
+		{"unmasked", [][]byte{serverFrame(true, opText, []byte("hello"))}, "", nil, closeProtocolError},
+		{"reserved bits", [][]byte{func() []byte {
+			f := clientFrame(true, opText, []byte("hello"))
+			f[0] |= 0x40
+			return f
+		}()}, "", nil, closeProtocolError},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil)}, "", nil, closeProtocolError},
+		{"continuation without a message", [][]byte{clientFrame(true, opContinuation, []byte("lo"))}, "", nil, closeProtocolError},
+		{"new message mid-fragment", [][]byte{
+			clientFrame(false, opText, []byte("hel")),
+			clientFrame(true, opText, []byte("lo")),
+		}, "", nil, closeProtocolError},
+		{"fragmented ping", [][]byte{clientFrame(false, opPing, nil)}, "", nil, closeProtocolError},
+		{"long ping", [][]byte{clientFrame(true, opPing, long[:126])}, "", nil, closeProtocolError},
+		{"close with a 1-byte payload", [][]byte{clientFrame(true, opClose, []byte{3})}, "", nil, closeProtocolError},
+		{"oversize frame", [][]byte{
+			// Only the header is sent, the length must fail before the payload is read
+			binary.BigEndian.AppendUint64([]byte{0x80 | opBinary, 0x80 | 127}, 1<<40),
+		}, "", nil, closeTooLarge},
+		{"oversize message", [][]byte{
+			clientFrame(false, opText, long),
+			binary.BigEndian.AppendUint64([]byte{opContinuation, 0x80 | 127}, maxMessageSize-uint64(len(long))+1),
+		}, "", nil, closeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, replies, err := exchange(t, tt.frames...)
+			if tt.close != 0 {
+				var werr *wsError
+				if !errors.As(err, &werr) || werr.code != tt.close {
+					t.Fatalf("err = %v, want a protocol error with code %d", err, tt.close)
+				}
+				tt.replies = append(tt.replies, wsFrame{opClose, closePayload(tt.close)})
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != tt.want {
+				t.Errorf("message %q, want %q", msg, tt.want)
+			}
+			if len(replies) != len(tt.replies) {
+				t.Fatalf("the server sent %v, want %v", replies, tt.replies)
+			}
+			for i, r := range replies {
+				if r.op != tt.replies[i].op || !bytes.Equal(r.payload, tt.replies[i].payload) {
+					t.Errorf("reply %d is %v, want %v", i, r, tt.replies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	frame := clientFrame(true, opClose, append(closePayload(closeNormal), "bye"...))
+	_, replies, err := exchange(t, frame)
+	if err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	if len(replies) != 1 || replies[0].op != opClose || !bytes.Equal(replies[0].payload, closePayload(closeNormal)) {
+		t.Errorf("the server replied %v, want a close frame echoing %d", replies, closeNormal)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &wsConn{conn: server, r: bufio.NewReader(server)}
+	go io.Copy(io.Discard, client)
+
+	if err := c.writeText([]byte(strings.Repeat("x", 70000))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeText([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing after closing: %v", err)
+	}
+}
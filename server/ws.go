@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// /v1/ws streams chat completions over a WebSocket. Each message is a JSON
+// object with a type and an id chosen by the client:
+//
+//	→ {"type": "chat", "id": "1", "messages": [...], "max_tokens": 64}
+//	← {"type": "progress", "id": "1", "evaluated": 512, "total": 2048}
+//	← {"type": "delta", "id": "1", "content": "Hel"}
+//	← {"type": "done", "id": "1", "finish_reason": "stop", "usage": {...}}
+//	→ {"type": "cancel", "id": "1"}
+//	← {"type": "error", "id": "1", "error": {"message": "...", "type": "..."}}
+//
+// A chat request takes the fields of /v1/chat/completions except tools and
+// stream. Progress events report how much of a long prompt has been
+// evaluated, for showing before the first delta. One generation runs per
+// connection at a time; follow-ups are sent once the previous one is done.
+// Cancelling ends it with the "cancel" finish reason, and closing the
+// connection cancels it too.
+
+type wsRequest struct {
+	Type     string           `json:"type"`
+	ID       string           `json:"id"`
+	Messages []requestMessage `json:"messages"`
+
+	ResponseFormat *responseFormat `json:"response_format"`
+	samplingRequest
+}
+
+type wsEvent struct {
+	Type         string    `json:"type"`
+	ID           string    `json:"id"`
+	Content      string    `json:"content,omitempty"`
+	Evaluated    int       `json:"evaluated,omitempty"`
+	Total        int       `json:"total,omitempty"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+	Usage        *usage    `json:"usage,omitempty"`
+	Error        *apiError `json:"error,omitempty"`
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, s.cfg.WebSocketOrigins)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer conn.close()
+
+	send := func(e wsEvent) {
+		data, _ := json.Marshal(e)
+		conn.writeText(data)
+	}
+	sendError := func(id string, err error) {
+		body := apiErrorOf(err)
+		send(wsEvent{Type: "error", ID: id, Error: &body})
+	}
+
+	var (
+		mu      sync.Mutex
+		running bool
+		current string
+		cancel  context.CancelFunc
+		wg      sync.WaitGroup
+	)
+	defer func() {
+		mu.Lock()
+		if cancel != nil {
+			cancel()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			sendError("", &requestError{message: "invalid message: " + err.Error()})
+			continue
+		}
+
+		switch req.Type {
+		case "cancel":
+			mu.Lock()
+			if running && (req.ID == "" || req.ID == current) {
+				cancel()
+			}
+			mu.Unlock()
+		case "chat":
+			mu.Lock()
+			if running {
+				mu.Unlock()
+				sendError(req.ID, &requestError{message: "a generation is already running on this connection"})
+				continue
+			}
+			ctx, stop := context.WithCancel(r.Context())
+			running, current, cancel = true, req.ID, stop
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.wsChat(ctx, r, &req, send, sendError)
+				stop()
+				mu.Lock()
+				running, cancel = false, nil
+				mu.Unlock()
+			}()
+		default:
+			sendError(req.ID, &requestError{param: "type", message: `type must be "chat" or "cancel"`})
+		}
+	}
+}
+
+// wsChat runs one chat request of a WebSocket connection. Each is reported
+// to the sink on its own.
+func (s *Server) wsChat(ctx context.Context, r *http.Request, req *wsRequest, send func(wsEvent), sendError func(string, error)) {
+	rec := &Record{Time: time.Now(), Method: "WS", Path: r.URL.Path, RemoteAddr: r.RemoteAddr, Status: http.StatusOK}
+	r = r.WithContext(context.WithValue(ctx, recordKey{}, rec))
+	fail := func(err error) {
+		rec.Status = errorStatus(err)
+		sendError(req.ID, err)
+	}
+	defer func() {
+		if s.cfg.Sink != nil {
+			rec.Latency = time.Since(rec.Time)
+			s.cfg.Sink.Record(*rec)
+		}
+	}()
+
+	if len(req.Messages) == 0 {
+		fail(&requestError{param: "messages", message: "messages must not be empty"})
+		return
+	}
+	g, err := req.ResponseFormat.grammar()
+	if err != nil {
+		fail(err)
+		return
+	}
+	req.grammar = g
+
+	messages := make([]bindings.ChatMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = toolMessage(m)
+	}
+
+	messages, err = s.screen(messages)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := s.lock(r); err != nil {
+		fail(err)
+		return
+	}
+	defer s.unlock()
+
+	prompt, err := s.ctx.Model().ApplyChatTemplate(s.withSystem(messages), true)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	req.onPrefill = func(done, total int) {
+		send(wsEvent{Type: "progress", ID: req.ID, Evaluated: done, Total: total})
+	}
+	result, err := s.generate(r, prompt, &req.samplingRequest, func(piece string) {
+		send(wsEvent{Type: "delta", ID: req.ID, Content: piece})
+	}, true)
+	if err != nil {
+		fail(err)
+		return
+	}
+	send(wsEvent{Type: "done", ID: req.ID, FinishReason: string(result.FinishReason), Usage: usageOf(result)})
+}
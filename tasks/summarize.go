@@ -0,0 +1,80 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/matthiase/alpaca/prompt"
+)
+
+// SummarizeOptions configures Summarize
+type SummarizeOptions struct {
+	ChunkSize int // tokens of text summarized at once, 0 uses 1024
+	MaxTokens int // tokens of each summary, 0 uses 512
+
+	// Instructions are added to those given to the model, e.g. "Use at
+	// most three bullet points."
+	Instructions string
+}
+
+var (
+	summarizePrompt = prompt.Must(prompt.Parse("Summarize the text the user sends. Reply with the summary only, without an introduction.{{with .instructions}} {{.}}{{end}}"))
+	combinePrompt   = prompt.Must(prompt.Parse("The user sends summaries of consecutive parts of one document. Combine them into a single summary of the whole document. Reply with the summary only, without an introduction.{{with .instructions}} {{.}}{{end}}"))
+)
+
+// Summarize summarizes text. A text longer than ChunkSize is split into
+// chunks that are summarized one by one, and their summaries are combined,
+// in several rounds if they don't fit in a chunk either.
+func Summarize(ctx context.Context, m Model, text string, opts SummarizeOptions) (string, error) {
+	maxTokens := opts.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = 512
+	}
+	vars := map[string]any{"instructions": opts.Instructions}
+	system, err := summarizePrompt.Execute(vars)
+	if err != nil {
+		return "", err
+	}
+	combine, err := combinePrompt.Execute(vars)
+	if err != nil {
+		return "", err
+	}
+
+	chunks, err := m.chunks(text, opts.ChunkSize)
+	if err != nil {
+		return "", err
+	}
+	var summaries []string
+	for _, chunk := range chunks {
+		if strings.TrimSpace(chunk.Text) == "" {
+			continue
+		}
+		summary, err := m.generate(ctx, system, chunk.Text, maxTokens)
+		if err != nil {
+			return "", err
+		}
+		summaries = append(summaries, summary)
+	}
+	if len(summaries) == 0 {
+		return "", errors.New("text is empty")
+	}
+
+	for len(summaries) > 1 {
+		groups, err := m.chunks(strings.Join(summaries, "\n\n"), opts.ChunkSize)
+		if err != nil {
+			return "", err
+		}
+		if len(groups) >= len(summaries) {
+			return "", errors.New("summaries don't fit in a chunk, ChunkSize must be larger than MaxTokens")
+		}
+		combined := make([]string, len(groups))
+		for i, group := range groups {
+			if combined[i], err = m.generate(ctx, combine, group.Text, maxTokens); err != nil {
+				return "", err
+			}
+		}
+		summaries = combined
+	}
+	return summaries[0], nil
+}
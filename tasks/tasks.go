@@ -0,0 +1,73 @@
+// Package tasks implements common uses of a chat model on top of the rest of
+// alpaca: summarizing and translating texts of any length. Long texts are
+// split into chunks by token count with textsplit and the outputs for the
+// chunks are combined, map-reduce style.
+package tasks
+
+import (
+	"context"
+	"strings"
+
+	"github.com/matthiase/alpaca/bindings"
+	"github.com/matthiase/alpaca/textsplit"
+)
+
+// defaultChunkSize is the number of tokens of text processed at once, small
+// enough to leave room for the output in common context sizes
+const defaultChunkSize = 1024
+
+// Model is the model a task runs on
+type Model struct {
+	Generator bindings.Generator
+	Tokenizer textsplit.Tokenizer
+
+	// ChatTemplate renders the instructions and the text as a prompt. Nil
+	// joins them with blank lines, for base models.
+	ChatTemplate func(messages []bindings.ChatMessage) (string, error)
+}
+
+// FromContext returns the Model of a context and the chat template of its
+// model
+func FromContext(c *bindings.Context) Model {
+	model := c.Model()
+	return Model{
+		Generator: c,
+		Tokenizer: model,
+		ChatTemplate: func(messages []bindings.ChatMessage) (string, error) {
+			return model.ApplyChatTemplate(messages, true)
+		},
+	}
+}
+
+// generate follows the instructions of system on text
+func (m Model) generate(ctx context.Context, system, text string, maxTokens int) (string, error) {
+	messages := []bindings.ChatMessage{
+		{Role: bindings.RoleSystem, Content: system},
+		{Role: bindings.RoleUser, Content: text},
+	}
+	prompt := system + "\n\n" + text + "\n\n"
+	if m.ChatTemplate != nil {
+		var err error
+		if prompt, err = m.ChatTemplate(messages); err != nil {
+			return "", err
+		}
+	}
+
+	// Both tasks should stick to the text rather than be creative
+	opts := bindings.DefaultGenerateOptions()
+	opts.Temperature = 0
+	opts.MaxTokens = maxTokens
+	res, err := m.Generator.Generate(ctx, prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(res.Text), nil
+}
+
+// chunks splits text into chunks of at most size tokens
+func (m Model) chunks(text string, size int) ([]textsplit.Chunk, error) {
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	return textsplit.Split(m.Tokenizer, text, textsplit.Options{ChunkSize: size})
+}
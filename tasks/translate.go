@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/matthiase/alpaca/prompt"
+)
+
+// TranslateOptions configures Translate
+type TranslateOptions struct {
+	From      string // language of the text, empty lets the model tell
+	ChunkSize int    // tokens of text translated at once, 0 uses 1024
+}
+
+var translatePrompt = prompt.Must(prompt.Parse("Translate the text the user sends{{with .from}} from {{.}}{{end}} into {{.to}}. Keep its formatting and reply with the translation only."))
+
+// Translate translates text into the language to, e.g. "French". A text
+// longer than ChunkSize is translated chunk by chunk, cut at paragraph,
+// line or sentence boundaries, and the translations are joined with the
+// white space that separated the chunks.
+func Translate(ctx context.Context, m Model, text, to string, opts TranslateOptions) (string, error) {
+	if to == "" {
+		return "", errors.New("target language is empty")
+	}
+	system, err := translatePrompt.Execute(map[string]any{"from": opts.From, "to": to})
+	if err != nil {
+		return "", err
+	}
+
+	chunks, err := m.chunks(text, opts.ChunkSize)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, chunk := range chunks {
+		body := strings.TrimSpace(chunk.Text)
+		if body == "" {
+			b.WriteString(chunk.Text)
+			continue
+		}
+		// Translations are seldom much longer than the original
+		translation, err := m.generate(ctx, system, body, 2*chunk.Tokens+16)
+		if err != nil {
+			return "", err
+		}
+		lead := chunk.Text[:strings.Index(chunk.Text, body)]
+		b.WriteString(lead + translation + chunk.Text[len(lead)+len(body):])
+	}
+	return b.String(), nil
+}
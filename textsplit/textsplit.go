@@ -0,0 +1,152 @@
+// Package textsplit splits documents into chunks of a bounded number of
+// tokens, as counted by the model that will embed or read them.
+package textsplit
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// Tokenizer counts tokens, it is implemented by *bindings.Model
+type Tokenizer interface {
+	Tokenize(text string, addSpecial, parseSpecial bool) ([]bindings.Token, error)
+}
+
+// Options configures Split
+type Options struct {
+	ChunkSize int // maximum tokens per chunk, 0 uses 512
+	Overlap   int // tokens of the previous chunk repeated at the start of the next
+}
+
+// Chunk is a part of the document
+type Chunk struct {
+	Text   string
+	Start  int // byte offset of Text in the document
+	End    int
+	Tokens int
+}
+
+// separators are the boundaries text is split at, from the most to the least
+// preferred
+var separators = []string{"\n\n", "\n", ". ", " "}
+
+// Split breaks text into chunks, cutting at paragraph, line, sentence and
+// word boundaries in that order of preference, and only inside a word when
+// the word alone exceeds ChunkSize. Tokens are counted per piece, so a chunk
+// may tokenize to a few tokens more or less as a whole.
+func Split(tok Tokenizer, text string, opts Options) ([]Chunk, error) {
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = 512
+	}
+	if opts.Overlap < 0 || opts.Overlap >= size {
+		return nil, errors.New("overlap must be between 0 and the chunk size")
+	}
+
+	s := &splitter{tok: tok, text: text, size: size}
+	if err := s.split(0, len(text), 0); err != nil {
+		return nil, err
+	}
+	return pack(text, s.pieces, size, opts.Overlap), nil
+}
+
+// piece is a span of the text that fits in a chunk
+type piece struct {
+	start, end int
+	tokens     int
+}
+
+type splitter struct {
+	tok    Tokenizer
+	text   string
+	size   int
+	pieces []piece
+}
+
+// split adds the span [start, end) as pieces, splitting it at separators
+// from level on when it is too long
+func (s *splitter) split(start, end, level int) error {
+	if start == end {
+		return nil
+	}
+	n, err := s.count(start, end)
+	if err != nil {
+		return err
+	}
+	if n <= s.size {
+		s.pieces = append(s.pieces, piece{start, end, n})
+		return nil
+	}
+
+	if level == len(separators) {
+		// A single word too long for a chunk is cut in half
+		mid := start + (end-start)/2
+		for mid > start && !utf8.RuneStart(s.text[mid]) {
+			mid--
+		}
+		if mid == start {
+			_, n := utf8.DecodeRuneInString(s.text[start:end])
+			mid = start + n
+		}
+		if mid == end {
+			s.pieces = append(s.pieces, piece{start, end, n})
+			return nil
+		}
+		if err := s.split(start, mid, level); err != nil {
+			return err
+		}
+		return s.split(mid, end, level)
+	}
+
+	// Separators stay at the end of the part before them
+	sep := separators[level]
+	for start < end {
+		i := strings.Index(s.text[start:end], sep)
+		partEnd := end
+		if i >= 0 {
+			partEnd = start + i + len(sep)
+		}
+		if err := s.split(start, partEnd, level+1); err != nil {
+			return err
+		}
+		start = partEnd
+	}
+	return nil
+}
+
+func (s *splitter) count(start, end int) (int, error) {
+	tokens, err := s.tok.Tokenize(s.text[start:end], false, false)
+	return len(tokens), err
+}
+
+// pack joins consecutive pieces into chunks of at most size tokens, starting
+// each chunk with pieces from the end of the previous one worth up to overlap
+// tokens
+func pack(text string, pieces []piece, size, overlap int) []Chunk {
+	var chunks []Chunk
+	for first := 0; first < len(pieces); {
+		last, tokens := first, 0
+		for last < len(pieces) && (last == first || tokens+pieces[last].tokens <= size) {
+			tokens += pieces[last].tokens
+			last++
+		}
+		start, end := pieces[first].start, pieces[last-1].end
+		chunks = append(chunks, Chunk{Text: text[start:end], Start: start, End: end, Tokens: tokens})
+		if last == len(pieces) {
+			break
+		}
+
+		// Back up over whole pieces, always moving forward by at least one
+		// and leaving room for the piece the next chunk adds
+		next, repeated := last, 0
+		for next-1 > first && repeated+pieces[next-1].tokens <= min(overlap, size-pieces[last].tokens) {
+			next--
+			repeated += pieces[next].tokens
+		}
+		first = next
+	}
+	return chunks
+}
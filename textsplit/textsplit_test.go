@@ -0,0 +1,150 @@
+package textsplit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/matthiase/alpaca/bindings"
+)
+
+// runes is a tokenizer with one token per character
+type runes struct{}
+
+func (runes) Tokenize(text string, addSpecial, parseSpecial bool) ([]bindings.Token, error) {
+	return make([]bindings.Token, utf8.RuneCountInString(text)), nil
+}
+
+type failing struct{}
+
+func (failing) Tokenize(string, bool, bool) ([]bindings.Token, error) {
+	return nil, errors.New("no model")
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		opts Options
+		want []string
+	}{
+		{"fits", "hello world", Options{ChunkSize: 20}, []string{"hello world"}},
+		{"default size", strings.Repeat("a ", 300), Options{}, []string{strings.Repeat("a ", 256), strings.Repeat("a ", 44)}},
+		{"empty", "", Options{ChunkSize: 4}, nil},
+		{
+			"paragraphs",
+			"aaaa\n\nbbbb\n\ncccc",
+			Options{ChunkSize: 6},
+			[]string{"aaaa\n\n", "bbbb\n\n", "cccc"},
+		},
+		{
+			"paragraphs joined",
+			"aa\n\nbb\n\ncccc",
+			Options{ChunkSize: 8},
+			[]string{"aa\n\nbb\n\n", "cccc"},
+		},
+		{
+			"lines before sentences",
+			"one. two\nthree. four",
+			Options{ChunkSize: 9},
+			[]string{"one. two\n", "three. ", "four"},
+		},
+		{
+			"words",
+			"one two three four five",
+			Options{ChunkSize: 10},
+			[]string{"one two ", "three ", "four five"},
+		},
+		{
+			"overlap",
+			"one two three four five",
+			Options{ChunkSize: 10, Overlap: 4},
+			[]string{"one two ", "two three ", "four five"},
+		},
+		{
+			"overlap of several pieces",
+			"a b c d e f g h",
+			Options{ChunkSize: 6, Overlap: 4},
+			[]string{"a b c ", "b c d ", "c d e ", "d e f ", "e f g ", "f g h"},
+		},
+		{
+			"no overlap before a piece that needs the whole chunk",
+			"a b c dddd",
+			Options{ChunkSize: 4, Overlap: 2},
+			[]string{"a b ", "b c ", "dddd"},
+		},
+		{
+			"long word",
+			"abcdefghij",
+			Options{ChunkSize: 4},
+			[]string{"ab", "cde", "fg", "hij"},
+		},
+		{
+			"long word of multibyte characters",
+			"ééééé",
+			Options{ChunkSize: 2},
+			[]string{"éé", "é", "éé"},
+		},
+	}
+	for _, tt := range tests {
+		chunks, err := Split(runes{}, tt.text, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, c := range chunks {
+			got = append(got, c.Text)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSplitBoundaries checks that chunks cover the text in order, overlap by
+// at most Overlap tokens and stay within ChunkSize, for many sizes
+func TestSplitBoundaries(t *testing.T) {
+	text := "The first paragraph. It has two sentences.\n\n" +
+		"The second one is on\nthree lines\nwith a verylongwordthatmustbecut.\n\n" +
+		"Ünïcödé text. Ends here"
+	for size := 1; size <= 40; size++ {
+		for _, overlap := range []int{0, size / 3, size - 1} {
+			chunks, err := Split(runes{}, text, Options{ChunkSize: size, Overlap: overlap})
+			if err != nil {
+				t.Fatalf("size %d overlap %d: %v", size, overlap, err)
+			}
+			end := 0
+			for i, c := range chunks {
+				if c.Text != text[c.Start:c.End] || !utf8.ValidString(c.Text) {
+					t.Fatalf("size %d overlap %d: chunk %d %q doesn't match [%d, %d)", size, overlap, i, c.Text, c.Start, c.End)
+				}
+				if n := utf8.RuneCountInString(c.Text); c.Tokens != n || n > size {
+					t.Fatalf("size %d overlap %d: chunk %d %q has %d tokens", size, overlap, i, c.Text, c.Tokens)
+				}
+				if c.Start > end || c.End <= end {
+					t.Fatalf("size %d overlap %d: chunk %d [%d, %d) doesn't continue from %d", size, overlap, i, c.Start, c.End, end)
+				}
+				if repeated := utf8.RuneCountInString(text[c.Start:end]); repeated > overlap {
+					t.Fatalf("size %d overlap %d: chunk %d repeats %d tokens", size, overlap, i, repeated)
+				}
+				end = c.End
+			}
+			if end != len(text) {
+				t.Fatalf("size %d overlap %d: chunks end at %d of %d", size, overlap, end, len(text))
+			}
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	for _, opts := range []Options{{ChunkSize: 4, Overlap: 4}, {ChunkSize: 4, Overlap: -1}, {Overlap: 512}} {
+		if _, err := Split(runes{}, "text", opts); err == nil {
+			t.Errorf("no error for %+v", opts)
+		}
+	}
+	if _, err := Split(failing{}, "text", Options{}); err == nil || err.Error() != "no model" {
+		t.Errorf("got %v, want the tokenizer's error", err)
+	}
+}